@@ -3,8 +3,12 @@ package main
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"os"
+	"os/signal"
 	"runtime"
-	"sync"
+	"syscall"
+	"time"
 
 	_ "github.com/jackc/pgx/v4/stdlib"
 
@@ -12,8 +16,13 @@ import (
 	"github.com/nivanov045/gofermart/internal/accrual/server"
 	"github.com/nivanov045/gofermart/internal/accrual/services"
 	"github.com/nivanov045/gofermart/internal/accrual/storages"
+	"github.com/nivanov045/gofermart/internal/graceful"
+	"github.com/nivanov045/gofermart/internal/health"
+	"github.com/nivanov045/gofermart/internal/tracing"
 )
 
+const healthCheckTimeout = 5 * time.Second
+
 func main() {
 	log.Init(log.InfoLevel)
 
@@ -22,35 +31,59 @@ func main() {
 		log.Panic(err)
 	}
 
+	shutdownTracing, err := tracing.Init(context.Background(), "accrual", cfg.TraceExporter)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		err := shutdownTracing(ctx)
+		if err != nil {
+			log.Error(err)
+		}
+	}()
+
 	db, err := sql.Open("pgx", cfg.DatabaseURI)
 	if err != nil {
 		log.Panic(err)
 	}
 	defer db.Close()
 
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	storage, queue, err := storages.NewDBStorage(ctx, db)
 	if err != nil {
 		log.Panic(err)
 	}
 
-	wg := sync.WaitGroup{}
 	service := services.NewService(storage, queue, runtime.NumCPU())
-	wg.Add(1)
-	go func() {
-		service.Run(ctx)
-		wg.Done()
-	}()
+	go service.Run(ctx)
 
-	accrualServer := server.NewServer(service)
-	wg.Add(1)
-	go func() {
-		err = accrualServer.Run(cfg.Address)
+	checker := health.New(healthCheckTimeout)
+	checker.Add("database", db.PingContext)
+	checker.Add("migrations", func(ctx context.Context) error {
+		pending, err := storages.PendingMigrations(ctx, db)
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
-		wg.Done()
-	}()
+		if len(pending) > 0 {
+			return fmt.Errorf("not applied: %v", pending)
+		}
+		return nil
+	})
 
-	wg.Wait()
+	accrualServer := server.NewServer(service, checker)
+	err = accrualServer.Run(ctx, cfg.Address, graceful.Config{
+		Delay:   cfg.ShutdownDelay,
+		Timeout: cfg.ShutdownTimeout,
+		OnShutdown: func() {
+			log.Info("shutting down")
+			checker.SetShuttingDown()
+		},
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	log.Info("stopped")
 }
@@ -5,20 +5,31 @@ import (
 	"context"
 	"encoding/json"
 	"io/ioutil"
-	"log"
 	"math/rand"
 	"net/http"
 	"strconv"
 	"time"
 
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+
+	"github.com/nivanov045/gofermart/cmd/gophermart/metrics"
+	"github.com/nivanov045/gofermart/internal/amount"
+	"github.com/nivanov045/gofermart/internal/compress"
+	"github.com/nivanov045/gofermart/internal/logger"
 	"github.com/nivanov045/gofermart/internal/order"
+	"github.com/nivanov045/gofermart/internal/tracing"
 )
 
+const statusRegistered = "REGISTERED"
+
 type accrualsystem struct {
 	databasePath     string
 	isDebug          bool
 	channelToService chan<- order.Order
 	ordersToProcess  chan string
+	client           *http.Client
 }
 
 func New(databasePath string, isDebug bool) (*accrualsystem, error) {
@@ -26,20 +37,18 @@ func New(databasePath string, isDebug bool) (*accrualsystem, error) {
 		databasePath:    databasePath,
 		isDebug:         isDebug,
 		ordersToProcess: make(chan string),
+		client:          &http.Client{Transport: tracing.Transport(compress.Transport(http.DefaultTransport))},
 	}
-	go resultAccrualSystem.processOrders()
 	return resultAccrualSystem, nil
 }
 
-func (a *accrualsystem) processOrders() {
-	ctx := context.Background()
+func (a *accrualsystem) processOrders(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case ord := <-a.ordersToProcess:
-			log.Println("accrual::processOrders::info: added")
-			go a.getAccrual(ord)
+			go a.getAccrual(ctx, ord)
 		default:
 			time.Sleep(100 * time.Millisecond)
 		}
@@ -50,106 +59,158 @@ func (a *accrualsystem) SetChannelToResponseToService(ch chan order.Order) {
 	a.channelToService = ch
 }
 
-func (a *accrualsystem) RunListenToService(channelFromService <-chan string) {
-	log.Println("accrual::RunListenToService::info: started")
-	ctx := context.Background()
+// RunListenToService requests accruals of orders from channelFromService until ctx is done
+func (a *accrualsystem) RunListenToService(ctx context.Context, channelFromService <-chan string) {
+	log.Info().Msg("listening to service")
+	go a.processOrders(ctx)
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case ord := <-channelFromService:
-			log.Println("accrual::RunListenToService::info: received value")
-			a.ordersToProcess <- ord
+			log.Debug().Str(logger.FieldOrder, ord).Msg("order is sent to accrual system")
+			metrics.AccrualBacklogAdd(1)
+			a.retry(ctx, ord)
 		default:
 			time.Sleep(1 * time.Second)
 		}
 	}
 }
 
-func (a *accrualsystem) getAccrual(orderNumber string) {
+func (a *accrualsystem) getAccrual(ctx context.Context, orderNumber string) {
+	ctx, span := tracing.Start(ctx, "accrualsystem.getAccrual",
+		attribute.String(logger.FieldOrder, orderNumber))
+	defer span.End()
+	l := log.With().Str(logger.FieldOrder, orderNumber).Logger()
 	if a.isDebug {
 		var resultOrder order.Order
 		resultOrder.Number = orderNumber
 		random := rand.Intn(10)
 		if random < 2 {
-			log.Println("accrual::getAccrual::info: NEW:", orderNumber)
+			l.Info().Str("status", order.ProcessingTypeNew).Msg("debug accrual")
 			time.Sleep(1 * time.Second)
-			a.ordersToProcess <- orderNumber
+			a.retry(ctx, orderNumber)
 			return
 		}
 		if random < 3 {
-			log.Println("accrual::getAccrual::info: PROCESSING:", orderNumber)
+			l.Info().Str("status", order.ProcessingTypeProcessing).Msg("debug accrual")
 			resultOrder.Status = order.ProcessingTypeProcessing
 		} else if random < 4 {
-			log.Println("accrual::getAccrual::info: INVALID:", orderNumber)
+			l.Info().Str("status", order.ProcessingTypeInvalid).Msg("debug accrual")
 			resultOrder.Status = order.ProcessingTypeInvalid
 		} else {
-			log.Println("accrual::getAccrual::info: PROCESSED:", orderNumber)
+			l.Info().Str("status", order.ProcessingTypeProcessed).Msg("debug accrual")
 			resultOrder.Status = order.ProcessingTypeProcessed
-			resultOrder.Accrual = int64(random * 1000)
+			resultOrder.Accrual = amount.Amount(random * 1000)
 		}
-		a.channelToService <- resultOrder
+		a.sendToService(ctx, resultOrder)
 		return
 	}
 
-	client := &http.Client{}
 	requestURL := a.databasePath + "/api/orders/" + orderNumber
-	request, err := http.NewRequest(http.MethodGet, requestURL, bytes.NewBuffer([]byte(orderNumber)))
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, bytes.NewBuffer([]byte(orderNumber)))
 	if err != nil {
-		log.Println("accrual::getAccrual::error: NewRequest:", err)
-		a.ordersToProcess <- orderNumber
+		l.Error().Err(err).Msg("in request creation")
+		a.retry(ctx, orderNumber)
 		return
 	}
 	request.Header.Set("Content-Type", "text/html")
-	response, err := client.Do(request)
+	start := time.Now()
+	response, err := a.client.Do(request)
 	if err != nil {
-		log.Println("accrual::getAccrual::error: Do:", err)
-		a.ordersToProcess <- orderNumber
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "accrual system is unavailable")
+		metrics.ObserveAccrualRequest(0, start)
+		l.Error().Err(err).Msg("in request")
+		a.retry(ctx, orderNumber)
 		return
 	}
+	metrics.ObserveAccrualRequest(response.StatusCode, start)
 	switch response.StatusCode {
 	case http.StatusOK:
 		defer response.Body.Close()
 		respBody, err := ioutil.ReadAll(response.Body)
 		if err != nil {
-			log.Println("accrual::getAccrual::error: ReadAll:", err)
-			a.ordersToProcess <- orderNumber
+			l.Error().Err(err).Msg("in response reading")
+			a.retry(ctx, orderNumber)
 			return
 		}
 		var resultOrderInterface order.InterfaceForAccrualSystem
 		err = json.Unmarshal(respBody, &resultOrderInterface)
 		if err != nil {
-			log.Println("accrual::getAccrual::error: Unmarshal:", err)
-			a.ordersToProcess <- orderNumber
+			l.Error().Err(err).Msg("in response parsing")
+			a.retry(ctx, orderNumber)
 			return
 		}
 		resultAsOrder := order.Order{
 			Number: resultOrderInterface.Number,
 			Status: resultOrderInterface.Status,
 		}
+		// accrual system registered the order but hasn't started its processing
+		if resultAsOrder.Status == statusRegistered {
+			resultAsOrder.Status = order.ProcessingTypeNew
+		}
 		if resultOrderInterface.Status == order.ProcessingTypeProcessed {
-			resultAsOrder.Accrual = int64(resultOrderInterface.Accrual * 100)
+			resultAsOrder.Accrual = resultOrderInterface.Accrual
 		}
-		a.channelToService <- resultAsOrder
+		a.sendToService(ctx, resultAsOrder)
 	case http.StatusTooManyRequests:
 		retryAfter := response.Header.Get("Retry-After")
 		n, err := strconv.ParseInt(retryAfter, 10, 64)
 		if err != nil {
-			log.Println("accrual::getAccrual::error: ParseInt:", err)
+			l.Error().Err(err).Msg("in Retry-After parsing, order is dropped")
+			metrics.AccrualBacklogAdd(-1)
 			return
 		}
-		time.Sleep(time.Duration(n) * time.Second)
-		a.ordersToProcess <- orderNumber
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Duration(n) * time.Second):
+			a.retry(ctx, orderNumber)
+		}
 	default:
-		log.Println("accrual::getAccrual::info: default")
 		defer response.Body.Close()
 		respBody, err := ioutil.ReadAll(response.Body)
 		if err != nil {
-			log.Println("accrual::getAccrual::error: ReadAll:", err)
-			a.ordersToProcess <- orderNumber
+			l.Error().Err(err).Msg("in response reading")
+			a.retry(ctx, orderNumber)
 			return
 		}
-		log.Println("accrual::getAccrual::info:", string(respBody))
-		a.ordersToProcess <- orderNumber
+		l.Warn().Int("status", response.StatusCode).Str("body", string(respBody)).Msg("unexpected response")
+		a.retry(ctx, orderNumber)
+	}
+}
+
+// retry queues the order for another request, orders left at shutdown keep their status
+// and are sent again at the next start
+func (a *accrualsystem) retry(ctx context.Context, orderNumber string) {
+	select {
+	case <-ctx.Done():
+	case a.ordersToProcess <- orderNumber:
+	}
+}
+
+// sendToService passes order with accrual system's response to service, so it leaves backlog
+func (a *accrualsystem) sendToService(ctx context.Context, resultOrder order.Order) {
+	metrics.AccrualBacklogAdd(-1)
+	select {
+	case <-ctx.Done():
+	case a.channelToService <- resultOrder:
+	}
+}
+
+// CheckReachable checks that accrual system responds, response status doesn't matter
+func (a *accrualsystem) CheckReachable(ctx context.Context) error {
+	if a.isDebug {
+		return nil
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, a.databasePath+"/api/orders/0", nil)
+	if err != nil {
+		return err
+	}
+	response, err := a.client.Do(request)
+	if err != nil {
+		return err
 	}
+	response.Body.Close()
+	return nil
 }
@@ -0,0 +1,49 @@
+package accrualsystem
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nivanov045/gofermart/internal/order"
+)
+
+func TestGetAccrualStatuses(t *testing.T) {
+	tests := []struct {
+		response string
+		want     order.Order
+	}{
+		{`{"order":"12345678903","status":"REGISTERED"}`,
+			order.Order{Number: "12345678903", Status: order.ProcessingTypeNew}},
+		{`{"order":"12345678903","status":"PROCESSING"}`,
+			order.Order{Number: "12345678903", Status: order.ProcessingTypeProcessing}},
+		{`{"order":"12345678903","status":"INVALID"}`,
+			order.Order{Number: "12345678903", Status: order.ProcessingTypeInvalid}},
+		{`{"order":"12345678903","status":"PROCESSED","accrual":500.5}`,
+			order.Order{Number: "12345678903", Status: order.ProcessingTypeProcessed, Accrual: 500_50}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want.Status, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(tt.response))
+			}))
+			defer server.Close()
+			a := &accrualsystem{databasePath: server.URL, ordersToProcess: make(chan string, 1), client: server.Client()}
+			ch := make(chan order.Order, 1)
+			a.SetChannelToResponseToService(ch)
+
+			a.getAccrual(context.Background(), "12345678903")
+			select {
+			case got := <-ch:
+				if got != tt.want {
+					t.Errorf("order = %+v, want %+v", got, tt.want)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("order isn't sent to service")
+			}
+		})
+	}
+}
@@ -1,62 +1,354 @@
 package api
 
 import (
+	"context"
+	"crypto/subtle"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rs/zerolog/log"
+
+	"github.com/nivanov045/gofermart/cmd/gophermart/events"
+	"github.com/nivanov045/gofermart/cmd/gophermart/metrics"
+	"github.com/nivanov045/gofermart/cmd/gophermart/validator"
+	"github.com/nivanov045/gofermart/internal/apierror"
+	"github.com/nivanov045/gofermart/internal/compress"
+	"github.com/nivanov045/gofermart/internal/graceful"
+	"github.com/nivanov045/gofermart/internal/logger"
+	"github.com/nivanov045/gofermart/internal/tracing"
 )
 
 type Authenticator interface {
-	Register([]byte) (string, error)
-	Login([]byte) (string, error)
-	CheckAuthentication(string) (string, error)
-	Logout(string) error
+	Register(context.Context, []byte) (string, error)
+	Login(context.Context, []byte) (string, error)
+	CheckAuthentication(context.Context, string) (string, error)
+	Logout(context.Context, string) error
+	GetReferral(context.Context, string) ([]byte, error)
+	DeleteAccount(context.Context, string, []byte) error
+	DeleteAccountByAdmin(context.Context, string) error
 }
 
 type Service interface {
-	AddOrder(string, []byte) (bool, error)
-	GetOrders(string) ([]byte, error)
-	GetBalance(string) ([]byte, error)
-	MakeWithdraw(string, []byte) error
-	GetWithdraws(string) ([]byte, error)
+	AddOrder(context.Context, string, []byte) (bool, error)
+	GetOrders(context.Context, string) ([]byte, error)
+	GetBalance(context.Context, string) ([]byte, error)
+	MakeWithdraw(context.Context, string, []byte) error
+	GetWithdraws(context.Context, string) ([]byte, error)
+	GetTier(context.Context, string) ([]byte, error)
+	MakeTransfer(context.Context, string, []byte) error
+	AddWebhookEndpoint(context.Context, string, []byte) ([]byte, error)
+	GetWebhookEndpoints(context.Context, string) ([]byte, error)
+	RemoveWebhookEndpoint(context.Context, string, string) error
+	GetDeadWebhookDeliveries(context.Context) ([]byte, error)
+	RetryWebhookDelivery(context.Context, string) error
+}
+
+type EventStream interface {
+	Subscribe(login string, lastEventID uint64) *events.Subscription
+	Close()
+}
+
+type RateLimiter interface {
+	Allow(key string) (bool, time.Duration)
+}
+
+type HealthChecker interface {
+	Liveness(http.ResponseWriter, *http.Request)
+	Readiness(http.ResponseWriter, *http.Request)
 }
 
 type api struct {
 	authenticator Authenticator
 	service       Service
+	health        HealthChecker
+	stream        EventStream
+	heartbeat     time.Duration
+	adminToken    string
+	authLimiter   RateLimiter
+	dataLimiter   RateLimiter
+	// forwarding headers are trusted only from trustedProxies
+	trustedProxies []*net.IPNet
 }
 
-func New(service Service, authenticator Authenticator) *api {
-	return &api{service: service, authenticator: authenticator}
+// New creates api, order streams send heartbeat comments every heartbeat, admin
+// endpoints are disabled if adminToken is empty. Registrations, logins and admin endpoints
+// are limited by authLimiter per IP, other user endpoints by dataLimiter per login or IP of
+// anonymous clients. Clients' IPs are taken from forwarding headers only if requests
+// come from trustedProxies.
+func New(service Service, authenticator Authenticator, health HealthChecker, stream EventStream,
+	heartbeat time.Duration, adminToken string, authLimiter RateLimiter, dataLimiter RateLimiter,
+	trustedProxies []*net.IPNet) *api {
+	return &api{
+		service:        service,
+		authenticator:  authenticator,
+		health:         health,
+		stream:         stream,
+		heartbeat:      heartbeat,
+		adminToken:     adminToken,
+		authLimiter:    authLimiter,
+		dataLimiter:    dataLimiter,
+		trustedProxies: trustedProxies,
+	}
 }
 
-func (a *api) Run(address string) error {
-	log.Println("api::Run::info: started with addr:", address)
+// openAPI describes routes under /api/, the contract is checked by apitest
+//
+//go:embed openapi.json
+var openAPI []byte
+
+// Run serves api until ctx is done, then shuts down gracefully
+func (a *api) Run(ctx context.Context, address string, shutdown graceful.Config) error {
+	log.Info().Str("address", address).Msg("api started")
+	server := &http.Server{Addr: address, Handler: a.Handler()}
+	// streams don't end by themselves, so they would hold shutdown until timeout
+	server.RegisterOnShutdown(a.stream.Close)
+	return graceful.Serve(ctx, server, shutdown)
+}
+
+// Handler returns router with all middlewares and routes of api
+func (a *api) Handler() http.Handler {
 	r := chi.NewRouter()
 
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
-	r.Use(middleware.Logger)
+	r.Use(realIP(a.trustedProxies))
+	r.Use(logger.Middleware)
+	r.Use(tracing.Middleware("gophermart"))
 	r.Use(middleware.Recoverer)
+	r.Use(metrics.Middleware)
+	r.Use(compress.Middleware)
+	r.NotFound(apierror.NotFound)
+	r.MethodNotAllowed(apierror.MethodNotAllowed)
+
+	authLimit := rateLimit("auth", a.authLimiter, ipKey)
+	dataLimit := rateLimit("data", a.dataLimiter, loginKey)
 
 	// Specificated
 	r.Route("/api/user/", func(r chi.Router) {
-		r.Post("/register", a.registerHandler)
-		r.Post("/login", a.loginHandler)
-		r.Post("/orders", a.addOrderHandler)
-		r.Get("/orders", a.getOrdersHandler)
-		r.Get("/balance", a.getBalanceHandler)
-		r.Post("/balance/withdraw", a.makeWithdrawHandler)
-		r.Get("/withdrawals", a.getWithdrawsHandler)
+		r.With(authLimit).Post("/register", a.registerHandler)
+		r.With(authLimit).Post("/login", a.loginHandler)
+		r.Group(func(r chi.Router) {
+			r.Use(a.authenticate, dataLimit)
+			r.Post("/orders", a.addOrderHandler)
+			r.Get("/orders", a.getOrdersHandler)
+			r.Get("/balance", a.getBalanceHandler)
+			r.Post("/balance/withdraw", a.makeWithdrawHandler)
+			r.Get("/withdrawals", a.getWithdrawsHandler)
+		})
 	})
 
 	// Not specificated
-	r.Post("/api/user/logout", a.logoutHandler)
+	r.Group(func(r chi.Router) {
+		r.Use(a.authenticate, dataLimit)
+		r.Post("/api/user/logout", a.logoutHandler)
+		r.Get("/api/user/tier", a.getTierHandler)
+		r.Get("/api/user/orders/stream", a.streamOrdersHandler)
+		r.Post("/api/user/balance/transfer", a.makeTransferHandler)
+		r.Get("/api/user/referral", a.getReferralHandler)
+		r.Delete("/api/user", a.deleteAccountHandler)
+		r.Post("/api/user/webhooks", a.addWebhookEndpointHandler)
+		r.Get("/api/user/webhooks", a.getWebhookEndpointsHandler)
+		r.Delete("/api/user/webhooks/{id}", a.removeWebhookEndpointHandler)
+	})
+	if a.adminToken != "" {
+		r.Group(func(r chi.Router) {
+			// guessing of admin token is limited like guessing of passwords
+			r.Use(authLimit)
+			r.Delete("/api/admin/users/{login}", a.adminDeleteAccountHandler)
+			r.Post("/api/admin/webhooks", a.adminAddWebhookEndpointHandler)
+			r.Get("/api/admin/webhooks", a.adminGetWebhookEndpointsHandler)
+			r.Delete("/api/admin/webhooks/{id}", a.adminRemoveWebhookEndpointHandler)
+			r.Get("/api/admin/webhooks/dead", a.adminGetDeadWebhookDeliveriesHandler)
+			r.Post("/api/admin/webhooks/dead/{id}/retry", a.adminRetryWebhookDeliveryHandler)
+		})
+	}
+	r.Get("/healthz", a.health.Liveness)
+	r.Get("/readyz", a.health.Readiness)
+	r.Get("/openapi.json", serveOpenAPI)
+	return r
+}
+
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	w.Write(openAPI)
+}
+
+// rateLimit rejects requests over the limit of their key with 429 Too Many Requests,
+// Retry-After is in seconds like the one of accrual system
+func rateLimit(name string, limiter RateLimiter, key func(*http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			allowed, retryAfter := limiter.Allow(key(r))
+			if !allowed {
+				metrics.ObserveRateLimited(name)
+				seconds := int((retryAfter + time.Second - 1) / time.Second)
+				w.Header().Set("Retry-After", strconv.Itoa(seconds))
+				apierror.Write(w, r, http.StatusTooManyRequests, apierror.CodeTooManyRequests,
+					"too many requests, retry after "+strconv.Itoa(seconds)+"s")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ipKey is IP of client, realIP has already replaced RemoteAddr with it if the request
+// came through a trusted proxy
+func ipKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// loginKey is login of authenticated client, anonymous clients and ones with expired
+// sessions share limits of their IPs
+func loginKey(r *http.Request) string {
+	session, ok := r.Context().Value(sessionKey{}).(sessionResult)
+	if !ok || session.err != nil {
+		return ipKey(r)
+	}
+	return "login:" + session.login
+}
+
+// ParseTrustedProxies parses CIDRs or single IPs of proxies whose forwarding headers are
+// trusted
+func ParseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	result := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, errors.New("wrong trusted proxy " + strconv.Quote(proxy))
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, errors.New("wrong trusted proxy " + strconv.Quote(proxy))
+		}
+		result = append(result, network)
+	}
+	return result, nil
+}
+
+// realIP replaces RemoteAddr with IP of client from X-Forwarded-For or X-Real-IP if the
+// request came from a trusted proxy, headers of other clients are ignored as anyone can
+// set them
+func realIP(trustedProxies []*net.IPNet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ip := forwardedIP(r, trustedProxies); ip != nil {
+				r.RemoteAddr = ip.String()
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
 
-	return http.ListenAndServe(address, r)
+// forwardedIP walks X-Forwarded-For from the nearest proxy and returns the first address
+// which isn't of a trusted proxy, it's nil if headers can't be used
+func forwardedIP(r *http.Request, trustedProxies []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(net.ParseIP(host), trustedProxies) {
+		return nil
+	}
+	if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+		addresses := strings.Split(strings.Join(values, ","), ",")
+		for i := len(addresses) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(addresses[i]))
+			if ip == nil {
+				return nil
+			}
+			if i == 0 || !isTrustedProxy(ip, trustedProxies) {
+				return ip
+			}
+		}
+	}
+	return net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP")))
+}
+
+func isTrustedProxy(ip net.IP, trustedProxies []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type sessionKey struct{}
+
+type sessionResult struct {
+	login string
+	err   error
+}
+
+// authenticate checks the session once per request, the rate limit and handlers take
+// its login from the context
+func (a *api) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), sessionKey{}, a.checkSession(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (a *api) checkSession(r *http.Request) sessionResult {
+	c, err := r.Cookie("session_token")
+	if err != nil {
+		return sessionResult{err: err}
+	}
+	login, err := a.authenticator.CheckAuthentication(r.Context(), c.Value)
+	return sessionResult{login: login, err: err}
+}
+
+// authenticatedLogin returns login of the request's session, otherwise it writes 401
+// Unauthorized or 500 Internal Server Error and returns false
+func (a *api) authenticatedLogin(w http.ResponseWriter, r *http.Request) (string, bool) {
+	session, ok := r.Context().Value(sessionKey{}).(sessionResult)
+	if !ok {
+		session = a.checkSession(r)
+	}
+	if session.err != nil {
+		if errors.Is(session.err, http.ErrNoCookie) || session.err.Error() == "no such token" ||
+			session.err.Error() == "session token expired" {
+			writeUnauthorized(w, r)
+			return "", false
+		}
+		logger.Ctx(r.Context()).Error().Err(session.err).Msg("unhandled in auth check")
+		apierror.Internal(w, r)
+		return "", false
+	}
+	return session.login, true
+}
+
+func writeUnauthorized(w http.ResponseWriter, r *http.Request) {
+	apierror.Write(w, r, http.StatusUnauthorized, apierror.CodeUnauthorized, "session is missing or expired")
+}
+
+func writeWrongRequest(w http.ResponseWriter, r *http.Request) {
+	apierror.Write(w, r, http.StatusBadRequest, apierror.CodeBadRequest, "request body is malformed")
 }
 
 func (a *api) registerHandler(w http.ResponseWriter, r *http.Request) {
@@ -65,30 +357,29 @@ func (a *api) registerHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	respBody, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Println("api::registerHandler::warning: can't read response body with:", err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("{}"))
+		logger.Ctx(r.Context()).Warn().Err(err).Msg("can't read request body")
+		apierror.Write(w, r, http.StatusBadRequest, apierror.CodeBadRequest, "can't read request body")
 		return
 	}
 
-	token, err := a.authenticator.Register(respBody)
+	token, err := a.authenticator.Register(r.Context(), respBody)
 	if err != nil {
-		if err.Error() == "wrong request" {
-			w.WriteHeader(http.StatusBadRequest)
-		} else if err.Error() == "login is already in use" {
-			w.WriteHeader(http.StatusConflict)
-		} else {
-			log.Println("api::registerHandler::error: unhandled:", err)
-			w.WriteHeader(http.StatusInternalServerError)
+		switch err.Error() {
+		case "wrong request", "wrong query":
+			writeWrongRequest(w, r)
+		case "login is already in use":
+			apierror.Write(w, r, http.StatusConflict, apierror.CodeLoginInUse, "login is already in use")
+		default:
+			logger.Ctx(r.Context()).Error().Err(err).Msg("unhandled")
+			apierror.Internal(w, r)
 		}
-	} else {
-		log.Println("api::registerHandler::info: StatusOK")
-		http.SetCookie(w, &http.Cookie{
-			Name:  "session_token",
-			Value: token,
-		})
-		w.WriteHeader(http.StatusOK)
+		return
 	}
+	http.SetCookie(w, &http.Cookie{
+		Name:  "session_token",
+		Value: token,
+	})
+	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("{}"))
 }
 
@@ -98,30 +389,29 @@ func (a *api) loginHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	respBody, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Println("api::loginHandler::warning: can't read response body with:", err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("{}"))
+		logger.Ctx(r.Context()).Warn().Err(err).Msg("can't read request body")
+		apierror.Write(w, r, http.StatusBadRequest, apierror.CodeBadRequest, "can't read request body")
 		return
 	}
 
-	token, err := a.authenticator.Login(respBody)
+	token, err := a.authenticator.Login(r.Context(), respBody)
 	if err != nil {
-		if err.Error() == "wrong request" {
-			w.WriteHeader(http.StatusBadRequest)
-		} else if err.Error() == "wrong login or password" {
-			w.WriteHeader(http.StatusUnauthorized)
-		} else {
-			log.Println("api::loginHandler::error: unhandled:", err)
-			w.WriteHeader(http.StatusInternalServerError)
+		switch err.Error() {
+		case "wrong request", "wrong query":
+			writeWrongRequest(w, r)
+		case "wrong login or password":
+			apierror.Write(w, r, http.StatusUnauthorized, apierror.CodeWrongCredentials, "wrong login or password")
+		default:
+			logger.Ctx(r.Context()).Error().Err(err).Msg("unhandled")
+			apierror.Internal(w, r)
 		}
-	} else {
-		log.Println("api::loginHandler::info: StatusOK")
-		http.SetCookie(w, &http.Cookie{
-			Name:  "session_token",
-			Value: token,
-		})
-		w.WriteHeader(http.StatusOK)
+		return
 	}
+	http.SetCookie(w, &http.Cookie{
+		Name:  "session_token",
+		Value: token,
+	})
+	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("{}"))
 }
 
@@ -130,25 +420,17 @@ func (a *api) logoutHandler(w http.ResponseWriter, r *http.Request) {
 
 	c, err := r.Cookie("session_token")
 	if err != nil {
-		if err == http.ErrNoCookie {
-			log.Println("api::logoutHandler::warning:", err)
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("{}"))
-			return
-		}
-		w.WriteHeader(http.StatusInternalServerError)
+		writeUnauthorized(w, r)
 		return
 	}
-	sessionToken := c.Value
-	err = a.authenticator.Logout(sessionToken)
+	err = a.authenticator.Logout(r.Context(), c.Value)
 	if err != nil {
 		if err.Error() == "no such token" {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("{}"))
+			writeUnauthorized(w, r)
 			return
 		}
-		log.Println("api::logoutHandler::error: unhandled in auth check:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		logger.Ctx(r.Context()).Error().Err(err).Msg("unhandled in logout")
+		apierror.Internal(w, r)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -158,239 +440,526 @@ func (a *api) logoutHandler(w http.ResponseWriter, r *http.Request) {
 func (a *api) addOrderHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("content-type", "application/json")
 
-	c, err := r.Cookie("session_token")
-	if err != nil {
-		if err == http.ErrNoCookie {
-			log.Println("api::addOrderHandler::warning:", err)
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("{}"))
-			return
-		}
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-	sessionToken := c.Value
-	login, err := a.authenticator.CheckAuthentication(sessionToken)
-	if err != nil {
-		if err.Error() == "no such token" || err.Error() == "session token expired" {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("{}"))
-			return
-		}
-		log.Println("api::addOrderHandler::error: unhandled in auth check:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	login, ok := a.authenticatedLogin(w, r)
+	if !ok {
 		return
 	}
 
 	defer r.Body.Close()
 	respBody, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Println("api::addOrderHandler::warning: can't read response body with:", err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("{}"))
+		logger.Ctx(r.Context()).Warn().Err(err).Msg("can't read request body")
+		apierror.Write(w, r, http.StatusBadRequest, apierror.CodeBadRequest, "can't read request body")
 		return
 	}
 
-	isOrderNotExisted, err := a.service.AddOrder(login, respBody)
+	isOrderNotExisted, err := a.service.AddOrder(r.Context(), login, respBody)
 	if err != nil {
-		log.Println("api::addOrderHandler::warning in order adding:", err)
-		if err.Error() == "wrong request" {
-			w.WriteHeader(http.StatusBadRequest)
-		} else if err.Error() == "order was uploaded by another user" {
-			w.WriteHeader(http.StatusConflict)
-		} else if err.Error() == "wrong format of order" {
-			w.WriteHeader(http.StatusUnprocessableEntity)
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
+		logger.Ctx(r.Context()).Warn().Err(err).Msg("in order adding")
+		switch err.Error() {
+		case "wrong request":
+			writeWrongRequest(w, r)
+		case "order was uploaded by another user":
+			apierror.Write(w, r, http.StatusConflict, apierror.CodeOrderOfAnotherUser,
+				"order was uploaded by another user")
+		case "wrong format of order":
+			apierror.Write(w, r, http.StatusUnprocessableEntity, apierror.CodeInvalidOrderNumber,
+				"order number is invalid")
+		default:
+			apierror.Internal(w, r)
 		}
+		return
+	}
+	if isOrderNotExisted {
+		w.WriteHeader(http.StatusAccepted)
 	} else {
-		if isOrderNotExisted {
-			w.WriteHeader(http.StatusAccepted)
-		} else {
-			w.WriteHeader(http.StatusOK)
-		}
+		w.WriteHeader(http.StatusOK)
 	}
 	w.Write([]byte("{}"))
 }
 
 func (a *api) getOrdersHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("api::getOrdersHandler::info: started")
 	w.Header().Set("content-type", "application/json")
 
-	c, err := r.Cookie("session_token")
+	login, ok := a.authenticatedLogin(w, r)
+	if !ok {
+		return
+	}
+
+	res, err := a.service.GetOrders(r.Context(), login)
 	if err != nil {
-		if err == http.ErrNoCookie {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("{}"))
+		if err.Error() == "no orders" {
+			w.WriteHeader(http.StatusNoContent)
 			return
 		}
-		w.WriteHeader(http.StatusInternalServerError)
+		logger.Ctx(r.Context()).Error().Err(err).Msg("unhandled")
+		apierror.Internal(w, r)
 		return
 	}
-	sessionToken := c.Value
-	login, err := a.authenticator.CheckAuthentication(sessionToken)
-	if err != nil {
-		if err.Error() == "no such token" {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("{}"))
+	w.WriteHeader(http.StatusOK)
+	w.Write(res)
+}
+
+// streamOrdersHandler pushes changes of user's orders and balance as Server-Sent Events,
+// reconnected clients get missed events after ID from Last-Event-ID header
+func (a *api) streamOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	login, ok := a.authenticatedLogin(w, r)
+	if !ok {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		logger.Ctx(r.Context()).Error().Msg("response writer doesn't support streaming")
+		apierror.Internal(w, r)
+		return
+	}
+	var lastEventID uint64
+	if header := r.Header.Get("Last-Event-ID"); header != "" {
+		var err error
+		lastEventID, err = strconv.ParseUint(header, 10, 64)
+		if err != nil {
+			apierror.Write(w, r, http.StatusBadRequest, apierror.CodeBadRequest, "Last-Event-ID is not an event ID")
 			return
 		}
-		log.Println("api::getOrdersHandler::error: unhandled in auth check:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	}
+	subscription := a.stream.Subscribe(login, lastEventID)
+	defer subscription.Close()
+
+	w.Header().Set("content-type", "text/event-stream")
+	w.Header().Set("cache-control", "no-cache")
+	w.Header().Set("x-accel-buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	for _, event := range subscription.Missed {
+		writeEvent(w, event)
+	}
+	flusher.Flush()
+	heartbeat := time.NewTicker(a.heartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-subscription.Events:
+			if !ok {
+				// client resumes after reconnect
+				return
+			}
+			writeEvent(w, event)
+		case <-heartbeat.C:
+			io.WriteString(w, ": heartbeat\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w io.Writer, event events.Event) {
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Data)
+}
+
+func (a *api) getBalanceHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+
+	login, ok := a.authenticatedLogin(w, r)
+	if !ok {
 		return
 	}
 
-	res, err := a.service.GetOrders(login)
+	res, err := a.service.GetBalance(r.Context(), login)
 	if err != nil {
-		if err.Error() == "no orders" {
-			w.WriteHeader(http.StatusNoContent)
-		} else {
-			log.Println("api::getOrdersHandler::error: unhandled:", err)
-			w.WriteHeader(http.StatusInternalServerError)
-		}
-		w.Write([]byte("{}"))
+		logger.Ctx(r.Context()).Error().Err(err).Msg("unhandled")
+		apierror.Internal(w, r)
 		return
 	}
-	w.Write(res)
 	w.WriteHeader(http.StatusOK)
+	w.Write(res)
 }
 
-func (a *api) getBalanceHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("api::getBalanceHandler::info: started")
+func (a *api) makeWithdrawHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("content-type", "application/json")
 
-	c, err := r.Cookie("session_token")
+	login, ok := a.authenticatedLogin(w, r)
+	if !ok {
+		return
+	}
+
+	defer r.Body.Close()
+	respBody, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		if err == http.ErrNoCookie {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("{}"))
-			return
+		logger.Ctx(r.Context()).Warn().Err(err).Msg("can't read request body")
+		apierror.Write(w, r, http.StatusBadRequest, apierror.CodeBadRequest, "can't read request body")
+		return
+	}
+
+	err = a.service.MakeWithdraw(r.Context(), login, respBody)
+	var validationErr *validator.Error
+	if errors.As(err, &validationErr) {
+		logger.Ctx(r.Context()).Warn().Str("code", validationErr.Code).Msg("withdrawal is rejected")
+		status := http.StatusBadRequest
+		if validationErr.IsLimit() {
+			status = http.StatusForbidden
 		}
-		w.WriteHeader(http.StatusInternalServerError)
+		apierror.Write(w, r, status, validationErr.Code, validationErr.Message)
 		return
 	}
-	sessionToken := c.Value
-	login, err := a.authenticator.CheckAuthentication(sessionToken)
 	if err != nil {
-		if err.Error() == "no such token" {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("{}"))
-			return
+		switch err.Error() {
+		case "wrong request":
+			writeWrongRequest(w, r)
+		case "not enough balance":
+			apierror.Write(w, r, http.StatusPaymentRequired, apierror.CodeInsufficientBalance, "not enough balance")
+		case "wrong format of order":
+			apierror.Write(w, r, http.StatusUnprocessableEntity, apierror.CodeInvalidOrderNumber,
+				"order number is invalid")
+		default:
+			logger.Ctx(r.Context()).Error().Err(err).Msg("unhandled")
+			apierror.Internal(w, r)
 		}
-		log.Println("api::getOrdersHandler::error: unhandled in auth check:", err)
-		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("{}"))
+}
 
-	res, err := a.service.GetBalance(login)
+func (a *api) getWithdrawsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+
+	login, ok := a.authenticatedLogin(w, r)
+	if !ok {
+		return
+	}
+
+	res, err := a.service.GetWithdraws(r.Context(), login)
 	if err != nil {
-		log.Println("api::getBalanceHandler::error: unhandled:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("{}"))
+		if err.Error() == "no withdraws" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		logger.Ctx(r.Context()).Error().Err(err).Msg("unhandled")
+		apierror.Internal(w, r)
 		return
 	}
+	w.WriteHeader(http.StatusOK)
 	w.Write(res)
+}
+
+func (a *api) getTierHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+
+	login, ok := a.authenticatedLogin(w, r)
+	if !ok {
+		return
+	}
+
+	res, err := a.service.GetTier(r.Context(), login)
+	if err != nil {
+		logger.Ctx(r.Context()).Error().Err(err).Msg("unhandled")
+		apierror.Internal(w, r)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
+	w.Write(res)
 }
 
-func (a *api) makeWithdrawHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("api::makeWithdrawHandler::info: started")
+func (a *api) makeTransferHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("content-type", "application/json")
 
-	c, err := r.Cookie("session_token")
+	login, ok := a.authenticatedLogin(w, r)
+	if !ok {
+		return
+	}
+
+	defer r.Body.Close()
+	respBody, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		if err == http.ErrNoCookie {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("{}"))
-			return
-		}
-		w.WriteHeader(http.StatusInternalServerError)
+		logger.Ctx(r.Context()).Warn().Err(err).Msg("can't read request body")
+		apierror.Write(w, r, http.StatusBadRequest, apierror.CodeBadRequest, "can't read request body")
+		return
+	}
+
+	err = a.service.MakeTransfer(r.Context(), login, respBody)
+	var validationErr *validator.Error
+	if errors.As(err, &validationErr) {
+		apierror.Write(w, r, http.StatusBadRequest, validationErr.Code, validationErr.Message)
 		return
 	}
-	sessionToken := c.Value
-	login, err := a.authenticator.CheckAuthentication(sessionToken)
 	if err != nil {
-		if err.Error() == "no such token" {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("{}"))
-			return
+		switch err.Error() {
+		case "wrong request":
+			writeWrongRequest(w, r)
+		case "transfer to yourself":
+			apierror.Write(w, r, http.StatusBadRequest, apierror.CodeSelfTransfer, "transfer to yourself")
+		case "not enough balance":
+			apierror.Write(w, r, http.StatusPaymentRequired, apierror.CodeInsufficientBalance, "not enough balance")
+		case "account is too young":
+			apierror.Write(w, r, http.StatusForbidden, apierror.CodeAccountTooYoung, "account is too young")
+		case "daily transfer limit exceeded":
+			apierror.Write(w, r, http.StatusForbidden, apierror.CodeTransferLimitExceeded,
+				"daily transfer limit exceeded")
+		case "no such user":
+			apierror.Write(w, r, http.StatusNotFound, apierror.CodeUserNotFound, "no such user")
+		default:
+			logger.Ctx(r.Context()).Error().Err(err).Msg("unhandled")
+			apierror.Internal(w, r)
 		}
-		log.Println("api::getOrdersHandler::error: unhandled in auth check:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("{}"))
+}
+
+func (a *api) getReferralHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+
+	login, ok := a.authenticatedLogin(w, r)
+	if !ok {
+		return
+	}
+
+	res, err := a.authenticator.GetReferral(r.Context(), login)
+	if err != nil {
+		logger.Ctx(r.Context()).Error().Err(err).Msg("unhandled")
+		apierror.Internal(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(res)
+}
+
+func (a *api) deleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+
+	login, ok := a.authenticatedLogin(w, r)
+	if !ok {
 		return
 	}
 
 	defer r.Body.Close()
 	respBody, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Println("api::makeWithdrawHandler::warning: can't read response body with:", err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("{}"))
+		logger.Ctx(r.Context()).Warn().Err(err).Msg("can't read request body")
+		apierror.Write(w, r, http.StatusBadRequest, apierror.CodeBadRequest, "can't read request body")
+		return
+	}
+
+	err = a.authenticator.DeleteAccount(r.Context(), login, respBody)
+	if err != nil {
+		switch err.Error() {
+		case "wrong request":
+			writeWrongRequest(w, r)
+		case "wrong password":
+			apierror.Write(w, r, http.StatusForbidden, apierror.CodeWrongPassword, "wrong password")
+		default:
+			logger.Ctx(r.Context()).Error().Err(err).Msg("unhandled")
+			apierror.Internal(w, r)
+		}
 		return
 	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   "session_token",
+		MaxAge: -1,
+	})
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("{}"))
+}
+
+// checkAdminToken writes 401 Unauthorized and returns false if request has no admin token
+// in "Authorization: Bearer <token>" header
+func (a *api) checkAdminToken(w http.ResponseWriter, r *http.Request) bool {
+	header := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(header, "Bearer ")
+	if token == header || subtle.ConstantTimeCompare([]byte(token), []byte(a.adminToken)) != 1 {
+		apierror.Write(w, r, http.StatusUnauthorized, apierror.CodeUnauthorized, "admin token is missing or wrong")
+		return false
+	}
+	return true
+}
 
-	err = a.service.MakeWithdraw(login, respBody)
+func (a *api) adminDeleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+
+	if !a.checkAdminToken(w, r) {
+		return
+	}
+
+	login := chi.URLParam(r, "login")
+	err := a.authenticator.DeleteAccountByAdmin(r.Context(), login)
 	if err != nil {
-		if err.Error() == "wrong request" {
-			w.WriteHeader(http.StatusBadRequest)
-		} else if err.Error() == "not enough balance" {
-			w.WriteHeader(http.StatusPaymentRequired)
-		} else if err.Error() == "wrong format of order" {
-			w.WriteHeader(http.StatusUnprocessableEntity)
+		if err.Error() == "no such user" {
+			apierror.WriteDetails(w, r, http.StatusNotFound, apierror.CodeUserNotFound, "no such user",
+				map[string]string{"login": login})
 		} else {
-			log.Println("api::makeWithdrawHandler::error: unhandled:", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			logger.Ctx(r.Context()).Error().Err(err).Msg("unhandled")
+			apierror.Internal(w, r)
 		}
-	} else {
-		w.WriteHeader(http.StatusOK)
+		return
 	}
+	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("{}"))
 }
 
-func (a *api) getWithdrawsHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("api::getWithdrawsHandler::info: started")
+func (a *api) addWebhookEndpointHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("content-type", "application/json")
 
-	c, err := r.Cookie("session_token")
+	login, ok := a.authenticatedLogin(w, r)
+	if !ok {
+		return
+	}
+	a.addWebhookEndpoint(w, r, login)
+}
+
+func (a *api) getWebhookEndpointsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+
+	login, ok := a.authenticatedLogin(w, r)
+	if !ok {
+		return
+	}
+	a.getWebhookEndpoints(w, r, login)
+}
+
+func (a *api) removeWebhookEndpointHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+
+	login, ok := a.authenticatedLogin(w, r)
+	if !ok {
+		return
+	}
+	a.removeWebhookEndpoint(w, r, login)
+}
+
+func (a *api) adminAddWebhookEndpointHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+
+	if a.checkAdminToken(w, r) {
+		a.addWebhookEndpoint(w, r, "")
+	}
+}
+
+func (a *api) adminGetWebhookEndpointsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+
+	if a.checkAdminToken(w, r) {
+		a.getWebhookEndpoints(w, r, "")
+	}
+}
+
+func (a *api) adminRemoveWebhookEndpointHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+
+	if a.checkAdminToken(w, r) {
+		a.removeWebhookEndpoint(w, r, "")
+	}
+}
+
+// addWebhookEndpoint adds endpoint of login, of admins if login is empty
+func (a *api) addWebhookEndpoint(w http.ResponseWriter, r *http.Request, login string) {
+	defer r.Body.Close()
+	respBody, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		if err == http.ErrNoCookie {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("{}"))
-			return
+		logger.Ctx(r.Context()).Warn().Err(err).Msg("can't read request body")
+		apierror.Write(w, r, http.StatusBadRequest, apierror.CodeBadRequest, "can't read request body")
+		return
+	}
+
+	res, err := a.service.AddWebhookEndpoint(r.Context(), login, respBody)
+	if err != nil {
+		switch err.Error() {
+		case "wrong request":
+			writeWrongRequest(w, r)
+		case "wrong webhook url":
+			apierror.Write(w, r, http.StatusBadRequest, apierror.CodeWrongWebhookURL,
+				"webhook url must be an absolute http or https url")
+		default:
+			logger.Ctx(r.Context()).Error().Err(err).Msg("unhandled")
+			apierror.Internal(w, r)
 		}
-		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	sessionToken := c.Value
-	login, err := a.authenticator.CheckAuthentication(sessionToken)
+	w.WriteHeader(http.StatusOK)
+	w.Write(res)
+}
+
+// getWebhookEndpoints writes endpoints of login, of admins if login is empty
+func (a *api) getWebhookEndpoints(w http.ResponseWriter, r *http.Request, login string) {
+	res, err := a.service.GetWebhookEndpoints(r.Context(), login)
 	if err != nil {
-		if err.Error() == "no such token" {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("{}"))
+		if err.Error() == "no webhook endpoints" {
+			w.WriteHeader(http.StatusNoContent)
 			return
 		}
-		log.Println("api::getOrdersHandler::error: unhandled in auth check:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		logger.Ctx(r.Context()).Error().Err(err).Msg("unhandled")
+		apierror.Internal(w, r)
 		return
 	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(res)
+}
 
-	res, err := a.service.GetWithdraws(login)
+// removeWebhookEndpoint removes endpoint of login, of admins if login is empty
+func (a *api) removeWebhookEndpoint(w http.ResponseWriter, r *http.Request, login string) {
+	id := chi.URLParam(r, "id")
+	err := a.service.RemoveWebhookEndpoint(r.Context(), login, id)
 	if err != nil {
-		if err.Error() == "no withdraws" {
-			w.WriteHeader(http.StatusNoContent)
+		if err.Error() == "no such webhook endpoint" {
+			apierror.WriteDetails(w, r, http.StatusNotFound, apierror.CodeWebhookEndpointNotFound,
+				"no such webhook endpoint", map[string]string{"id": id})
 		} else {
-			log.Println("api::getWithdrawsHandler::error: unhandled:", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			logger.Ctx(r.Context()).Error().Err(err).Msg("unhandled")
+			apierror.Internal(w, r)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("{}"))
+}
+
+// adminGetDeadWebhookDeliveriesHandler is the dead letter view of webhooks
+func (a *api) adminGetDeadWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+
+	if !a.checkAdminToken(w, r) {
+		return
+	}
+	res, err := a.service.GetDeadWebhookDeliveries(r.Context())
+	if err != nil {
+		if err.Error() == "no dead webhook deliveries" {
+			w.WriteHeader(http.StatusNoContent)
+			return
 		}
-		w.Write([]byte("{}"))
+		logger.Ctx(r.Context()).Error().Err(err).Msg("unhandled")
+		apierror.Internal(w, r)
 		return
 	}
+	w.WriteHeader(http.StatusOK)
 	w.Write(res)
+}
+
+func (a *api) adminRetryWebhookDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+
+	if !a.checkAdminToken(w, r) {
+		return
+	}
+	id := chi.URLParam(r, "id")
+	err := a.service.RetryWebhookDelivery(r.Context(), id)
+	if err != nil {
+		if err.Error() == "no such dead webhook delivery" {
+			apierror.WriteDetails(w, r, http.StatusNotFound, apierror.CodeWebhookDeliveryNotFound,
+				"no such dead webhook delivery", map[string]string{"id": id})
+		} else {
+			logger.Ctx(r.Context()).Error().Err(err).Msg("unhandled")
+			apierror.Internal(w, r)
+		}
+		return
+	}
 	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("{}"))
 }
 
 type API interface {
-	Run(serviceAddress string) error
+	Run(ctx context.Context, serviceAddress string, shutdown graceful.Config) error
+	Handler() http.Handler
 }
 
 var _ API = &api{}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nivanov045/gofermart/cmd/gophermart/ratelimit"
+)
+
+func TestForwardedIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"direct client", "203.0.113.1:1234", nil, "203.0.113.1:1234"},
+		{"spoofed by client", "203.0.113.1:1234", map[string]string{"X-Real-IP": "198.51.100.1"}, "203.0.113.1:1234"},
+		{"spoofed forwarding", "203.0.113.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			"203.0.113.1:1234"},
+		{"real ip of proxy", "192.0.2.1:1234", map[string]string{"X-Real-IP": "198.51.100.1"}, "198.51.100.1"},
+		{"chain of proxies", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1, 10.0.0.2"},
+			"198.51.100.1"},
+		{"forged start of chain", "10.0.0.1:1234",
+			map[string]string{"X-Forwarded-For": "10.0.0.3, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"malformed chain", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "junk, 10.0.0.2"},
+			"10.0.0.1:1234"},
+		{"proxy without headers", "10.0.0.1:1234", nil, "10.0.0.1:1234"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+			var got string
+			realIP(proxies)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.RemoteAddr
+			})).ServeHTTP(httptest.NewRecorder(), req)
+			if got != tt.want {
+				t.Errorf("RemoteAddr = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	for _, proxy := range []string{"10.0.0.0/33", "proxy"} {
+		if _, err := ParseTrustedProxies([]string{proxy}); err == nil {
+			t.Errorf("ParseTrustedProxies(%q) succeeded", proxy)
+		}
+	}
+}
+
+type countingAuthenticator struct {
+	Authenticator
+	checks int
+}
+
+func (a *countingAuthenticator) CheckAuthentication(ctx context.Context, sessionToken string) (string, error) {
+	a.checks++
+	return "alice", nil
+}
+
+// TestSessionIsCheckedOnce checks that the rate limit and the handler share the login
+func TestSessionIsCheckedOnce(t *testing.T) {
+	auth := &countingAuthenticator{}
+	a := &api{authenticator: auth}
+	var login string
+	handler := a.authenticate(rateLimit("data", ratelimit.New(1, time.Minute), loginKey)(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			login, _ = a.authenticatedLogin(w, r)
+		})))
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest(http.MethodGet, "/api/user/orders", nil)
+		req.AddCookie(&http.Cookie{Name: "session_token", Value: "token"})
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("request %d = %d, want %d", i, rec.Code, want)
+		}
+		if auth.checks != i+1 {
+			t.Errorf("session is checked %d times for %d requests", auth.checks, i+1)
+		}
+	}
+	if login != "alice" {
+		t.Errorf("login = %q", login)
+	}
+}
+
+func TestLoginKeyOfAnonymousClient(t *testing.T) {
+	auth := &countingAuthenticator{}
+	a := &api{authenticator: auth}
+	var key string
+	a.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key = loginKey(r)
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if key != "ip:192.0.2.1" {
+		t.Errorf("loginKey = %q, want ip:192.0.2.1", key)
+	}
+	if auth.checks != 0 {
+		t.Errorf("session is checked without a cookie")
+	}
+}
@@ -0,0 +1,11 @@
+package api_test
+
+import (
+	"testing"
+
+	"github.com/nivanov045/gofermart/cmd/gophermart/api/apitest"
+)
+
+func TestContract(t *testing.T) {
+	apitest.Run(t)
+}
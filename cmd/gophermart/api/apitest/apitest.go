@@ -0,0 +1,553 @@
+// Package apitest is a contract suite for gophermart api. It runs every handler on the
+// in-memory storage and checks responses against the OpenAPI document served at
+// /openapi.json, so the document can't drift from handlers:
+//
+//	func TestContract(t *testing.T) {
+//		apitest.Run(t)
+//	}
+package apitest
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nivanov045/gofermart/cmd/gophermart/api"
+	"github.com/nivanov045/gofermart/cmd/gophermart/authenticator"
+	"github.com/nivanov045/gofermart/cmd/gophermart/crypto"
+	"github.com/nivanov045/gofermart/cmd/gophermart/events"
+	"github.com/nivanov045/gofermart/cmd/gophermart/ratelimit"
+	"github.com/nivanov045/gofermart/cmd/gophermart/service"
+	"github.com/nivanov045/gofermart/cmd/gophermart/storage"
+	"github.com/nivanov045/gofermart/cmd/gophermart/validator"
+	"github.com/nivanov045/gofermart/cmd/gophermart/webhooks"
+	"github.com/nivanov045/gofermart/internal/amount"
+	"github.com/nivanov045/gofermart/internal/contract"
+	"github.com/nivanov045/gofermart/internal/health"
+	"github.com/nivanov045/gofermart/internal/order"
+	"github.com/nivanov045/gofermart/internal/webhook"
+)
+
+const (
+	adminToken = "admin-token"
+	// accrual is accrued by the fake accrual system for every order
+	accrual = amount.Amount(100_00)
+
+	validOrder   = "12345678903"
+	invalidOrder = "12345678904"
+	newOrder     = "2377225624"
+)
+
+// accrualSystem processes every order at once with the same accrual
+type accrualSystem struct {
+	toService chan order.Order
+}
+
+func (a *accrualSystem) SetChannelToResponseToService(ch chan order.Order) {
+	a.toService = ch
+}
+
+func (a *accrualSystem) RunListenToService(ctx context.Context, fromService <-chan string) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case number := <-fromService:
+			a.toService <- order.Order{Number: number, Status: order.ProcessingTypeProcessed, Accrual: accrual}
+		}
+	}
+}
+
+// Run runs the suite on a new api
+func Run(t *testing.T) {
+	memory := storage.NewMemory()
+	hub := events.New(time.Minute)
+	serv := service.New(memory, &accrualSystem{}, validator.New(memory, 50_00, 0), hub, service.Config{
+		TierWindow:         24 * time.Hour,
+		TransferDailyLimit: 10_00,
+		// the receiver is an httptest server on loopback
+		WebhookAllowPrivate: true,
+	}, false)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go serv.Run(ctx)
+	auth := authenticator.New(memory, false, crypto.New("key"), 5, time.Hour)
+	handler := api.New(serv, auth, health.New(time.Second), hub, time.Second, adminToken,
+		ratelimit.New(0, time.Minute), ratelimit.New(0, time.Minute), nil).Handler()
+	c := contract.New(t, handler, "/openapi.json", "/api/")
+	receiver := newReceiver()
+	defer receiver.Close()
+	dispatcher := webhooks.New(memory, receiver.Client(), webhooks.Config{
+		Timeout:     5 * time.Second,
+		Backoff:     time.Minute,
+		MaxAttempts: 1,
+	})
+
+	alice := session(t, expect(t, c, newRequest(http.MethodPost, "/api/user/register", "",
+		`{"login":"alice","password":"secret"}`), http.StatusOK))
+	expect(t, c, newRequest(http.MethodPost, "/api/user/register", "",
+		`{"login":"alice","password":"secret"}`), http.StatusConflict)
+	expect(t, c, newRequest(http.MethodPost, "/api/user/register", "", `{"login":`), http.StatusBadRequest)
+	expect(t, c, newRequest(http.MethodPost, "/api/user/register", "",
+		`{"login":"carol","password":"secret","referral_code":"UNKNOWN"}`), http.StatusBadRequest)
+
+	var referral struct {
+		Code string `json:"referral_code"`
+	}
+	decode(t, expect(t, c, newRequest(http.MethodGet, "/api/user/referral", alice, ""), http.StatusOK), &referral)
+	bob := session(t, expect(t, c, newRequest(http.MethodPost, "/api/user/register", "",
+		`{"login":"bob","password":"secret","referral_code":"`+referral.Code+`"}`), http.StatusOK))
+
+	expect(t, c, newRequest(http.MethodPost, "/api/user/login", "",
+		`{"login":"alice","password":"wrong"}`), http.StatusUnauthorized)
+	expect(t, c, newRequest(http.MethodPost, "/api/user/login", "", `{"login":`), http.StatusBadRequest)
+	alice = session(t, expect(t, c, newRequest(http.MethodPost, "/api/user/login", "",
+		`{"login":"alice","password":"secret"}`), http.StatusOK))
+
+	expect(t, c, newStreamRequest("", ""), http.StatusUnauthorized)
+	expect(t, c, newStreamRequest(alice, "abc"), http.StatusBadRequest)
+	// IDs of another process are reset, the reset event is where the stream resumes from
+	reset := streamEvents(t, expect(t, c, newStreamRequest(alice, "1"), http.StatusOK))
+	if len(reset) != 1 || reset[0].Type != events.TypeReset {
+		t.Fatalf("events = %v, want one reset event", reset)
+	}
+
+	expect(t, c, newRequest(http.MethodGet, "/api/user/webhooks", alice, ""), http.StatusNoContent)
+	expect(t, c, newRequest(http.MethodPost, "/api/user/webhooks", "", `{"url":"http://example.com"}`),
+		http.StatusUnauthorized)
+	expect(t, c, newRequest(http.MethodPost, "/api/user/webhooks", alice, `{"url":"ftp://example.com"}`),
+		http.StatusBadRequest)
+	expect(t, c, newRequest(http.MethodPost, "/api/user/webhooks", alice, `{"url":`), http.StatusBadRequest)
+	var endpoint struct {
+		ID     int64  `json:"id"`
+		Secret string `json:"secret"`
+	}
+	decode(t, expect(t, c, newRequest(http.MethodPost, "/api/user/webhooks", alice,
+		`{"url":"`+receiver.URL+`/ok"}`), http.StatusOK), &endpoint)
+	expect(t, c, newRequest(http.MethodGet, "/api/user/webhooks", alice, ""), http.StatusOK)
+	expect(t, c, newAdminRequest(http.MethodGet, "/api/admin/webhooks", adminToken, ""), http.StatusNoContent)
+	expect(t, c, newAdminRequest(http.MethodPost, "/api/admin/webhooks", "wrong",
+		`{"url":"http://example.com"}`), http.StatusUnauthorized)
+	expect(t, c, newAdminRequest(http.MethodPost, "/api/admin/webhooks", adminToken, `{"url":"example.com"}`),
+		http.StatusBadRequest)
+	var adminEndpoint struct {
+		ID int64 `json:"id"`
+	}
+	decode(t, expect(t, c, newAdminRequest(http.MethodPost, "/api/admin/webhooks", adminToken,
+		`{"url":"`+receiver.URL+`/fail"}`), http.StatusOK), &adminEndpoint)
+	expect(t, c, newAdminRequest(http.MethodGet, "/api/admin/webhooks", adminToken, ""), http.StatusOK)
+	expect(t, c, newAdminRequest(http.MethodGet, "/api/admin/webhooks/dead", adminToken, ""), http.StatusNoContent)
+	// metrics are served at their own address, not next to user endpoints
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, newAdminRequest(http.MethodGet, "/metrics", adminToken, ""))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET /metrics = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	expect(t, c, newRequest(http.MethodGet, "/api/user/orders", "", ""), http.StatusUnauthorized)
+	expect(t, c, newRequest(http.MethodGet, "/api/user/orders", alice, ""), http.StatusNoContent)
+	expect(t, c, newRequest(http.MethodGet, "/api/user/withdrawals", alice, ""), http.StatusNoContent)
+	expect(t, c, newRequest(http.MethodPost, "/api/user/orders", alice, validOrder), http.StatusAccepted)
+	expect(t, c, newRequest(http.MethodPost, "/api/user/orders", alice, validOrder), http.StatusOK)
+	expect(t, c, newRequest(http.MethodPost, "/api/user/orders", bob, validOrder), http.StatusConflict)
+	expect(t, c, newRequest(http.MethodPost, "/api/user/orders", alice, invalidOrder),
+		http.StatusUnprocessableEntity)
+	waitForAccrual(t, c, alice)
+	missed := streamEvents(t, expect(t, c, newStreamRequest(alice, reset[0].ID), http.StatusOK))
+	if len(missed) != 2 || missed[0].Type != events.TypeOrder || missed[1].Type != events.TypeBalance {
+		t.Errorf("events = %v, want order and balance events", missed)
+	}
+	expect(t, c, newRequest(http.MethodGet, "/api/user/orders", alice, ""), http.StatusOK)
+
+	withdraw := func(order string, sum string) string {
+		return `{"order":"` + order + `","sum":` + sum + `}`
+	}
+	expect(t, c, newRequest(http.MethodPost, "/api/user/balance/withdraw", alice, withdraw(newOrder, "1")),
+		http.StatusOK)
+	expect(t, c, newRequest(http.MethodPost, "/api/user/balance/withdraw", alice, withdraw(newOrder, "-1")),
+		http.StatusBadRequest)
+	expect(t, c, newRequest(http.MethodPost, "/api/user/balance/withdraw", alice, withdraw(newOrder, "60")),
+		http.StatusForbidden)
+	expect(t, c, newRequest(http.MethodPost, "/api/user/balance/withdraw", alice, withdraw(newOrder, "50")),
+		http.StatusOK)
+	expect(t, c, newRequest(http.MethodPost, "/api/user/balance/withdraw", alice, withdraw(newOrder, "50")),
+		http.StatusPaymentRequired)
+	expect(t, c, newRequest(http.MethodPost, "/api/user/balance/withdraw", alice, withdraw(invalidOrder, "1")),
+		http.StatusUnprocessableEntity)
+	expect(t, c, newRequest(http.MethodPost, "/api/user/balance/withdraw", alice, `{"order":`),
+		http.StatusBadRequest)
+	expect(t, c, newRequest(http.MethodGet, "/api/user/withdrawals", alice, ""), http.StatusOK)
+	expect(t, c, newRequest(http.MethodGet, "/api/user/tier", alice, ""), http.StatusOK)
+
+	// alice's endpoint gets her events, the admin's one refuses them and they are dead at once
+	deliveries := receiver.wait(t, dispatcher, 3)
+	for _, d := range deliveries {
+		err := webhook.Verify(endpoint.Secret, d.header.Get(webhook.HeaderSignature), d.body, time.Minute)
+		if err != nil {
+			t.Errorf("signature of %s delivery: %v", d.header.Get(webhook.HeaderEvent), err)
+		}
+	}
+	if events := receiver.events(); events != webhook.EventOrderProcessed+" "+webhook.EventWithdrawalCreated+" "+
+		webhook.EventWithdrawalCreated {
+		t.Errorf("delivered events = %s", events)
+	}
+	var dead []struct {
+		ID int64 `json:"id"`
+	}
+	decode(t, expect(t, c, newAdminRequest(http.MethodGet, "/api/admin/webhooks/dead", adminToken, ""),
+		http.StatusOK), &dead)
+	if len(dead) != 3 {
+		t.Fatalf("dead deliveries = %v, want 3", dead)
+	}
+	deadID := strconv.FormatInt(dead[0].ID, 10)
+	expect(t, c, newAdminRequest(http.MethodPost, "/api/admin/webhooks/dead/"+deadID+"/retry", "wrong", ""),
+		http.StatusUnauthorized)
+	expect(t, c, newAdminRequest(http.MethodPost, "/api/admin/webhooks/dead/"+deadID+"/retry", adminToken, ""),
+		http.StatusOK)
+	expect(t, c, newAdminRequest(http.MethodPost, "/api/admin/webhooks/dead/"+deadID+"/retry", adminToken, ""),
+		http.StatusNotFound)
+
+	transfer := func(login string, sum string) string {
+		return `{"login":"` + login + `","sum":` + sum + `}`
+	}
+	expect(t, c, newRequest(http.MethodPost, "/api/user/balance/transfer", alice, transfer("alice", "1")),
+		http.StatusBadRequest)
+	expect(t, c, newRequest(http.MethodPost, "/api/user/balance/transfer", alice, transfer("zed", "1")),
+		http.StatusNotFound)
+	// sums aren't rounded, so nothing is transferred instead of a rounded sum
+	for _, tt := range []struct {
+		sum  string
+		code string
+	}{
+		{"0.005", validator.CodeTooPreciseSum},
+		{"0.004", validator.CodeTooPreciseSum},
+		{"0", validator.CodeNonPositiveSum},
+		{"-1", validator.CodeNonPositiveSum},
+	} {
+		expectCode(t, c, newRequest(http.MethodPost, "/api/user/balance/transfer", alice, transfer("bob", tt.sum)),
+			http.StatusBadRequest, tt.code)
+	}
+	expect(t, c, newRequest(http.MethodPost, "/api/user/balance/transfer", alice, transfer("bob", "1000")),
+		http.StatusPaymentRequired)
+	expect(t, c, newRequest(http.MethodPost, "/api/user/balance/transfer", alice, transfer("bob", "20")),
+		http.StatusForbidden)
+	expect(t, c, newRequest(http.MethodPost, "/api/user/balance/transfer", alice, transfer("bob", "1")),
+		http.StatusOK)
+	expect(t, c, newRequest(http.MethodPost, "/api/user/balance/transfer", alice, `{"login":`),
+		http.StatusBadRequest)
+	expect(t, c, newRequest(http.MethodGet, "/api/user/orders", bob, ""), http.StatusOK)
+
+	expect(t, c, newRequest(http.MethodPost, "/api/user/logout", bob, ""), http.StatusOK)
+	expect(t, c, newRequest(http.MethodPost, "/api/user/logout", bob, ""), http.StatusUnauthorized)
+
+	endpointID := strconv.FormatInt(endpoint.ID, 10)
+	expect(t, c, newRequest(http.MethodDelete, "/api/user/webhooks/"+endpointID, bob, ""), http.StatusUnauthorized)
+	expect(t, c, newRequest(http.MethodDelete, "/api/user/webhooks/"+endpointID, alice, ""), http.StatusOK)
+	expect(t, c, newRequest(http.MethodDelete, "/api/user/webhooks/"+endpointID, alice, ""), http.StatusNotFound)
+	adminEndpointID := strconv.FormatInt(adminEndpoint.ID, 10)
+	expect(t, c, newAdminRequest(http.MethodDelete, "/api/admin/webhooks/"+adminEndpointID, "wrong", ""),
+		http.StatusUnauthorized)
+	expect(t, c, newAdminRequest(http.MethodDelete, "/api/admin/webhooks/"+adminEndpointID, adminToken, ""),
+		http.StatusOK)
+	expect(t, c, newAdminRequest(http.MethodDelete, "/api/admin/webhooks/"+adminEndpointID, adminToken, ""),
+		http.StatusNotFound)
+
+	expect(t, c, newRequest(http.MethodDelete, "/api/user", alice, `{"password":`), http.StatusBadRequest)
+	expect(t, c, newRequest(http.MethodDelete, "/api/user", alice, `{"password":"wrong"}`), http.StatusForbidden)
+	expect(t, c, newRequest(http.MethodDelete, "/api/user", alice, `{"password":"secret"}`), http.StatusOK)
+
+	expect(t, c, newAdminRequest(http.MethodDelete, "/api/admin/users/bob", "wrong", ""), http.StatusUnauthorized)
+	withoutScheme := newRequest(http.MethodDelete, "/api/admin/users/bob", "", "")
+	withoutScheme.Header.Set("Authorization", adminToken)
+	expect(t, c, withoutScheme, http.StatusUnauthorized)
+	expect(t, c, newAdminRequest(http.MethodDelete, "/api/admin/users/zed", adminToken, ""), http.StatusNotFound)
+	expect(t, c, newAdminRequest(http.MethodDelete, "/api/admin/users/bob", adminToken, ""), http.StatusOK)
+
+	c.CheckCoverage()
+	runRateLimits(t)
+}
+
+// runRateLimits runs api which allows two requests a minute, registrations and admin
+// requests share limit of IP and authenticated clients have limits of their own.
+// Forwarding headers are trusted from 192.0.2.1, which is the address of httptest requests.
+func runRateLimits(t *testing.T) {
+	memory := storage.NewMemory()
+	hub := events.New(time.Minute)
+	_, proxy, _ := net.ParseCIDR("192.0.2.1/32")
+	serv := service.New(memory, &accrualSystem{}, validator.New(memory, 0, 0), hub, service.Config{}, false)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go serv.Run(ctx)
+	auth := authenticator.New(memory, false, crypto.New("key"), 5, time.Hour)
+	handler := api.New(serv, auth, health.New(time.Second), hub, time.Second, adminToken,
+		ratelimit.New(2, time.Minute), ratelimit.New(2, time.Minute), []*net.IPNet{proxy}).Handler()
+	c := contract.New(t, handler, "/openapi.json", "/api/")
+
+	expect(t, c, newRequest(http.MethodPost, "/api/user/register", "",
+		`{"login":"alice","password":"secret"}`), http.StatusOK)
+	bob := session(t, expect(t, c, newRequest(http.MethodPost, "/api/user/register", "",
+		`{"login":"bob","password":"secret"}`), http.StatusOK))
+	expectRetryAfter(t, expect(t, c, newRequest(http.MethodPost, "/api/user/login", "",
+		`{"login":"alice","password":"secret"}`), http.StatusTooManyRequests))
+	// headers of other clients are ignored, so they can't get limits of new IPs
+	spoofed := newRequest(http.MethodPost, "/api/user/register", "", `{"login":"eve","password":"secret"}`)
+	spoofed.RemoteAddr = "203.0.113.1:1234"
+	expect(t, c, spoofed, http.StatusOK)
+	for _, tt := range []struct {
+		header string
+		want   int
+	}{
+		{"X-Real-IP", http.StatusOK},
+		{"X-Forwarded-For", http.StatusTooManyRequests},
+	} {
+		spoofed = newRequest(http.MethodPost, "/api/user/login", "", `{"login":"eve","password":"secret"}`)
+		spoofed.RemoteAddr = "203.0.113.1:1234"
+		spoofed.Header.Set(tt.header, "198.51.100.2")
+		expect(t, c, spoofed, tt.want)
+	}
+	fromProxy := newRequest(http.MethodPost, "/api/user/login", "", `{"login":"alice","password":"secret"}`)
+	fromProxy.Header.Set("X-Forwarded-For", "198.51.100.1, 192.0.2.1")
+	alice := session(t, expect(t, c, fromProxy, http.StatusOK))
+
+	for i := 0; i < 2; i++ {
+		expect(t, c, newRequest(http.MethodGet, "/api/user/orders", alice, ""), http.StatusNoContent)
+		expect(t, c, newRequest(http.MethodGet, "/api/user/orders", "", ""), http.StatusUnauthorized)
+	}
+	expectRetryAfter(t, expect(t, c, newRequest(http.MethodGet, "/api/user/orders", alice, ""),
+		http.StatusTooManyRequests))
+	expectRetryAfter(t, expect(t, c, newRequest(http.MethodGet, "/api/user/balance", "", ""),
+		http.StatusTooManyRequests))
+	expect(t, c, newRequest(http.MethodGet, "/api/user/orders", bob, ""), http.StatusNoContent)
+
+	// admin token can't be guessed faster than the limit of IP
+	for _, tt := range []struct {
+		token string
+		want  int
+	}{
+		{"wrong", http.StatusUnauthorized},
+		{"wrong", http.StatusUnauthorized},
+		{adminToken, http.StatusTooManyRequests},
+	} {
+		admin := newAdminRequest(http.MethodGet, "/api/admin/webhooks", tt.token, "")
+		admin.RemoteAddr = "203.0.113.2:1234"
+		expect(t, c, admin, tt.want)
+	}
+}
+
+func expectRetryAfter(t *testing.T, resp *http.Response) {
+	t.Helper()
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 1 {
+		t.Errorf("Retry-After = %q, want positive seconds", resp.Header.Get("Retry-After"))
+	}
+}
+
+// newRequest creates request with session cookie if session isn't empty, order numbers
+// are sent as plain text and other bodies as JSON
+func newRequest(method string, path string, session string, body string) *http.Request {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		if path == "/api/user/orders" {
+			req.Header.Set("Content-Type", "text/plain")
+		} else {
+			req.Header.Set("Content-Type", "application/json")
+		}
+	}
+	if session != "" {
+		req.AddCookie(&http.Cookie{Name: "session_token", Value: session})
+	}
+	return req
+}
+
+func newAdminRequest(method string, path string, token string, body string) *http.Request {
+	req := newRequest(method, path, "", body)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+// newStreamRequest creates request to the order stream which returns after missed events
+// are sent, lastEventID is sent if it isn't empty
+func newStreamRequest(session string, lastEventID string) *http.Request {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := newRequest(http.MethodGet, "/api/user/orders/stream", session, "").WithContext(ctx)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	return req
+}
+
+type streamEvent struct {
+	ID   string
+	Type string
+	Data string
+}
+
+// streamEvents parses events of the order stream response
+func streamEvents(t *testing.T, resp *http.Response) []streamEvent {
+	t.Helper()
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("response can't be read: %v", err)
+	}
+	var result []streamEvent
+	for _, block := range strings.Split(string(body), "\n\n") {
+		var event streamEvent
+		for _, line := range strings.Split(block, "\n") {
+			field, value, _ := strings.Cut(line, ": ")
+			switch field {
+			case "id":
+				event.ID = value
+			case "event":
+				event.Type = value
+			case "data":
+				event.Data = value
+			}
+		}
+		if event.Type != "" {
+			result = append(result, event)
+		}
+	}
+	return result
+}
+
+func expect(t *testing.T, c *contract.Checker, req *http.Request, want int) *http.Response {
+	t.Helper()
+	method, path := req.Method, req.URL.Path
+	resp := c.Do(req)
+	if resp.StatusCode != want {
+		body, _ := io.ReadAll(resp.Body)
+		t.Errorf("%s %s = %d, want %d: %s", method, path, resp.StatusCode, want, body)
+	}
+	return resp
+}
+
+// expectCode is expect which also checks code of the error response
+func expectCode(t *testing.T, c *contract.Checker, req *http.Request, want int, wantCode string) {
+	t.Helper()
+	method, path := req.Method, req.URL.Path
+	var body struct {
+		Code string `json:"code"`
+	}
+	decode(t, expect(t, c, req, want), &body)
+	if body.Code != wantCode {
+		t.Errorf("%s %s code = %s, want %s", method, path, body.Code, wantCode)
+	}
+}
+
+func session(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "session_token" && cookie.Value != "" {
+			return cookie.Value
+		}
+	}
+	t.Fatalf("response has no session cookie")
+	return ""
+}
+
+func decode(t *testing.T, resp *http.Response, v interface{}) {
+	t.Helper()
+	defer resp.Body.Close()
+	err := json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		t.Fatalf("response can't be decoded: %v", err)
+	}
+}
+
+// waitForAccrual waits until accrual of uploaded order is on session's balance
+func waitForAccrual(t *testing.T, c *contract.Checker, session string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var balance struct {
+			Current amount.Amount `json:"current"`
+		}
+		decode(t, expect(t, c, newRequest(http.MethodGet, "/api/user/balance", session, ""), http.StatusOK),
+			&balance)
+		if balance.Current == accrual {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("balance = %v, want %v", balance.Current, accrual)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+type webhookDispatcher interface {
+	DispatchOnce(ctx context.Context) (int, error)
+}
+
+type delivery struct {
+	header http.Header
+	body   []byte
+}
+
+// receiver records webhook deliveries to /ok and refuses ones to other paths
+type receiver struct {
+	*httptest.Server
+	mu         sync.Mutex
+	deliveries []delivery
+}
+
+func newReceiver() *receiver {
+	r := &receiver{}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/ok" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		r.deliveries = append(r.deliveries, delivery{header: req.Header.Clone(), body: body})
+		r.mu.Unlock()
+	}))
+	return r
+}
+
+// wait dispatches deliveries till want ones are received, events are written by
+// accrual processing in background, so they may be late
+func (r *receiver) wait(t *testing.T, dispatcher webhookDispatcher, want int) []delivery {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		_, err := dispatcher.DispatchOnce(context.Background())
+		if err != nil {
+			t.Fatalf("DispatchOnce: %v", err)
+		}
+		r.mu.Lock()
+		deliveries := append([]delivery(nil), r.deliveries...)
+		r.mu.Unlock()
+		if len(deliveries) >= want {
+			return deliveries
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d webhooks are delivered, want %d", len(deliveries), want)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// events returns sorted types of received deliveries separated by spaces, deliveries
+// are sent concurrently, so they may be received in any order
+func (r *receiver) events() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var result []string
+	for _, d := range r.deliveries {
+		result = append(result, d.header.Get(webhook.HeaderEvent))
+	}
+	sort.Strings(result)
+	return strings.Join(result, " ")
+}
@@ -1,68 +1,101 @@
 package authenticator
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+
+	"github.com/nivanov045/gofermart/internal/audit"
+	"github.com/nivanov045/gofermart/internal/logger"
 )
 
 type Storage interface {
-	AddUser(login string, passwordHash string) error
-	AddSession(login string, sessionToken string, expiresAt time.Time) error
-	GetSessionInfo(sessionToken string) (string, time.Time, error)
-	CheckPassword(login string, passwordHash string) (bool, error)
-	RemoveSession(sessionToken string) error
+	AddUser(ctx context.Context, login string, passwordHash string, referralCode string) error
+	AddSession(ctx context.Context, login string, sessionToken string, expiresAt time.Time) error
+	GetSessionInfo(ctx context.Context, sessionToken string) (string, time.Time, error)
+	CheckPassword(ctx context.Context, login string, passwordHash string) (bool, error)
+	RemoveSession(ctx context.Context, sessionToken string) error
+	FindUserByReferralCode(ctx context.Context, referralCode string) (string, error)
+	GetReferralCode(ctx context.Context, login string) (string, error)
+	CountReferrals(ctx context.Context, login string) (int, error)
+	AddReferral(ctx context.Context, referrer string, referred string, maxReferrals int) error
+	DeleteUser(ctx context.Context, login string, anonymousLogin string) error
+	ReserveLogin(ctx context.Context, loginHash string, until time.Time) error
+	IsLoginReserved(ctx context.Context, loginHash string) (bool, error)
+	AddAuditRecord(ctx context.Context, record audit.Record) error
+	WithTx(ctx context.Context, fn func(ctx context.Context) error) error
 }
 
 type Crypto interface {
 	CreateHash(s string) string
+	CreateLoginHash(login string) string
 }
 
 type authenticator struct {
-	storage Storage
-	isDebug bool
-	crypto  Crypto
+	storage          Storage
+	isDebug          bool
+	crypto           Crypto
+	maxReferrals     int
+	loginReservation time.Duration
 }
 
-func New(storage Storage, isDebug bool, crypto Crypto) *authenticator {
-	return &authenticator{storage: storage, isDebug: isDebug, crypto: crypto}
+// New creates authenticator, logins of deleted accounts can't be registered again for
+// loginReservation
+func New(storage Storage, isDebug bool, crypto Crypto, maxReferrals int, loginReservation time.Duration) *authenticator {
+	return &authenticator{
+		storage:          storage,
+		isDebug:          isDebug,
+		crypto:           crypto,
+		maxReferrals:     maxReferrals,
+		loginReservation: loginReservation,
+	}
 }
 
-func (a *authenticator) CheckAuthentication(sessionToken string) (string, error) {
-	login, expiredAt, err := a.storage.GetSessionInfo(sessionToken)
+func (a *authenticator) CheckAuthentication(ctx context.Context, sessionToken string) (string, error) {
+	login, expiredAt, err := a.storage.GetSessionInfo(ctx, sessionToken)
 	if err != nil {
 		return "", err
 	}
 	if expiredAt.Before(time.Now()) {
 		return "", errors.New("session token expired")
 	}
+	logger.Annotate(ctx, logger.FieldLogin, login)
 	return login, nil
 }
 
 type userAuthData struct {
-	Login    string `json:"login"`
-	Password string `json:"password"`
+	Login        string `json:"login"`
+	Password     string `json:"password"`
+	ReferralCode string `json:"referral_code,omitempty"`
 }
 
-func (a *authenticator) Register(requestBody []byte) (string, error) {
+func newReferralCode() string {
+	return strings.ToUpper(strings.ReplaceAll(uuid.NewString(), "-", "")[:12])
+}
+
+func (a *authenticator) Register(ctx context.Context, requestBody []byte) (string, error) {
 	var authData userAuthData
 	err := json.Unmarshal(requestBody, &authData)
 	if err != nil {
 		return "", errors.New("wrong query")
 	}
-	hash := a.crypto.CreateHash(authData.Password)
-	log.Println(hash)
-	err = a.storage.AddUser(authData.Login, hash)
-	if err != nil {
-		if err.Error() == "login is already in use" {
-			return "", err
+	logger.Annotate(ctx, logger.FieldLogin, authData.Login)
+	var referrer string
+	if authData.ReferralCode != "" {
+		referrer, err = a.storage.FindUserByReferralCode(ctx, authData.ReferralCode)
+		if err != nil {
+			if err.Error() == "no such referral code" {
+				return "", errors.New("wrong request")
+			}
+			return "", fmt.Errorf("authenticator::regitster: at storage.FindUserByReferralCode: [%w]", err)
 		}
-		return "", fmt.Errorf("authenticator::regitster: at storage.AddUser: [%w]", err)
 	}
+	hash := a.crypto.CreateHash(authData.Password)
 	var newSessionToken string
 	if a.isDebug {
 		newSessionToken = authData.Login + "_s"
@@ -70,25 +103,62 @@ func (a *authenticator) Register(requestBody []byte) (string, error) {
 		newSessionToken = uuid.NewString()
 	}
 	expiresAt := time.Now().Add(120 * time.Hour)
-	err = a.storage.AddSession(authData.Login, newSessionToken, expiresAt)
+	// user is never left registered without a session
+	err = a.storage.WithTx(ctx, func(ctx context.Context) error {
+		err := a.storage.AddUser(ctx, authData.Login, hash, newReferralCode())
+		if err != nil {
+			if err.Error() == "login is already in use" {
+				return err
+			}
+			return fmt.Errorf("authenticator::regitster: at storage.AddUser: [%w]", err)
+		}
+		// checked after the user is added, so a concurrent deletion of the login is seen
+		isReserved, err := a.storage.IsLoginReserved(ctx, a.crypto.CreateLoginHash(authData.Login))
+		if err != nil {
+			return fmt.Errorf("authenticator::regitster: at storage.IsLoginReserved: [%w]", err)
+		}
+		if isReserved {
+			return errors.New("login is already in use")
+		}
+		if referrer != "" {
+			err = a.storage.AddReferral(ctx, referrer, authData.Login, a.maxReferrals)
+			switch {
+			case err == nil:
+			case err.Error() == "referral limit reached":
+				// registration is not rejected because of referrer's limit
+				logger.Ctx(ctx).Warn().Err(err).Msg("referral is not added")
+			case err.Error() == "no such user":
+				// referrer was deleted after the code was found
+				return errors.New("wrong request")
+			default:
+				return fmt.Errorf("authenticator::regitster: at storage.AddReferral: [%w]", err)
+			}
+		}
+		err = a.storage.AddSession(ctx, authData.Login, newSessionToken, expiresAt)
+		if err != nil {
+			return fmt.Errorf("authenticator::regitster: at storage.AddSession: [%w]", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return "", fmt.Errorf("authenticator::regitster: at storage.AddSession: [%w]", err)
+		return "", err
 	}
 	return newSessionToken, nil
 }
 
-func (a *authenticator) Login(requestBody []byte) (string, error) {
+func (a *authenticator) Login(ctx context.Context, requestBody []byte) (string, error) {
 	var userAuthData userAuthData
 	err := json.Unmarshal(requestBody, &userAuthData)
 	if err != nil {
 		return "", errors.New("wrong query")
 	}
-	res, err := a.storage.CheckPassword(userAuthData.Login, a.crypto.CreateHash(userAuthData.Password))
+	logger.Annotate(ctx, logger.FieldLogin, userAuthData.Login)
+	res, err := a.storage.CheckPassword(ctx, userAuthData.Login, a.crypto.CreateHash(userAuthData.Password))
 	if err != nil {
 		return "", err
 	}
 	if !res {
-		return "", nil
+		return "", errors.New("wrong login or password")
 	}
 	var newSessionToken string
 	if a.isDebug {
@@ -97,15 +167,83 @@ func (a *authenticator) Login(requestBody []byte) (string, error) {
 		newSessionToken = uuid.NewString()
 	}
 	expiresAt := time.Now().Add(120 * time.Hour)
-	err = a.storage.AddSession(userAuthData.Login, newSessionToken, expiresAt)
+	err = a.storage.AddSession(ctx, userAuthData.Login, newSessionToken, expiresAt)
 	return newSessionToken, err
 }
 
-func (a *authenticator) Logout(sessionToken string) error {
-	_, _, err := a.storage.GetSessionInfo(sessionToken)
+func (a *authenticator) Logout(ctx context.Context, sessionToken string) error {
+	_, _, err := a.storage.GetSessionInfo(ctx, sessionToken)
 	if err != nil {
 		return err
 	}
-	err = a.storage.RemoveSession(sessionToken)
+	err = a.storage.RemoveSession(ctx, sessionToken)
 	return err
 }
+
+func (a *authenticator) GetReferral(ctx context.Context, login string) ([]byte, error) {
+	referralCode, err := a.storage.GetReferralCode(ctx, login)
+	if err != nil {
+		return nil, err
+	}
+	count, err := a.storage.CountReferrals(ctx, login)
+	if err != nil {
+		return nil, err
+	}
+	type referralInfo struct {
+		Code      string `json:"referral_code"`
+		Referrals int    `json:"referrals"`
+		Limit     int    `json:"referrals_limit"`
+	}
+	return json.Marshal(referralInfo{Code: referralCode, Referrals: count, Limit: a.maxReferrals})
+}
+
+// DeleteAccount deletes account of logged-in user after the password is confirmed
+func (a *authenticator) DeleteAccount(ctx context.Context, login string, requestBody []byte) error {
+	var request struct {
+		Password string `json:"password"`
+	}
+	err := json.Unmarshal(requestBody, &request)
+	if err != nil || request.Password == "" {
+		return errors.New("wrong request")
+	}
+	isPasswordCorrect, err := a.storage.CheckPassword(ctx, login, a.crypto.CreateHash(request.Password))
+	if err != nil {
+		return err
+	}
+	if !isPasswordCorrect {
+		return errors.New("wrong password")
+	}
+	return a.deleteAccount(ctx, login, audit.ActorUser)
+}
+
+func (a *authenticator) DeleteAccountByAdmin(ctx context.Context, login string) error {
+	return a.deleteAccount(ctx, login, audit.ActorAdmin)
+}
+
+// deleteAccount anonymises the account, reserves its login and writes the audit record
+// in one transaction
+func (a *authenticator) deleteAccount(ctx context.Context, login string, actor string) error {
+	anonymousLogin := "deleted-" + strings.ReplaceAll(uuid.NewString(), "-", "")
+	return a.storage.WithTx(ctx, func(ctx context.Context) error {
+		err := a.storage.DeleteUser(ctx, login, anonymousLogin)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		err = a.storage.ReserveLogin(ctx, a.crypto.CreateLoginHash(login), now.Add(a.loginReservation))
+		if err != nil {
+			return fmt.Errorf("authenticator::deleteAccount: at storage.ReserveLogin: [%w]", err)
+		}
+		err = a.storage.AddAuditRecord(ctx, audit.Record{
+			Action:    audit.ActionAccountDeleted,
+			Actor:     actor,
+			Subject:   anonymousLogin,
+			CreatedAt: now,
+		})
+		if err != nil {
+			return fmt.Errorf("authenticator::deleteAccount: at storage.AddAuditRecord: [%w]", err)
+		}
+		logger.Ctx(ctx).Info().Str("actor", actor).Str("anonymous_login", anonymousLogin).Msg("account is deleted")
+		return nil
+	})
+}
@@ -0,0 +1,172 @@
+// Package backup implements export and import subcommands of gophermart:
+//
+//	gophermart export --user <login> [--with-credentials] [--file <path>] [-d <dsn>]
+//	gophermart import [--file <path>] [-d <dsn>] [-k <key>]
+//
+// The document is written to stdout and read from stdin if file isn't set, dsn
+// defaults to DATABASE_URI. Exports answer personal data requests, so they don't have
+// the password hash unless --with-credentials is set for backups and moves between
+// environments, only such documents can be imported. Import checks reservations of
+// logins of deleted accounts, which are hashed with the key of the service, it defaults
+// to KEY. Imported orders without final status are sent to accrual system when
+// gophermart starts.
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/nivanov045/gofermart/cmd/gophermart/config"
+	"github.com/nivanov045/gofermart/cmd/gophermart/crypto"
+	"github.com/nivanov045/gofermart/cmd/gophermart/storage"
+	"github.com/nivanov045/gofermart/internal/logger"
+	"github.com/nivanov045/gofermart/internal/userexport"
+)
+
+type Storage interface {
+	ExportUser(ctx context.Context, login string) (userexport.Document, error)
+	ImportUser(ctx context.Context, doc userexport.Document) error
+	IsLoginReserved(ctx context.Context, loginHash string) (bool, error)
+	WithTx(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+type Crypto interface {
+	CreateLoginHash(login string) string
+}
+
+// commandTimeout limits the whole export or import
+const commandTimeout = 5 * time.Minute
+
+// Export writes the document with all data of login to w, password hash is written only
+// withCredentials
+func Export(ctx context.Context, storage Storage, login string, withCredentials bool, w io.Writer) error {
+	doc, err := storage.ExportUser(ctx, login)
+	if err != nil {
+		return err
+	}
+	if !withCredentials {
+		doc.Account.PasswordHash = ""
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(doc)
+}
+
+// Import reads the document from r and imports it, returns login of imported user
+func Import(ctx context.Context, storage Storage, crypto Crypto, r io.Reader) (string, error) {
+	var doc userexport.Document
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&doc)
+	if err != nil {
+		return "", fmt.Errorf("wrong document: %w", err)
+	}
+	if doc.Version != userexport.Version {
+		return "", errors.New("unsupported document version " + strconv.Itoa(doc.Version))
+	}
+	if doc.Account.Login == "" {
+		return "", errors.New("wrong document: no login")
+	}
+	if doc.Account.PasswordHash == "" {
+		return "", errors.New("wrong document: no password hash, it's exported with --with-credentials")
+	}
+	err = storage.WithTx(ctx, func(ctx context.Context) error {
+		err := storage.ImportUser(ctx, doc)
+		if err != nil {
+			return err
+		}
+		isReserved, err := storage.IsLoginReserved(ctx, crypto.CreateLoginHash(doc.Account.Login))
+		if err != nil {
+			return err
+		}
+		if isReserved {
+			return errors.New("login is already in use")
+		}
+		return nil
+	})
+	return doc.Account.Login, err
+}
+
+// IsCommand reports if args, without program name, start with a subcommand
+func IsCommand(args []string) bool {
+	return len(args) > 0 && (args[0] == "export" || args[0] == "import")
+}
+
+// RunCommand runs subcommand from args, without program name
+func RunCommand(args []string) error {
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	databaseURI := flags.String("d", os.Getenv("DATABASE_URI"), "database dsn")
+	file := flags.String("file", "", "document path, stdout or stdin if empty")
+	login := flags.String("user", "", "login of exported user")
+	withCredentials := flags.Bool("with-credentials", false,
+		"export password hash for backups and moves between environments")
+	key := flags.String("k", os.Getenv("KEY"), "key of the service")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+	if *databaseURI == "" {
+		return errors.New("database dsn is not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	switch args[0] {
+	case "export":
+		if *login == "" {
+			return errors.New("user is not set")
+		}
+		out := os.Stdout
+		if *file != "" {
+			out, err = os.Create(*file)
+			if err != nil {
+				return err
+			}
+			defer out.Close()
+		}
+		myStorage, err := storage.New(*databaseURI, storage.PoolConfig{}, commandTimeout, storage.ReplicaConfig{})
+		if err != nil {
+			return err
+		}
+		defer myStorage.Close()
+		err = Export(ctx, myStorage, *login, *withCredentials, out)
+		if err != nil {
+			return err
+		}
+		log.Info().Str(logger.FieldLogin, *login).Msg("exported")
+		return nil
+	case "import":
+		in := os.Stdin
+		if *file != "" {
+			in, err = os.Open(*file)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+		}
+		myStorage, err := storage.New(*databaseURI, storage.PoolConfig{}, commandTimeout, storage.ReplicaConfig{})
+		if err != nil {
+			return err
+		}
+		defer myStorage.Close()
+		if *key == "" {
+			*key = config.DefaultKey
+		}
+		imported, err := Import(ctx, myStorage, crypto.New(*key), in)
+		if err != nil {
+			return err
+		}
+		log.Info().Str(logger.FieldLogin, imported).Msg("imported")
+		return nil
+	}
+	return errors.New("unknown command " + args[0])
+}
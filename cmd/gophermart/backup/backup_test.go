@@ -0,0 +1,76 @@
+package backup_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nivanov045/gofermart/cmd/gophermart/backup"
+	"github.com/nivanov045/gofermart/cmd/gophermart/crypto"
+	"github.com/nivanov045/gofermart/cmd/gophermart/storage"
+)
+
+func TestImportOfReservedLogin(t *testing.T) {
+	ctx := context.Background()
+	s := storage.NewMemory()
+	myCrypto := crypto.New("key")
+	if err := s.AddUser(ctx, "alice", "alice_hash", "ALICE"); err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	var doc bytes.Buffer
+	if err := backup.Export(ctx, s, "alice", true, &doc); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	if err := s.DeleteUser(ctx, "alice", "deleted-1"); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if err := s.ReserveLogin(ctx, myCrypto.CreateLoginHash("alice"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("ReserveLogin: %v", err)
+	}
+
+	_, err := backup.Import(ctx, s, myCrypto, bytes.NewReader(doc.Bytes()))
+	if err == nil || err.Error() != "login is already in use" {
+		t.Fatalf("Import of reserved login = %v", err)
+	}
+	if _, err := s.GetUserRegistrationTime(ctx, "alice"); err == nil {
+		t.Errorf("user of reserved login is imported")
+	}
+
+	// the reservation is of the key, logins hashed with another key are free
+	login, err := backup.Import(ctx, s, crypto.New("another key"), bytes.NewReader(doc.Bytes()))
+	if err != nil || login != "alice" {
+		t.Errorf("Import = %q, %v", login, err)
+	}
+}
+
+func TestExportForPersonalDataRequest(t *testing.T) {
+	ctx := context.Background()
+	s := storage.NewMemory()
+	if err := s.AddUser(ctx, "alice", "alice_hash", "ALICE"); err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	var doc bytes.Buffer
+	if err := backup.Export(ctx, s, "alice", false, &doc); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	if strings.Contains(doc.String(), "alice_hash") || strings.Contains(doc.String(), "password_hash") {
+		t.Errorf("document has password hash: %s", doc.String())
+	}
+	if !strings.Contains(doc.String(), `"login": "alice"`) {
+		t.Errorf("document has no login: %s", doc.String())
+	}
+
+	// without credentials the account couldn't be logged in, so it isn't imported
+	if err := s.DeleteUser(ctx, "alice", "deleted-1"); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	_, err := backup.Import(ctx, s, crypto.New("key"), bytes.NewReader(doc.Bytes()))
+	if err == nil || !strings.Contains(err.Error(), "no password hash") {
+		t.Errorf("Import of document without credentials = %v", err)
+	}
+	if _, err := s.GetUserRegistrationTime(ctx, "alice"); err == nil {
+		t.Errorf("user without credentials is imported")
+	}
+}
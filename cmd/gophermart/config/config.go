@@ -2,17 +2,93 @@ package config
 
 import (
 	"flag"
-	"log"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/caarlos0/env/v6"
+	"github.com/rs/zerolog/log"
+
+	"github.com/nivanov045/gofermart/internal/amount"
+	"github.com/nivanov045/gofermart/internal/logger"
+	"github.com/nivanov045/gofermart/internal/tracing"
 )
 
+// DefaultKey is the key of hashes if neither -k nor KEY is set
+const DefaultKey = "1337qwerty"
+
 type Config struct {
 	ServiceAddress string `env:"RUN_ADDRESS"`
 	AccrualAddress string `env:"ACCRUAL_SYSTEM_ADDRESS"`
 	DatabaseURI    string `env:"DATABASE_URI"`
-	Key            string `env:"KEY"`
-	DebugMode      bool
+	// Replicas are used for reads of users' history when they are healthy and don't lag
+	// more than MaxReplicaLag, 0 means lag isn't checked
+	DatabaseReplicaURIs  []string      `env:"DATABASE_REPLICA_URIS" envSeparator:","`
+	ReplicaCheckInterval time.Duration `env:"REPLICA_CHECK_INTERVAL"`
+	ReadYourWritesWindow time.Duration `env:"READ_YOUR_WRITES_WINDOW"`
+	MaxReplicaLag        time.Duration `env:"REPLICA_MAX_LAG"`
+	Key                  string        `env:"KEY"`
+	TierWindow           time.Duration `env:"TIER_WINDOW"`
+	// TransferDailyLimit is in points, 0 means unlimited
+	TransferDailyLimit    amount.Amount `env:"TRANSFER_DAILY_LIMIT"`
+	TransferMinAccountAge time.Duration `env:"TRANSFER_MIN_ACCOUNT_AGE"`
+	ReferrerBonus         amount.Amount `env:"REFERRER_BONUS"`
+	ReferredBonus         amount.Amount `env:"REFERRED_BONUS"`
+	MaxReferrals          int           `env:"MAX_REFERRALS"`
+	// Withdraw limits are in points, 0 means unlimited
+	WithdrawTransactionLimit amount.Amount `env:"WITHDRAW_TRANSACTION_LIMIT"`
+	WithdrawDailyLimit       amount.Amount `env:"WITHDRAW_DAILY_LIMIT"`
+	// Database pool settings, zero values keep pgxpool defaults
+	DBMaxConns        int           `env:"DB_MAX_CONNS"`
+	DBMinConns        int           `env:"DB_MIN_CONNS"`
+	DBMaxConnLifetime time.Duration `env:"DB_MAX_CONN_LIFETIME"`
+	DBMaxConnIdleTime time.Duration `env:"DB_MAX_CONN_IDLE_TIME"`
+	DBConnectTimeout  time.Duration `env:"DB_CONNECT_TIMEOUT"`
+	DBQueryTimeout    time.Duration `env:"DB_QUERY_TIMEOUT"`
+	// Background jobs, schedules are "@every <duration>", "@hourly" or "@daily"
+	SessionGCSchedule string        `env:"SESSION_GC_SCHEDULE"`
+	RetentionSchedule string        `env:"RETENTION_SCHEDULE"`
+	JobRunsRetention  time.Duration `env:"JOB_RUNS_RETENTION"`
+	AuditLogRetention time.Duration `env:"AUDIT_LOG_RETENTION"`
+	// LoginReservation is how long login of a deleted account can't be registered
+	LoginReservation time.Duration `env:"LOGIN_RESERVATION"`
+	// AdminToken enables admin endpoints, it's passed as a bearer token
+	AdminToken string `env:"ADMIN_TOKEN"`
+	// MetricsAddress serves /metrics apart from the API, so it isn't reachable where
+	// the API is published, empty disables metrics
+	MetricsAddress string `env:"METRICS_ADDRESS"`
+	// Order streams send heartbeat every StreamHeartbeat, missed events are resumed
+	// within StreamRetention
+	StreamHeartbeat time.Duration `env:"STREAM_HEARTBEAT"`
+	StreamRetention time.Duration `env:"STREAM_RETENTION"`
+	// Webhook deliveries are dispatched every WebhookInterval and retried after
+	// WebhookBackoff, which is doubled after each failure, till WebhookMaxAttempts.
+	// Delivered and dead ones are kept for WebhookRetention. Endpoints at loopback,
+	// private and link-local addresses are refused unless WebhookAllowPrivate is set.
+	WebhookInterval     time.Duration `env:"WEBHOOK_INTERVAL"`
+	WebhookTimeout      time.Duration `env:"WEBHOOK_TIMEOUT"`
+	WebhookBackoff      time.Duration `env:"WEBHOOK_BACKOFF"`
+	WebhookMaxAttempts  int           `env:"WEBHOOK_MAX_ATTEMPTS"`
+	WebhookRetention    time.Duration `env:"WEBHOOK_RETENTION"`
+	WebhookAllowPrivate bool          `env:"WEBHOOK_ALLOW_PRIVATE"`
+	// Requests per minute of registrations and logins per IP and of other user endpoints
+	// per login or IP of anonymous clients, 0 means unlimited
+	RateLimitAuth int `env:"RATE_LIMIT_AUTH"`
+	RateLimitData int `env:"RATE_LIMIT_DATA"`
+	// IPs of clients are taken from X-Forwarded-For and X-Real-IP only if requests come
+	// from TrustedProxies, CIDRs or IPs
+	TrustedProxies []string `env:"TRUSTED_PROXIES" envSeparator:","`
+	// On shutdown readiness fails at once, server keeps serving for ShutdownDelay and
+	// waits for active requests up to ShutdownTimeout
+	ShutdownDelay   time.Duration `env:"SHUTDOWN_DELAY"`
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT"`
+	// LogLevel is one of zerolog levels, LogFormat is "json" or "console"
+	LogLevel  string `env:"LOG_LEVEL"`
+	LogFormat string `env:"LOG_FORMAT"`
+	// TraceExporter is "none", "stdout" or "otlp" configured by OTEL_EXPORTER_OTLP_* variables
+	TraceExporter string `env:"TRACE_EXPORTER"`
+	DebugMode     bool
 }
 
 func BuildConfig() (Config, error) {
@@ -26,7 +102,54 @@ func (cfg *Config) buildFromFlags() {
 	flag.StringVar(&cfg.ServiceAddress, "a", "127.0.0.1:8080", "service address")
 	flag.StringVar(&cfg.AccrualAddress, "r", "", "accrual system address")
 	flag.StringVar(&cfg.DatabaseURI, "d", "", "database dsn")
-	flag.StringVar(&cfg.Key, "k", "1337qwerty", "key for passwords hashing")
+	flag.Func("dr", "comma separated database replica dsns", func(s string) error {
+		cfg.DatabaseReplicaURIs = strings.Split(s, ",")
+		return nil
+	})
+	flag.DurationVar(&cfg.ReplicaCheckInterval, "drc", 5*time.Second, "interval of replicas health checks")
+	flag.DurationVar(&cfg.ReadYourWritesWindow, "dry", 10*time.Second, "how long user's reads go to primary after their writes")
+	flag.DurationVar(&cfg.MaxReplicaLag, "drl", 3*time.Second, "replication lag after which replica isn't read, 0 is unchecked")
+	flag.StringVar(&cfg.Key, "k", DefaultKey, "key for passwords hashing")
+	flag.DurationVar(&cfg.TierWindow, "tw", 30*24*time.Hour, "rolling window for loyalty tier calculation")
+	flag.TextVar(&cfg.TransferDailyLimit, "tl", amount.Amount(1000_00), "daily limit of points transferred by user, 0 is unlimited")
+	flag.DurationVar(&cfg.TransferMinAccountAge, "ta", 24*time.Hour, "minimal account age to transfer points")
+	flag.TextVar(&cfg.ReferrerBonus, "rb", amount.Amount(100_00), "bonus points for referrer")
+	flag.TextVar(&cfg.ReferredBonus, "rdb", amount.Amount(50_00), "bonus points for referred user")
+	flag.IntVar(&cfg.MaxReferrals, "rm", 10, "maximum number of referrals per user")
+	flag.TextVar(&cfg.WithdrawTransactionLimit, "wl", amount.Amount(0), "maximal sum of one withdrawal, 0 is unlimited")
+	flag.TextVar(&cfg.WithdrawDailyLimit, "wdl", amount.Amount(0), "maximal sum withdrawn by user a day, 0 is unlimited")
+	flag.IntVar(&cfg.DBMaxConns, "dbmax", 10, "maximal number of database connections")
+	flag.IntVar(&cfg.DBMinConns, "dbmin", 0, "minimal number of idle database connections")
+	flag.DurationVar(&cfg.DBMaxConnLifetime, "dblt", time.Hour, "maximal lifetime of database connection")
+	flag.DurationVar(&cfg.DBMaxConnIdleTime, "dbit", 30*time.Minute, "maximal idle time of database connection")
+	flag.DurationVar(&cfg.DBConnectTimeout, "dbct", 5*time.Second, "database connection timeout")
+	flag.DurationVar(&cfg.DBQueryTimeout, "dbqt", 5*time.Second, "timeout of one database query")
+	flag.StringVar(&cfg.SessionGCSchedule, "sgc", "@every 1h", "schedule of expired sessions removal")
+	flag.StringVar(&cfg.RetentionSchedule, "rs", "@daily", "schedule of old records removal")
+	flag.DurationVar(&cfg.JobRunsRetention, "jrr", 30*24*time.Hour, "how long history of background jobs is kept")
+	flag.DurationVar(&cfg.AuditLogRetention, "alr", 365*24*time.Hour, "how long audit log is kept")
+	flag.DurationVar(&cfg.LoginReservation, "lr", 90*24*time.Hour, "how long login of deleted account can't be registered")
+	flag.StringVar(&cfg.AdminToken, "at", "", "token of admin endpoints, they are disabled if empty")
+	flag.StringVar(&cfg.MetricsAddress, "ma", "127.0.0.1:9090", "metrics address, metrics are disabled if empty")
+	flag.DurationVar(&cfg.StreamHeartbeat, "sh", 15*time.Second, "interval of order stream heartbeats")
+	flag.DurationVar(&cfg.StreamRetention, "sr", 10*time.Minute, "how long missed order stream events are kept")
+	flag.DurationVar(&cfg.WebhookInterval, "whi", 5*time.Second, "interval of webhook dispatching")
+	flag.DurationVar(&cfg.WebhookTimeout, "wht", 10*time.Second, "timeout of one webhook delivery")
+	flag.DurationVar(&cfg.WebhookBackoff, "whb", 30*time.Second, "delay of the first webhook retry, it's doubled after each failure")
+	flag.IntVar(&cfg.WebhookMaxAttempts, "wha", 10, "attempts of webhook delivery before it's dead")
+	flag.DurationVar(&cfg.WebhookRetention, "whr", 30*24*time.Hour, "how long delivered and dead webhooks are kept")
+	flag.BoolVar(&cfg.WebhookAllowPrivate, "whp", false, "allow webhook endpoints at loopback, private and link-local addresses")
+	flag.IntVar(&cfg.RateLimitAuth, "rla", 20, "registrations and logins per minute per IP, 0 is unlimited")
+	flag.IntVar(&cfg.RateLimitData, "rld", 600, "requests of user endpoints per minute per login or IP, 0 is unlimited")
+	flag.Func("tp", "comma separated CIDRs or IPs of proxies whose forwarding headers are trusted", func(s string) error {
+		cfg.TrustedProxies = strings.Split(s, ",")
+		return nil
+	})
+	flag.DurationVar(&cfg.ShutdownDelay, "sd", 5*time.Second, "how long server is not ready before shutdown")
+	flag.DurationVar(&cfg.ShutdownTimeout, "st", 30*time.Second, "maximal wait for active requests on shutdown")
+	flag.StringVar(&cfg.LogLevel, "ll", "info", "log level: debug, info, warn or error")
+	flag.StringVar(&cfg.LogFormat, "lf", logger.FormatJSON, "log format: json or console")
+	flag.StringVar(&cfg.TraceExporter, "te", tracing.ExporterNone, "trace exporter: none, stdout or otlp")
 	flag.BoolVar(&cfg.DebugMode, "deb", false, "is debug mode enabled")
 	flag.Parse()
 }
@@ -34,7 +157,47 @@ func (cfg *Config) buildFromFlags() {
 func (cfg *Config) buildFromEnv() error {
 	err := env.Parse(cfg)
 	if err != nil {
-		log.Println("config::buildFromEnv::error: in env parsing:", err)
+		log.Error().Err(err).Msg("in env parsing")
 	}
 	return err
 }
+
+// redacted is the same mask as url.URL.Redacted uses
+const redacted = "xxxxx"
+
+var keywordPassword = regexp.MustCompile(`password=\S+`)
+
+// Redacted returns copy of cfg which is safe to log: keys, tokens and database
+// passwords are masked
+func (cfg Config) Redacted() Config {
+	if cfg.Key != "" {
+		cfg.Key = redacted
+	}
+	if cfg.AdminToken != "" {
+		cfg.AdminToken = redacted
+	}
+	cfg.DatabaseURI = redactDSN(cfg.DatabaseURI)
+	replicas := make([]string, len(cfg.DatabaseReplicaURIs))
+	for i, uri := range cfg.DatabaseReplicaURIs {
+		replicas[i] = redactDSN(uri)
+	}
+	cfg.DatabaseReplicaURIs = replicas
+	return cfg
+}
+
+// redactDSN masks password of both URL and keyword/value connection strings
+func redactDSN(dsn string) string {
+	u, err := url.Parse(dsn)
+	if err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			return u.Redacted()
+		}
+	}
+	if err == nil && u.Query().Has("password") {
+		query := u.Query()
+		query.Set("password", redacted)
+		u.RawQuery = query.Encode()
+		return u.String()
+	}
+	return keywordPassword.ReplaceAllString(dsn, "password="+redacted)
+}
@@ -19,3 +19,9 @@ func (crypto *crypto) CreateHash(s string) string {
 	h.Write([]byte(s))
 	return hex.EncodeToString(h.Sum(nil))
 }
+
+// CreateLoginHash returns the hash under which login of a deleted account is reserved,
+// the prefix keeps it different from a password hash of the same string
+func (crypto *crypto) CreateLoginHash(login string) string {
+	return crypto.CreateHash("login:" + login)
+}
@@ -0,0 +1,200 @@
+// Package events fans out changes of users' orders and balances to their subscribers,
+// e.g. to order streams of api.
+//
+// Events of a user are kept for a while, so subscriber which reconnects with ID of the
+// last received event gets what it missed. IDs start from the hub creation time, so IDs
+// of a previous process are recognized. When missed events are lost, subscriber gets
+// TypeReset event and has to fetch orders and balance again.
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	TypeOrder   = "order"
+	TypeBalance = "balance"
+	TypeReset   = "reset"
+)
+
+const (
+	// historySize limits events kept per user
+	historySize = 100
+	// bufferSize is how many events may wait for a subscriber, slower subscribers are
+	// unsubscribed and have to resume
+	bufferSize = 16
+)
+
+type Event struct {
+	ID   uint64
+	Type string
+	Data []byte
+}
+
+type Subscription struct {
+	// Events is closed when subscriber doesn't keep up with events or hub is closed
+	Events <-chan Event
+	// Missed are events after lastEventID which were published before subscription
+	Missed []Event
+
+	hub    *hub
+	login  string
+	events chan Event
+	closed bool
+}
+
+type userEvents struct {
+	history []storedEvent
+	// lostID is ID of the newest event which was removed from history
+	lostID      uint64
+	subscribers map[*Subscription]struct{}
+}
+
+type storedEvent struct {
+	Event
+	publishedAt time.Time
+}
+
+type hub struct {
+	mu        sync.Mutex
+	retention time.Duration
+	startID   uint64
+	lastID    uint64
+	// lostID is the newest lostID of users which were forgotten
+	lostID    uint64
+	lastSweep time.Time
+	users     map[string]*userEvents
+	closed    bool
+}
+
+// New creates hub which keeps events for retention
+func New(retention time.Duration) *hub {
+	now := time.Now()
+	startID := uint64(now.UnixMicro())
+	return &hub{
+		retention: retention,
+		startID:   startID,
+		lastID:    startID,
+		lastSweep: now,
+		users:     make(map[string]*userEvents),
+	}
+}
+
+// Publish sends event to subscribers of login without blocking
+func (h *hub) Publish(login string, eventType string, data []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	h.sweep(now)
+	user := h.user(login)
+	h.lastID++
+	event := Event{ID: h.lastID, Type: eventType, Data: data}
+	user.history = append(user.history, storedEvent{Event: event, publishedAt: now})
+	if len(user.history) > historySize {
+		user.lostID = user.history[0].ID
+		user.history = user.history[1:]
+	}
+	for s := range user.subscribers {
+		select {
+		case s.events <- event:
+		default:
+			h.unsubscribe(s)
+		}
+	}
+}
+
+// Subscribe subscribes to events of login, events after lastEventID are returned as
+// missed. lastEventID is 0 if subscriber needs only new events.
+func (h *hub) Subscribe(login string, lastEventID uint64) *Subscription {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	events := make(chan Event, bufferSize)
+	s := &Subscription{Events: events, hub: h, login: login, events: events}
+	if h.closed {
+		s.closed = true
+		close(events)
+		return s
+	}
+	user := h.user(login)
+	user.subscribers[s] = struct{}{}
+	if lastEventID == 0 {
+		return s
+	}
+	if lastEventID < h.startID || lastEventID > h.lastID || lastEventID < user.lostID {
+		s.Missed = []Event{{ID: h.lastID, Type: TypeReset, Data: []byte("{}")}}
+		return s
+	}
+	for _, event := range user.history {
+		if event.ID > lastEventID {
+			s.Missed = append(s.Missed, event.Event)
+		}
+	}
+	return s
+}
+
+// Close unsubscribes
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.unsubscribe(s)
+}
+
+// Close closes all subscriptions, later subscriptions are closed at once
+func (h *hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for _, user := range h.users {
+		for s := range user.subscribers {
+			h.unsubscribe(s)
+		}
+	}
+}
+
+// user returns events of login, events of forgotten users are lost, so new users start
+// with the newest lostID of them
+func (h *hub) user(login string) *userEvents {
+	user, ok := h.users[login]
+	if !ok {
+		user = &userEvents{lostID: h.lostID, subscribers: make(map[*Subscription]struct{})}
+		h.users[login] = user
+	}
+	return user
+}
+
+func (h *hub) unsubscribe(s *Subscription) {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.events)
+	if user, ok := h.users[s.login]; ok {
+		delete(user.subscribers, s)
+	}
+}
+
+// sweep removes events older than retention at most once per retention, users without
+// events and subscribers are forgotten
+func (h *hub) sweep(now time.Time) {
+	if now.Sub(h.lastSweep) < h.retention {
+		return
+	}
+	h.lastSweep = now
+	for login, user := range h.users {
+		expired := 0
+		for expired < len(user.history) && now.Sub(user.history[expired].publishedAt) > h.retention {
+			expired++
+		}
+		if expired > 0 {
+			user.lostID = user.history[expired-1].ID
+			user.history = user.history[expired:]
+		}
+		if len(user.history) == 0 && len(user.subscribers) == 0 {
+			if user.lostID > h.lostID {
+				h.lostID = user.lostID
+			}
+			delete(h.users, login)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+// publish publishes n order events of login and returns their IDs
+func publish(h *hub, login string, n int) []uint64 {
+	var ids []uint64
+	for i := 0; i < n; i++ {
+		h.Publish(login, TypeOrder, []byte(`{}`))
+		ids = append(ids, h.lastID)
+	}
+	return ids
+}
+
+func ids(events []Event) []uint64 {
+	var result []uint64
+	for _, event := range events {
+		result = append(result, event.ID)
+	}
+	return result
+}
+
+func equal(a []uint64, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func isReset(s *Subscription) bool {
+	return len(s.Missed) == 1 && s.Missed[0].Type == TypeReset
+}
+
+func TestResume(t *testing.T) {
+	h := New(time.Minute)
+	alice := publish(h, "alice", 3)
+	publish(h, "bob", 2)
+
+	s := h.Subscribe("alice", alice[0])
+	defer s.Close()
+	if got := ids(s.Missed); !equal(got, alice[1:]) {
+		t.Errorf("missed = %v, want %v", got, alice[1:])
+	}
+	if s := h.Subscribe("alice", alice[2]); len(s.Missed) != 0 {
+		t.Errorf("missed after the last event = %v", s.Missed)
+	}
+	if s := h.Subscribe("alice", 0); len(s.Missed) != 0 {
+		t.Errorf("missed of new subscriber = %v", s.Missed)
+	}
+
+	next := publish(h, "alice", 1)
+	publish(h, "bob", 1)
+	select {
+	case event := <-s.Events:
+		if event.ID != next[0] {
+			t.Errorf("event = %d, want %d", event.ID, next[0])
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event isn't sent to subscriber")
+	}
+	select {
+	case event := <-s.Events:
+		t.Errorf("event of another user %d is sent", event.ID)
+	default:
+	}
+}
+
+func TestReset(t *testing.T) {
+	h := New(time.Minute)
+	alice := publish(h, "alice", historySize+2)
+
+	// alice[1] is the newest lost event, so nothing after it is lost
+	if s := h.Subscribe("alice", alice[1]); isReset(s) || len(s.Missed) != historySize {
+		t.Errorf("resume from the newest lost event = %d missed events", len(s.Missed))
+	}
+	tests := []struct {
+		name        string
+		lastEventID uint64
+	}{
+		{"events are lost", alice[0]},
+		{"event of previous process", h.startID - 1},
+		{"event from future", h.lastID + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := h.Subscribe("alice", tt.lastEventID)
+			defer s.Close()
+			if !isReset(s) || s.Missed[0].ID != h.lastID {
+				t.Errorf("missed = %v, want reset", s.Missed)
+			}
+		})
+	}
+}
+
+func TestResetAfterRetention(t *testing.T) {
+	const retention = 50 * time.Millisecond
+	h := New(retention)
+	alice := publish(h, "alice", 2)
+	bob := publish(h, "bob", 1)
+	time.Sleep(2 * retention)
+	publish(h, "carol", 1)
+
+	if _, ok := h.users["alice"]; ok {
+		t.Errorf("user without events and subscribers isn't forgotten")
+	}
+	// users which are forgotten start with the newest lost event of others
+	for login, lastEventID := range map[string]uint64{"alice": alice[0], "dave": alice[1]} {
+		if s := h.Subscribe(login, lastEventID); !isReset(s) {
+			t.Errorf("missed of %s = %v, want reset", login, s.Missed)
+		}
+	}
+	if s := h.Subscribe("bob", bob[0]); len(s.Missed) != 0 {
+		t.Errorf("missed of bob after the newest lost event = %v", s.Missed)
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	h := New(time.Minute)
+	s := h.Subscribe("alice", 0)
+	publish(h, "alice", bufferSize+1)
+	received := 0
+	for range s.Events {
+		received++
+	}
+	if received != bufferSize {
+		t.Errorf("slow subscriber received %d events before unsubscription, want %d", received, bufferSize)
+	}
+	s.Close()
+}
+
+func TestClose(t *testing.T) {
+	h := New(time.Minute)
+	s := h.Subscribe("alice", 0)
+	h.Close()
+	if _, ok := <-s.Events; ok {
+		t.Errorf("subscription isn't closed with hub")
+	}
+	s.Close()
+	if _, ok := <-h.Subscribe("alice", 0).Events; ok {
+		t.Errorf("subscription to closed hub isn't closed")
+	}
+}
@@ -1,35 +1,219 @@
 package main
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
 
 	"github.com/nivanov045/gofermart/cmd/gophermart/accrualsystem"
 	"github.com/nivanov045/gofermart/cmd/gophermart/api"
 	"github.com/nivanov045/gofermart/cmd/gophermart/authenticator"
+	"github.com/nivanov045/gofermart/cmd/gophermart/backup"
 	"github.com/nivanov045/gofermart/cmd/gophermart/config"
 	"github.com/nivanov045/gofermart/cmd/gophermart/crypto"
+	"github.com/nivanov045/gofermart/cmd/gophermart/events"
+	"github.com/nivanov045/gofermart/cmd/gophermart/metrics"
+	"github.com/nivanov045/gofermart/cmd/gophermart/migration"
+	"github.com/nivanov045/gofermart/cmd/gophermart/ratelimit"
+	"github.com/nivanov045/gofermart/cmd/gophermart/scheduler"
 	"github.com/nivanov045/gofermart/cmd/gophermart/service"
 	"github.com/nivanov045/gofermart/cmd/gophermart/storage"
+	"github.com/nivanov045/gofermart/cmd/gophermart/validator"
+	"github.com/nivanov045/gofermart/cmd/gophermart/webhooks"
+	"github.com/nivanov045/gofermart/internal/graceful"
+	"github.com/nivanov045/gofermart/internal/health"
+	"github.com/nivanov045/gofermart/internal/logger"
+	"github.com/nivanov045/gofermart/internal/tracing"
 )
 
 func main() {
+	if backup.IsCommand(os.Args[1:]) {
+		err := backup.RunCommand(os.Args[1:])
+		if err != nil {
+			log.Fatal().Err(err).Str("command", os.Args[1]).Msg("command failed")
+		}
+		return
+	}
+	if migration.IsCommand(os.Args[1:]) {
+		err := migration.RunCommand(os.Args[1:])
+		if err != nil {
+			log.Fatal().Err(err).Str("command", os.Args[1]).Msg("command failed")
+		}
+		return
+	}
 	cfg, err := config.BuildConfig()
 	if err != nil {
-		log.Fatalln("service::main::error: in env parsing:", err)
+		log.Fatal().Err(err).Msg("in env parsing")
+	}
+	err = logger.Init(cfg.LogLevel, cfg.LogFormat)
+	if err != nil {
+		log.Fatal().Err(err).Msg("in logger initialization")
+	}
+	log.Info().Interface("cfg", cfg.Redacted()).Msg("config is loaded")
+	shutdownTracing, err := tracing.Init(context.Background(), "gophermart", cfg.TraceExporter)
+	if err != nil {
+		log.Fatal().Err(err).Msg("in tracing initialization")
 	}
-	log.Println("service::main::info: cfg:", cfg)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		err := shutdownTracing(ctx)
+		if err != nil {
+			log.Error().Err(err).Msg("in tracing shutdown")
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	myStorage, err := storage.New(cfg.DatabaseURI)
+	var myStorage interface {
+		service.Storage
+		authenticator.Storage
+		scheduler.Storage
+		webhooks.Storage
+		metrics.OrderCounter
+		Ping(ctx context.Context) error
+		PendingMigrations(ctx context.Context) ([]int64, error)
+		HashLoginReservations(ctx context.Context, hash func(login string) string) (int64, error)
+	}
+	if cfg.DatabaseURI == "" {
+		log.Info().Msg("database is not set, data is kept in memory")
+		myStorage = storage.NewMemory()
+	} else {
+		poolConfig := storage.PoolConfig{
+			MaxConns:        int32(cfg.DBMaxConns),
+			MinConns:        int32(cfg.DBMinConns),
+			MaxConnLifetime: cfg.DBMaxConnLifetime,
+			MaxConnIdleTime: cfg.DBMaxConnIdleTime,
+			ConnectTimeout:  cfg.DBConnectTimeout,
+		}
+		replicaConfig := storage.ReplicaConfig{
+			URIs:                 cfg.DatabaseReplicaURIs,
+			CheckInterval:        cfg.ReplicaCheckInterval,
+			ReadYourWritesWindow: cfg.ReadYourWritesWindow,
+			MaxLag:               cfg.MaxReplicaLag,
+		}
+		myStorage, err = storage.New(cfg.DatabaseURI, poolConfig, cfg.DBQueryTimeout, replicaConfig)
+		if err != nil {
+			log.Fatal().Err(err).Msg("in storage creation")
+		}
+	}
+	err = metrics.RegisterOrderCounter(myStorage, cfg.DBQueryTimeout)
+	if err != nil {
+		log.Fatal().Err(err).Msg("in metrics registration")
+	}
+	jobs, err := scheduler.New(myStorage,
+		scheduler.SessionGC(myStorage, cfg.SessionGCSchedule),
+		scheduler.RetentionPurge("job_runs", cfg.RetentionSchedule, cfg.JobRunsRetention, myStorage.RemoveJobRuns),
+		scheduler.RetentionPurge("audit_log", cfg.RetentionSchedule, cfg.AuditLogRetention, myStorage.RemoveAuditRecords),
+		scheduler.RetentionPurge("login_reservations", cfg.RetentionSchedule, 0, myStorage.RemoveLoginReservations),
+		scheduler.RetentionPurge("webhook_outbox", cfg.RetentionSchedule, cfg.WebhookRetention,
+			myStorage.RemoveWebhookDeliveries),
+	)
 	if err != nil {
-		log.Fatalln("service::main::error: in storage creation:", err)
+		log.Fatal().Err(err).Msg("in scheduler creation")
 	}
+	// background workers stop with ctx, main waits for them before exit
+	var workers sync.WaitGroup
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		jobs.Run(ctx)
+	}()
+	dispatcher := webhooks.New(myStorage, webhooks.NewClient(cfg.WebhookAllowPrivate), webhooks.Config{
+		Interval:    cfg.WebhookInterval,
+		Timeout:     cfg.WebhookTimeout,
+		Backoff:     cfg.WebhookBackoff,
+		MaxAttempts: cfg.WebhookMaxAttempts,
+	})
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		dispatcher.Run(ctx)
+	}()
 	accrualSystem, err := accrualsystem.New(cfg.AccrualAddress, cfg.DebugMode)
 	if err != nil {
-		log.Fatalln("service::main::error: in accrual system creation:", err)
+		log.Fatal().Err(err).Msg("in accrual system creation")
 	}
-	serv := service.New(myStorage, accrualSystem, cfg.DebugMode)
+	serviceCfg := service.Config{
+		TierWindow:            cfg.TierWindow,
+		TransferDailyLimit:    cfg.TransferDailyLimit,
+		TransferMinAccountAge: cfg.TransferMinAccountAge,
+		ReferrerBonus:         cfg.ReferrerBonus,
+		ReferredBonus:         cfg.ReferredBonus,
+		WebhookAllowPrivate:   cfg.WebhookAllowPrivate,
+	}
+	withdrawValidator := validator.New(myStorage, cfg.WithdrawTransactionLimit, cfg.WithdrawDailyLimit)
+	orderEvents := events.New(cfg.StreamRetention)
+	serv := service.New(myStorage, accrualSystem, withdrawValidator, orderEvents, serviceCfg, cfg.DebugMode)
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		serv.Run(ctx)
+	}()
+	go func() {
+		err := serv.RequeuePendingOrders(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Error().Err(err).Msg("in pending orders requeue")
+		}
+	}()
 	myCrypto := crypto.New(cfg.Key)
-	auth := authenticator.New(myStorage, cfg.DebugMode, myCrypto)
-	myAPI := api.New(serv, auth)
-	log.Fatalln(myAPI.Run(cfg.ServiceAddress))
+	hashed, err := myStorage.HashLoginReservations(context.Background(), myCrypto.CreateLoginHash)
+	if err != nil {
+		log.Fatal().Err(err).Msg("in login reservations hashing")
+	}
+	if hashed > 0 {
+		log.Info().Int64("hashed", hashed).Msg("login reservations are hashed")
+	}
+	auth := authenticator.New(myStorage, cfg.DebugMode, myCrypto, cfg.MaxReferrals, cfg.LoginReservation)
+
+	checker := health.New(cfg.DBQueryTimeout)
+	checker.Add("database", myStorage.Ping)
+	checker.Add("migrations", func(ctx context.Context) error {
+		pending, err := myStorage.PendingMigrations(ctx)
+		if err != nil {
+			return err
+		}
+		if len(pending) > 0 {
+			return fmt.Errorf("not applied: %v", pending)
+		}
+		return nil
+	})
+	checker.Add("accrual", accrualSystem.CheckReachable)
+
+	trustedProxies, err := api.ParseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		log.Fatal().Err(err).Msg("in config")
+	}
+	if cfg.MetricsAddress != "" {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			err := metrics.Run(ctx, cfg.MetricsAddress, graceful.Config{Timeout: cfg.ShutdownTimeout})
+			if err != nil {
+				log.Error().Err(err).Msg("in metrics")
+			}
+		}()
+	}
+	myAPI := api.New(serv, auth, checker, orderEvents, cfg.StreamHeartbeat, cfg.AdminToken,
+		ratelimit.New(cfg.RateLimitAuth, time.Minute), ratelimit.New(cfg.RateLimitData, time.Minute), trustedProxies)
+	err = myAPI.Run(ctx, cfg.ServiceAddress, graceful.Config{
+		Delay:   cfg.ShutdownDelay,
+		Timeout: cfg.ShutdownTimeout,
+		OnShutdown: func() {
+			log.Info().Msg("shutting down")
+			checker.SetShuttingDown()
+		},
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("in api")
+	}
+	workers.Wait()
+	log.Info().Msg("stopped")
 }
@@ -0,0 +1,167 @@
+// Package metrics keeps gophermart's Prometheus collectors. Labels are limited to route
+// patterns, storage method names, statuses and response codes, so their number doesn't
+// grow with users or orders.
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+
+	"github.com/nivanov045/gofermart/internal/graceful"
+	"github.com/nivanov045/gofermart/internal/logger"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gophermart_http_requests_total",
+		Help: "HTTP requests by route pattern, method and response code.",
+	}, []string{"route", "method", "code"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gophermart_http_request_duration_seconds",
+		Help:    "HTTP request latency by route pattern and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+	httpRateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gophermart_http_rate_limited_total",
+		Help: `Requests rejected with 429 Too Many Requests by limit, "auth" or "data".`,
+	}, []string{"limit"})
+
+	queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gophermart_storage_query_duration_seconds",
+		Help:    "Storage query latency by storage method.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"method"})
+
+	accrualRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gophermart_accrual_requests_total",
+		Help: `Requests to accrual system by response code, "error" if there was no response.`,
+	}, []string{"code"})
+	accrualDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "gophermart_accrual_request_duration_seconds",
+		Help:    "Accrual system request latency.",
+		Buckets: prometheus.DefBuckets,
+	})
+	accrualRateLimited = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gophermart_accrual_rate_limited_total",
+		Help: "Responses of accrual system with 429 Too Many Requests.",
+	})
+	accrualBacklog = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gophermart_accrual_backlog",
+		Help: "Orders sent to accrual pipeline which have no response yet, final or not.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(httpRequests, httpDuration, httpRateLimited, queryDuration,
+		accrualRequests, accrualDuration, accrualRateLimited, accrualBacklog)
+}
+
+// Handler serves all registered metrics in Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Run serves Handler at /metrics of address until ctx is done, then shuts down gracefully
+func Run(ctx context.Context, address string, shutdown graceful.Config) error {
+	log.Info().Str("address", address).Msg("metrics started")
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	return graceful.Serve(ctx, &http.Server{Addr: address, Handler: mux}, shutdown)
+}
+
+// Middleware counts requests per chi route pattern, so path parameters don't create new
+// label values. Requests which matched no route are counted as "unmatched".
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(status)).Inc()
+		httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// ObserveRateLimited counts request rejected by limit
+func ObserveRateLimited(limit string) {
+	httpRateLimited.WithLabelValues(limit).Inc()
+}
+
+// ObserveQuery records duration of storage method started at start, it's meant to be
+// deferred at the top of the method
+func ObserveQuery(method string, start time.Time) {
+	queryDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+// ObserveAccrualRequest records accrual system request, code is 0 if there was no response
+func ObserveAccrualRequest(code int, start time.Time) {
+	label := "error"
+	if code != 0 {
+		label = strconv.Itoa(code)
+	}
+	accrualRequests.WithLabelValues(label).Inc()
+	accrualDuration.Observe(time.Since(start).Seconds())
+	if code == http.StatusTooManyRequests {
+		accrualRateLimited.Inc()
+	}
+}
+
+// AccrualBacklogAdd changes number of orders waiting for accrual system's response by delta,
+// an order leaves backlog with any status as orders aren't polled again after a response
+func AccrualBacklogAdd(delta int) {
+	accrualBacklog.Add(float64(delta))
+}
+
+type OrderCounter interface {
+	CountOrdersByStatus(ctx context.Context) (map[string]int, error)
+}
+
+type ordersCollector struct {
+	counter OrderCounter
+	timeout time.Duration
+	desc    *prometheus.Desc
+}
+
+// RegisterOrderCounter exposes count of orders by status, counts are queried on scrape
+func RegisterOrderCounter(counter OrderCounter, timeout time.Duration) error {
+	return prometheus.Register(&ordersCollector{
+		counter: counter,
+		timeout: timeout,
+		desc: prometheus.NewDesc("gophermart_orders", "Orders by processing status.",
+			[]string{"status"}, nil),
+	})
+}
+
+func (c *ordersCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *ordersCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	counts, err := c.counter.CountOrdersByStatus(ctx)
+	if err != nil {
+		logger.Ctx(ctx).Error().Err(err).Msg("in CountOrdersByStatus")
+		ch <- prometheus.NewInvalidMetric(c.desc, err)
+		return
+	}
+	for status, count := range counts {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(count), status)
+	}
+}
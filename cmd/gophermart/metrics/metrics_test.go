@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nivanov045/gofermart/internal/graceful"
+)
+
+func TestRun(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- Run(ctx, address, graceful.Config{Timeout: time.Second})
+	}()
+
+	var response *http.Response
+	for i := 0; i < 50; i++ {
+		response, err = http.Get("http://" + address + "/metrics")
+		if err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	body, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil || response.StatusCode != http.StatusOK || !strings.Contains(string(body), "gophermart_accrual_backlog") {
+		t.Errorf("GET /metrics = %d, %v:\n%s", response.StatusCode, err, body)
+	}
+
+	cancel()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Errorf("Run = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run isn't stopped by ctx")
+	}
+}
@@ -0,0 +1,74 @@
+// Package migration implements migrate subcommand of gophermart:
+//
+//	gophermart migrate [-d <dsn>] up
+//	gophermart migrate [-d <dsn>] down <steps>
+//
+// Service applies pending migrations on start, so up is only needed to migrate before
+// a deployment. Down rolls back steps last applied migrations, services which are
+// running aren't ready until the migrations are applied again. dsn defaults to
+// DATABASE_URI.
+package migration
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/nivanov045/gofermart/cmd/gophermart/storage"
+)
+
+// commandTimeout limits all migrations of the command
+const commandTimeout = 10 * time.Minute
+
+// IsCommand reports if args, without program name, start with migrate subcommand
+func IsCommand(args []string) bool {
+	return len(args) > 0 && args[0] == "migrate"
+}
+
+// RunCommand runs migrate subcommand from args, without program name
+func RunCommand(args []string) error {
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	databaseURI := flags.String("d", os.Getenv("DATABASE_URI"), "database dsn")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+	if *databaseURI == "" {
+		return errors.New("database dsn is not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	switch flags.Arg(0) {
+	case "up":
+		if flags.NArg() != 1 {
+			return errors.New("usage: migrate [-d <dsn>] up")
+		}
+		err = storage.MigrateUp(ctx, *databaseURI)
+		if err != nil {
+			return err
+		}
+		log.Info().Msg("migrations are applied")
+		return nil
+	case "down":
+		if flags.NArg() != 2 {
+			return errors.New("usage: migrate [-d <dsn>] down <steps>")
+		}
+		steps, err := strconv.Atoi(flags.Arg(1))
+		if err != nil || steps < 1 {
+			return errors.New("steps must be a positive number")
+		}
+		err = storage.MigrateDown(ctx, *databaseURI, steps)
+		if err != nil {
+			return err
+		}
+		log.Info().Int("steps", steps).Msg("migrations are rolled back")
+		return nil
+	}
+	return errors.New("unknown migration direction " + strconv.Quote(flags.Arg(0)) + ", it's up or down")
+}
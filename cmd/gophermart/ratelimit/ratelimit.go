@@ -0,0 +1,71 @@
+// Package ratelimit limits requests per key, e.g. per login or IP of clients.
+//
+// Every key may do limit requests per period at once, then requests are allowed evenly,
+// one per period/limit. It's GCRA: the only state of a key is the time when its
+// requests are allowed again without waiting, so keys are cheap and forgotten when
+// they are idle for period.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+type limiter struct {
+	mu       sync.Mutex
+	limit    int
+	period   time.Duration
+	interval time.Duration
+	// tats are theoretical arrival times of next requests of keys
+	tats      map[string]time.Time
+	lastSweep time.Time
+}
+
+// New creates limiter of limit requests per period, 0 limit means unlimited
+func New(limit int, period time.Duration) *limiter {
+	l := &limiter{
+		limit:     limit,
+		period:    period,
+		tats:      make(map[string]time.Time),
+		lastSweep: time.Now(),
+	}
+	if limit > 0 {
+		l.interval = period / time.Duration(limit)
+	}
+	return l
+}
+
+// Allow counts request of key, if it's over the limit, it isn't counted and the time
+// after which request of key will be allowed is returned
+func (l *limiter) Allow(key string) (bool, time.Duration) {
+	if l.limit <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.sweep(now)
+	tat := l.tats[key]
+	if tat.Before(now) {
+		tat = now
+	}
+	// burst of limit requests takes period-interval ahead of now
+	if wait := tat.Sub(now) - (l.period - l.interval); wait > 0 {
+		return false, wait
+	}
+	l.tats[key] = tat.Add(l.interval)
+	return true, 0
+}
+
+// sweep forgets keys which are idle at most once per period
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.period {
+		return
+	}
+	l.lastSweep = now
+	for key, tat := range l.tats {
+		if tat.Before(now) {
+			delete(l.tats, key)
+		}
+	}
+}
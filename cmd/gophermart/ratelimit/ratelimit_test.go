@@ -0,0 +1,55 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	const period = 300 * time.Millisecond
+	l := New(3, period)
+	for i := 0; i < 3; i++ {
+		if allowed, _ := l.Allow("alice"); !allowed {
+			t.Fatalf("request %d of burst is limited", i)
+		}
+	}
+	allowed, wait := l.Allow("alice")
+	if allowed || wait <= 0 || wait > period/3 {
+		t.Fatalf("request over burst = %v, %v, want wait up to %v", allowed, wait, period/3)
+	}
+	if allowed, _ := l.Allow("bob"); !allowed {
+		t.Errorf("request of another key is limited")
+	}
+
+	// limited requests aren't counted, so the next one is allowed after the wait
+	time.Sleep(wait)
+	if allowed, wait := l.Allow("alice"); !allowed {
+		t.Fatalf("request after the wait is limited for %v", wait)
+	}
+	if allowed, wait := l.Allow("alice"); allowed || wait <= 0 {
+		t.Errorf("requests are allowed faster than one per %v", period/3)
+	}
+}
+
+func TestAllowWithoutLimit(t *testing.T) {
+	l := New(0, time.Minute)
+	for i := 0; i < 100; i++ {
+		if allowed, wait := l.Allow("alice"); !allowed || wait != 0 {
+			t.Fatalf("request %d = %v, %v", i, allowed, wait)
+		}
+	}
+}
+
+func TestIdleKeysAreForgotten(t *testing.T) {
+	const period = 100 * time.Millisecond
+	l := New(2, period)
+	l.Allow("alice")
+	l.Allow("bob")
+	time.Sleep(period + period/2)
+	l.Allow("bob")
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.tats["alice"]; ok || len(l.tats) != 1 {
+		t.Errorf("keys after idle period = %v", l.tats)
+	}
+}
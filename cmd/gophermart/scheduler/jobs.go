@@ -0,0 +1,29 @@
+package scheduler
+
+import (
+	"context"
+	"time"
+)
+
+// SessionGC removes sessions which are expired
+func SessionGC(storage Storage, schedule string) Job {
+	return Job{
+		Name:     "session_gc",
+		Schedule: schedule,
+		Run: func(ctx context.Context) (int64, error) {
+			return storage.RemoveExpiredSessions(ctx, time.Now())
+		},
+	}
+}
+
+// RetentionPurge removes records older than retention with purge
+func RetentionPurge(name string, schedule string, retention time.Duration,
+	purge func(ctx context.Context, before time.Time) (int64, error)) Job {
+	return Job{
+		Name:     "retention_" + name,
+		Schedule: schedule,
+		Run: func(ctx context.Context) (int64, error) {
+			return purge(ctx, time.Now().Add(-retention))
+		},
+	}
+}
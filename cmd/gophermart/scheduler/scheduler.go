@@ -0,0 +1,143 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/nivanov045/gofermart/internal/jobrun"
+)
+
+type Storage interface {
+	// TryLockJob returns false if the job is locked by another instance, unlock must be
+	// called after the run otherwise
+	TryLockJob(ctx context.Context, job string) (unlock func(), ok bool, err error)
+	LastJobRun(ctx context.Context, job string) (time.Time, error)
+	AddJobRun(ctx context.Context, run jobrun.JobRun) error
+	RemoveJobRuns(ctx context.Context, before time.Time) (int64, error)
+	RemoveExpiredSessions(ctx context.Context, before time.Time) (int64, error)
+	RemoveAuditRecords(ctx context.Context, before time.Time) (int64, error)
+	RemoveLoginReservations(ctx context.Context, before time.Time) (int64, error)
+	RemoveWebhookDeliveries(ctx context.Context, before time.Time) (int64, error)
+}
+
+// Job is run once per its schedule by one of the instances, Run returns number of
+// affected records
+type Job struct {
+	Name     string
+	Schedule string
+	Run      func(ctx context.Context) (int64, error)
+}
+
+// maxCheckPeriod is how often jobs with long intervals check if they are due, so
+// restarts and other instances don't shift the schedule much
+const maxCheckPeriod = time.Minute
+
+type scheduler struct {
+	storage Storage
+	jobs    []Job
+}
+
+func New(storage Storage, jobs ...Job) (*scheduler, error) {
+	for _, j := range jobs {
+		if _, err := ParseSchedule(j.Schedule); err != nil {
+			return nil, errors.New("wrong schedule of job " + j.Name + ": " + err.Error())
+		}
+	}
+	return &scheduler{storage: storage, jobs: jobs}, nil
+}
+
+// ParseSchedule supports "@every <duration>", "@hourly" and "@daily"
+func ParseSchedule(schedule string) (time.Duration, error) {
+	switch {
+	case schedule == "@hourly":
+		return time.Hour, nil
+	case schedule == "@daily":
+		return 24 * time.Hour, nil
+	case strings.HasPrefix(schedule, "@every "):
+		interval, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(schedule, "@every ")))
+		if err != nil {
+			return 0, err
+		}
+		if interval <= 0 {
+			return 0, errors.New("interval must be positive")
+		}
+		return interval, nil
+	}
+	return 0, errors.New("unknown schedule " + schedule)
+}
+
+// Run runs jobs till ctx is done
+func (s *scheduler) Run(ctx context.Context) {
+	log.Info().Int("jobs", len(s.jobs)).Msg("scheduler started")
+	var wg sync.WaitGroup
+	for _, j := range s.jobs {
+		wg.Add(1)
+		go func(j Job) {
+			defer wg.Done()
+			s.runJob(ctx, j)
+		}(j)
+	}
+	wg.Wait()
+}
+
+func (s *scheduler) runJob(ctx context.Context, j Job) {
+	interval, _ := ParseSchedule(j.Schedule)
+	checkPeriod := interval
+	if checkPeriod > maxCheckPeriod {
+		checkPeriod = maxCheckPeriod
+	}
+	ticker := time.NewTicker(checkPeriod)
+	defer ticker.Stop()
+	for {
+		s.runIfDue(ctx, j, interval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runIfDue runs the job if the instance holds the job's lock and the last run of any
+// instance is at least interval ago
+func (s *scheduler) runIfDue(ctx context.Context, j Job, interval time.Duration) {
+	unlock, ok, err := s.storage.TryLockJob(ctx, j.Name)
+	if err != nil {
+		log.Error().Err(err).Str("job", j.Name).Msg("in lock")
+		return
+	}
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	lastRun, err := s.storage.LastJobRun(ctx, j.Name)
+	if err != nil {
+		log.Error().Err(err).Str("job", j.Name).Msg("in last run search")
+		return
+	}
+	// a bit of slack, so runs aren't skipped because of ticker jitter
+	if time.Since(lastRun) < interval-time.Second {
+		return
+	}
+
+	run := jobrun.JobRun{Job: j.Name, StartedAt: time.Now()}
+	run.Affected, err = j.Run(ctx)
+	run.FinishedAt = time.Now()
+	if err != nil {
+		run.Error = err.Error()
+		log.Error().Err(err).Str("job", j.Name).Dur("duration", run.FinishedAt.Sub(run.StartedAt)).Msg("job failed")
+	} else {
+		log.Info().Str("job", j.Name).Dur("duration", run.FinishedAt.Sub(run.StartedAt)).
+			Int64("affected", run.Affected).Msg("job done")
+	}
+	err = s.storage.AddJobRun(ctx, run)
+	if err != nil {
+		log.Error().Err(err).Str("job", j.Name).Msg("in run saving")
+	}
+}
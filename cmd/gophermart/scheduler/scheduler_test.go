@@ -0,0 +1,141 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nivanov045/gofermart/internal/jobrun"
+)
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		schedule string
+		want     time.Duration
+		wantErr  bool
+	}{
+		{"@hourly", time.Hour, false},
+		{"@daily", 24 * time.Hour, false},
+		{"@every 5m", 5 * time.Minute, false},
+		{"@every  90s ", 90 * time.Second, false},
+		{"@every 0s", 0, true},
+		{"@every -1m", 0, true},
+		{"@every often", 0, true},
+		{"@weekly", 0, true},
+		{"5m", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSchedule(tt.schedule)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseSchedule(%q) = %v, %v, want %v, error %v", tt.schedule, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	_, err := New(nil, Job{Name: "job", Schedule: "@weekly"})
+	if err == nil || err.Error() != "wrong schedule of job job: unknown schedule @weekly" {
+		t.Errorf("New with wrong schedule: %v", err)
+	}
+}
+
+// jobStorage is storage of one job, another instance holds its lock if locked is set
+type jobStorage struct {
+	Storage
+	locked   bool
+	lockErr  error
+	unlocked int
+	lastRun  time.Time
+	runs     []jobrun.JobRun
+}
+
+func (s *jobStorage) TryLockJob(ctx context.Context, job string) (func(), bool, error) {
+	if s.lockErr != nil || s.locked {
+		return nil, false, s.lockErr
+	}
+	return func() { s.unlocked++ }, true, nil
+}
+
+func (s *jobStorage) LastJobRun(ctx context.Context, job string) (time.Time, error) {
+	return s.lastRun, nil
+}
+
+func (s *jobStorage) AddJobRun(ctx context.Context, run jobrun.JobRun) error {
+	s.runs = append(s.runs, run)
+	return nil
+}
+
+func TestRunIfDue(t *testing.T) {
+	tests := []struct {
+		name      string
+		storage   *jobStorage
+		err       error
+		wantRun   bool
+		wantError string
+	}{
+		{"never run", &jobStorage{}, nil, true, ""},
+		{"due", &jobStorage{lastRun: time.Now().Add(-time.Hour)}, nil, true, ""},
+		{"due with jitter", &jobStorage{lastRun: time.Now().Add(-time.Hour + time.Second/2)}, nil, true, ""},
+		{"not due", &jobStorage{lastRun: time.Now().Add(-time.Hour + time.Minute)}, nil, false, ""},
+		{"locked by another instance", &jobStorage{locked: true}, nil, false, ""},
+		{"lock error", &jobStorage{lockErr: errors.New("connection refused")}, nil, false, ""},
+		{"failed", &jobStorage{}, errors.New("timeout"), true, "timeout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runs := 0
+			j := Job{Name: "job", Schedule: "@hourly", Run: func(ctx context.Context) (int64, error) {
+				runs++
+				return 3, tt.err
+			}}
+			s := &scheduler{storage: tt.storage, jobs: []Job{j}}
+			s.runIfDue(context.Background(), j, time.Hour)
+
+			if tt.wantRun != (runs == 1) {
+				t.Fatalf("job is run %d times", runs)
+			}
+			// the lock is released whenever it's taken
+			wantUnlocked := 1
+			if tt.storage.locked || tt.storage.lockErr != nil {
+				wantUnlocked = 0
+			}
+			if tt.storage.unlocked != wantUnlocked {
+				t.Errorf("lock is released %d times, want %d", tt.storage.unlocked, wantUnlocked)
+			}
+			if !tt.wantRun {
+				if len(tt.storage.runs) != 0 {
+					t.Errorf("skipped run is saved")
+				}
+				return
+			}
+			if len(tt.storage.runs) != 1 {
+				t.Fatalf("run is saved %d times", len(tt.storage.runs))
+			}
+			run := tt.storage.runs[0]
+			if run.Job != "job" || run.Affected != 3 || run.Error != tt.wantError || run.FinishedAt.Before(run.StartedAt) {
+				t.Errorf("saved run = %+v", run)
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	s, err := New(&jobStorage{}, Job{Name: "job", Schedule: "@every 1h", Run: func(ctx context.Context) (int64, error) {
+		return 0, nil
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run doesn't return after ctx is done")
+	}
+}
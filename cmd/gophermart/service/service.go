@@ -4,70 +4,253 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"log"
+	"sort"
 	"strconv"
+	"sync"
 	"time"
 
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/nivanov045/gofermart/cmd/gophermart/events"
+	"github.com/nivanov045/gofermart/cmd/gophermart/validator"
+	"github.com/nivanov045/gofermart/internal/amount"
+	"github.com/nivanov045/gofermart/internal/balance"
 	"github.com/nivanov045/gofermart/internal/checksums"
+	"github.com/nivanov045/gofermart/internal/credit"
+	"github.com/nivanov045/gofermart/internal/logger"
 	"github.com/nivanov045/gofermart/internal/order"
+	"github.com/nivanov045/gofermart/internal/tracing"
+	"github.com/nivanov045/gofermart/internal/webhook"
 	"github.com/nivanov045/gofermart/internal/withdraw"
 )
 
 type Storage interface {
-	FindOrderByUser(login string, number string) (bool, error)
-	FindOrder(number string) (bool, error)
-	AddOrder(login string, number string) error
-	UpdateOrder(order2 order.Order) error
-	GetOrders(login string) ([]order.Order, error)
-	MakeWithdraw(login string, order string, sum int64) error
-	GetWithdraws(login string) ([]withdraw.Withdraw, error)
+	FindOrderByUser(ctx context.Context, login string, number string) (bool, error)
+	FindOrder(ctx context.Context, number string) (bool, error)
+	AddOrder(ctx context.Context, login string, number string) error
+	UpdateOrder(ctx context.Context, order2 order.Order) error
+	GetPendingOrders(ctx context.Context) ([]string, error)
+	GetOrders(ctx context.Context, login string) ([]order.Order, error)
+	MakeWithdraw(ctx context.Context, login string, order string, sum amount.Amount) error
+	GetWithdraws(ctx context.Context, login string) ([]withdraw.Withdraw, error)
+	GetOrderOwner(ctx context.Context, number string) (string, error)
+	GetCredits(ctx context.Context, login string) ([]credit.Credit, error)
+	GetUserRegistrationTime(ctx context.Context, login string) (time.Time, error)
+	MakeTransfer(ctx context.Context, from string, to string, reference string, sum amount.Amount, dailyLimit amount.Amount) error
+	PayReferralBonus(ctx context.Context, referred string, referrerBonus amount.Amount, referredBonus amount.Amount) (bool, error)
+	LockUser(ctx context.Context, login string) error
+	WithTx(ctx context.Context, fn func(ctx context.Context) error) error
+	AddWebhookEndpoint(ctx context.Context, endpoint webhook.Endpoint) (int64, error)
+	GetWebhookEndpoints(ctx context.Context, login string) ([]webhook.Endpoint, error)
+	RemoveWebhookEndpoint(ctx context.Context, login string, id int64) error
+	AddWebhookEvent(ctx context.Context, login string, event webhook.Event) error
+	GetDeadWebhookDeliveries(ctx context.Context, limit int) ([]webhook.Delivery, error)
+	RetryWebhookDelivery(ctx context.Context, id int64) error
+}
+
+type WithdrawValidator interface {
+	Validate(ctx context.Context, login string, sum string) (amount.Amount, error)
+}
+
+// EventPublisher gets changes applied by accrual system responses, see events package
+type EventPublisher interface {
+	Publish(login string, eventType string, data []byte)
 }
 
 type AccrualSystem interface {
 	SetChannelToResponseToService(chan order.Order)
-	RunListenToService(<-chan string)
+	RunListenToService(ctx context.Context, fromService <-chan string)
+}
+
+type Config struct {
+	TierWindow            time.Duration
+	TransferDailyLimit    amount.Amount
+	TransferMinAccountAge time.Duration
+	ReferrerBonus         amount.Amount
+	ReferredBonus         amount.Amount
+	// WebhookAllowPrivate allows endpoints at loopback, private and link-local addresses
+	WebhookAllowPrivate bool
 }
 
 type service struct {
 	storage           Storage
 	isDebug           bool
+	cfg               Config
+	withdrawValidator WithdrawValidator
+	events            EventPublisher
+	tiers             *tierEngine
 	accrualSystem     AccrualSystem
 	toAccrualSystem   chan string
 	fromAccrualSystem chan order.Order
+	// stopped is closed when Run returns, so new orders aren't sent to nobody
+	stopped chan struct{}
 }
 
-func New(storage Storage, accrualSystem AccrualSystem, isDebug bool) *service {
+func New(storage Storage, accrualSystem AccrualSystem, withdrawValidator WithdrawValidator,
+	events EventPublisher, cfg Config, isDebug bool) *service {
 	resultService := &service{
 		storage:           storage,
 		isDebug:           isDebug,
+		cfg:               cfg,
+		withdrawValidator: withdrawValidator,
+		events:            events,
+		tiers:             newTierEngine(storage, cfg.TierWindow),
 		accrualSystem:     accrualSystem,
 		toAccrualSystem:   make(chan string),
 		fromAccrualSystem: make(chan order.Order),
+		stopped:           make(chan struct{}),
 	}
 	resultService.accrualSystem.SetChannelToResponseToService(resultService.fromAccrualSystem)
-	go resultService.RunListenToAccrual()
-	go resultService.accrualSystem.RunListenToService(resultService.toAccrualSystem)
 	return resultService
 }
 
-func (s *service) RunListenToAccrual() {
-	ctx := context.Background()
+// Run exchanges orders with accrual system until ctx is done
+func (s *service) Run(ctx context.Context) {
+	defer close(s.stopped)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.accrualSystem.RunListenToService(ctx, s.toAccrualSystem)
+	}()
+	s.RunListenToAccrual(ctx)
+	wg.Wait()
+}
+
+func (s *service) RunListenToAccrual(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case ord := <-s.fromAccrualSystem:
-			log.Println("service::RunListenToAccrual::info: received value")
-			err := s.storage.UpdateOrder(ord)
-			if err != nil {
-				log.Println("service::RunListenToAccrual::error:", err)
-			}
+			s.processAccrual(ctx, ord)
 		default:
 			time.Sleep(1 * time.Second)
 		}
 	}
 }
 
+// RequeuePendingOrders sends orders without final status to accrual system, they are
+// the ones which were in the pipeline at shutdown or were restored by import
+func (s *service) RequeuePendingOrders(ctx context.Context) error {
+	numbers, err := s.storage.GetPendingOrders(ctx)
+	if err != nil {
+		return err
+	}
+	for _, number := range numbers {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.stopped:
+			return errors.New("service is stopped")
+		case s.toAccrualSystem <- number:
+		}
+	}
+	logger.Ctx(ctx).Info().Int("orders", len(numbers)).Msg("pending orders are sent to accrual system")
+	return nil
+}
+
+// processAccrual saves accrual system's response about the order
+func (s *service) processAccrual(ctx context.Context, ord order.Order) {
+	ctx, span := tracing.Start(ctx, "service.processAccrual",
+		attribute.String(logger.FieldOrder, ord.Number), attribute.String("status", ord.Status))
+	defer span.End()
+	ctx = logger.With(ctx, logger.FieldOrder, ord.Number)
+	logger.Ctx(ctx).Info().Str("status", ord.Status).Msg("accrual system responded")
+	if ord.Status == order.ProcessingTypeProcessed && ord.Accrual > 0 {
+		ord = s.applyTierMultiplier(ctx, ord)
+	}
+	// referral bonus and webhook event are written with the change, so the order isn't
+	// left processed without them
+	err := s.storage.WithTx(ctx, func(ctx context.Context) error {
+		err := s.storage.UpdateOrder(ctx, ord)
+		if err != nil {
+			return err
+		}
+		if ord.Status == order.ProcessingTypeProcessed {
+			err = s.payReferralBonus(ctx, ord)
+			if err != nil {
+				return err
+			}
+		}
+		return s.addOrderWebhookEvent(ctx, ord)
+	})
+	if err != nil {
+		logger.Ctx(ctx).Error().Err(err).Msg("in order update")
+		return
+	}
+	s.publishChanges(ctx, ord)
+}
+
+// orderChange is data of order events of streams and webhooks
+type orderChange struct {
+	Number  string        `json:"number"`
+	Status  string        `json:"status"`
+	Accrual amount.Amount `json:"accrual,omitempty"`
+}
+
+func newOrderChange(ord order.Order) orderChange {
+	return orderChange{Number: ord.Number, Status: ord.Status, Accrual: ord.Accrual}
+}
+
+// publishChanges notifies owner of the order about its new status and, if the order is
+// processed, about the new balance
+func (s *service) publishChanges(ctx context.Context, ord order.Order) {
+	login, err := s.storage.GetOrderOwner(ctx, ord.Number)
+	if err != nil {
+		logger.Ctx(ctx).Error().Err(err).Msg("in owner search")
+		return
+	}
+	data, err := json.Marshal(newOrderChange(ord))
+	if err != nil {
+		logger.Ctx(ctx).Error().Err(err).Msg("in order event marshaling")
+		return
+	}
+	s.events.Publish(login, events.TypeOrder, data)
+	if ord.Status != order.ProcessingTypeProcessed {
+		return
+	}
+	data, err = s.GetBalance(ctx, login)
+	if err != nil {
+		logger.Ctx(ctx).Error().Err(err).Msg("in balance calculation")
+		return
+	}
+	s.events.Publish(login, events.TypeBalance, data)
+}
+
+// applyTierMultiplier multiplies accrual by owner's tier, on error accrual is left as is
+func (s *service) applyTierMultiplier(ctx context.Context, ord order.Order) order.Order {
+	login, err := s.storage.GetOrderOwner(ctx, ord.Number)
+	if err != nil {
+		logger.Ctx(ctx).Error().Err(err).Msg("in owner search")
+		return ord
+	}
+	accrual, err := s.tiers.apply(ctx, login, ord.Accrual)
+	if err != nil {
+		logger.Ctx(ctx).Error().Err(err).Msg("in tier calculation")
+		return ord
+	}
+	ord.Accrual = accrual
+	return ord
+}
+
+// payReferralBonus pays referral bonuses when referred user's first order is processed
+func (s *service) payReferralBonus(ctx context.Context, ord order.Order) error {
+	login, err := s.storage.GetOrderOwner(ctx, ord.Number)
+	if err != nil {
+		return err
+	}
+	isPaid, err := s.storage.PayReferralBonus(ctx, login, s.cfg.ReferrerBonus, s.cfg.ReferredBonus)
+	if err != nil {
+		return err
+	}
+	if isPaid {
+		logger.Ctx(ctx).Info().Str(logger.FieldLogin, login).Msg("referral bonus is paid")
+	}
+	return nil
+}
+
 func (s *service) checkOrderNumber(orderNumber string) bool {
 	if s.isDebug {
 		return true
@@ -80,47 +263,73 @@ func (s *service) checkOrderNumber(orderNumber string) bool {
 }
 
 // AddOrder returns true if order didn't exist before call, false if existed
-func (s *service) AddOrder(login string, requestBody []byte) (bool, error) {
+func (s *service) AddOrder(ctx context.Context, login string, requestBody []byte) (bool, error) {
+	ctx, span := tracing.Start(ctx, "service.AddOrder")
+	defer span.End()
 	orderNumber := string(requestBody)
 	if !s.checkOrderNumber(orderNumber) {
 		return true, errors.New("wrong format of order")
 	}
-	isExists, err := s.storage.FindOrderByUser(login, orderNumber)
+	logger.Annotate(ctx, logger.FieldOrder, orderNumber)
+	isExists, err := s.storage.FindOrderByUser(ctx, login, orderNumber)
 	if err != nil || isExists {
 		return false, err
 	}
-	isExists, err = s.storage.FindOrder(orderNumber)
+	isExists, err = s.storage.FindOrder(ctx, orderNumber)
 	if err != nil {
 		return false, err
 	}
 	if isExists {
 		return false, errors.New("order was uploaded by another user")
 	}
-	err = s.storage.AddOrder(login, orderNumber)
+	err = s.storage.AddOrder(ctx, login, orderNumber)
 	if err != nil {
 		return true, err
 	}
-	s.toAccrualSystem <- orderNumber
+	select {
+	case s.toAccrualSystem <- orderNumber:
+	case <-s.stopped:
+		// the order stays NEW and is sent at the next start, see RequeuePendingOrders
+	}
 	return true, nil
 }
 
-func (s *service) GetOrders(login string) ([]byte, error) {
-	orders, err := s.storage.GetOrders(login)
+func (s *service) GetOrders(ctx context.Context, login string) ([]byte, error) {
+	ctx, span := tracing.Start(ctx, "service.GetOrders")
+	defer span.End()
+	orders, err := s.storage.GetOrders(ctx, login)
 	if err != nil {
 		return nil, err
 	}
-	if len(orders) == 0 {
-		return nil, errors.New("no orders")
+	credits, err := s.storage.GetCredits(ctx, login)
+	if err != nil {
+		return nil, err
 	}
 	var ordersToResponse []order.Interface
 	for _, ord := range orders {
 		ordersToResponse = append(ordersToResponse, order.Interface{
 			Number:     ord.Number,
 			Status:     ord.Status,
-			Accrual:    float64(ord.Accrual) / 100,
+			Accrual:    ord.Accrual,
 			UploadedAt: ord.UploadedAt,
+			Type:       order.TypeOrder,
+		})
+	}
+	for _, c := range credits {
+		ordersToResponse = append(ordersToResponse, order.Interface{
+			Number:     c.Reference,
+			Status:     order.ProcessingTypeProcessed,
+			Accrual:    c.Sum,
+			UploadedAt: c.CreatedAt,
+			Type:       c.Type,
 		})
 	}
+	if len(ordersToResponse) == 0 {
+		return nil, errors.New("no orders")
+	}
+	sort.SliceStable(ordersToResponse, func(i, j int) bool {
+		return ordersToResponse[i].UploadedAt.Before(ordersToResponse[j].UploadedAt)
+	})
 	marshal, err := json.Marshal(ordersToResponse)
 	if err != nil {
 		return nil, err
@@ -128,15 +337,19 @@ func (s *service) GetOrders(login string) ([]byte, error) {
 	return marshal, nil
 }
 
-func (s *service) calculateBalance(login string) (current int64, withdrawn int64, err error) {
+func (s *service) calculateBalance(ctx context.Context, login string) (current amount.Amount, withdrawn amount.Amount, err error) {
 	current = 0
 	withdrawn = 0
 	err = nil
-	withdraws, err := s.storage.GetWithdraws(login)
+	withdraws, err := s.storage.GetWithdraws(ctx, login)
 	if err != nil {
 		return current, withdrawn, err
 	}
-	orders, err := s.storage.GetOrders(login)
+	orders, err := s.storage.GetOrders(ctx, login)
+	if err != nil {
+		return current, withdrawn, err
+	}
+	credits, err := s.storage.GetCredits(ctx, login)
 	if err != nil {
 		return current, withdrawn, err
 	}
@@ -146,22 +359,23 @@ func (s *service) calculateBalance(login string) (current int64, withdrawn int64
 	for _, o := range orders {
 		current += o.Accrual
 	}
+	for _, c := range credits {
+		current += c.Sum
+	}
 	current -= withdrawn
 	return current, withdrawn, err
 }
 
-func (s *service) GetBalance(login string) ([]byte, error) {
-	current, withdrawn, err := s.calculateBalance(login)
+func (s *service) GetBalance(ctx context.Context, login string) ([]byte, error) {
+	ctx, span := tracing.Start(ctx, "service.GetBalance")
+	defer span.End()
+	current, withdrawn, err := s.calculateBalance(ctx, login)
 	if err != nil {
 		return nil, err
 	}
-	type balance struct {
-		Current   float64 `json:"current"`
-		Withdrawn float64 `json:"withdrawn"`
-	}
-	bal := balance{
-		Current:   float64(current) / 100,
-		Withdrawn: float64(withdrawn) / 100,
+	bal := balance.Balance{
+		Current:   current,
+		Withdrawn: withdrawn,
 	}
 	marshal, err := json.Marshal(bal)
 	if err != nil {
@@ -170,35 +384,58 @@ func (s *service) GetBalance(login string) ([]byte, error) {
 	return marshal, nil
 }
 
-func (s *service) MakeWithdraw(login string, requestBody []byte) error {
+func (s *service) MakeWithdraw(ctx context.Context, login string, requestBody []byte) error {
+	ctx, span := tracing.Start(ctx, "service.MakeWithdraw")
+	defer span.End()
 	type request struct {
-		Order string  `json:"order"`
-		Sum   float64 `json:"sum"`
+		Order string      `json:"order"`
+		Sum   json.Number `json:"sum"`
 	}
 	var currentRequest request
 	err := json.Unmarshal(requestBody, &currentRequest)
 	if err != nil {
-		return errors.New("wrong query")
+		return errors.New("wrong request")
 	}
 	isOrderOk := s.checkOrderNumber(currentRequest.Order)
 	if !isOrderOk {
 		return errors.New("wrong format of order")
 	}
-	current, _, err := s.calculateBalance(login)
-	if err != nil {
-		return err
-	}
-	sumFromRequest := int64(currentRequest.Sum * 100)
-	if current < sumFromRequest {
-		return errors.New("not enough balance")
-	}
-	err = s.storage.MakeWithdraw(login, currentRequest.Order, sumFromRequest)
-	return err
-
+	logger.Annotate(ctx, logger.FieldOrder, currentRequest.Order)
+	// balance check and withdrawal are done under user's lock, so concurrent requests
+	// can't overdraw the balance
+	return s.storage.WithTx(ctx, func(ctx context.Context) error {
+		err := s.storage.LockUser(ctx, login)
+		if err != nil {
+			return err
+		}
+		sum, err := s.withdrawValidator.Validate(ctx, login, currentRequest.Sum.String())
+		if err != nil {
+			return err
+		}
+		current, _, err := s.calculateBalance(ctx, login)
+		if err != nil {
+			return err
+		}
+		if current < sum {
+			return errors.New("not enough balance")
+		}
+		err = s.storage.MakeWithdraw(ctx, login, currentRequest.Order, sum)
+		if err != nil {
+			return err
+		}
+		return s.addWebhookEvent(ctx, login, webhook.EventWithdrawalCreated, withdraw.Interface{
+			Order:       currentRequest.Order,
+			Sum:         sum,
+			ProcessedAt: time.Now(),
+			Type:        withdraw.TypeWithdrawal,
+		})
+	})
 }
 
-func (s *service) GetWithdraws(login string) ([]byte, error) {
-	withdraws, err := s.storage.GetWithdraws(login)
+func (s *service) GetWithdraws(ctx context.Context, login string) ([]byte, error) {
+	ctx, span := tracing.Start(ctx, "service.GetWithdraws")
+	defer span.End()
+	withdraws, err := s.storage.GetWithdraws(ctx, login)
 	if err != nil {
 		return nil, err
 	}
@@ -209,8 +446,9 @@ func (s *service) GetWithdraws(login string) ([]byte, error) {
 	for _, w := range withdraws {
 		el := withdraw.Interface{
 			Order:       w.Order,
-			Sum:         float64(w.Sum) / 100,
+			Sum:         w.Sum,
 			ProcessedAt: w.ProcessedAt,
+			Type:        w.Type,
 		}
 		resutlWithdrawInterface = append(resutlWithdrawInterface, el)
 	}
@@ -220,3 +458,69 @@ func (s *service) GetWithdraws(login string) ([]byte, error) {
 	}
 	return marshal, nil
 }
+
+func (s *service) MakeTransfer(ctx context.Context, login string, requestBody []byte) error {
+	ctx, span := tracing.Start(ctx, "service.MakeTransfer")
+	defer span.End()
+	type request struct {
+		Login string      `json:"login"`
+		Sum   json.Number `json:"sum"`
+	}
+	var currentRequest request
+	err := json.Unmarshal(requestBody, &currentRequest)
+	if err != nil || currentRequest.Login == "" {
+		return errors.New("wrong request")
+	}
+	sum, err := validator.ParseSum(currentRequest.Sum.String())
+	if err != nil {
+		return err
+	}
+	if currentRequest.Login == login {
+		return errors.New("transfer to yourself")
+	}
+	registeredAt, err := s.storage.GetUserRegistrationTime(ctx, login)
+	if err != nil {
+		return err
+	}
+	if time.Since(registeredAt) < s.cfg.TransferMinAccountAge {
+		return errors.New("account is too young")
+	}
+	_, err = s.storage.GetUserRegistrationTime(ctx, currentRequest.Login)
+	if err != nil {
+		return err
+	}
+	return s.storage.MakeTransfer(ctx, login, currentRequest.Login, uuid.NewString(), sum, s.cfg.TransferDailyLimit)
+}
+
+func (s *service) GetTier(ctx context.Context, login string) ([]byte, error) {
+	ctx, span := tracing.Start(ctx, "service.GetTier")
+	defer span.End()
+	accrued, err := s.tiers.accrued(ctx, login)
+	if err != nil {
+		return nil, err
+	}
+	current, next := s.tiers.tierFor(accrued)
+	type tierInfo struct {
+		Tier           string        `json:"tier"`
+		Multiplier     float64       `json:"multiplier"`
+		Accrued        amount.Amount `json:"accrued"`
+		NextTier       string        `json:"next_tier,omitempty"`
+		NextTierAt     amount.Amount `json:"next_tier_accrual,omitempty"`
+		LeftToNextTier amount.Amount `json:"left_to_next_tier,omitempty"`
+	}
+	info := tierInfo{
+		Tier:       current.Name,
+		Multiplier: float64(current.Multiplier) / 100,
+		Accrued:    accrued,
+	}
+	if next != nil {
+		info.NextTier = next.Name
+		info.NextTierAt = next.Threshold
+		info.LeftToNextTier = next.Threshold - accrued
+	}
+	marshal, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	return marshal, nil
+}
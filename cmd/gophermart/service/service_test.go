@@ -0,0 +1,187 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nivanov045/gofermart/cmd/gophermart/events"
+	"github.com/nivanov045/gofermart/cmd/gophermart/storage"
+	"github.com/nivanov045/gofermart/cmd/gophermart/validator"
+	"github.com/nivanov045/gofermart/internal/amount"
+	"github.com/nivanov045/gofermart/internal/order"
+	"github.com/nivanov045/gofermart/internal/pgtest"
+)
+
+// accrualSystem passes orders sent by service to the test, which responds with toService
+type accrualSystem struct {
+	toService chan<- order.Order
+	sent      chan string
+}
+
+func newAccrualSystem() *accrualSystem {
+	return &accrualSystem{sent: make(chan string, 10)}
+}
+
+func (a *accrualSystem) SetChannelToResponseToService(ch chan order.Order) {
+	a.toService = ch
+}
+
+func (a *accrualSystem) RunListenToService(ctx context.Context, fromService <-chan string) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case number := <-fromService:
+			a.sent <- number
+		}
+	}
+}
+
+// next returns the order sent to accrual system
+func (a *accrualSystem) next(t *testing.T) string {
+	t.Helper()
+	select {
+	case number := <-a.sent:
+		return number
+	case <-time.After(5 * time.Second):
+		t.Fatal("no order is sent to accrual system")
+		return ""
+	}
+}
+
+// testStorage is Storage with methods of authenticator which tests use to add users
+type testStorage interface {
+	Storage
+	AddUser(ctx context.Context, login string, passwordHash string, referralCode string) error
+	AddReferral(ctx context.Context, referrer string, referred string, maxReferrals int) error
+}
+
+func newTestService(t *testing.T, cfg Config) (*service, *accrualSystem, testStorage) {
+	t.Helper()
+	return newTestServiceOf(t, storage.NewMemory(), cfg)
+}
+
+func newTestServiceOf(t *testing.T, s testStorage, cfg Config) (*service, *accrualSystem, testStorage) {
+	t.Helper()
+	accrual := newAccrualSystem()
+	serv := New(s, accrual, validator.New(s, 0, 0), events.New(time.Minute), cfg, false)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		<-serv.stopped
+	})
+	go serv.Run(ctx)
+	return serv, accrual, s
+}
+
+// storages returns the memory storage and, if TEST_DATABASE_URI is set, Postgres
+func storages() map[string]func(t *testing.T) testStorage {
+	return map[string]func(t *testing.T) testStorage{
+		"memory": func(t *testing.T) testStorage { return storage.NewMemory() },
+		"postgres": func(t *testing.T) testStorage {
+			s, err := storage.New(pgtest.DSN(t), storage.PoolConfig{}, 5*time.Second, storage.ReplicaConfig{})
+			if err != nil {
+				t.Fatalf("storage.New: %v", err)
+			}
+			t.Cleanup(s.Close)
+			return s
+		},
+	}
+}
+
+func TestReferralBonus(t *testing.T) {
+	for name, newStorage := range storages() {
+		t.Run(name, func(t *testing.T) {
+			testReferralBonus(t, newStorage(t))
+		})
+	}
+}
+
+// testReferralBonus checks balances of both users after orders of the referred one
+func testReferralBonus(t *testing.T, s testStorage) {
+	ctx := context.Background()
+	serv, _, _ := newTestServiceOf(t, s, Config{ReferrerBonus: 100_00, ReferredBonus: 50_00})
+	for _, login := range []string{"referrer", "referred", "other"} {
+		if err := s.AddUser(ctx, login, login+"_hash", login+"_code"); err != nil {
+			t.Fatalf("AddUser: %v", err)
+		}
+	}
+	if err := s.AddReferral(ctx, "referrer", "referred", 10); err != nil {
+		t.Fatalf("AddReferral: %v", err)
+	}
+	for number, login := range map[string]string{
+		"12345678903": "referred", "4561261212345467": "referred", "2377225624": "referred", "79927398713": "other",
+	} {
+		if err := s.AddOrder(ctx, login, number); err != nil {
+			t.Fatalf("AddOrder: %v", err)
+		}
+	}
+	steps := []struct {
+		name             string
+		ord              order.Order
+		referrer, wanted amount.Amount
+	}{
+		{"invalid order pays nothing", order.Order{Number: "12345678903", Status: order.ProcessingTypeInvalid}, 0, 0},
+		{"order of another user pays nothing",
+			order.Order{Number: "79927398713", Status: order.ProcessingTypeProcessed, Accrual: 10_00}, 0, 0},
+		{"first processed order pays both",
+			order.Order{Number: "4561261212345467", Status: order.ProcessingTypeProcessed, Accrual: 10_00}, 100_00, 60_00},
+		{"bonus is paid once",
+			order.Order{Number: "2377225624", Status: order.ProcessingTypeProcessed, Accrual: 20_00}, 100_00, 80_00},
+		{"repeated response pays nothing",
+			order.Order{Number: "2377225624", Status: order.ProcessingTypeProcessed, Accrual: 20_00}, 100_00, 80_00},
+	}
+	for _, step := range steps {
+		serv.processAccrual(ctx, step.ord)
+		for login, want := range map[string]amount.Amount{"referrer": step.referrer, "referred": step.wanted} {
+			current, _, err := serv.calculateBalance(ctx, login)
+			if err != nil || current != want {
+				t.Errorf("%s: balance of %s = %v, %v, want %v", step.name, login, current, err, want)
+			}
+		}
+	}
+}
+
+func TestRequeuePendingOrders(t *testing.T) {
+	ctx := context.Background()
+	serv, accrual, memory := newTestService(t, Config{})
+	if err := memory.AddUser(ctx, "alice", "hash", "ALICE"); err != nil {
+		t.Fatal(err)
+	}
+	numbers := []string{"12345678903", "4561261212345467", "2377225624"}
+	for _, number := range numbers {
+		if err := memory.AddOrder(ctx, "alice", number); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	err := memory.UpdateOrder(ctx, order.Order{Number: numbers[1], Status: order.ProcessingTypeProcessing})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = memory.UpdateOrder(ctx, order.Order{Number: numbers[2], Status: order.ProcessingTypeInvalid})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = serv.RequeuePendingOrders(ctx); err != nil {
+		t.Fatalf("RequeuePendingOrders: %v", err)
+	}
+	for _, want := range numbers[:2] {
+		if got := accrual.next(t); got != want {
+			t.Errorf("order sent to accrual system = %s, want %s", got, want)
+		}
+	}
+	select {
+	case number := <-accrual.sent:
+		t.Errorf("order %s with final status is sent to accrual system", number)
+	default:
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err = serv.RequeuePendingOrders(cancelled); err == nil {
+		t.Errorf("RequeuePendingOrders isn't stopped by ctx")
+	}
+}
@@ -0,0 +1,72 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/nivanov045/gofermart/internal/amount"
+	"github.com/nivanov045/gofermart/internal/order"
+)
+
+// tier is a loyalty level. Threshold is the amount of points a user has to accrue over
+// the rolling window to reach it, Multiplier is applied to new accruals in percents.
+type tier struct {
+	Name       string
+	Threshold  amount.Amount
+	Multiplier int64
+}
+
+var defaultTiers = []tier{
+	{Name: "Basic", Threshold: 0, Multiplier: 100},
+	{Name: "Silver", Threshold: 500_00, Multiplier: 110},
+	{Name: "Gold", Threshold: 2000_00, Multiplier: 125},
+	{Name: "Platinum", Threshold: 5000_00, Multiplier: 150},
+}
+
+type tierEngine struct {
+	storage Storage
+	window  time.Duration
+	tiers   []tier
+}
+
+func newTierEngine(storage Storage, window time.Duration) *tierEngine {
+	return &tierEngine{storage: storage, window: window, tiers: defaultTiers}
+}
+
+// accrued sums accruals of orders processed inside the rolling window
+func (e *tierEngine) accrued(ctx context.Context, login string) (amount.Amount, error) {
+	orders, err := e.storage.GetOrders(ctx, login)
+	if err != nil {
+		return 0, err
+	}
+	windowStart := time.Now().Add(-e.window)
+	var result amount.Amount
+	for _, o := range orders {
+		if o.Status != order.ProcessingTypeProcessed || o.ProcessedAt.Before(windowStart) {
+			continue
+		}
+		result += o.Accrual
+	}
+	return result, nil
+}
+
+// tierFor returns current tier and the next one, next is nil for the top tier
+func (e *tierEngine) tierFor(accrued amount.Amount) (current tier, next *tier) {
+	current = e.tiers[0]
+	for i, t := range e.tiers {
+		if accrued < t.Threshold {
+			return current, &e.tiers[i]
+		}
+		current = t
+	}
+	return current, nil
+}
+
+func (e *tierEngine) apply(ctx context.Context, login string, accrual amount.Amount) (amount.Amount, error) {
+	accrued, err := e.accrued(ctx, login)
+	if err != nil {
+		return accrual, err
+	}
+	current, _ := e.tierFor(accrued)
+	return accrual.Percent(current.Multiplier), nil
+}
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nivanov045/gofermart/internal/amount"
+	"github.com/nivanov045/gofermart/internal/order"
+)
+
+// ordersStorage returns the same orders of any user
+type ordersStorage struct {
+	Storage
+	orders []order.Order
+}
+
+func (s *ordersStorage) GetOrders(ctx context.Context, login string) ([]order.Order, error) {
+	return s.orders, nil
+}
+
+func TestTierFor(t *testing.T) {
+	e := newTierEngine(nil, time.Hour)
+	tests := []struct {
+		accrued amount.Amount
+		want    string
+		next    string
+	}{
+		{0, "Basic", "Silver"},
+		{499_99, "Basic", "Silver"},
+		{500_00, "Silver", "Gold"},
+		{1999_99, "Silver", "Gold"},
+		{2000_00, "Gold", "Platinum"},
+		{4999_99, "Gold", "Platinum"},
+		{5000_00, "Platinum", ""},
+		{1_000_000_00, "Platinum", ""},
+	}
+	for _, tt := range tests {
+		current, next := e.tierFor(tt.accrued)
+		nextName := ""
+		if next != nil {
+			nextName = next.Name
+		}
+		if current.Name != tt.want || nextName != tt.next {
+			t.Errorf("tierFor(%v) = %s, %s, want %s, %s", tt.accrued, current.Name, nextName, tt.want, tt.next)
+		}
+	}
+}
+
+func TestTierApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		accrued amount.Amount
+		accrual amount.Amount
+		want    amount.Amount
+	}{
+		{"basic keeps accrual", 0, 10_05, 10_05},
+		{"silver rounds half up", 500_00, 5, 6},
+		{"silver rounds down", 500_00, 4, 4},
+		{"gold", 2000_00, 100_00, 125_00},
+		{"gold rounds half up", 2000_00, 2, 3},
+		{"platinum", 5000_00, 1, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := &ordersStorage{orders: []order.Order{
+				{Status: order.ProcessingTypeProcessed, Accrual: tt.accrued, ProcessedAt: time.Now()},
+			}}
+			got, err := newTierEngine(storage, time.Hour).apply(context.Background(), "alice", tt.accrual)
+			if err != nil || got != tt.want {
+				t.Errorf("apply(%v) = %v, %v, want %v", tt.accrual, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTierAccruedWindow(t *testing.T) {
+	now := time.Now()
+	window := 30 * 24 * time.Hour
+	storage := &ordersStorage{orders: []order.Order{
+		// uploaded before the window, but processed inside it
+		{Status: order.ProcessingTypeProcessed, Accrual: 1_00, UploadedAt: now.Add(-2 * window),
+			ProcessedAt: now.Add(-time.Hour)},
+		{Status: order.ProcessingTypeProcessed, Accrual: 10_00, UploadedAt: now.Add(-window),
+			ProcessedAt: now.Add(-window + time.Minute)},
+		// processed before the window
+		{Status: order.ProcessingTypeProcessed, Accrual: 100_00, UploadedAt: now.Add(-2 * window),
+			ProcessedAt: now.Add(-window - time.Minute)},
+		{Status: order.ProcessingTypeProcessing, UploadedAt: now},
+		{Status: order.ProcessingTypeInvalid, UploadedAt: now},
+	}}
+	got, err := newTierEngine(storage, window).accrued(context.Background(), "alice")
+	if err != nil || got != 11_00 {
+		t.Errorf("accrued = %v, %v, want 11", got, err)
+	}
+}
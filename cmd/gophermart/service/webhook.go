@@ -0,0 +1,198 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nivanov045/gofermart/internal/logger"
+	"github.com/nivanov045/gofermart/internal/order"
+	"github.com/nivanov045/gofermart/internal/tracing"
+	"github.com/nivanov045/gofermart/internal/webhook"
+)
+
+const (
+	maxWebhookURLLength = 2048
+	// deadDeliveriesLimit limits the dead letter view, the most recent are shown
+	deadDeliveriesLimit = 100
+)
+
+type webhookEndpoint struct {
+	ID        int64     `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type deadDelivery struct {
+	ID         int64           `json:"id"`
+	EndpointID int64           `json:"endpoint_id"`
+	Login      string          `json:"login,omitempty"`
+	URL        string          `json:"url"`
+	Event      string          `json:"event"`
+	Payload    json.RawMessage `json:"payload"`
+	Attempts   int             `json:"attempts"`
+	LastError  string          `json:"last_error"`
+	CreatedAt  time.Time       `json:"created_at"`
+	DeadAt     time.Time       `json:"dead_at"`
+}
+
+// addWebhookEvent writes event to the outbox, it's called in the transaction of the change
+func (s *service) addWebhookEvent(ctx context.Context, login string, eventType string, data interface{}) error {
+	event, err := webhook.NewEvent(eventType, login, data)
+	if err != nil {
+		return err
+	}
+	return s.storage.AddWebhookEvent(ctx, login, event)
+}
+
+// addOrderWebhookEvent writes event of the order if its processing is finished
+func (s *service) addOrderWebhookEvent(ctx context.Context, ord order.Order) error {
+	var eventType string
+	switch ord.Status {
+	case order.ProcessingTypeProcessed:
+		eventType = webhook.EventOrderProcessed
+	case order.ProcessingTypeInvalid:
+		eventType = webhook.EventOrderInvalid
+	default:
+		return nil
+	}
+	login, err := s.storage.GetOrderOwner(ctx, ord.Number)
+	if err != nil {
+		return err
+	}
+	return s.addWebhookEvent(ctx, login, eventType, newOrderChange(ord))
+}
+
+// AddWebhookEndpoint registers endpoint of login, of admins if login is empty. The
+// secret of signatures is returned only here.
+func (s *service) AddWebhookEndpoint(ctx context.Context, login string, requestBody []byte) ([]byte, error) {
+	ctx, span := tracing.Start(ctx, "service.AddWebhookEndpoint")
+	defer span.End()
+	type request struct {
+		URL string `json:"url"`
+	}
+	var currentRequest request
+	err := json.Unmarshal(requestBody, &currentRequest)
+	if err != nil {
+		return nil, errors.New("wrong request")
+	}
+	if !isWebhookURL(currentRequest.URL, s.cfg.WebhookAllowPrivate) {
+		return nil, errors.New("wrong webhook url")
+	}
+	secret, err := webhook.NewSecret()
+	if err != nil {
+		return nil, err
+	}
+	endpoint := webhook.Endpoint{Login: login, URL: currentRequest.URL, Secret: secret, CreatedAt: time.Now()}
+	endpoint.ID, err = s.storage.AddWebhookEndpoint(ctx, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	logger.Ctx(ctx).Info().Int64("endpoint", endpoint.ID).Msg("webhook endpoint is added")
+	return json.Marshal(webhookEndpoint{
+		ID:        endpoint.ID,
+		URL:       endpoint.URL,
+		Secret:    endpoint.Secret,
+		CreatedAt: endpoint.CreatedAt,
+	})
+}
+
+// isWebhookURL rejects URLs of the service's own network early, names are checked by
+// the dispatcher when they are resolved
+func isWebhookURL(rawURL string, allowPrivate bool) bool {
+	if len(rawURL) > maxWebhookURLLength {
+		return false
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" || u.User != nil {
+		return false
+	}
+	if allowPrivate {
+		return true
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip == nil || webhook.IsPublicAddress(ip)
+}
+
+// GetWebhookEndpoints returns endpoints of login without secrets, of admins if login is empty
+func (s *service) GetWebhookEndpoints(ctx context.Context, login string) ([]byte, error) {
+	ctx, span := tracing.Start(ctx, "service.GetWebhookEndpoints")
+	defer span.End()
+	endpoints, err := s.storage.GetWebhookEndpoints(ctx, login)
+	if err != nil {
+		return nil, err
+	}
+	if len(endpoints) == 0 {
+		return nil, errors.New("no webhook endpoints")
+	}
+	result := make([]webhookEndpoint, 0, len(endpoints))
+	for _, e := range endpoints {
+		result = append(result, webhookEndpoint{ID: e.ID, URL: e.URL, CreatedAt: e.CreatedAt})
+	}
+	return json.Marshal(result)
+}
+
+// RemoveWebhookEndpoint removes endpoint of login with its undelivered events, of admins
+// if login is empty
+func (s *service) RemoveWebhookEndpoint(ctx context.Context, login string, id string) error {
+	ctx, span := tracing.Start(ctx, "service.RemoveWebhookEndpoint")
+	defer span.End()
+	endpointID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return errors.New("no such webhook endpoint")
+	}
+	return s.storage.RemoveWebhookEndpoint(ctx, login, endpointID)
+}
+
+// GetDeadWebhookDeliveries returns the most recent deliveries which are out of attempts
+func (s *service) GetDeadWebhookDeliveries(ctx context.Context) ([]byte, error) {
+	ctx, span := tracing.Start(ctx, "service.GetDeadWebhookDeliveries")
+	defer span.End()
+	deliveries, err := s.storage.GetDeadWebhookDeliveries(ctx, deadDeliveriesLimit)
+	if err != nil {
+		return nil, err
+	}
+	if len(deliveries) == 0 {
+		return nil, errors.New("no dead webhook deliveries")
+	}
+	result := make([]deadDelivery, 0, len(deliveries))
+	for _, d := range deliveries {
+		result = append(result, deadDelivery{
+			ID:         d.ID,
+			EndpointID: d.EndpointID,
+			Login:      d.Login,
+			URL:        d.URL,
+			Event:      d.Type,
+			Payload:    d.Payload,
+			Attempts:   d.Attempts,
+			LastError:  d.LastError,
+			CreatedAt:  d.CreatedAt,
+			DeadAt:     d.DeadAt,
+		})
+	}
+	return json.Marshal(result)
+}
+
+// RetryWebhookDelivery sends dead delivery again with all attempts
+func (s *service) RetryWebhookDelivery(ctx context.Context, id string) error {
+	ctx, span := tracing.Start(ctx, "service.RetryWebhookDelivery")
+	defer span.End()
+	deliveryID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return errors.New("no such dead webhook delivery")
+	}
+	return s.storage.RetryWebhookDelivery(ctx, deliveryID)
+}
@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nivanov045/gofermart/cmd/gophermart/crypto"
+	"github.com/nivanov045/gofermart/internal/amount"
+	"github.com/nivanov045/gofermart/internal/audit"
+	"github.com/nivanov045/gofermart/internal/order"
+	"github.com/nivanov045/gofermart/internal/pgtest"
+	"github.com/nivanov045/gofermart/internal/webhook"
+)
+
+// deletedLogin is unlike anything else in the data, so any occurrence is a leak
+const deletedLogin = "leaky-login"
+
+func TestDeletedLoginIsGoneMemory(t *testing.T) {
+	s := NewMemory()
+	deleteAccount(t, s)
+	var data strings.Builder
+	dump(&data, reflect.ValueOf(s.memData))
+	if strings.Contains(data.String(), deletedLogin) {
+		t.Errorf("login of deleted account is kept: %s", data.String())
+	}
+	// the dump reaches credits and the outbox
+	for _, want := range []string{"referral:deleted-1:referrer", `"login":"deleted-1"`} {
+		if !strings.Contains(data.String(), want) {
+			t.Errorf("%s isn't found in %s", want, data.String())
+		}
+	}
+}
+
+func TestDeletedLoginIsGonePostgres(t *testing.T) {
+	dsn := pgtest.DSN(t)
+	s, err := New(dsn, PoolConfig{}, 5*time.Second, ReplicaConfig{})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer s.Close()
+	deleteAccount(t, s)
+
+	db := openDB(t, dsn)
+	defer db.Close()
+	for _, table := range userTables(t, dsn) {
+		rows, err := db.Query(`SELECT t::text FROM ` + table + ` t;`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var row string
+			if err = rows.Scan(&row); err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(row, deletedLogin) {
+				t.Errorf("login of deleted account is kept in %s: %s", table, row)
+			}
+		}
+		if err = rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		rows.Close()
+	}
+}
+
+type deletionStorage interface {
+	AddUser(ctx context.Context, login string, passwordHash string, referralCode string) error
+	AddReferral(ctx context.Context, referrer string, referred string, maxReferrals int) error
+	AddSession(ctx context.Context, login string, sessionToken string, expiresAt time.Time) error
+	AddOrder(ctx context.Context, login string, orderNumber string) error
+	UpdateOrder(ctx context.Context, ord order.Order) error
+	PayReferralBonus(ctx context.Context, referred string, referrerBonus amount.Amount,
+		referredBonus amount.Amount) (bool, error)
+	MakeWithdraw(ctx context.Context, login string, orderNumber string, sum amount.Amount) error
+	AddWebhookEndpoint(ctx context.Context, endpoint webhook.Endpoint) (int64, error)
+	AddWebhookEvent(ctx context.Context, login string, event webhook.Event) error
+	DeleteUser(ctx context.Context, login string, anonymousLogin string) error
+	ReserveLogin(ctx context.Context, loginHash string, until time.Time) error
+	AddAuditRecord(ctx context.Context, record audit.Record) error
+}
+
+// deleteAccount fills all data of deletedLogin which is kept after deletion and deletes
+// the account like the authenticator does
+func deleteAccount(t *testing.T, s deletionStorage) {
+	t.Helper()
+	ctx := context.Background()
+	now := time.Now()
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{"AddUser(referrer)", func() error { return s.AddUser(ctx, "referrer", "referrer_hash", "REFERRER") }},
+		{"AddUser", func() error { return s.AddUser(ctx, deletedLogin, "hash", "CODE") }},
+		{"AddUser(referred)", func() error { return s.AddUser(ctx, "referred", "referred_hash", "REFERRED") }},
+		{"AddReferral", func() error { return s.AddReferral(ctx, "referrer", deletedLogin, 10) }},
+		{"AddReferral(referred)", func() error { return s.AddReferral(ctx, deletedLogin, "referred", 10) }},
+		{"AddSession", func() error { return s.AddSession(ctx, deletedLogin, "token", now.Add(time.Hour)) }},
+		{"AddOrder", func() error { return s.AddOrder(ctx, deletedLogin, "12345678903") }},
+		{"UpdateOrder", func() error {
+			return s.UpdateOrder(ctx, order.Order{Number: "12345678903", Status: order.ProcessingTypeProcessed, Accrual: 100_00})
+		}},
+		{"PayReferralBonus", func() error {
+			_, err := s.PayReferralBonus(ctx, deletedLogin, 10_00, 5_00)
+			return err
+		}},
+		{"PayReferralBonus(referred)", func() error {
+			_, err := s.PayReferralBonus(ctx, "referred", 10_00, 5_00)
+			return err
+		}},
+		{"MakeWithdraw", func() error { return s.MakeWithdraw(ctx, deletedLogin, "2377225624", 10_00) }},
+		{"AddWebhookEndpoint", func() error {
+			_, err := s.AddWebhookEndpoint(ctx, webhook.Endpoint{Login: deletedLogin, URL: "http://user", CreatedAt: now})
+			return err
+		}},
+		{"AddWebhookEndpoint(admin)", func() error {
+			_, err := s.AddWebhookEndpoint(ctx, webhook.Endpoint{URL: "http://admin", CreatedAt: now})
+			return err
+		}},
+		{"AddWebhookEvent", func() error {
+			event, err := webhook.NewEvent(webhook.EventOrderProcessed, deletedLogin, map[string]string{"number": "12345678903"})
+			if err != nil {
+				return err
+			}
+			return s.AddWebhookEvent(ctx, deletedLogin, event)
+		}},
+		{"DeleteUser", func() error { return s.DeleteUser(ctx, deletedLogin, "deleted-1") }},
+		{"ReserveLogin", func() error {
+			return s.ReserveLogin(ctx, crypto.New("key").CreateLoginHash(deletedLogin), now.Add(time.Hour))
+		}},
+		{"AddAuditRecord", func() error {
+			return s.AddAuditRecord(ctx, audit.Record{
+				Action:    audit.ActionAccountDeleted,
+				Actor:     audit.ActorUser,
+				Subject:   "deleted-1",
+				CreatedAt: now,
+			})
+		}},
+	}
+	for _, step := range steps {
+		if err := step.run(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+	}
+}
+
+// dump writes all data reachable from v including unexported fields, pointers are
+// followed instead of printed as addresses
+func dump(b *strings.Builder, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if !v.IsNil() {
+			dump(b, v.Elem())
+		}
+	case reflect.Struct:
+		if v.Type() == reflect.TypeOf(time.Time{}) {
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			dump(b, v.Field(i))
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			b.Write(v.Bytes())
+			b.WriteByte(' ')
+			return
+		}
+		for i := 0; i < v.Len(); i++ {
+			dump(b, v.Index(i))
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			dump(b, iter.Key())
+			dump(b, iter.Value())
+		}
+	case reflect.String:
+		b.WriteString(v.String())
+		b.WriteByte(' ')
+	default:
+		fmt.Fprint(b, v)
+		b.WriteByte(' ')
+	}
+}
@@ -0,0 +1,1121 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nivanov045/gofermart/internal/amount"
+	"github.com/nivanov045/gofermart/internal/audit"
+	"github.com/nivanov045/gofermart/internal/credit"
+	"github.com/nivanov045/gofermart/internal/jobrun"
+	"github.com/nivanov045/gofermart/internal/order"
+	"github.com/nivanov045/gofermart/internal/userexport"
+	"github.com/nivanov045/gofermart/internal/webhook"
+	"github.com/nivanov045/gofermart/internal/withdraw"
+)
+
+// memStorage keeps everything in memory, it follows semantics of the database storage
+// including constraints, so it can replace it locally and in tests.
+// Writes are serialized with transactions by txMu, reads may see changes of a running
+// transaction.
+type memStorage struct {
+	txMu sync.Mutex
+	mu   sync.RWMutex
+	memData
+
+	jobLocksMu sync.Mutex
+	jobLocks   map[string]*sync.Mutex
+}
+
+type memData struct {
+	users       map[string]*memUser
+	referralOf  map[string]string
+	orders      map[string]*memOrder
+	withdraws   []memWithdraw
+	credits     []memCredit
+	creditRefs  map[string]bool
+	sessions    map[string]memSession
+	userSession map[string]string
+	referrals   map[string]*memReferral
+	jobRuns     []jobrun.JobRun
+	// reservedLogins keeps hashes of logins of deleted accounts till the end of reservation
+	reservedLogins map[string]time.Time
+	auditLog       []audit.Record
+	// webhookOutbox has deliveries to webhookEndpoints, IDs of both are sequential
+	webhookEndpoints []webhook.Endpoint
+	webhookOutbox    []memDelivery
+	lastWebhookID    int64
+}
+
+type memTxKey struct{}
+
+type memUser struct {
+	login        string
+	passwordHash string
+	createdAt    time.Time
+	referralCode string
+	isDeleted    bool
+}
+
+type memOrder struct {
+	login string
+	order order.Order
+}
+
+type memWithdraw struct {
+	login    string
+	withdraw withdraw.Withdraw
+}
+
+type memCredit struct {
+	login  string
+	credit credit.Credit
+}
+
+type memSession struct {
+	login      string
+	validUntil time.Time
+}
+
+// memDelivery keeps the delivery without data of its endpoint, they are joined on reads
+type memDelivery struct {
+	delivery      webhook.Delivery
+	nextAttemptAt time.Time
+	deliveredAt   time.Time
+}
+
+type memReferral struct {
+	referrer  string
+	createdAt time.Time
+	bonusPaid bool
+}
+
+func NewMemory() *memStorage {
+	return &memStorage{memData: memData{
+		users:       make(map[string]*memUser),
+		referralOf:  make(map[string]string),
+		orders:      make(map[string]*memOrder),
+		creditRefs:  make(map[string]bool),
+		sessions:    make(map[string]memSession),
+		userSession: make(map[string]string),
+		referrals:   make(map[string]*memReferral),
+
+		reservedLogins: make(map[string]time.Time),
+	}, jobLocks: make(map[string]*sync.Mutex)}
+}
+
+// WithTx runs fn exclusively of other writes, changes made by fn are reverted if it
+// returns an error
+func (s *memStorage) WithTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !s.inTx(ctx) {
+		s.txMu.Lock()
+		defer s.txMu.Unlock()
+		ctx = context.WithValue(ctx, memTxKey{}, s)
+	}
+	s.mu.RLock()
+	snapshot := s.memData.clone()
+	s.mu.RUnlock()
+	err := fn(ctx)
+	if err != nil {
+		s.mu.Lock()
+		s.memData = snapshot
+		s.mu.Unlock()
+	}
+	return err
+}
+
+func (s *memStorage) inTx(ctx context.Context) bool {
+	tx, ok := ctx.Value(memTxKey{}).(*memStorage)
+	return ok && tx == s
+}
+
+// lock locks storage for a write and returns unlock function, outside of transactions
+// it waits for running ones
+func (s *memStorage) lock(ctx context.Context) func() {
+	inTx := s.inTx(ctx)
+	if !inTx {
+		s.txMu.Lock()
+	}
+	s.mu.Lock()
+	return func() {
+		s.mu.Unlock()
+		if !inTx {
+			s.txMu.Unlock()
+		}
+	}
+}
+
+func (d *memData) clone() memData {
+	result := memData{
+		users:       make(map[string]*memUser, len(d.users)),
+		referralOf:  make(map[string]string, len(d.referralOf)),
+		orders:      make(map[string]*memOrder, len(d.orders)),
+		withdraws:   append([]memWithdraw(nil), d.withdraws...),
+		credits:     append([]memCredit(nil), d.credits...),
+		creditRefs:  make(map[string]bool, len(d.creditRefs)),
+		sessions:    make(map[string]memSession, len(d.sessions)),
+		userSession: make(map[string]string, len(d.userSession)),
+		referrals:   make(map[string]*memReferral, len(d.referrals)),
+		jobRuns:     append([]jobrun.JobRun(nil), d.jobRuns...),
+
+		reservedLogins: make(map[string]time.Time, len(d.reservedLogins)),
+		auditLog:       append([]audit.Record(nil), d.auditLog...),
+
+		webhookEndpoints: append([]webhook.Endpoint(nil), d.webhookEndpoints...),
+		webhookOutbox:    append([]memDelivery(nil), d.webhookOutbox...),
+		lastWebhookID:    d.lastWebhookID,
+	}
+	for k, v := range d.reservedLogins {
+		result.reservedLogins[k] = v
+	}
+	for k, v := range d.users {
+		u := *v
+		result.users[k] = &u
+	}
+	for k, v := range d.referralOf {
+		result.referralOf[k] = v
+	}
+	for k, v := range d.orders {
+		o := *v
+		result.orders[k] = &o
+	}
+	for k, v := range d.creditRefs {
+		result.creditRefs[k] = v
+	}
+	for k, v := range d.sessions {
+		result.sessions[k] = v
+	}
+	for k, v := range d.userSession {
+		result.userSession[k] = v
+	}
+	for k, v := range d.referrals {
+		r := *v
+		result.referrals[k] = &r
+	}
+	return result
+}
+
+// LockUser only checks that user exists, WithTx already serializes writes
+func (s *memStorage) LockUser(ctx context.Context, login string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.users[login]; !ok {
+		return errors.New("no such user")
+	}
+	return nil
+}
+
+// Ping always succeeds, memory storage has no connection to lose
+func (s *memStorage) Ping(ctx context.Context) error {
+	return nil
+}
+
+// PendingMigrations returns nothing, memory storage has no schema
+func (s *memStorage) PendingMigrations(ctx context.Context) ([]int64, error) {
+	return nil, nil
+}
+
+func (s *memStorage) FindOrderByUser(ctx context.Context, login string, number string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	o, ok := s.orders[number]
+	return ok && o.login == login, nil
+}
+
+func (s *memStorage) FindOrder(ctx context.Context, number string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.orders[number]
+	return ok, nil
+}
+
+func (s *memStorage) AddOrder(ctx context.Context, login string, number string) error {
+	defer s.lock(ctx)()
+	if _, ok := s.users[login]; !ok {
+		return errors.New("no such user")
+	}
+	if _, ok := s.orders[number]; ok {
+		return errors.New("order already exists")
+	}
+	s.orders[number] = &memOrder{
+		login: login,
+		order: order.Order{Number: number, Status: order.ProcessingTypeNew, UploadedAt: time.Now()},
+	}
+	return nil
+}
+
+func (s *memStorage) GetOrders(ctx context.Context, login string) ([]order.Order, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var resultOrders []order.Order
+	for _, o := range s.orders {
+		if o.login == login {
+			resultOrders = append(resultOrders, o.order)
+		}
+	}
+	sort.Slice(resultOrders, func(i, j int) bool {
+		return resultOrders[i].UploadedAt.Before(resultOrders[j].UploadedAt)
+	})
+	return resultOrders, nil
+}
+
+func (s *memStorage) UpdateOrder(ctx context.Context, orderData order.Order) error {
+	defer s.lock(ctx)()
+	if orderData.Accrual < 0 {
+		return errors.New("accrual must be non-negative")
+	}
+	switch orderData.Status {
+	case order.ProcessingTypeNew, order.ProcessingTypeProcessing, order.ProcessingTypeInvalid,
+		order.ProcessingTypeProcessed:
+	default:
+		return errors.New("unknown order status")
+	}
+	o, ok := s.orders[orderData.Number]
+	if !ok {
+		return nil
+	}
+	o.order.Status = orderData.Status
+	o.order.Accrual = orderData.Accrual
+	if orderData.Status != order.ProcessingTypeProcessed {
+		o.order.ProcessedAt = time.Time{}
+	} else if o.order.ProcessedAt.IsZero() {
+		o.order.ProcessedAt = time.Now()
+	}
+	return nil
+}
+
+func (s *memStorage) GetOrderOwner(ctx context.Context, number string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	o, ok := s.orders[number]
+	if !ok {
+		return "", errors.New("no such order")
+	}
+	return o.login, nil
+}
+
+func (s *memStorage) CountOrdersByStatus(ctx context.Context) (map[string]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := make(map[string]int)
+	for _, o := range s.orders {
+		result[o.order.Status]++
+	}
+	return result, nil
+}
+
+func (s *memStorage) GetPendingOrders(ctx context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var pending []order.Order
+	for _, o := range s.orders {
+		if o.order.Status == order.ProcessingTypeNew || o.order.Status == order.ProcessingTypeProcessing {
+			pending = append(pending, o.order)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].UploadedAt.Before(pending[j].UploadedAt)
+	})
+	result := make([]string, len(pending))
+	for i, o := range pending {
+		result[i] = o.Number
+	}
+	return result, nil
+}
+
+func (s *memStorage) MakeWithdraw(ctx context.Context, login string, order string, sum amount.Amount) error {
+	defer s.lock(ctx)()
+	if _, ok := s.users[login]; !ok {
+		return errors.New("no such user")
+	}
+	if sum < 0 {
+		return errors.New("sum must be non-negative")
+	}
+	s.withdraws = append(s.withdraws, memWithdraw{login: login, withdraw: withdraw.Withdraw{
+		Order:       order,
+		Sum:         sum,
+		ProcessedAt: time.Now(),
+		Type:        withdraw.TypeWithdrawal,
+	}})
+	return nil
+}
+
+func (s *memStorage) GetWithdraws(ctx context.Context, login string) ([]withdraw.Withdraw, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var resultWithdraws []withdraw.Withdraw
+	for _, w := range s.withdraws {
+		if w.login == login {
+			resultWithdraws = append(resultWithdraws, w.withdraw)
+		}
+	}
+	return resultWithdraws, nil
+}
+
+func (s *memStorage) GetCredits(ctx context.Context, login string) ([]credit.Credit, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var resultCredits []credit.Credit
+	for _, c := range s.credits {
+		if c.login == login {
+			resultCredits = append(resultCredits, c.credit)
+		}
+	}
+	return resultCredits, nil
+}
+
+// balance must be called with s.mu held
+func (s *memStorage) balance(login string) amount.Amount {
+	var result amount.Amount
+	for _, o := range s.orders {
+		if o.login == login && o.order.Status == order.ProcessingTypeProcessed {
+			result += o.order.Accrual
+		}
+	}
+	for _, c := range s.credits {
+		if c.login == login {
+			result += c.credit.Sum
+		}
+	}
+	for _, w := range s.withdraws {
+		if w.login == login {
+			result -= w.withdraw.Sum
+		}
+	}
+	return result
+}
+
+func (s *memStorage) MakeTransfer(ctx context.Context, from string, to string, reference string, sum amount.Amount,
+	dailyLimit amount.Amount) error {
+	defer s.lock(ctx)()
+	if _, ok := s.users[from]; !ok {
+		return errors.New("no such user")
+	}
+	if _, ok := s.users[to]; !ok {
+		return errors.New("no such user")
+	}
+	if sum < 0 {
+		return errors.New("sum must be non-negative")
+	}
+	if s.creditRefs[reference] {
+		return errors.New("reference is already used")
+	}
+	if s.balance(from) < sum {
+		return errors.New("not enough balance")
+	}
+	if dailyLimit > 0 {
+		transferred := sum
+		dayStart := time.Now().Add(-24 * time.Hour)
+		for _, w := range s.withdraws {
+			if w.login == from && w.withdraw.Type == withdraw.TypeTransfer && w.withdraw.ProcessedAt.After(dayStart) {
+				transferred += w.withdraw.Sum
+			}
+		}
+		if transferred > dailyLimit {
+			return errors.New("daily transfer limit exceeded")
+		}
+	}
+
+	now := time.Now()
+	s.withdraws = append(s.withdraws, memWithdraw{login: from, withdraw: withdraw.Withdraw{
+		Order:       reference,
+		Sum:         sum,
+		ProcessedAt: now,
+		Type:        withdraw.TypeTransfer,
+	}})
+	s.credits = append(s.credits, memCredit{login: to, credit: credit.Credit{
+		Reference: reference,
+		Type:      credit.TypeTransfer,
+		Sum:       sum,
+		CreatedAt: now,
+	}})
+	s.creditRefs[reference] = true
+	return nil
+}
+
+func (s *memStorage) AddUser(ctx context.Context, login string, passwordHash string, referralCode string) error {
+	defer s.lock(ctx)()
+	if _, ok := s.users[login]; ok {
+		return errors.New("login is already in use")
+	}
+	if _, ok := s.referralOf[referralCode]; ok {
+		return errors.New("referral code is already in use")
+	}
+	s.users[login] = &memUser{
+		login:        login,
+		passwordHash: passwordHash,
+		createdAt:    time.Now(),
+		referralCode: referralCode,
+	}
+	s.referralOf[referralCode] = login
+	return nil
+}
+
+func (s *memStorage) FindUserByReferralCode(ctx context.Context, referralCode string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	login, ok := s.referralOf[referralCode]
+	if !ok {
+		return "", errors.New("no such referral code")
+	}
+	return login, nil
+}
+
+func (s *memStorage) GetReferralCode(ctx context.Context, login string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[login]
+	if !ok {
+		return "", errors.New("no such user")
+	}
+	return u.referralCode, nil
+}
+
+// countReferrals must be called with s.mu held
+func (s *memStorage) countReferrals(login string) int {
+	count := 0
+	for _, r := range s.referrals {
+		if r.referrer == login {
+			count++
+		}
+	}
+	return count
+}
+
+func (s *memStorage) CountReferrals(ctx context.Context, login string) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.countReferrals(login), nil
+}
+
+func (s *memStorage) AddReferral(ctx context.Context, referrer string, referred string, maxReferrals int) error {
+	defer s.lock(ctx)()
+	if _, ok := s.users[referrer]; !ok {
+		return errors.New("no such user")
+	}
+	if _, ok := s.users[referred]; !ok {
+		return errors.New("no such user")
+	}
+	if referrer == referred {
+		return errors.New("user can't refer themselves")
+	}
+	if _, ok := s.referrals[referred]; ok {
+		return errors.New("user is already referred")
+	}
+	if s.countReferrals(referrer) >= maxReferrals {
+		return errors.New("referral limit reached")
+	}
+	s.referrals[referred] = &memReferral{referrer: referrer, createdAt: time.Now()}
+	return nil
+}
+
+func (s *memStorage) PayReferralBonus(ctx context.Context, referred string, referrerBonus amount.Amount,
+	referredBonus amount.Amount) (bool, error) {
+	defer s.lock(ctx)()
+	r, ok := s.referrals[referred]
+	if !ok || r.bonusPaid {
+		return false, nil
+	}
+	if referrerBonus < 0 || referredBonus < 0 {
+		return false, errors.New("sum must be non-negative")
+	}
+	r.bonusPaid = true
+	now := time.Now()
+	for _, c := range []memCredit{
+		{login: r.referrer, credit: credit.Credit{Reference: referralReference(referred, referrerParty), Sum: referrerBonus}},
+		{login: referred, credit: credit.Credit{Reference: referralReference(referred, referredParty), Sum: referredBonus}},
+	} {
+		c.credit.Type = credit.TypeReferralBonus
+		c.credit.CreatedAt = now
+		s.credits = append(s.credits, c)
+		s.creditRefs[c.credit.Reference] = true
+	}
+	return true, nil
+}
+
+func (s *memStorage) GetUserRegistrationTime(ctx context.Context, login string) (time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[login]
+	if !ok {
+		return time.Time{}, errors.New("no such user")
+	}
+	return u.createdAt, nil
+}
+
+func (s *memStorage) AddSession(ctx context.Context, login string, sessionToken string, expiresAt time.Time) error {
+	defer s.lock(ctx)()
+	if _, ok := s.users[login]; !ok {
+		return errors.New("no such user")
+	}
+	if existing, ok := s.sessions[sessionToken]; ok && existing.login != login {
+		return errors.New("session token is already in use")
+	}
+	if previous, ok := s.userSession[login]; ok {
+		delete(s.sessions, previous)
+	}
+	s.sessions[sessionToken] = memSession{login: login, validUntil: expiresAt}
+	s.userSession[login] = sessionToken
+	return nil
+}
+
+func (s *memStorage) GetSessionInfo(ctx context.Context, sessionToken string) (string, time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	session, ok := s.sessions[sessionToken]
+	if !ok {
+		return "", time.Time{}, errors.New("no such token")
+	}
+	return session.login, session.validUntil, nil
+}
+
+func (s *memStorage) CheckPassword(ctx context.Context, login string, passwordHash string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[login]
+	return ok && !u.isDeleted && u.passwordHash == passwordHash, nil
+}
+
+func (s *memStorage) RemoveSession(ctx context.Context, sessionToken string) error {
+	defer s.lock(ctx)()
+	session, ok := s.sessions[sessionToken]
+	if !ok {
+		return nil
+	}
+	delete(s.sessions, sessionToken)
+	delete(s.userSession, session.login)
+	return nil
+}
+
+func (s *memStorage) RemoveExpiredSessions(ctx context.Context, before time.Time) (int64, error) {
+	defer s.lock(ctx)()
+	var removed int64
+	for token, session := range s.sessions {
+		if session.validUntil.Before(before) {
+			delete(s.sessions, token)
+			delete(s.userSession, session.login)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// TryLockJob locks the job within the process only
+func (s *memStorage) TryLockJob(ctx context.Context, job string) (func(), bool, error) {
+	s.jobLocksMu.Lock()
+	jobLock, ok := s.jobLocks[job]
+	if !ok {
+		jobLock = &sync.Mutex{}
+		s.jobLocks[job] = jobLock
+	}
+	s.jobLocksMu.Unlock()
+	if !jobLock.TryLock() {
+		return nil, false, nil
+	}
+	return jobLock.Unlock, true, nil
+}
+
+func (s *memStorage) LastJobRun(ctx context.Context, job string) (time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var result time.Time
+	for _, run := range s.jobRuns {
+		if run.Job == job && run.StartedAt.After(result) {
+			result = run.StartedAt
+		}
+	}
+	return result, nil
+}
+
+func (s *memStorage) AddJobRun(ctx context.Context, run jobrun.JobRun) error {
+	defer s.lock(ctx)()
+	s.jobRuns = append(s.jobRuns, run)
+	return nil
+}
+
+func (s *memStorage) RemoveJobRuns(ctx context.Context, before time.Time) (int64, error) {
+	defer s.lock(ctx)()
+	var kept []jobrun.JobRun
+	for _, run := range s.jobRuns {
+		if !run.StartedAt.Before(before) {
+			kept = append(kept, run)
+		}
+	}
+	removed := int64(len(s.jobRuns) - len(kept))
+	s.jobRuns = kept
+	return removed, nil
+}
+
+func (s *memStorage) ExportUser(ctx context.Context, login string) (userexport.Document, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[login]
+	if !ok {
+		return userexport.Document{}, errors.New("no such user")
+	}
+	doc := userexport.Document{
+		Version:    userexport.Version,
+		ExportedAt: time.Now(),
+		Account: userexport.Account{
+			Login:        u.login,
+			PasswordHash: u.passwordHash,
+			CreatedAt:    u.createdAt,
+			ReferralCode: u.referralCode,
+		},
+		Orders:      []userexport.Order{},
+		Withdrawals: []userexport.Withdrawal{},
+		Credits:     []userexport.Credit{},
+		Sessions:    []userexport.Session{},
+	}
+	if r, ok := s.referrals[login]; ok {
+		doc.Account.ReferredBy = r.referrer
+		doc.Account.ReferralBonusPaid = r.bonusPaid
+	}
+	for _, o := range s.orders {
+		if o.login == login {
+			exported := userexport.Order{
+				Number:     o.order.Number,
+				Status:     o.order.Status,
+				Accrual:    o.order.Accrual,
+				UploadedAt: o.order.UploadedAt,
+			}
+			if !o.order.ProcessedAt.IsZero() {
+				processedAt := o.order.ProcessedAt
+				exported.ProcessedAt = &processedAt
+			}
+			doc.Orders = append(doc.Orders, exported)
+		}
+	}
+	sort.Slice(doc.Orders, func(i, j int) bool {
+		return doc.Orders[i].UploadedAt.Before(doc.Orders[j].UploadedAt)
+	})
+	for _, w := range s.withdraws {
+		if w.login == login {
+			doc.Withdrawals = append(doc.Withdrawals, userexport.Withdrawal{
+				Order:       w.withdraw.Order,
+				Sum:         w.withdraw.Sum,
+				ProcessedAt: w.withdraw.ProcessedAt,
+				Type:        w.withdraw.Type,
+			})
+		}
+	}
+	for _, c := range s.credits {
+		if c.login == login {
+			doc.Credits = append(doc.Credits, userexport.Credit{
+				Reference: c.credit.Reference,
+				Type:      c.credit.Type,
+				Sum:       c.credit.Sum,
+				CreatedAt: c.credit.CreatedAt,
+			})
+		}
+	}
+	if token, ok := s.userSession[login]; ok {
+		doc.Sessions = append(doc.Sessions, userexport.Session{ValidUntil: s.sessions[token].validUntil})
+	}
+	return doc, nil
+}
+
+func (s *memStorage) ImportUser(ctx context.Context, doc userexport.Document) error {
+	return s.WithTx(ctx, func(ctx context.Context) error {
+		defer s.lock(ctx)()
+		account := doc.Account
+		if user, ok := s.users[account.Login]; ok {
+			// data isn't merged into another user's account
+			if user.passwordHash != account.PasswordHash || !user.createdAt.Equal(account.CreatedAt) {
+				return errors.New("login is used by another account")
+			}
+		} else {
+			if _, ok := s.referralOf[account.ReferralCode]; ok {
+				return errors.New("referral code is already in use")
+			}
+			s.users[account.Login] = &memUser{
+				login:        account.Login,
+				passwordHash: account.PasswordHash,
+				createdAt:    account.CreatedAt,
+				referralCode: account.ReferralCode,
+			}
+			s.referralOf[account.ReferralCode] = account.Login
+		}
+		for _, o := range doc.Orders {
+			existing, ok := s.orders[o.Number]
+			if !ok {
+				imported := order.Order{
+					Number:     o.Number,
+					Status:     o.Status,
+					Accrual:    o.Accrual,
+					UploadedAt: o.UploadedAt,
+				}
+				if processedAt := importedProcessedAt(o); processedAt != nil {
+					imported.ProcessedAt = *processedAt
+				}
+				s.orders[o.Number] = &memOrder{login: account.Login, order: imported}
+			} else if existing.login != account.Login {
+				return errors.New("order " + o.Number + " belongs to another user")
+			}
+		}
+		for _, w := range doc.Withdrawals {
+			imported := withdraw.Withdraw{Order: w.Order, Sum: w.Sum, ProcessedAt: w.ProcessedAt, Type: w.Type}
+			isFound := false
+			for _, existing := range s.withdraws {
+				if existing.login == account.Login && existing.withdraw.Order == imported.Order &&
+					existing.withdraw.Sum == imported.Sum && existing.withdraw.Type == imported.Type &&
+					existing.withdraw.ProcessedAt.Equal(imported.ProcessedAt) {
+					isFound = true
+					break
+				}
+			}
+			if !isFound {
+				s.withdraws = append(s.withdraws, memWithdraw{login: account.Login, withdraw: imported})
+			}
+		}
+		for _, c := range doc.Credits {
+			if s.creditRefs[c.Reference] {
+				for _, existing := range s.credits {
+					if existing.credit.Reference == c.Reference && existing.login != account.Login {
+						return errors.New("credit " + c.Reference + " belongs to another user")
+					}
+				}
+				continue
+			}
+			s.credits = append(s.credits, memCredit{login: account.Login, credit: credit.Credit{
+				Reference: c.Reference,
+				Type:      c.Type,
+				Sum:       c.Sum,
+				CreatedAt: c.CreatedAt,
+			}})
+			s.creditRefs[c.Reference] = true
+		}
+		if account.ReferredBy != "" {
+			_, isReferred := s.referrals[account.Login]
+			_, isReferrerFound := s.users[account.ReferredBy]
+			if !isReferred && isReferrerFound {
+				s.referrals[account.Login] = &memReferral{
+					referrer:  account.ReferredBy,
+					createdAt: account.CreatedAt,
+					bonusPaid: account.ReferralBonusPaid,
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *memStorage) DeleteUser(ctx context.Context, login string, anonymousLogin string) error {
+	defer s.lock(ctx)()
+	u, ok := s.users[login]
+	if !ok || u.isDeleted {
+		return errors.New("no such user")
+	}
+	if _, ok := s.users[anonymousLogin]; ok {
+		return errors.New("login is already in use")
+	}
+	// payloads of login's events are kept in the outbox of admins' endpoints
+	payloads := make(map[int][]byte)
+	for i, d := range s.webhookOutbox {
+		payload, ok, err := webhook.ReplaceLogin(d.delivery.Payload, login, anonymousLogin)
+		if err != nil {
+			return err
+		}
+		if ok {
+			payloads[i] = payload
+		}
+	}
+	if token, ok := s.userSession[login]; ok {
+		delete(s.sessions, token)
+		delete(s.userSession, login)
+	}
+	delete(s.users, login)
+	delete(s.referralOf, u.referralCode)
+	u.login = anonymousLogin
+	u.referralCode = anonymousLogin
+	u.passwordHash = ""
+	u.isDeleted = true
+	s.users[anonymousLogin] = u
+	s.referralOf[anonymousLogin] = anonymousLogin
+
+	for _, o := range s.orders {
+		if o.login == login {
+			o.login = anonymousLogin
+		}
+	}
+	for i := range s.withdraws {
+		if s.withdraws[i].login == login {
+			s.withdraws[i].login = anonymousLogin
+		}
+	}
+	for i := range s.credits {
+		c := &s.credits[i]
+		if c.login == login {
+			c.login = anonymousLogin
+		}
+		for _, party := range []string{referrerParty, referredParty} {
+			if c.credit.Reference == referralReference(login, party) {
+				delete(s.creditRefs, c.credit.Reference)
+				c.credit.Reference = referralReference(anonymousLogin, party)
+				s.creditRefs[c.credit.Reference] = true
+			}
+		}
+	}
+	if r, ok := s.referrals[login]; ok {
+		delete(s.referrals, login)
+		s.referrals[anonymousLogin] = r
+	}
+	for _, r := range s.referrals {
+		if r.referrer == login {
+			r.referrer = anonymousLogin
+		}
+	}
+	for i, payload := range payloads {
+		s.webhookOutbox[i].delivery.Payload = payload
+	}
+	for _, e := range s.webhookEndpoints {
+		if e.Login == login {
+			s.removeWebhookEndpoint(e.ID)
+		}
+	}
+	return nil
+}
+
+func (s *memStorage) ReserveLogin(ctx context.Context, loginHash string, until time.Time) error {
+	defer s.lock(ctx)()
+	if until.After(s.reservedLogins[loginHash]) {
+		s.reservedLogins[loginHash] = until
+	}
+	return nil
+}
+
+func (s *memStorage) IsLoginReserved(ctx context.Context, loginHash string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.reservedLogins[loginHash].After(time.Now()), nil
+}
+
+// HashLoginReservations does nothing, logins are reserved in memory by hashes only
+func (s *memStorage) HashLoginReservations(ctx context.Context, hash func(login string) string) (int64, error) {
+	return 0, nil
+}
+
+func (s *memStorage) RemoveLoginReservations(ctx context.Context, before time.Time) (int64, error) {
+	defer s.lock(ctx)()
+	var removed int64
+	for login, reservedUntil := range s.reservedLogins {
+		if reservedUntil.Before(before) {
+			delete(s.reservedLogins, login)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func (s *memStorage) AddAuditRecord(ctx context.Context, record audit.Record) error {
+	defer s.lock(ctx)()
+	s.auditLog = append(s.auditLog, record)
+	return nil
+}
+
+func (s *memStorage) RemoveAuditRecords(ctx context.Context, before time.Time) (int64, error) {
+	defer s.lock(ctx)()
+	var kept []audit.Record
+	for _, record := range s.auditLog {
+		if !record.CreatedAt.Before(before) {
+			kept = append(kept, record)
+		}
+	}
+	removed := int64(len(s.auditLog) - len(kept))
+	s.auditLog = kept
+	return removed, nil
+}
+
+func (s *memStorage) AddWebhookEndpoint(ctx context.Context, endpoint webhook.Endpoint) (int64, error) {
+	defer s.lock(ctx)()
+	if endpoint.Login != "" {
+		if _, ok := s.users[endpoint.Login]; !ok {
+			return 0, errors.New("no such user")
+		}
+	}
+	s.lastWebhookID++
+	endpoint.ID = s.lastWebhookID
+	s.webhookEndpoints = append(s.webhookEndpoints, endpoint)
+	return endpoint.ID, nil
+}
+
+func (s *memStorage) GetWebhookEndpoints(ctx context.Context, login string) ([]webhook.Endpoint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var result []webhook.Endpoint
+	for _, e := range s.webhookEndpoints {
+		if e.Login == login {
+			result = append(result, e)
+		}
+	}
+	return result, nil
+}
+
+func (s *memStorage) RemoveWebhookEndpoint(ctx context.Context, login string, id int64) error {
+	defer s.lock(ctx)()
+	for _, e := range s.webhookEndpoints {
+		if e.ID == id && e.Login == login {
+			s.removeWebhookEndpoint(id)
+			return nil
+		}
+	}
+	return errors.New("no such webhook endpoint")
+}
+
+// removeWebhookEndpoint removes endpoint with its deliveries, it must be called with
+// s.mu held
+func (s *memStorage) removeWebhookEndpoint(id int64) {
+	var endpoints []webhook.Endpoint
+	for _, e := range s.webhookEndpoints {
+		if e.ID != id {
+			endpoints = append(endpoints, e)
+		}
+	}
+	s.webhookEndpoints = endpoints
+	var outbox []memDelivery
+	for _, d := range s.webhookOutbox {
+		if d.delivery.EndpointID != id {
+			outbox = append(outbox, d)
+		}
+	}
+	s.webhookOutbox = outbox
+}
+
+func (s *memStorage) AddWebhookEvent(ctx context.Context, login string, event webhook.Event) error {
+	defer s.lock(ctx)()
+	for _, e := range s.webhookEndpoints {
+		if e.Login != "" && e.Login != login {
+			continue
+		}
+		s.lastWebhookID++
+		s.webhookOutbox = append(s.webhookOutbox, memDelivery{
+			delivery:      webhook.Delivery{Event: event, ID: s.lastWebhookID, EndpointID: e.ID},
+			nextAttemptAt: event.CreatedAt,
+		})
+	}
+	return nil
+}
+
+// withEndpoint fills delivery with data of its endpoint, it must be called with s.mu held
+func (s *memStorage) withEndpoint(d webhook.Delivery) webhook.Delivery {
+	for _, e := range s.webhookEndpoints {
+		if e.ID == d.EndpointID {
+			d.Login = e.Login
+			d.URL = e.URL
+			d.Secret = e.Secret
+		}
+	}
+	return d
+}
+
+func (s *memStorage) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]webhook.Delivery, error) {
+	defer s.lock(ctx)()
+	now := time.Now()
+	var due []*memDelivery
+	for i := range s.webhookOutbox {
+		d := &s.webhookOutbox[i]
+		if d.deliveredAt.IsZero() && d.delivery.DeadAt.IsZero() && !d.nextAttemptAt.After(now) {
+			due = append(due, d)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].nextAttemptAt.Before(due[j].nextAttemptAt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	result := make([]webhook.Delivery, 0, len(due))
+	for _, d := range due {
+		d.nextAttemptAt = now.Add(lease)
+		result = append(result, s.withEndpoint(d.delivery))
+	}
+	return result, nil
+}
+
+// delivery returns delivery of the outbox, it must be called with s.mu held
+func (s *memStorage) delivery(id int64) *memDelivery {
+	for i := range s.webhookOutbox {
+		if s.webhookOutbox[i].delivery.ID == id {
+			return &s.webhookOutbox[i]
+		}
+	}
+	return nil
+}
+
+func (s *memStorage) MarkWebhookDelivered(ctx context.Context, id int64) error {
+	defer s.lock(ctx)()
+	if d := s.delivery(id); d != nil {
+		d.delivery.Attempts++
+		d.delivery.LastError = ""
+		d.deliveredAt = time.Now()
+	}
+	return nil
+}
+
+func (s *memStorage) MarkWebhookFailed(ctx context.Context, id int64, lastError string, retryAt time.Time) error {
+	defer s.lock(ctx)()
+	if d := s.delivery(id); d != nil {
+		d.delivery.Attempts++
+		d.delivery.LastError = lastError
+		if retryAt.IsZero() {
+			d.delivery.DeadAt = time.Now()
+		} else {
+			d.nextAttemptAt = retryAt
+		}
+	}
+	return nil
+}
+
+func (s *memStorage) GetDeadWebhookDeliveries(ctx context.Context, limit int) ([]webhook.Delivery, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var result []webhook.Delivery
+	for _, d := range s.webhookOutbox {
+		if !d.delivery.DeadAt.IsZero() {
+			result = append(result, s.withEndpoint(d.delivery))
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if !result[i].DeadAt.Equal(result[j].DeadAt) {
+			return result[i].DeadAt.After(result[j].DeadAt)
+		}
+		return result[i].ID > result[j].ID
+	})
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+func (s *memStorage) RetryWebhookDelivery(ctx context.Context, id int64) error {
+	defer s.lock(ctx)()
+	d := s.delivery(id)
+	if d == nil || d.delivery.DeadAt.IsZero() {
+		return errors.New("no such dead webhook delivery")
+	}
+	d.delivery.Attempts = 0
+	d.delivery.DeadAt = time.Time{}
+	d.nextAttemptAt = time.Now()
+	return nil
+}
+
+func (s *memStorage) RemoveWebhookDeliveries(ctx context.Context, before time.Time) (int64, error) {
+	defer s.lock(ctx)()
+	var kept []memDelivery
+	for _, d := range s.webhookOutbox {
+		isDelivered := !d.deliveredAt.IsZero() && d.deliveredAt.Before(before)
+		isDead := !d.delivery.DeadAt.IsZero() && d.delivery.DeadAt.Before(before)
+		if !isDelivered && !isDead {
+			kept = append(kept, d)
+		}
+	}
+	removed := int64(len(s.webhookOutbox) - len(kept))
+	s.webhookOutbox = kept
+	return removed, nil
+}
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS referrals;
+DROP TABLE IF EXISTS credits;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS withdraws;
+DROP TABLE IF EXISTS orders;
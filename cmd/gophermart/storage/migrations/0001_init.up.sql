@@ -0,0 +1,45 @@
+-- Tables could be created before migrations were introduced, so everything is created
+-- only if missing and columns added later are appended to existing tables.
+CREATE TABLE IF NOT EXISTS orders (
+    order_num TEXT UNIQUE,
+    user_login TEXT,
+    created_at TIMESTAMP,
+    status TEXT,
+    accrual BIGINT
+);
+
+CREATE TABLE IF NOT EXISTS withdraws (
+    user_login TEXT,
+    order_num TEXT,
+    created_at TIMESTAMP,
+    sum BIGINT
+);
+ALTER TABLE withdraws ADD COLUMN IF NOT EXISTS type TEXT DEFAULT 'WITHDRAWAL';
+
+CREATE TABLE IF NOT EXISTS users (
+    user_login TEXT UNIQUE,
+    password_hash TEXT
+);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS created_at TIMESTAMP;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS referral_code TEXT UNIQUE;
+
+CREATE TABLE IF NOT EXISTS sessions (
+    user_login TEXT UNIQUE,
+    session_token TEXT,
+    valid_until TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS credits (
+    user_login TEXT,
+    created_at TIMESTAMP,
+    sum BIGINT,
+    reference TEXT UNIQUE,
+    type TEXT
+);
+
+CREATE TABLE IF NOT EXISTS referrals (
+    referrer_login TEXT,
+    referred_login TEXT UNIQUE,
+    created_at TIMESTAMP,
+    bonus_paid BOOLEAN DEFAULT FALSE
+);
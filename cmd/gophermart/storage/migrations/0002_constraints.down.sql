@@ -0,0 +1,60 @@
+ALTER TABLE referrals ADD COLUMN referrer_login TEXT;
+ALTER TABLE referrals ADD COLUMN referred_login TEXT UNIQUE;
+UPDATE referrals r SET referrer_login = u.user_login FROM users u WHERE u.id = r.referrer_id;
+UPDATE referrals r SET referred_login = u.user_login FROM users u WHERE u.id = r.referred_id;
+ALTER TABLE referrals
+    DROP COLUMN referrer_id,
+    DROP COLUMN referred_id,
+    ALTER COLUMN created_at DROP NOT NULL,
+    ALTER COLUMN bonus_paid DROP NOT NULL;
+
+ALTER TABLE credits ADD COLUMN user_login TEXT;
+UPDATE credits c SET user_login = u.user_login FROM users u WHERE u.id = c.user_id;
+ALTER TABLE credits
+    DROP COLUMN user_id,
+    DROP COLUMN id,
+    DROP CONSTRAINT credits_type_check,
+    DROP CONSTRAINT credits_sum_check,
+    ALTER COLUMN created_at DROP NOT NULL,
+    ALTER COLUMN sum DROP NOT NULL,
+    ALTER COLUMN reference DROP NOT NULL,
+    ALTER COLUMN type DROP NOT NULL;
+
+ALTER TABLE sessions ADD COLUMN user_login TEXT UNIQUE;
+UPDATE sessions s SET user_login = u.user_login FROM users u WHERE u.id = s.user_id;
+ALTER TABLE sessions
+    DROP COLUMN user_id,
+    DROP CONSTRAINT sessions_session_token_key,
+    ALTER COLUMN session_token DROP NOT NULL,
+    ALTER COLUMN valid_until DROP NOT NULL;
+
+ALTER TABLE withdraws ADD COLUMN user_login TEXT;
+UPDATE withdraws w SET user_login = u.user_login FROM users u WHERE u.id = w.user_id;
+ALTER TABLE withdraws
+    DROP COLUMN user_id,
+    DROP COLUMN id,
+    DROP CONSTRAINT withdraws_type_check,
+    DROP CONSTRAINT withdraws_sum_check,
+    ALTER COLUMN order_num DROP NOT NULL,
+    ALTER COLUMN created_at DROP NOT NULL,
+    ALTER COLUMN sum DROP NOT NULL,
+    ALTER COLUMN type DROP NOT NULL;
+
+ALTER TABLE orders ADD COLUMN user_login TEXT;
+UPDATE orders o SET user_login = u.user_login FROM users u WHERE u.id = o.user_id;
+ALTER TABLE orders
+    DROP COLUMN user_id,
+    DROP CONSTRAINT orders_pkey,
+    DROP CONSTRAINT orders_status_check,
+    DROP CONSTRAINT orders_accrual_check,
+    ALTER COLUMN created_at DROP NOT NULL,
+    ALTER COLUMN status DROP NOT NULL,
+    ALTER COLUMN accrual DROP NOT NULL,
+    ALTER COLUMN accrual DROP DEFAULT;
+
+ALTER TABLE users
+    DROP COLUMN id,
+    ALTER COLUMN user_login DROP NOT NULL,
+    ALTER COLUMN password_hash DROP NOT NULL,
+    ALTER COLUMN created_at DROP NOT NULL,
+    ALTER COLUMN referral_code DROP NOT NULL;
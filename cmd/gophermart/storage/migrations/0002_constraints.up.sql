@@ -0,0 +1,87 @@
+-- Users get numeric ids which replace logins in all referencing tables. Rows referencing
+-- logins without a user make the migration fail instead of being silently dropped,
+-- except for sessions which can always be recreated by logging in.
+ALTER TABLE users ADD COLUMN id BIGSERIAL;
+UPDATE users SET created_at = '1970-01-01' WHERE created_at IS NULL;
+UPDATE users SET referral_code = upper(substr(md5(random()::text || id::text), 1, 12))
+WHERE referral_code IS NULL;
+ALTER TABLE users
+    ADD PRIMARY KEY (id),
+    ALTER COLUMN user_login SET NOT NULL,
+    ALTER COLUMN password_hash SET NOT NULL,
+    ALTER COLUMN created_at SET NOT NULL,
+    ALTER COLUMN referral_code SET NOT NULL;
+
+ALTER TABLE orders ADD COLUMN user_id BIGINT REFERENCES users (id);
+UPDATE orders o SET user_id = u.id FROM users u WHERE u.user_login = o.user_login;
+UPDATE orders SET accrual = 0 WHERE accrual IS NULL;
+-- Statuses of accrual system were stored as is, its REGISTERED is NEW of gophermart.
+UPDATE orders SET status = 'NEW'
+WHERE status IS NULL OR status NOT IN ('NEW', 'PROCESSING', 'INVALID', 'PROCESSED');
+ALTER TABLE orders
+    DROP COLUMN user_login,
+    ADD PRIMARY KEY (order_num),
+    ALTER COLUMN user_id SET NOT NULL,
+    ALTER COLUMN created_at SET NOT NULL,
+    ALTER COLUMN status SET NOT NULL,
+    ALTER COLUMN accrual SET NOT NULL,
+    ALTER COLUMN accrual SET DEFAULT 0,
+    ADD CONSTRAINT orders_status_check CHECK (status IN ('NEW', 'PROCESSING', 'INVALID', 'PROCESSED')),
+    ADD CONSTRAINT orders_accrual_check CHECK (accrual >= 0);
+CREATE INDEX orders_user_id_created_at_idx ON orders (user_id, created_at);
+
+-- Negative withdrawals could be made before sums were validated, they are kept as is,
+-- so the sum check is enforced for new rows only.
+ALTER TABLE withdraws ADD COLUMN id BIGSERIAL PRIMARY KEY;
+ALTER TABLE withdraws ADD COLUMN user_id BIGINT REFERENCES users (id);
+UPDATE withdraws w SET user_id = u.id FROM users u WHERE u.user_login = w.user_login;
+UPDATE withdraws SET type = 'WITHDRAWAL' WHERE type IS NULL;
+ALTER TABLE withdraws
+    DROP COLUMN user_login,
+    ALTER COLUMN user_id SET NOT NULL,
+    ALTER COLUMN order_num SET NOT NULL,
+    ALTER COLUMN created_at SET NOT NULL,
+    ALTER COLUMN sum SET NOT NULL,
+    ALTER COLUMN type SET NOT NULL,
+    ADD CONSTRAINT withdraws_type_check CHECK (type IN ('WITHDRAWAL', 'TRANSFER')),
+    ADD CONSTRAINT withdraws_sum_check CHECK (sum >= 0) NOT VALID;
+CREATE INDEX withdraws_user_id_created_at_idx ON withdraws (user_id, created_at);
+
+ALTER TABLE sessions ADD COLUMN user_id BIGINT REFERENCES users (id) ON DELETE CASCADE;
+UPDATE sessions s SET user_id = u.id FROM users u WHERE u.user_login = s.user_login;
+DELETE FROM sessions WHERE user_id IS NULL OR session_token IS NULL OR valid_until IS NULL;
+ALTER TABLE sessions
+    DROP COLUMN user_login,
+    ADD PRIMARY KEY (user_id),
+    ALTER COLUMN session_token SET NOT NULL,
+    ALTER COLUMN valid_until SET NOT NULL,
+    ADD CONSTRAINT sessions_session_token_key UNIQUE (session_token);
+
+ALTER TABLE credits ADD COLUMN id BIGSERIAL PRIMARY KEY;
+ALTER TABLE credits ADD COLUMN user_id BIGINT REFERENCES users (id);
+UPDATE credits c SET user_id = u.id FROM users u WHERE u.user_login = c.user_login;
+ALTER TABLE credits
+    DROP COLUMN user_login,
+    ALTER COLUMN user_id SET NOT NULL,
+    ALTER COLUMN created_at SET NOT NULL,
+    ALTER COLUMN sum SET NOT NULL,
+    ALTER COLUMN reference SET NOT NULL,
+    ALTER COLUMN type SET NOT NULL,
+    ADD CONSTRAINT credits_type_check CHECK (type IN ('TRANSFER', 'REFERRAL_BONUS')),
+    ADD CONSTRAINT credits_sum_check CHECK (sum >= 0);
+CREATE INDEX credits_user_id_created_at_idx ON credits (user_id, created_at);
+
+ALTER TABLE referrals ADD COLUMN referrer_id BIGINT REFERENCES users (id);
+ALTER TABLE referrals ADD COLUMN referred_id BIGINT REFERENCES users (id);
+UPDATE referrals r SET referrer_id = u.id FROM users u WHERE u.user_login = r.referrer_login;
+UPDATE referrals r SET referred_id = u.id FROM users u WHERE u.user_login = r.referred_login;
+UPDATE referrals SET bonus_paid = FALSE WHERE bonus_paid IS NULL;
+ALTER TABLE referrals
+    DROP COLUMN referrer_login,
+    DROP COLUMN referred_login,
+    ADD PRIMARY KEY (referred_id),
+    ALTER COLUMN referrer_id SET NOT NULL,
+    ALTER COLUMN created_at SET NOT NULL,
+    ALTER COLUMN bonus_paid SET NOT NULL,
+    ADD CONSTRAINT referrals_check CHECK (referrer_id <> referred_id);
+CREATE INDEX referrals_referrer_id_idx ON referrals (referrer_id);
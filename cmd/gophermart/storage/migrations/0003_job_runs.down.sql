@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS sessions_valid_until_idx;
+DROP TABLE IF EXISTS job_runs;
@@ -0,0 +1,12 @@
+CREATE TABLE job_runs (
+    id BIGSERIAL PRIMARY KEY,
+    job TEXT NOT NULL,
+    started_at TIMESTAMP NOT NULL,
+    finished_at TIMESTAMP NOT NULL,
+    affected BIGINT NOT NULL DEFAULT 0,
+    error TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX job_runs_job_started_at_idx ON job_runs (job, started_at);
+CREATE INDEX job_runs_started_at_idx ON job_runs (started_at);
+
+CREATE INDEX sessions_valid_until_idx ON sessions (valid_until);
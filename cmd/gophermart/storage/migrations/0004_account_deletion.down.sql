@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS audit_log;
+DROP TABLE IF EXISTS reserved_logins;
+-- Deleted accounts get an empty hash, which matches no password.
+UPDATE users SET password_hash = '' WHERE password_hash IS NULL;
+ALTER TABLE users
+    DROP COLUMN IF EXISTS deleted_at,
+    ALTER COLUMN password_hash SET NOT NULL;
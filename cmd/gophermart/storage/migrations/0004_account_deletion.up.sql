@@ -0,0 +1,19 @@
+-- Deleted accounts keep their rows for accounting, personal data is removed from them.
+ALTER TABLE users
+    ALTER COLUMN password_hash DROP NOT NULL,
+    ADD COLUMN deleted_at TIMESTAMP;
+
+-- Logins of deleted accounts can't be registered again till reserved_until.
+CREATE TABLE reserved_logins (
+    login TEXT PRIMARY KEY,
+    reserved_until TIMESTAMP NOT NULL
+);
+
+CREATE TABLE audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMP NOT NULL,
+    action TEXT NOT NULL,
+    actor TEXT NOT NULL,
+    subject TEXT NOT NULL
+);
+CREATE INDEX audit_log_created_at_idx ON audit_log (created_at);
@@ -0,0 +1,28 @@
+-- Endpoints without a user are registered by admins and get events of all users.
+CREATE TABLE webhook_endpoints (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT REFERENCES users (id),
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX webhook_endpoints_user_id_idx ON webhook_endpoints (user_id);
+
+-- Events are written for every endpoint in the transaction of the change, the
+-- dispatcher sends them till they are delivered or dead.
+CREATE TABLE webhook_outbox (
+    id BIGSERIAL PRIMARY KEY,
+    endpoint_id BIGINT NOT NULL REFERENCES webhook_endpoints (id) ON DELETE CASCADE,
+    event TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL,
+    last_error TEXT NOT NULL DEFAULT '',
+    delivered_at TIMESTAMP,
+    dead_at TIMESTAMP
+);
+CREATE INDEX webhook_outbox_next_attempt_at_idx ON webhook_outbox (next_attempt_at)
+    WHERE delivered_at IS NULL AND dead_at IS NULL;
+CREATE INDEX webhook_outbox_dead_at_idx ON webhook_outbox (dead_at) WHERE dead_at IS NOT NULL;
+CREATE INDEX webhook_outbox_delivered_at_idx ON webhook_outbox (delivered_at) WHERE delivered_at IS NOT NULL;
@@ -0,0 +1,4 @@
+-- Hashes can't be turned back into logins, so hashed reservations are dropped.
+DELETE FROM reserved_logins WHERE is_hashed;
+ALTER TABLE reserved_logins DROP COLUMN is_hashed;
+ALTER TABLE reserved_logins RENAME COLUMN login_hash TO login;
@@ -0,0 +1,6 @@
+-- Reservations keep a keyed hash of the login, so deleted accounts leave no login
+-- behind. The key isn't known here, rows reserved before are hashed by the service
+-- on start.
+ALTER TABLE reserved_logins RENAME COLUMN login TO login_hash;
+ALTER TABLE reserved_logins ADD COLUMN is_hashed BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE reserved_logins ALTER COLUMN is_hashed SET DEFAULT TRUE;
@@ -0,0 +1,4 @@
+-- Loyalty tiers count accruals by the time orders were processed. It wasn't kept
+-- before, upload time is the closest known one.
+ALTER TABLE orders ADD COLUMN processed_at TIMESTAMP;
+UPDATE orders SET processed_at = created_at WHERE status = 'PROCESSED';
@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"io/fs"
+	"testing"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/stdlib"
+
+	"github.com/nivanov045/gofermart/internal/migrate"
+	"github.com/nivanov045/gofermart/internal/pgtest"
+)
+
+// TestMigrationsUpDownUp checks that down scripts undo up scripts completely, so
+// migrations can be applied again after a rollback
+func TestMigrationsUpDownUp(t *testing.T) {
+	dsn := pgtest.DSN(t)
+	ctx := context.Background()
+	files, err := fs.Glob(migrations, "migrations/*.up.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := len(files)
+
+	db := openDB(t, dsn)
+	defer db.Close()
+	for _, query := range baselineData {
+		if _, err = db.Exec(query); err != nil {
+			t.Fatalf("baseline data: %v", err)
+		}
+	}
+	err = MigrateUp(ctx, dsn)
+	if err != nil {
+		t.Fatalf("MigrateUp: %v", err)
+	}
+	checkMigrations(t, dsn, 0)
+	checkBaselineData(t, db)
+	err = MigrateDown(ctx, dsn, 1)
+	if err != nil {
+		t.Fatalf("MigrateDown of the last one: %v", err)
+	}
+	checkMigrations(t, dsn, 1)
+	err = MigrateDown(ctx, dsn, all)
+	if err != nil {
+		t.Fatalf("MigrateDown of all: %v", err)
+	}
+	checkMigrations(t, dsn, all)
+	if tables := userTables(t, dsn); len(tables) != 0 {
+		t.Errorf("tables %v are left after rollback of all migrations", tables)
+	}
+	err = MigrateUp(ctx, dsn)
+	if err != nil {
+		t.Fatalf("MigrateUp after rollback: %v", err)
+	}
+	checkMigrations(t, dsn, 0)
+}
+
+// baselineData is the schema which storage.New created before migrations, with rows
+// it could write: accrual system's statuses, orders without accrual and withdrawals and
+// users without columns added later
+var baselineData = []string{
+	`CREATE TABLE orders (order_num TEXT UNIQUE, user_login TEXT, created_at TIMESTAMP, status TEXT,
+		accrual BIGINT);`,
+	`CREATE TABLE withdraws (user_login TEXT, order_num TEXT, created_at TIMESTAMP, sum BIGINT);`,
+	`CREATE TABLE users (user_login TEXT UNIQUE, password_hash TEXT);`,
+	`CREATE TABLE sessions (user_login TEXT UNIQUE, session_token TEXT, valid_until TIMESTAMP);`,
+	`INSERT INTO users VALUES ('alice', 'alice_hash'), ('bob', 'bob_hash');`,
+	`INSERT INTO orders VALUES
+		('12345678903', 'alice', '2022-01-01', 'REGISTERED', NULL),
+		('4561261212345467', 'alice', '2022-01-02', 'PROCESSING', NULL),
+		('2377225624', 'alice', '2022-01-03', 'PROCESSED', 50000),
+		('79927398713', 'bob', '2022-01-04', 'INVALID', NULL);`,
+	`INSERT INTO withdraws VALUES ('alice', '2377225624', '2022-01-05', 10000);`,
+	`INSERT INTO sessions VALUES ('alice', 'token', '2022-01-06'), ('deleted', 'orphan', '2022-01-06');`,
+}
+
+// checkBaselineData checks that rows of baselineData are kept with values of constrained
+// columns filled
+func checkBaselineData(t *testing.T, db *sql.DB) {
+	t.Helper()
+	checks := []struct {
+		query string
+		want  string
+	}{
+		{`SELECT string_agg(o.order_num || ':' || u.user_login || ':' || o.status || ':' || o.accrual, ',' ORDER BY o.created_at)
+			FROM orders o JOIN users u ON u.id = o.user_id;`,
+			"12345678903:alice:NEW:0,4561261212345467:alice:PROCESSING:0,2377225624:alice:PROCESSED:50000," +
+				"79927398713:bob:INVALID:0"},
+		{`SELECT string_agg(w.order_num || ':' || u.user_login || ':' || w.type || ':' || w.sum, ',')
+			FROM withdraws w JOIN users u ON u.id = w.user_id;`,
+			"2377225624:alice:WITHDRAWAL:10000"},
+		{`SELECT string_agg(u.user_login || ':' || s.session_token, ',') FROM sessions s JOIN users u ON u.id = s.user_id;`,
+			"alice:token"},
+		{`SELECT count(*)::text FROM users WHERE created_at IS NOT NULL AND referral_code IS NOT NULL;`, "2"},
+		{`SELECT string_agg(order_num, ',') FROM orders WHERE processed_at = created_at;`, "2377225624"},
+		{`SELECT count(*)::text FROM orders WHERE processed_at IS NULL;`, "3"},
+	}
+	for _, check := range checks {
+		var got string
+		if err := db.QueryRow(check.query).Scan(&got); err != nil {
+			t.Fatalf("%s: %v", check.query, err)
+		}
+		if got != check.want {
+			t.Errorf("%s = %q, want %q", check.query, got, check.want)
+		}
+	}
+}
+
+func openDB(t *testing.T, dsn string) *sql.DB {
+	t.Helper()
+	connConfig, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stdlib.OpenDB(*connConfig)
+}
+
+func checkMigrations(t *testing.T, dsn string, wantPending int) {
+	t.Helper()
+	err := withMigrator(dsn, func(migrator *migrate.Migrator) error {
+		pending, err := migrator.Pending(context.Background())
+		if err != nil {
+			return err
+		}
+		if len(pending) != wantPending {
+			t.Errorf("pending migrations = %v, want %d", pending, wantPending)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Pending: %v", err)
+	}
+}
+
+// userTables returns tables of the test schema except the tracking one
+func userTables(t *testing.T, dsn string) []string {
+	t.Helper()
+	db := openDB(t, dsn)
+	defer db.Close()
+	rows, err := db.Query(`SELECT table_name FROM information_schema.tables
+		WHERE table_schema = current_schema() AND table_name <> 'schema_migrations';`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var table string
+		err = rows.Scan(&table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, table)
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return tables
+}
@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/rs/zerolog/log"
+)
+
+// ReplicaConfig configures reads from replicas, reads of a user go to the primary for
+// ReadYourWritesWindow after the user's writes, so replication lag isn't visible to them.
+// Replicas which lag behind the primary more than MaxLag aren't read, 0 MaxLag means
+// lag isn't checked. ReadYourWritesWindow should be longer than MaxLag and
+// CheckInterval together.
+//
+// Writes are remembered by the process which made them only. With several instances a
+// user's read which goes to another instance may miss the user's write, it's at most
+// MaxLag and CheckInterval stale.
+type ReplicaConfig struct {
+	URIs                 []string
+	CheckInterval        time.Duration
+	ReadYourWritesWindow time.Duration
+	MaxLag               time.Duration
+}
+
+type replica struct {
+	pool      *pgxpool.Pool
+	isHealthy atomic.Bool
+}
+
+type replicaSet struct {
+	replicas []*replica
+	next     atomic.Uint64
+	window   time.Duration
+	maxLag   time.Duration
+	done     chan struct{}
+
+	mu         sync.Mutex
+	lastWrites map[string]time.Time
+}
+
+func newReplicaSet(cfg ReplicaConfig, poolConfig PoolConfig) (*replicaSet, error) {
+	result := &replicaSet{
+		window:     cfg.ReadYourWritesWindow,
+		maxLag:     cfg.MaxLag,
+		done:       make(chan struct{}),
+		lastWrites: make(map[string]time.Time),
+	}
+	for _, uri := range cfg.URIs {
+		config, err := pgxpool.ParseConfig(uri)
+		if err != nil {
+			result.close()
+			return nil, err
+		}
+		applyPoolConfig(config, poolConfig)
+		// replica being down at start isn't fatal, reads go to the primary till it's back
+		config.LazyConnect = true
+		pool, err := pgxpool.ConnectConfig(context.Background(), config)
+		if err != nil {
+			result.close()
+			return nil, err
+		}
+		result.replicas = append(result.replicas, &replica{pool: pool})
+	}
+	checkInterval := cfg.CheckInterval
+	if checkInterval <= 0 {
+		checkInterval = 5 * time.Second
+	}
+	result.check(poolConfig.ConnectTimeout)
+	go result.runChecks(checkInterval, poolConfig.ConnectTimeout)
+	return result, nil
+}
+
+func (rs *replicaSet) runChecks(interval time.Duration, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rs.done:
+			return
+		case <-ticker.C:
+			rs.check(timeout)
+			rs.forgetOldWrites()
+		}
+	}
+}
+
+func (rs *replicaSet) check(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	for i, r := range rs.replicas {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := rs.checkReplica(ctx, r)
+		cancel()
+		isHealthy := err == nil
+		if r.isHealthy.Swap(isHealthy) != isHealthy {
+			if isHealthy {
+				log.Info().Int("replica", i).Msg("replica is up")
+			} else {
+				log.Warn().Err(err).Int("replica", i).Msg("replica is down")
+			}
+		}
+	}
+}
+
+// checkReplica checks that replica accepts queries and doesn't lag more than maxLag
+func (rs *replicaSet) checkReplica(ctx context.Context, r *replica) error {
+	if rs.maxLag <= 0 {
+		return r.pool.Ping(ctx)
+	}
+	// replay timestamp of an idle primary gets old, so a replica which replayed all
+	// received WAL doesn't lag
+	var lagSeconds float64
+	err := r.pool.QueryRow(ctx, `SELECT CASE
+			WHEN NOT pg_is_in_recovery() OR pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+			ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+		END::float8;`).Scan(&lagSeconds)
+	if err != nil {
+		return err
+	}
+	if lag := time.Duration(lagSeconds * float64(time.Second)); lag > rs.maxLag {
+		return fmt.Errorf("replication lag %v is over %v", lag.Round(time.Millisecond), rs.maxLag)
+	}
+	return nil
+}
+
+// pick returns next healthy replica, nil if login wrote recently or all replicas are down
+func (rs *replicaSet) pick(login string) *pgxpool.Pool {
+	if rs.wroteRecently(login) {
+		return nil
+	}
+	n := uint64(len(rs.replicas))
+	// every try moves the counter, so reads of a down replica are spread evenly over the rest
+	for i := uint64(0); i < n; i++ {
+		r := rs.replicas[rs.next.Add(1)%n]
+		if r.isHealthy.Load() {
+			return r.pool
+		}
+	}
+	return nil
+}
+
+func (rs *replicaSet) markWrite(logins ...string) {
+	now := time.Now()
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for _, login := range logins {
+		rs.lastWrites[login] = now
+	}
+}
+
+func (rs *replicaSet) wroteRecently(login string) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	lastWrite, ok := rs.lastWrites[login]
+	return ok && time.Since(lastWrite) < rs.window
+}
+
+func (rs *replicaSet) forgetOldWrites() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for login, lastWrite := range rs.lastWrites {
+		if time.Since(lastWrite) >= rs.window {
+			delete(rs.lastWrites, login)
+		}
+	}
+}
+
+func (rs *replicaSet) close() {
+	close(rs.done)
+	for _, r := range rs.replicas {
+		r.pool.Close()
+	}
+}
@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// newTestReplicaSet creates replicas which never connect, healthy sets their health
+func newTestReplicaSet(t *testing.T, window time.Duration, healthy ...bool) *replicaSet {
+	t.Helper()
+	rs := &replicaSet{window: window, done: make(chan struct{}), lastWrites: make(map[string]time.Time)}
+	for _, isHealthy := range healthy {
+		config, err := pgxpool.ParseConfig("postgres://gophermart@127.0.0.1:1/gophermart")
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.LazyConnect = true
+		pool, err := pgxpool.ConnectConfig(context.Background(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := &replica{pool: pool}
+		r.isHealthy.Store(isHealthy)
+		rs.replicas = append(rs.replicas, r)
+	}
+	t.Cleanup(rs.close)
+	return rs
+}
+
+// picks returns how many times every replica is picked in n reads, -1 stands for primary
+func picks(rs *replicaSet, login string, n int) map[int]int {
+	result := make(map[int]int)
+	for i := 0; i < n; i++ {
+		pool := rs.pick(login)
+		index := -1
+		for j, r := range rs.replicas {
+			if r.pool == pool {
+				index = j
+			}
+		}
+		result[index]++
+	}
+	return result
+}
+
+func TestPick(t *testing.T) {
+	tests := []struct {
+		name    string
+		healthy []bool
+		want    map[int]int
+	}{
+		{"no replicas", nil, map[int]int{-1: 6}},
+		{"round robin", []bool{true, true, true}, map[int]int{0: 2, 1: 2, 2: 2}},
+		{"down replica is skipped", []bool{true, false, true}, map[int]int{0: 3, 2: 3}},
+		{"all replicas are down", []bool{false, false}, map[int]int{-1: 6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := picks(newTestReplicaSet(t, time.Minute, tt.healthy...), "alice", 6)
+			if len(got) != len(tt.want) {
+				t.Fatalf("picks = %v, want %v", got, tt.want)
+			}
+			for index, n := range tt.want {
+				if got[index] != n {
+					t.Errorf("picks = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestReadYourWrites(t *testing.T) {
+	const window = 100 * time.Millisecond
+	rs := newTestReplicaSet(t, window, true)
+	rs.markWrite("alice", "bob")
+	for _, login := range []string{"alice", "bob"} {
+		if rs.pick(login) != nil {
+			t.Errorf("read of %s goes to replica right after the write", login)
+		}
+	}
+	if rs.pick("carol") == nil {
+		t.Errorf("read of user without writes goes to primary")
+	}
+
+	time.Sleep(window)
+	rs.markWrite("bob")
+	rs.forgetOldWrites()
+	if rs.pick("alice") == nil {
+		t.Errorf("read of alice goes to primary after the window")
+	}
+	if rs.pick("bob") != nil {
+		t.Errorf("read of bob goes to replica after the new write")
+	}
+	if _, ok := rs.lastWrites["alice"]; ok || len(rs.lastWrites) != 1 {
+		t.Errorf("writes after forgetting = %v", rs.lastWrites)
+	}
+}
@@ -3,30 +3,75 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"embed"
 	"errors"
-	"log"
-	"runtime"
-	"strings"
+	"io/fs"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/jackc/pgx/v4/stdlib"
+	"github.com/rs/zerolog/log"
 
+	"github.com/nivanov045/gofermart/cmd/gophermart/metrics"
+	"github.com/nivanov045/gofermart/internal/amount"
+	"github.com/nivanov045/gofermart/internal/audit"
+	"github.com/nivanov045/gofermart/internal/credit"
+	"github.com/nivanov045/gofermart/internal/jobrun"
+	"github.com/nivanov045/gofermart/internal/logger"
+	"github.com/nivanov045/gofermart/internal/migrate"
 	"github.com/nivanov045/gofermart/internal/order"
+	"github.com/nivanov045/gofermart/internal/tracing"
+	"github.com/nivanov045/gofermart/internal/userexport"
+	"github.com/nivanov045/gofermart/internal/webhook"
 	"github.com/nivanov045/gofermart/internal/withdraw"
 )
 
+const (
+	ErrCodeDuplicateKeyViolatesUniqueConstraint = "23505"
+)
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// PoolConfig limits connection pool, zero values keep pgxpool defaults
+type PoolConfig struct {
+	MaxConns        int32
+	MinConns        int32
+	MaxConnLifetime time.Duration
+	MaxConnIdleTime time.Duration
+	ConnectTimeout  time.Duration
+}
+
 type storage struct {
-	databasePath string
-	db           *sql.DB
-	tables       []table
+	pool         *pgxpool.Pool
+	replicas     *replicaSet
+	queryTimeout time.Duration
+}
+
+// querier is implemented by both pool and transaction
+type querier interface {
+	Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
 }
 
+type txKey struct{}
+
 /*
-Tables:
-- orders: order_num|user_login|created_at|status|accrual
-- withdraws: user_login|created_at|sum|order_num
-- users: user_login|password_hash
-- sessions: user_login|session_token|valid_until
+Tables (see migrations for the schema):
+- users: id|user_login|password_hash|created_at|referral_code|deleted_at
+- orders: order_num|user_id|created_at|status|accrual|processed_at
+- withdraws: id|user_id|created_at|sum|order_num|type
+- sessions: user_id|session_token|valid_until
+- credits: id|user_id|created_at|sum|reference|type
+- referrals: referrer_id|referred_id|created_at|bonus_paid
+- job_runs: id|job|started_at|finished_at|affected|error
+- reserved_logins: login_hash|reserved_until|is_hashed
+- audit_log: id|created_at|action|actor|subject
+- webhook_endpoints: id|user_id|url|secret|created_at
+- webhook_outbox: id|endpoint_id|event|payload|created_at|attempts|next_attempt_at|last_error|delivered_at|dead_at
 
 Can be added for better user experience:
 - user_login|refresh_token|valid_until
@@ -35,293 +80,528 @@ Can be added for speedup:
 - user_login|orders|withdraws|current_balance|withdraws_balance
 */
 
-type table struct {
-	name    string
-	columns []column
-}
-
-type column struct {
-	name       string
-	attributes string
-}
-
-func (c *column) toString() string {
-	return c.name + " " + c.attributes
-}
-
-func New(databasePath string) (*storage, error) {
-	log.Println("storage::New::info: started")
-	var resultStorage = &storage{
-		databasePath: databasePath,
-		tables: []table{
-			{
-				name: "orders",
-				columns: []column{
-					{"order_num", "TEXT UNIQUE"},
-					{"user_login", "TEXT"},
-					{"created_at", "TIMESTAMP"},
-					{"status", "TEXT"},
-					{"accrual", "BIGINT"},
-				},
-			},
-			{
-				name: "withdraws",
-				columns: []column{
-					{"user_login", "TEXT"},
-					{"order_num", "TEXT"},
-					{"created_at", "TIMESTAMP"},
-					{"sum", "BIGINT"},
-				},
-			},
-			{
-				name: "users",
-				columns: []column{
-					{"user_login", "TEXT UNIQUE"},
-					{"password_hash", "TEXT"},
-				},
-			},
-			{
-				name: "sessions",
-				columns: []column{
-					{"user_login", "TEXT UNIQUE"},
-					{"session_token", "TEXT"},
-					{"valid_until", "TIMESTAMP"},
-				},
-			},
-		},
-	}
-
-	var err error
-	resultStorage.db, err = sql.Open("postgres", databasePath)
+// New connects to the database and applies migrations, every query is limited by
+// queryTimeout besides deadline of its context. Replicas are optional.
+func New(databasePath string, poolConfig PoolConfig, queryTimeout time.Duration,
+	replicaConfig ReplicaConfig) (*storage, error) {
+	log.Info().Msg("storage creation started")
+	config, err := pgxpool.ParseConfig(databasePath)
 	if err != nil {
-		log.Println("storage::New::error: in db open:", err)
+		log.Error().Err(err).Msg("in database config parsing")
 		return nil, errors.New(`can't create database'`)
 	}
-	runtime.SetFinalizer(resultStorage, func(s *storage) {
-		log.Println("storage::New::info: finalizer started")
-		defer s.db.Close()
-	})
+	applyPoolConfig(config, poolConfig)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
-	for _, table := range resultStorage.tables {
-		var isTableExists bool
-		row := resultStorage.db.QueryRowContext(ctx,
-			`SELECT EXISTS (
-			SELECT FROM information_schema.tables 
-			WHERE  table_name = $1);`, table.name)
-		err = row.Scan(&isTableExists)
+	err = runMigrations(ctx, config.ConnConfig)
+	if err != nil {
+		log.Error().Err(err).Msg("in migrations")
+		return nil, errors.New(`can't create database'`)
+	}
+	pool, err := pgxpool.ConnectConfig(ctx, config)
+	if err != nil {
+		log.Error().Err(err).Msg("in pool creation")
+		return nil, errors.New(`can't create database'`)
+	}
+	resultStorage := &storage{pool: pool, queryTimeout: queryTimeout}
+	if len(replicaConfig.URIs) > 0 {
+		resultStorage.replicas, err = newReplicaSet(replicaConfig, poolConfig)
 		if err != nil {
-			log.Println("storage::New::error: in table check:", err)
+			log.Error().Err(err).Msg("in replicas creation")
+			pool.Close()
 			return nil, errors.New(`can't create database'`)
 		}
-		if !isTableExists {
-			_, err = resultStorage.db.Exec(constructMakeTableQuery(table))
-			if err != nil {
-				log.Println("storage::New::error: in table creation:", err)
-				return nil, errors.New(`can't create database'`)
-			}
-		} else {
-			tableIsOk := true
-			for _, c := range table.columns {
-				var isColumnInTable bool
-				row := resultStorage.db.QueryRowContext(ctx,
-					`SELECT EXISTS (
-    				SELECT column_name FROM information_schema.columns
-    				WHERE table_name=$1 and column_name=$2);`, table.name, c.name)
-				err = row.Scan(&isColumnInTable)
-				if err != nil {
-					log.Println("storage::New::error: in columns check:", err)
-					return nil, errors.New(`can't create database'`)
-				}
-				if !isColumnInTable {
-					tableIsOk = false
-					break
-				}
-			}
-
-			if !tableIsOk {
-				log.Println("storage::New::info: table is wrong, clone, drop and create new")
-				_, err = resultStorage.db.Exec(`CREATE TABLE dupe_$1_$2 AS (SELECT * FROM $1);`, table.name,
-					time.Now().String())
-				if err != nil {
-					log.Println("storage::New::error: in table duplication:", err)
-					return nil, errors.New(`can't create database'`)
-				}
-				_, err = resultStorage.db.Exec(`DROP TABLE $1;`, table.name)
-				if err != nil {
-					log.Println("storage::New::error: in table drop:", err)
-					return nil, errors.New(`can't create database'`)
-				}
-				_, err = resultStorage.db.Exec(constructMakeTableQuery(table))
-				if err != nil {
-					log.Println("storage::New::error: in table creation:", err)
-					return nil, errors.New(`can't create database'`)
-				}
-			} else {
-				log.Println("storage::New::info: existing table", table.name, "is OK")
-			}
-		}
 	}
 	return resultStorage, nil
 }
 
-func constructMakeTableQuery(t table) string {
-	var query strings.Builder
-	query.WriteString(`CREATE TABLE ` + t.name)
-	if len(t.columns) == 0 {
-		query.WriteString(`;`)
-		return query.String()
+func applyPoolConfig(config *pgxpool.Config, poolConfig PoolConfig) {
+	if poolConfig.MaxConns > 0 {
+		config.MaxConns = poolConfig.MaxConns
+	}
+	if poolConfig.MinConns > 0 {
+		config.MinConns = poolConfig.MinConns
+	}
+	if poolConfig.MaxConnLifetime > 0 {
+		config.MaxConnLifetime = poolConfig.MaxConnLifetime
 	}
-	query.WriteString(` (` + t.columns[0].toString())
-	for i := 1; i < len(t.columns); i++ {
-		query.WriteString(`, ` + t.columns[i].toString())
+	if poolConfig.MaxConnIdleTime > 0 {
+		config.MaxConnIdleTime = poolConfig.MaxConnIdleTime
+	}
+	if poolConfig.ConnectTimeout > 0 {
+		config.ConnConfig.ConnectTimeout = poolConfig.ConnectTimeout
 	}
-	query.WriteString(`);`)
-	return query.String()
 }
 
-func (s *storage) FindOrderByUser(login string, number string) (bool, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// runMigrations applies migrations through a separate database/sql connection, which
+// is closed afterwards
+func runMigrations(ctx context.Context, connConfig *pgx.ConnConfig) error {
+	db := stdlib.OpenDB(*connConfig)
+	defer db.Close()
+	migrator, err := newMigrator(db)
+	if err != nil {
+		return err
+	}
+	return migrator.Up(ctx)
+}
+
+// MigrateUp applies pending migrations to database at dsn
+func MigrateUp(ctx context.Context, dsn string) error {
+	return withMigrator(dsn, func(migrator *migrate.Migrator) error {
+		return migrator.Up(ctx)
+	})
+}
+
+// MigrateDown rolls back steps last applied migrations of database at dsn
+func MigrateDown(ctx context.Context, dsn string, steps int) error {
+	return withMigrator(dsn, func(migrator *migrate.Migrator) error {
+		return migrator.Down(ctx, steps)
+	})
+}
+
+func withMigrator(dsn string, f func(migrator *migrate.Migrator) error) error {
+	connConfig, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		return err
+	}
+	db := stdlib.OpenDB(*connConfig)
+	defer db.Close()
+	migrator, err := newMigrator(db)
+	if err != nil {
+		return err
+	}
+	return f(migrator)
+}
+
+func newMigrator(db *sql.DB) (*migrate.Migrator, error) {
+	migrationsDir, err := fs.Sub(migrations, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return migrate.New(db, migrationsDir, "schema_migrations")
+}
+
+// observe starts span of storage method, returned func ends it and records its duration
+func observe(ctx context.Context, method string) (context.Context, func()) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "storage."+method)
+	return ctx, func() {
+		span.End()
+		metrics.ObserveQuery(method, start)
+	}
+}
+
+func (s *storage) Close() {
+	if s.replicas != nil {
+		s.replicas.close()
+	}
+	s.pool.Close()
+}
+
+// Ping checks that primary database accepts queries
+func (s *storage) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	return s.pool.Ping(ctx)
+}
+
+// PendingMigrations returns versions of migrations which are not applied, e.g. because
+// the database was rolled back after start
+func (s *storage) PendingMigrations(ctx context.Context) ([]int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	db := stdlib.OpenDB(*s.pool.Config().ConnConfig)
+	defer db.Close()
+	migrator, err := newMigrator(db)
+	if err != nil {
+		return nil, err
+	}
+	return migrator.Pending(ctx)
+}
+
+// WithTx runs fn in a transaction, storage methods called with ctx passed to fn take
+// part in it. The transaction is committed if fn returns nil and rolled back otherwise.
+// Nested calls run in a savepoint, so their failure doesn't abort the outer transaction.
+func (s *storage) WithTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	var tx pgx.Tx
+	var err error
+	if outer, ok := ctx.Value(txKey{}).(pgx.Tx); ok {
+		tx, err = outer.Begin(ctx)
+	} else {
+		tx, err = s.pool.Begin(ctx)
+	}
+	if err != nil {
+		logger.Ctx(ctx).Error().Err(err).Msg("in Begin")
+		return err
+	}
+	defer tx.Rollback(ctx)
+	err = fn(context.WithValue(ctx, txKey{}, tx))
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// conn returns transaction started by WithTx if there is one in ctx
+func (s *storage) conn(ctx context.Context) querier {
+	if tx, ok := ctx.Value(txKey{}).(pgx.Tx); ok {
+		return tx
+	}
+	return s.pool
+}
+
+// reader returns connection for read-only queries of login's data, it's a healthy
+// replica unless there is a transaction or login wrote recently
+func (s *storage) reader(ctx context.Context, login string) querier {
+	if _, ok := ctx.Value(txKey{}).(pgx.Tx); ok || s.replicas == nil {
+		return s.conn(ctx)
+	}
+	if replica := s.replicas.pick(login); replica != nil {
+		return replica
+	}
+	return s.pool
+}
+
+// markWrite sends reads of logins to the primary for read-your-writes window
+func (s *storage) markWrite(logins ...string) {
+	if s.replicas != nil {
+		s.replicas.markWrite(logins...)
+	}
+}
+
+func (s *storage) FindOrderByUser(ctx context.Context, login string, number string) (bool, error) {
+	ctx, end := observe(ctx, "FindOrderByUser")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
 	defer cancel()
 	var isExists bool
-	row := s.db.QueryRowContext(ctx,
+	row := s.conn(ctx).QueryRow(ctx,
 		`SELECT EXISTS (
-    	SELECT FROM orders WHERE order_num=$1 AND user_login=$2);`, number, login)
+    	SELECT FROM orders o JOIN users u ON u.id=o.user_id WHERE o.order_num=$1 AND u.user_login=$2);`,
+		number, login)
 	err := row.Scan(&isExists)
 	if err != nil {
-		log.Println("storage::FindOrderByUser::info: in QueryRowContext:", err)
+		logger.Ctx(ctx).Info().Err(err).Msg("in QueryRow")
 		return false, err
 	}
 	return isExists, nil
 }
 
-func (s *storage) FindOrder(number string) (bool, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (s *storage) FindOrder(ctx context.Context, number string) (bool, error) {
+	ctx, end := observe(ctx, "FindOrder")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
 	defer cancel()
 	var isExists bool
-	row := s.db.QueryRowContext(ctx,
+	row := s.conn(ctx).QueryRow(ctx,
 		`SELECT EXISTS (
     	SELECT FROM orders WHERE order_num=$1);`, number)
 	err := row.Scan(&isExists)
 	if err != nil {
-		log.Println("storage::FindOrder::info: in QueryRowContext:", err)
+		logger.Ctx(ctx).Info().Err(err).Msg("in QueryRow")
 		return false, err
 	}
 	return isExists, nil
 }
 
-func (s *storage) AddOrder(login string, number string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (s *storage) AddOrder(ctx context.Context, login string, number string) error {
+	ctx, end := observe(ctx, "AddOrder")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
 	defer cancel()
-	log.Println("storage::AddOrder::info:", login, number)
-	_, err := s.db.ExecContext(ctx,
-		`INSERT INTO orders(order_num, user_login, created_at, status)
-		VALUES ($1, $2, $3, $4);`, number, login, time.Now(), order.ProcessingTypeNew)
-	return err
+	s.markWrite(login)
+	logger.Ctx(ctx).Info().Msg("adding order")
+	res, err := s.conn(ctx).Exec(ctx,
+		`INSERT INTO orders(order_num, user_id, created_at, status)
+		SELECT $1, id, $3, $4 FROM users WHERE user_login=$2;`, number, login, time.Now(), order.ProcessingTypeNew)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == ErrCodeDuplicateKeyViolatesUniqueConstraint {
+			return errors.New("order already exists")
+		}
+		return err
+	}
+	return checkUserFound(res)
 }
 
-func (s *storage) GetOrders(login string) ([]order.Order, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (s *storage) GetOrders(ctx context.Context, login string) ([]order.Order, error) {
+	ctx, end := observe(ctx, "GetOrders")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
 	defer cancel()
 	var resultOrders []order.Order
 
-	rows, err := s.db.QueryContext(ctx,
-		`SELECT order_num, created_at, status, accrual FROM orders WHERE user_login=$1;`, login)
+	rows, err := s.reader(ctx, login).Query(ctx,
+		`SELECT o.order_num, o.created_at, o.status, o.accrual, o.processed_at FROM orders o
+		JOIN users u ON u.id=o.user_id WHERE u.user_login=$1 ORDER BY o.created_at;`, login)
 	if err != nil {
-		log.Println("storage::GetOrders::info: in QueryContext:", err)
-		return resultOrders, err
-	}
-	if rows.Err() != nil {
-		log.Println("storage::GetOrders::error: in rows:", err)
+		logger.Ctx(ctx).Info().Err(err).Msg("in Query")
 		return resultOrders, err
 	}
+	defer rows.Close()
 	for rows.Next() {
-		var orderNum, status string
-		var creationTime time.Time
-		var accrual sql.NullInt64
-		err := rows.Scan(&orderNum, &creationTime, &status, &accrual)
+		var val order.Order
+		var processedAt *time.Time
+		err := rows.Scan(&val.Number, &val.UploadedAt, &val.Status, &val.Accrual, &processedAt)
 		if err != nil {
-			log.Println("storage::GetOrders::info: in Scan:", err)
+			logger.Ctx(ctx).Info().Err(err).Msg("in Scan")
 			continue
 		}
-		log.Println("storage::GetOrders::info:", orderNum, status, creationTime, accrual)
-		val := order.Order{
-			Number:     orderNum,
-			Status:     status,
-			UploadedAt: creationTime,
-		}
-		if status == order.ProcessingTypeProcessed {
-			val.Accrual = accrual.Int64
+		if processedAt != nil {
+			val.ProcessedAt = *processedAt
 		}
+		logger.Ctx(ctx).Debug().Str(logger.FieldOrder, val.Number).Str("status", val.Status).Msg("order is read")
 		resultOrders = append(resultOrders, val)
 	}
-	return resultOrders, nil
+	return resultOrders, rows.Err()
 }
 
-func (s *storage) UpdateOrder(orderData order.Order) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// UpdateOrder sets status and accrual of the order, processing time is kept from the
+// first update to ProcessingTypeProcessed
+func (s *storage) UpdateOrder(ctx context.Context, orderData order.Order) error {
+	ctx, end := observe(ctx, "UpdateOrder")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
 	defer cancel()
-	_, err := s.db.ExecContext(ctx,
-		`UPDATE orders SET status = $1, accrual = $2 WHERE order_num = $3;`, orderData.Status, orderData.Accrual,
-		orderData.Number)
+	_, err := s.conn(ctx).Exec(ctx,
+		`UPDATE orders SET status = $1, accrual = $2,
+		processed_at = CASE WHEN $1 = $4 THEN COALESCE(processed_at, $5) END WHERE order_num = $3;`,
+		orderData.Status, orderData.Accrual, orderData.Number, order.ProcessingTypeProcessed, time.Now())
 	return err
 }
 
-func (s *storage) MakeWithdraw(login string, order string, sum int64) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (s *storage) GetOrderOwner(ctx context.Context, number string) (string, error) {
+	ctx, end := observe(ctx, "GetOrderOwner")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	var login string
+	row := s.conn(ctx).QueryRow(ctx,
+		`SELECT u.user_login FROM orders o JOIN users u ON u.id=o.user_id WHERE o.order_num=$1;`, number)
+	err := row.Scan(&login)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", errors.New("no such order")
+		}
+		return "", err
+	}
+	return login, nil
+}
+
+// CountOrdersByStatus counts orders of all users, statuses without orders are omitted
+func (s *storage) CountOrdersByStatus(ctx context.Context) (map[string]int, error) {
+	ctx, end := observe(ctx, "CountOrdersByStatus")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	rows, err := s.conn(ctx).Query(ctx, `SELECT status, count(*) FROM orders GROUP BY status;`)
+	if err != nil {
+		logger.Ctx(ctx).Info().Err(err).Msg("in Query")
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string]int)
+	for rows.Next() {
+		var status string
+		var count int
+		err := rows.Scan(&status, &count)
+		if err != nil {
+			return nil, err
+		}
+		result[status] = count
+	}
+	return result, rows.Err()
+}
+
+// GetPendingOrders returns numbers of orders of all users without final status, oldest
+// first
+func (s *storage) GetPendingOrders(ctx context.Context) ([]string, error) {
+	ctx, end := observe(ctx, "GetPendingOrders")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	rows, err := s.conn(ctx).Query(ctx, `SELECT order_num FROM orders WHERE status IN ($1, $2) ORDER BY created_at;`,
+		order.ProcessingTypeNew, order.ProcessingTypeProcessing)
+	if err != nil {
+		logger.Ctx(ctx).Info().Err(err).Msg("in Query")
+		return nil, err
+	}
+	defer rows.Close()
+	var result []string
+	for rows.Next() {
+		var number string
+		err := rows.Scan(&number)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, number)
+	}
+	return result, rows.Err()
+}
+
+func (s *storage) MakeWithdraw(ctx context.Context, login string, order string, sum amount.Amount) error {
+	ctx, end := observe(ctx, "MakeWithdraw")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
 	defer cancel()
-	_, err := s.db.ExecContext(ctx,
-		`INSERT INTO withdraws(user_login, created_at, sum, order_num)
-		VALUES ($1, $2, $3, $4);`, login, time.Now(), sum, order)
+	s.markWrite(login)
+	res, err := s.conn(ctx).Exec(ctx,
+		`INSERT INTO withdraws(user_id, created_at, sum, order_num, type)
+		SELECT id, $2, $3, $4, $5 FROM users WHERE user_login=$1;`, login, time.Now(), sum, order, withdraw.TypeWithdrawal)
 	if err != nil {
-		log.Println("storage::MakeWithdraw::error: in ExecContext:", err)
+		logger.Ctx(ctx).Error().Err(err).Msg("in Exec")
 		return err
 	}
-	return nil
+	return checkUserFound(res)
 }
 
-func (s *storage) GetWithdraws(login string) ([]withdraw.Withdraw, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (s *storage) GetWithdraws(ctx context.Context, login string) ([]withdraw.Withdraw, error) {
+	ctx, end := observe(ctx, "GetWithdraws")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
 	defer cancel()
 	var resultWithdraws []withdraw.Withdraw
 
-	rows, err := s.db.QueryContext(ctx,
-		`SELECT created_at, sum, order_num FROM withdraws WHERE user_login=$1;`, login)
+	rows, err := s.reader(ctx, login).Query(ctx,
+		`SELECT w.created_at, w.sum, w.order_num, w.type FROM withdraws w JOIN users u ON u.id=w.user_id
+		WHERE u.user_login=$1 ORDER BY w.created_at;`, login)
 	if err != nil {
-		log.Println("storage::GetWithdraws::info: in QueryContext:", err)
-		return resultWithdraws, err
-	}
-	if rows.Err() != nil {
-		log.Println("storage::GetWithdraws::error: in rows:", err)
+		logger.Ctx(ctx).Info().Err(err).Msg("in Query")
 		return resultWithdraws, err
 	}
+	defer rows.Close()
 	for rows.Next() {
-		var orderNum string
+		var orderNum, withdrawType string
 		var creationTime time.Time
-		var sum int64
-		err := rows.Scan(&creationTime, &sum, &orderNum)
+		var sum amount.Amount
+		err := rows.Scan(&creationTime, &sum, &orderNum, &withdrawType)
 		if err != nil {
-			log.Println("storage::GetWithdraws::info: in Scan:", err)
+			logger.Ctx(ctx).Info().Err(err).Msg("in Scan")
 			continue
 		}
 		resultWithdraws = append(resultWithdraws, withdraw.Withdraw{
 			Order:       orderNum,
 			Sum:         sum,
 			ProcessedAt: creationTime,
+			Type:        withdrawType,
 		})
 	}
-	return resultWithdraws, nil
+	return resultWithdraws, rows.Err()
 }
 
-func (s *storage) AddUser(login string, passwordHash string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (s *storage) GetCredits(ctx context.Context, login string) ([]credit.Credit, error) {
+	ctx, end := observe(ctx, "GetCredits")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
 	defer cancel()
-	_, err := s.db.ExecContext(ctx,
-		`INSERT INTO users(user_login, password_hash)
-		VALUES ($1, $2);`, login, passwordHash)
+	var resultCredits []credit.Credit
+
+	rows, err := s.reader(ctx, login).Query(ctx,
+		`SELECT c.reference, c.type, c.sum, c.created_at FROM credits c JOIN users u ON u.id=c.user_id
+		WHERE u.user_login=$1 ORDER BY c.created_at;`, login)
 	if err != nil {
-		if err.Error() == "pq: duplicate key value violates unique constraint \"users_user_login_key\"" {
+		logger.Ctx(ctx).Info().Err(err).Msg("in Query")
+		return resultCredits, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var val credit.Credit
+		err := rows.Scan(&val.Reference, &val.Type, &val.Sum, &val.CreatedAt)
+		if err != nil {
+			logger.Ctx(ctx).Info().Err(err).Msg("in Scan")
+			continue
+		}
+		resultCredits = append(resultCredits, val)
+	}
+	return resultCredits, rows.Err()
+}
+
+// MakeTransfer debits sender and credits recipient in one transaction. Sender's row
+// in users is locked, so balance and dailyLimit (0 means unlimited) checks can't race
+// with other transfers of the same user.
+func (s *storage) MakeTransfer(ctx context.Context, from string, to string, reference string, sum amount.Amount,
+	dailyLimit amount.Amount) error {
+	ctx, end := observe(ctx, "MakeTransfer")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	s.markWrite(from, to)
+	return s.WithTx(ctx, func(ctx context.Context) error {
+		fromID, err := s.lockUser(ctx, from)
+		if err != nil {
+			logger.Ctx(ctx).Error().Err(err).Msg("in lock")
+			return err
+		}
+		var toID int64
+		err = s.conn(ctx).QueryRow(ctx, `SELECT id FROM users WHERE user_login=$1;`, to).Scan(&toID)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return errors.New("no such user")
+			}
+			return err
+		}
+		// SUM of BIGINT is NUMERIC, it's cast back to scan it as amount
+		var balance amount.Amount
+		row := s.conn(ctx).QueryRow(ctx,
+			`SELECT (
+			COALESCE((SELECT SUM(accrual) FROM orders WHERE user_id=$1 AND status=$2), 0) +
+			COALESCE((SELECT SUM(sum) FROM credits WHERE user_id=$1), 0) -
+			COALESCE((SELECT SUM(sum) FROM withdraws WHERE user_id=$1), 0))::bigint;`, fromID, order.ProcessingTypeProcessed)
+		err = row.Scan(&balance)
+		if err != nil {
+			logger.Ctx(ctx).Error().Err(err).Msg("in balance calculation")
+			return err
+		}
+		if balance < sum {
+			return errors.New("not enough balance")
+		}
+		if dailyLimit > 0 {
+			var transferred amount.Amount
+			row := s.conn(ctx).QueryRow(ctx,
+				`SELECT COALESCE(SUM(sum), 0)::bigint FROM withdraws WHERE user_id=$1 AND type=$2 AND created_at>$3;`,
+				fromID, withdraw.TypeTransfer, time.Now().Add(-24*time.Hour))
+			err = row.Scan(&transferred)
+			if err != nil {
+				logger.Ctx(ctx).Error().Err(err).Msg("in daily sum calculation")
+				return err
+			}
+			if transferred+sum > dailyLimit {
+				return errors.New("daily transfer limit exceeded")
+			}
+		}
+
+		now := time.Now()
+		_, err = s.conn(ctx).Exec(ctx,
+			`INSERT INTO withdraws(user_id, created_at, sum, order_num, type)
+			VALUES ($1, $2, $3, $4, $5);`, fromID, now, sum, reference, withdraw.TypeTransfer)
+		if err != nil {
+			logger.Ctx(ctx).Error().Err(err).Msg("in debit")
+			return err
+		}
+		_, err = s.conn(ctx).Exec(ctx,
+			`INSERT INTO credits(user_id, created_at, sum, reference, type)
+			VALUES ($1, $2, $3, $4, $5);`, toID, now, sum, reference, credit.TypeTransfer)
+		if err != nil {
+			logger.Ctx(ctx).Error().Err(err).Msg("in credit")
+		}
+		return err
+	})
+}
+
+func (s *storage) AddUser(ctx context.Context, login string, passwordHash string, referralCode string) error {
+	ctx, end := observe(ctx, "AddUser")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	s.markWrite(login)
+	_, err := s.conn(ctx).Exec(ctx,
+		`INSERT INTO users(user_login, password_hash, created_at, referral_code) VALUES ($1, $2, $3, $4);`,
+		login, passwordHash, time.Now(), referralCode)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == ErrCodeDuplicateKeyViolatesUniqueConstraint &&
+			pgErr.ConstraintName == "users_user_login_key" {
 			return errors.New("login is already in use")
 		}
 		return err
@@ -329,25 +609,184 @@ func (s *storage) AddUser(login string, passwordHash string) error {
 	return nil
 }
 
-func (s *storage) AddSession(login string, sessionToken string, expiresAt time.Time) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (s *storage) FindUserByReferralCode(ctx context.Context, referralCode string) (string, error) {
+	ctx, end := observe(ctx, "FindUserByReferralCode")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
 	defer cancel()
-	_, err := s.db.ExecContext(ctx,
-		`INSERT INTO sessions(user_login, session_token, valid_until) VALUES ($1, $2, $3)
-		ON CONFLICT (user_login) DO UPDATE SET session_token=$2, valid_until=$3;`, login, sessionToken, expiresAt)
-	return err
+	var login string
+	row := s.conn(ctx).QueryRow(ctx,
+		`SELECT user_login FROM users WHERE referral_code=$1;`, referralCode)
+	err := row.Scan(&login)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", errors.New("no such referral code")
+		}
+		return "", err
+	}
+	return login, nil
+}
+
+func (s *storage) GetReferralCode(ctx context.Context, login string) (string, error) {
+	ctx, end := observe(ctx, "GetReferralCode")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	var referralCode string
+	row := s.reader(ctx, login).QueryRow(ctx,
+		`SELECT referral_code FROM users WHERE user_login=$1;`, login)
+	err := row.Scan(&referralCode)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", errors.New("no such user")
+		}
+		return "", err
+	}
+	return referralCode, nil
 }
 
-func (s *storage) GetSessionInfo(sessionToken string) (string, time.Time, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (s *storage) CountReferrals(ctx context.Context, login string) (int, error) {
+	ctx, end := observe(ctx, "CountReferrals")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	var count int
+	row := s.reader(ctx, login).QueryRow(ctx,
+		`SELECT COUNT(*) FROM referrals r JOIN users u ON u.id=r.referrer_id WHERE u.user_login=$1;`, login)
+	err := row.Scan(&count)
+	return count, err
+}
+
+// AddReferral links referred user to referrer unless referrer already has maxReferrals
+func (s *storage) AddReferral(ctx context.Context, referrer string, referred string, maxReferrals int) error {
+	ctx, end := observe(ctx, "AddReferral")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	s.markWrite(referrer, referred)
+	return s.WithTx(ctx, func(ctx context.Context) error {
+		referrerID, err := s.lockUser(ctx, referrer)
+		if err != nil {
+			logger.Ctx(ctx).Error().Err(err).Msg("in lock")
+			return err
+		}
+		var count int
+		row := s.conn(ctx).QueryRow(ctx,
+			`SELECT COUNT(*) FROM referrals WHERE referrer_id=$1;`, referrerID)
+		err = row.Scan(&count)
+		if err != nil {
+			logger.Ctx(ctx).Error().Err(err).Msg("in count")
+			return err
+		}
+		if count >= maxReferrals {
+			return errors.New("referral limit reached")
+		}
+		_, err = s.conn(ctx).Exec(ctx,
+			`INSERT INTO referrals(referrer_id, referred_id, created_at)
+			SELECT $1, id, $3 FROM users WHERE user_login=$2;`, referrerID, referred, time.Now())
+		if err != nil {
+			logger.Ctx(ctx).Error().Err(err).Msg("in insert")
+		}
+		return err
+	})
+}
+
+const (
+	referrerParty = "referrer"
+	referredParty = "referred"
+)
+
+// referralReference is the reference of party's credit of referral bonus, it's unique as
+// a user is referred only once
+func referralReference(referred string, party string) string {
+	return "referral:" + referred + ":" + party
+}
+
+// PayReferralBonus credits both sides of unpaid referral of referred user, returns false
+// if there is no such referral or the bonus was already paid
+func (s *storage) PayReferralBonus(ctx context.Context, referred string, referrerBonus amount.Amount,
+	referredBonus amount.Amount) (bool, error) {
+	ctx, end := observe(ctx, "PayReferralBonus")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	s.markWrite(referred)
+	isPaid := false
+	err := s.WithTx(ctx, func(ctx context.Context) error {
+		var referrerID, referredID int64
+		row := s.conn(ctx).QueryRow(ctx,
+			`UPDATE referrals r SET bonus_paid=TRUE FROM users u
+			WHERE u.id=r.referred_id AND u.user_login=$1 AND NOT r.bonus_paid
+			RETURNING r.referrer_id, r.referred_id;`, referred)
+		err := row.Scan(&referrerID, &referredID)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return nil
+			}
+			logger.Ctx(ctx).Error().Err(err).Msg("in update")
+			return err
+		}
+		now := time.Now()
+		_, err = s.conn(ctx).Exec(ctx,
+			`INSERT INTO credits(user_id, created_at, sum, reference, type)
+			VALUES ($1, $2, $3, $4, $5), ($6, $2, $7, $8, $5);`,
+			referrerID, now, referrerBonus, referralReference(referred, referrerParty), credit.TypeReferralBonus,
+			referredID, referredBonus, referralReference(referred, referredParty))
+		if err != nil {
+			logger.Ctx(ctx).Error().Err(err).Msg("in credit")
+			return err
+		}
+		isPaid = true
+		return nil
+	})
+	return isPaid, err
+}
+
+func (s *storage) GetUserRegistrationTime(ctx context.Context, login string) (time.Time, error) {
+	ctx, end := observe(ctx, "GetUserRegistrationTime")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	var createdAt time.Time
+	row := s.conn(ctx).QueryRow(ctx,
+		`SELECT created_at FROM users WHERE user_login=$1;`, login)
+	err := row.Scan(&createdAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return time.Time{}, errors.New("no such user")
+		}
+		return time.Time{}, err
+	}
+	return createdAt, nil
+}
+
+func (s *storage) AddSession(ctx context.Context, login string, sessionToken string, expiresAt time.Time) error {
+	ctx, end := observe(ctx, "AddSession")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	res, err := s.conn(ctx).Exec(ctx,
+		`INSERT INTO sessions(user_id, session_token, valid_until) SELECT id, $2, $3 FROM users WHERE user_login=$1
+		ON CONFLICT (user_id) DO UPDATE SET session_token=$2, valid_until=$3;`, login, sessionToken, expiresAt)
+	if err != nil {
+		return err
+	}
+	return checkUserFound(res)
+}
+
+func (s *storage) GetSessionInfo(ctx context.Context, sessionToken string) (string, time.Time, error) {
+	ctx, end := observe(ctx, "GetSessionInfo")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
 	defer cancel()
 	var login string
 	var expTime time.Time
-	row := s.db.QueryRowContext(ctx,
-		`SELECT user_login, valid_until FROM sessions WHERE session_token=$1;`, sessionToken)
+	row := s.conn(ctx).QueryRow(ctx,
+		`SELECT u.user_login, s.valid_until FROM sessions s JOIN users u ON u.id=s.user_id
+		WHERE s.session_token=$1;`, sessionToken)
 	err := row.Scan(&login, &expTime)
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if errors.Is(err, pgx.ErrNoRows) {
 			return "", time.Time{}, errors.New("no such token")
 		}
 		return "", time.Time{}, err
@@ -355,11 +794,13 @@ func (s *storage) GetSessionInfo(sessionToken string) (string, time.Time, error)
 	return login, expTime, nil
 }
 
-func (s *storage) CheckPassword(login string, passwordHash string) (bool, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (s *storage) CheckPassword(ctx context.Context, login string, passwordHash string) (bool, error) {
+	ctx, end := observe(ctx, "CheckPassword")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
 	defer cancel()
 	var isPasswordHashCorrect bool
-	row := s.db.QueryRowContext(ctx,
+	row := s.conn(ctx).QueryRow(ctx,
 		`SELECT EXISTS (
     	SELECT FROM users WHERE user_login=$1 AND password_hash=$2);`, login, passwordHash)
 	err := row.Scan(&isPasswordHashCorrect)
@@ -369,10 +810,761 @@ func (s *storage) CheckPassword(login string, passwordHash string) (bool, error)
 	return isPasswordHashCorrect, nil
 }
 
-func (s *storage) RemoveSession(sessionToken string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (s *storage) RemoveSession(ctx context.Context, sessionToken string) error {
+	ctx, end := observe(ctx, "RemoveSession")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
 	defer cancel()
-	_, err := s.db.ExecContext(ctx,
+	_, err := s.conn(ctx).Exec(ctx,
 		`DELETE FROM sessions WHERE session_token = $1;`, sessionToken)
 	return err
 }
+
+// RemoveExpiredSessions removes sessions which are valid until before
+func (s *storage) RemoveExpiredSessions(ctx context.Context, before time.Time) (int64, error) {
+	ctx, end := observe(ctx, "RemoveExpiredSessions")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	tag, err := s.conn(ctx).Exec(ctx, `DELETE FROM sessions WHERE valid_until < $1;`, before)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// TryLockJob takes advisory lock on a dedicated connection, the lock is released with
+// the connection if unlock fails
+func (s *storage) TryLockJob(ctx context.Context, job string) (func(), bool, error) {
+	ctx, end := observe(ctx, "TryLockJob")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	var ok bool
+	err = conn.QueryRow(ctx, `SELECT pg_try_advisory_lock(hashtext($1));`, "job:"+job).Scan(&ok)
+	if err != nil || !ok {
+		conn.Release()
+		return nil, false, err
+	}
+	unlock := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout)
+		defer cancel()
+		_, err := conn.Exec(ctx, `SELECT pg_advisory_unlock(hashtext($1));`, "job:"+job)
+		if err != nil {
+			logger.Ctx(ctx).Error().Err(err).Msg("in unlock")
+			conn.Conn().Close(ctx)
+		}
+		conn.Release()
+	}
+	return unlock, true, nil
+}
+
+// LastJobRun returns zero time if the job was never run
+func (s *storage) LastJobRun(ctx context.Context, job string) (time.Time, error) {
+	ctx, end := observe(ctx, "LastJobRun")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	var startedAt *time.Time
+	err := s.conn(ctx).QueryRow(ctx, `SELECT MAX(started_at) FROM job_runs WHERE job=$1;`, job).Scan(&startedAt)
+	if err != nil || startedAt == nil {
+		return time.Time{}, err
+	}
+	return *startedAt, nil
+}
+
+func (s *storage) AddJobRun(ctx context.Context, run jobrun.JobRun) error {
+	ctx, end := observe(ctx, "AddJobRun")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	_, err := s.conn(ctx).Exec(ctx,
+		`INSERT INTO job_runs(job, started_at, finished_at, affected, error) VALUES ($1, $2, $3, $4, $5);`,
+		run.Job, run.StartedAt, run.FinishedAt, run.Affected, run.Error)
+	return err
+}
+
+// RemoveJobRuns removes history of runs started before before
+func (s *storage) RemoveJobRuns(ctx context.Context, before time.Time) (int64, error) {
+	ctx, end := observe(ctx, "RemoveJobRuns")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	tag, err := s.conn(ctx).Exec(ctx, `DELETE FROM job_runs WHERE started_at < $1;`, before)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// DeleteUser replaces login and referral code of the user with anonymousLogin, removes
+// password hash, sessions and webhook endpoints. Orders, withdrawals and credits are
+// kept for accounting.
+func (s *storage) DeleteUser(ctx context.Context, login string, anonymousLogin string) error {
+	ctx, end := observe(ctx, "DeleteUser")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	s.markWrite(login, anonymousLogin)
+	return s.WithTx(ctx, func(ctx context.Context) error {
+		var userID int64
+		err := s.conn(ctx).QueryRow(ctx,
+			`UPDATE users SET user_login=$2, referral_code=$2, password_hash=NULL, deleted_at=$3
+			WHERE user_login=$1 AND deleted_at IS NULL RETURNING id;`, login, anonymousLogin, time.Now()).Scan(&userID)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return errors.New("no such user")
+			}
+			return err
+		}
+		_, err = s.conn(ctx).Exec(ctx, `DELETE FROM sessions WHERE user_id=$1;`, userID)
+		if err != nil {
+			return err
+		}
+		_, err = s.conn(ctx).Exec(ctx, `DELETE FROM webhook_endpoints WHERE user_id=$1;`, userID)
+		if err != nil {
+			return err
+		}
+		// references of referral bonuses are shown to the referrer
+		for _, party := range []string{referrerParty, referredParty} {
+			_, err = s.conn(ctx).Exec(ctx, `UPDATE credits SET reference=$2 WHERE reference=$1;`,
+				referralReference(login, party), referralReference(anonymousLogin, party))
+			if err != nil {
+				return err
+			}
+		}
+		return s.replaceWebhookLogin(ctx, login, anonymousLogin)
+	})
+}
+
+// replaceWebhookLogin replaces login in payloads of login's events, which are kept in
+// the outbox of admins' endpoints
+func (s *storage) replaceWebhookLogin(ctx context.Context, login string, newLogin string) error {
+	rows, err := s.conn(ctx).Query(ctx,
+		`SELECT id, payload FROM webhook_outbox WHERE payload::jsonb->>'login'=$1 FOR UPDATE;`, login)
+	if err != nil {
+		return err
+	}
+	payloads := make(map[int64][]byte)
+	for rows.Next() {
+		var id int64
+		var payload string
+		err = rows.Scan(&id, &payload)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		payloads[id] = []byte(payload)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for id, payload := range payloads {
+		payload, _, err = webhook.ReplaceLogin(payload, login, newLogin)
+		if err != nil {
+			return err
+		}
+		_, err = s.conn(ctx).Exec(ctx, `UPDATE webhook_outbox SET payload=$2 WHERE id=$1;`, id, string(payload))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReserveLogin forbids registration of the login with loginHash till until, the login
+// itself isn't kept
+func (s *storage) ReserveLogin(ctx context.Context, loginHash string, until time.Time) error {
+	ctx, end := observe(ctx, "ReserveLogin")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	_, err := s.conn(ctx).Exec(ctx,
+		`INSERT INTO reserved_logins(login_hash, reserved_until) VALUES ($1, $2)
+		ON CONFLICT (login_hash) DO UPDATE SET reserved_until=GREATEST(reserved_logins.reserved_until, $2);`,
+		loginHash, until)
+	return err
+}
+
+// IsLoginReserved reports if registration of the login with loginHash is forbidden.
+// Registration checks it after the user is added in the same transaction: the insert
+// waits for a concurrent deletion of the login, so its reservation is seen.
+func (s *storage) IsLoginReserved(ctx context.Context, loginHash string) (bool, error) {
+	ctx, end := observe(ctx, "IsLoginReserved")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	var isReserved bool
+	err := s.conn(ctx).QueryRow(ctx,
+		`SELECT EXISTS (SELECT FROM reserved_logins WHERE login_hash=$1 AND is_hashed AND reserved_until>$2);`,
+		loginHash, time.Now()).Scan(&isReserved)
+	return isReserved, err
+}
+
+// HashLoginReservations replaces logins reserved before migration to hashes with their
+// hashes, it returns the number of replaced reservations
+func (s *storage) HashLoginReservations(ctx context.Context, hash func(login string) string) (int64, error) {
+	ctx, end := observe(ctx, "HashLoginReservations")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	var hashed int64
+	err := s.WithTx(ctx, func(ctx context.Context) error {
+		rows, err := s.conn(ctx).Query(ctx,
+			`DELETE FROM reserved_logins WHERE NOT is_hashed RETURNING login_hash, reserved_until;`)
+		if err != nil {
+			return err
+		}
+		reservations := make(map[string]time.Time)
+		for rows.Next() {
+			var login string
+			var until time.Time
+			err = rows.Scan(&login, &until)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			reservations[login] = until
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		for login, until := range reservations {
+			err = s.ReserveLogin(ctx, hash(login), until)
+			if err != nil {
+				return err
+			}
+			hashed++
+		}
+		return nil
+	})
+	return hashed, err
+}
+
+// RemoveLoginReservations removes reservations which end before before
+func (s *storage) RemoveLoginReservations(ctx context.Context, before time.Time) (int64, error) {
+	ctx, end := observe(ctx, "RemoveLoginReservations")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	tag, err := s.conn(ctx).Exec(ctx, `DELETE FROM reserved_logins WHERE reserved_until < $1;`, before)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (s *storage) AddAuditRecord(ctx context.Context, record audit.Record) error {
+	ctx, end := observe(ctx, "AddAuditRecord")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	_, err := s.conn(ctx).Exec(ctx,
+		`INSERT INTO audit_log(created_at, action, actor, subject) VALUES ($1, $2, $3, $4);`,
+		record.CreatedAt, record.Action, record.Actor, record.Subject)
+	return err
+}
+
+// RemoveAuditRecords removes audit records created before before
+func (s *storage) RemoveAuditRecords(ctx context.Context, before time.Time) (int64, error) {
+	ctx, end := observe(ctx, "RemoveAuditRecords")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	tag, err := s.conn(ctx).Exec(ctx, `DELETE FROM audit_log WHERE created_at < $1;`, before)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// AddWebhookEndpoint returns ID of the new endpoint, endpoints with empty login are of
+// admins
+func (s *storage) AddWebhookEndpoint(ctx context.Context, endpoint webhook.Endpoint) (int64, error) {
+	ctx, end := observe(ctx, "AddWebhookEndpoint")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	var id int64
+	var err error
+	if endpoint.Login == "" {
+		err = s.conn(ctx).QueryRow(ctx,
+			`INSERT INTO webhook_endpoints(url, secret, created_at) VALUES ($1, $2, $3) RETURNING id;`,
+			endpoint.URL, endpoint.Secret, endpoint.CreatedAt).Scan(&id)
+	} else {
+		err = s.conn(ctx).QueryRow(ctx,
+			`INSERT INTO webhook_endpoints(user_id, url, secret, created_at)
+			SELECT id, $2, $3, $4 FROM users WHERE user_login=$1 RETURNING id;`,
+			endpoint.Login, endpoint.URL, endpoint.Secret, endpoint.CreatedAt).Scan(&id)
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, errors.New("no such user")
+	}
+	return id, err
+}
+
+// GetWebhookEndpoints returns endpoints of login, of admins if login is empty
+func (s *storage) GetWebhookEndpoints(ctx context.Context, login string) ([]webhook.Endpoint, error) {
+	ctx, end := observe(ctx, "GetWebhookEndpoints")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	var rows pgx.Rows
+	var err error
+	if login == "" {
+		rows, err = s.conn(ctx).Query(ctx,
+			`SELECT id, url, secret, created_at FROM webhook_endpoints WHERE user_id IS NULL ORDER BY id;`)
+	} else {
+		rows, err = s.conn(ctx).Query(ctx,
+			`SELECT e.id, e.url, e.secret, e.created_at FROM webhook_endpoints e JOIN users u ON u.id=e.user_id
+			WHERE u.user_login=$1 ORDER BY e.id;`, login)
+	}
+	if err != nil {
+		logger.Ctx(ctx).Info().Err(err).Msg("in Query")
+		return nil, err
+	}
+	defer rows.Close()
+	var result []webhook.Endpoint
+	for rows.Next() {
+		endpoint := webhook.Endpoint{Login: login}
+		err := rows.Scan(&endpoint.ID, &endpoint.URL, &endpoint.Secret, &endpoint.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, endpoint)
+	}
+	return result, rows.Err()
+}
+
+// RemoveWebhookEndpoint removes endpoint of login with its deliveries, endpoints of
+// admins are removed with empty login
+func (s *storage) RemoveWebhookEndpoint(ctx context.Context, login string, id int64) error {
+	ctx, end := observe(ctx, "RemoveWebhookEndpoint")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	var tag pgconn.CommandTag
+	var err error
+	if login == "" {
+		tag, err = s.conn(ctx).Exec(ctx, `DELETE FROM webhook_endpoints WHERE id=$1 AND user_id IS NULL;`, id)
+	} else {
+		tag, err = s.conn(ctx).Exec(ctx,
+			`DELETE FROM webhook_endpoints e USING users u WHERE e.id=$1 AND u.id=e.user_id AND u.user_login=$2;`,
+			id, login)
+	}
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errors.New("no such webhook endpoint")
+	}
+	return nil
+}
+
+// AddWebhookEvent writes event of login to the outbox for endpoints of login and of
+// admins, it's meant to be called in the transaction of the change
+func (s *storage) AddWebhookEvent(ctx context.Context, login string, event webhook.Event) error {
+	ctx, end := observe(ctx, "AddWebhookEvent")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	_, err := s.conn(ctx).Exec(ctx,
+		`INSERT INTO webhook_outbox(endpoint_id, event, payload, created_at, next_attempt_at)
+		SELECT e.id, $2, $3, $4, $4 FROM webhook_endpoints e LEFT JOIN users u ON u.id=e.user_id
+		WHERE e.user_id IS NULL OR u.user_login=$1;`, login, event.Type, string(event.Payload), event.CreatedAt)
+	return err
+}
+
+// ClaimWebhookDeliveries returns up to limit due deliveries and postpones them for lease,
+// so other dispatchers don't send them meanwhile
+func (s *storage) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]webhook.Delivery, error) {
+	ctx, end := observe(ctx, "ClaimWebhookDeliveries")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	now := time.Now()
+	rows, err := s.conn(ctx).Query(ctx,
+		`UPDATE webhook_outbox o SET next_attempt_at=$2 FROM webhook_endpoints e
+		LEFT JOIN users u ON u.id=e.user_id
+		WHERE e.id=o.endpoint_id AND o.id IN (
+			SELECT id FROM webhook_outbox WHERE delivered_at IS NULL AND dead_at IS NULL AND next_attempt_at<=$1
+			ORDER BY next_attempt_at LIMIT $3 FOR UPDATE SKIP LOCKED)
+		RETURNING o.id, o.endpoint_id, COALESCE(u.user_login, ''), e.url, e.secret, o.event, o.payload,
+			o.created_at, o.attempts, o.last_error;`, now, now.Add(lease), limit)
+	if err != nil {
+		logger.Ctx(ctx).Info().Err(err).Msg("in Query")
+		return nil, err
+	}
+	defer rows.Close()
+	var result []webhook.Delivery
+	for rows.Next() {
+		var val webhook.Delivery
+		var payload string
+		err := rows.Scan(&val.ID, &val.EndpointID, &val.Login, &val.URL, &val.Secret, &val.Type, &payload,
+			&val.CreatedAt, &val.Attempts, &val.LastError)
+		if err != nil {
+			return nil, err
+		}
+		val.Payload = []byte(payload)
+		result = append(result, val)
+	}
+	return result, rows.Err()
+}
+
+func (s *storage) MarkWebhookDelivered(ctx context.Context, id int64) error {
+	ctx, end := observe(ctx, "MarkWebhookDelivered")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	_, err := s.conn(ctx).Exec(ctx,
+		`UPDATE webhook_outbox SET attempts=attempts+1, last_error='', delivered_at=$2 WHERE id=$1;`, id, time.Now())
+	return err
+}
+
+// MarkWebhookFailed counts failed attempt of the delivery, which is retried at retryAt or
+// is dead if retryAt is zero
+func (s *storage) MarkWebhookFailed(ctx context.Context, id int64, lastError string, retryAt time.Time) error {
+	ctx, end := observe(ctx, "MarkWebhookFailed")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	var err error
+	if retryAt.IsZero() {
+		_, err = s.conn(ctx).Exec(ctx,
+			`UPDATE webhook_outbox SET attempts=attempts+1, last_error=$2, dead_at=$3 WHERE id=$1;`,
+			id, lastError, time.Now())
+	} else {
+		_, err = s.conn(ctx).Exec(ctx,
+			`UPDATE webhook_outbox SET attempts=attempts+1, last_error=$2, next_attempt_at=$3 WHERE id=$1;`,
+			id, lastError, retryAt)
+	}
+	return err
+}
+
+// GetDeadWebhookDeliveries returns up to limit deliveries which are out of attempts,
+// the most recent first
+func (s *storage) GetDeadWebhookDeliveries(ctx context.Context, limit int) ([]webhook.Delivery, error) {
+	ctx, end := observe(ctx, "GetDeadWebhookDeliveries")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	rows, err := s.conn(ctx).Query(ctx,
+		`SELECT o.id, o.endpoint_id, COALESCE(u.user_login, ''), e.url, o.event, o.payload, o.created_at, o.attempts,
+			o.last_error, o.dead_at
+		FROM webhook_outbox o JOIN webhook_endpoints e ON e.id=o.endpoint_id LEFT JOIN users u ON u.id=e.user_id
+		WHERE o.dead_at IS NOT NULL ORDER BY o.dead_at DESC, o.id DESC LIMIT $1;`, limit)
+	if err != nil {
+		logger.Ctx(ctx).Info().Err(err).Msg("in Query")
+		return nil, err
+	}
+	defer rows.Close()
+	var result []webhook.Delivery
+	for rows.Next() {
+		var val webhook.Delivery
+		var payload string
+		err := rows.Scan(&val.ID, &val.EndpointID, &val.Login, &val.URL, &val.Type, &payload, &val.CreatedAt,
+			&val.Attempts, &val.LastError, &val.DeadAt)
+		if err != nil {
+			return nil, err
+		}
+		val.Payload = []byte(payload)
+		result = append(result, val)
+	}
+	return result, rows.Err()
+}
+
+// RetryWebhookDelivery returns dead delivery to the outbox with all attempts
+func (s *storage) RetryWebhookDelivery(ctx context.Context, id int64) error {
+	ctx, end := observe(ctx, "RetryWebhookDelivery")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	tag, err := s.conn(ctx).Exec(ctx,
+		`UPDATE webhook_outbox SET attempts=0, dead_at=NULL, next_attempt_at=$2
+		WHERE id=$1 AND dead_at IS NOT NULL;`, id, time.Now())
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errors.New("no such dead webhook delivery")
+	}
+	return nil
+}
+
+// RemoveWebhookDeliveries removes deliveries which were delivered or died before before
+func (s *storage) RemoveWebhookDeliveries(ctx context.Context, before time.Time) (int64, error) {
+	ctx, end := observe(ctx, "RemoveWebhookDeliveries")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	tag, err := s.conn(ctx).Exec(ctx,
+		`DELETE FROM webhook_outbox WHERE delivered_at < $1 OR dead_at < $1;`, before)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// ExportUser collects all data of login in one transaction
+func (s *storage) ExportUser(ctx context.Context, login string) (userexport.Document, error) {
+	ctx, end := observe(ctx, "ExportUser")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	doc := userexport.Document{
+		Version:     userexport.Version,
+		ExportedAt:  time.Now(),
+		Orders:      []userexport.Order{},
+		Withdrawals: []userexport.Withdrawal{},
+		Credits:     []userexport.Credit{},
+		Sessions:    []userexport.Session{},
+	}
+	err := s.WithTx(ctx, func(ctx context.Context) error {
+		var userID int64
+		var referredBy *string
+		var bonusPaid *bool
+		account := &doc.Account
+		err := s.conn(ctx).QueryRow(ctx,
+			`SELECT u.id, u.user_login, COALESCE(u.password_hash, ''), u.created_at, u.referral_code, ru.user_login, r.bonus_paid
+			FROM users u LEFT JOIN referrals r ON r.referred_id=u.id LEFT JOIN users ru ON ru.id=r.referrer_id
+			WHERE u.user_login=$1;`, login).Scan(&userID, &account.Login, &account.PasswordHash, &account.CreatedAt,
+			&account.ReferralCode, &referredBy, &bonusPaid)
+		if err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return errors.New("no such user")
+			}
+			return err
+		}
+		if referredBy != nil {
+			account.ReferredBy = *referredBy
+			account.ReferralBonusPaid = *bonusPaid
+		}
+
+		rows, err := s.conn(ctx).Query(ctx,
+			`SELECT order_num, status, accrual, created_at, processed_at FROM orders WHERE user_id=$1
+			ORDER BY created_at;`, userID)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var val userexport.Order
+			err = rows.Scan(&val.Number, &val.Status, &val.Accrual, &val.UploadedAt, &val.ProcessedAt)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			doc.Orders = append(doc.Orders, val)
+		}
+		rows.Close()
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+
+		rows, err = s.conn(ctx).Query(ctx,
+			`SELECT order_num, sum, created_at, type FROM withdraws WHERE user_id=$1 ORDER BY created_at;`, userID)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var val userexport.Withdrawal
+			err = rows.Scan(&val.Order, &val.Sum, &val.ProcessedAt, &val.Type)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			doc.Withdrawals = append(doc.Withdrawals, val)
+		}
+		rows.Close()
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+
+		rows, err = s.conn(ctx).Query(ctx,
+			`SELECT reference, type, sum, created_at FROM credits WHERE user_id=$1 ORDER BY created_at;`, userID)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var val userexport.Credit
+			err = rows.Scan(&val.Reference, &val.Type, &val.Sum, &val.CreatedAt)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			doc.Credits = append(doc.Credits, val)
+		}
+		rows.Close()
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+
+		var validUntil time.Time
+		err = s.conn(ctx).QueryRow(ctx, `SELECT valid_until FROM sessions WHERE user_id=$1;`, userID).Scan(&validUntil)
+		if err == nil {
+			doc.Sessions = append(doc.Sessions, userexport.Session{ValidUntil: validUntil})
+		} else if !errors.Is(err, pgx.ErrNoRows) {
+			return err
+		}
+		return nil
+	})
+	return doc, err
+}
+
+// ImportUser restores data exported by ExportUser in one transaction. Records which
+// already exist are skipped, so repeated imports of a document change nothing. Import
+// fails if the login belongs to another account.
+func (s *storage) ImportUser(ctx context.Context, doc userexport.Document) error {
+	ctx, end := observe(ctx, "ImportUser")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	account := doc.Account
+	s.markWrite(account.Login)
+	return s.WithTx(ctx, func(ctx context.Context) error {
+		userID, err := s.importAccount(ctx, account)
+		if err != nil {
+			return err
+		}
+
+		for _, o := range doc.Orders {
+			_, err = s.conn(ctx).Exec(ctx,
+				`INSERT INTO orders(order_num, user_id, created_at, status, accrual, processed_at)
+				VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (order_num) DO NOTHING;`,
+				o.Number, userID, o.UploadedAt, o.Status, o.Accrual, importedProcessedAt(o))
+			if err != nil {
+				return err
+			}
+			var ownerID int64
+			err = s.conn(ctx).QueryRow(ctx, `SELECT user_id FROM orders WHERE order_num=$1;`, o.Number).Scan(&ownerID)
+			if err != nil {
+				return err
+			}
+			if ownerID != userID {
+				return errors.New("order " + o.Number + " belongs to another user")
+			}
+		}
+		for _, w := range doc.Withdrawals {
+			_, err = s.conn(ctx).Exec(ctx,
+				`INSERT INTO withdraws(user_id, created_at, sum, order_num, type)
+				SELECT $1::bigint, $2::timestamp, $3::bigint, $4::text, $5::text
+				WHERE NOT EXISTS (SELECT FROM withdraws
+				WHERE user_id=$1 AND created_at=$2 AND sum=$3 AND order_num=$4 AND type=$5);`,
+				userID, w.ProcessedAt, w.Sum, w.Order, w.Type)
+			if err != nil {
+				return err
+			}
+		}
+		for _, c := range doc.Credits {
+			_, err = s.conn(ctx).Exec(ctx,
+				`INSERT INTO credits(user_id, created_at, sum, reference, type) VALUES ($1, $2, $3, $4, $5)
+				ON CONFLICT (reference) DO NOTHING;`, userID, c.CreatedAt, c.Sum, c.Reference, c.Type)
+			if err != nil {
+				return err
+			}
+			var ownerID int64
+			err = s.conn(ctx).QueryRow(ctx, `SELECT user_id FROM credits WHERE reference=$1;`, c.Reference).
+				Scan(&ownerID)
+			if err != nil {
+				return err
+			}
+			if ownerID != userID {
+				return errors.New("credit " + c.Reference + " belongs to another user")
+			}
+		}
+		if account.ReferredBy != "" {
+			tag, err := s.conn(ctx).Exec(ctx,
+				`INSERT INTO referrals(referrer_id, referred_id, created_at, bonus_paid)
+				SELECT id, $2::bigint, $3::timestamp, $4::boolean FROM users WHERE user_login=$1
+				ON CONFLICT (referred_id) DO NOTHING;`, account.ReferredBy, userID, account.CreatedAt,
+				account.ReferralBonusPaid)
+			if err != nil {
+				return err
+			}
+			if tag.RowsAffected() == 0 {
+				logger.Ctx(ctx).Info().Str(logger.FieldLogin, account.Login).
+					Msg("referral is skipped, it exists or referrer is unknown")
+			}
+		}
+		return nil
+	})
+}
+
+// importedProcessedAt is processing time of imported order, documents exported before
+// it was kept have upload time of processed orders instead
+func importedProcessedAt(o userexport.Order) *time.Time {
+	if o.Status != order.ProcessingTypeProcessed {
+		return nil
+	}
+	if o.ProcessedAt == nil {
+		return &o.UploadedAt
+	}
+	return o.ProcessedAt
+}
+
+// importAccount creates and locks the account of document, an existing account is used
+// only if it's the exported one, so data isn't merged into another user's account
+func (s *storage) importAccount(ctx context.Context, account userexport.Account) (int64, error) {
+	var userID int64
+	var isSame bool
+	err := s.conn(ctx).QueryRow(ctx,
+		`SELECT id, password_hash=$2 AND created_at=$3::timestamp FROM users WHERE user_login=$1 FOR UPDATE;`,
+		account.Login, account.PasswordHash, account.CreatedAt).Scan(&userID, &isSame)
+	if err == nil {
+		if !isSame {
+			return 0, errors.New("login is used by another account")
+		}
+		return userID, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return 0, err
+	}
+	err = s.conn(ctx).QueryRow(ctx,
+		`INSERT INTO users(user_login, password_hash, created_at, referral_code) VALUES ($1, $2, $3, $4)
+		RETURNING id;`,
+		account.Login, account.PasswordHash, account.CreatedAt, account.ReferralCode).Scan(&userID)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == ErrCodeDuplicateKeyViolatesUniqueConstraint {
+			if pgErr.ConstraintName == "users_user_login_key" {
+				return 0, errors.New("login is already in use")
+			}
+			return 0, errors.New("referral code is already in use")
+		}
+		return 0, err
+	}
+	return userID, nil
+}
+
+// LockUser locks user's row till the end of the transaction started by WithTx, so
+// balance checks of the user can't race with concurrent balance changes
+func (s *storage) LockUser(ctx context.Context, login string) error {
+	ctx, end := observe(ctx, "LockUser")
+	defer end()
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout)
+	defer cancel()
+	_, err := s.lockUser(ctx, login)
+	return err
+}
+
+func (s *storage) lockUser(ctx context.Context, login string) (int64, error) {
+	var id int64
+	err := s.conn(ctx).QueryRow(ctx, `SELECT id FROM users WHERE user_login=$1 FOR UPDATE;`, login).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, errors.New("no such user")
+	}
+	return id, err
+}
+
+// checkUserFound checks result of INSERT ... SELECT FROM users WHERE user_login=...
+func checkUserFound(tag pgconn.CommandTag) error {
+	if tag.RowsAffected() == 0 {
+		return errors.New("no such user")
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package storage_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nivanov045/gofermart/cmd/gophermart/storage"
+	"github.com/nivanov045/gofermart/cmd/gophermart/storage/storagetest"
+	"github.com/nivanov045/gofermart/internal/pgtest"
+)
+
+func TestMemory(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Storage {
+		return storage.NewMemory()
+	})
+}
+
+func TestPostgres(t *testing.T) {
+	if os.Getenv(pgtest.EnvDSN) == "" {
+		t.Skip(pgtest.EnvDSN + " is not set")
+	}
+	storagetest.Run(t, func(t *testing.T) storagetest.Storage {
+		s, err := storage.New(pgtest.DSN(t), storage.PoolConfig{}, 5*time.Second, storage.ReplicaConfig{})
+		if err != nil {
+			t.Fatalf("storage can't be created: %v", err)
+		}
+		t.Cleanup(s.Close)
+		return s
+	})
+}
@@ -0,0 +1,984 @@
+// Package storagetest is a conformance suite for gophermart storages.
+//
+// Every implementation of service.Storage, authenticator.Storage, scheduler.Storage and
+// webhooks.Storage is expected to pass it. Tests of the storage package run it on the
+// in-memory storage and, if TEST_DATABASE_URI is set, on Postgres.
+package storagetest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nivanov045/gofermart/cmd/gophermart/authenticator"
+	"github.com/nivanov045/gofermart/cmd/gophermart/backup"
+	"github.com/nivanov045/gofermart/cmd/gophermart/metrics"
+	"github.com/nivanov045/gofermart/cmd/gophermart/scheduler"
+	"github.com/nivanov045/gofermart/cmd/gophermart/service"
+	"github.com/nivanov045/gofermart/cmd/gophermart/webhooks"
+	"github.com/nivanov045/gofermart/internal/amount"
+	"github.com/nivanov045/gofermart/internal/audit"
+	"github.com/nivanov045/gofermart/internal/credit"
+	"github.com/nivanov045/gofermart/internal/jobrun"
+	"github.com/nivanov045/gofermart/internal/order"
+	"github.com/nivanov045/gofermart/internal/userexport"
+	"github.com/nivanov045/gofermart/internal/webhook"
+	"github.com/nivanov045/gofermart/internal/withdraw"
+)
+
+type Storage interface {
+	service.Storage
+	authenticator.Storage
+	scheduler.Storage
+	webhooks.Storage
+	backup.Storage
+	metrics.OrderCounter
+	Ping(ctx context.Context) error
+	PendingMigrations(ctx context.Context) ([]int64, error)
+}
+
+// Run runs the suite, newStorage must return an empty storage on every call
+func Run(t *testing.T, newStorage func(t *testing.T) Storage) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s Storage)
+	}{
+		{"Health", testHealth},
+		{"Users", testUsers},
+		{"Sessions", testSessions},
+		{"Orders", testOrders},
+		{"DuplicateOrders", testDuplicateOrders},
+		{"Withdraws", testWithdraws},
+		{"ConcurrentWithdraws", testConcurrentWithdraws},
+		{"Transfers", testTransfers},
+		{"Referrals", testReferrals},
+		{"Transactions", testTransactions},
+		{"CancelledContext", testCancelledContext},
+		{"ExpiredSessions", testExpiredSessions},
+		{"JobRuns", testJobRuns},
+		{"ExportImport", testExportImport},
+		{"AccountDeletion", testAccountDeletion},
+		{"Webhooks", testWebhooks},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStorage(t))
+		})
+	}
+}
+
+func addUser(t *testing.T, s Storage, login string) {
+	t.Helper()
+	ctx := context.Background()
+	err := s.AddUser(ctx, login, login+"_hash", login+"_code")
+	if err != nil {
+		t.Fatalf("AddUser(%q): %v", login, err)
+	}
+}
+
+func checkErr(t *testing.T, err error, want string) {
+	t.Helper()
+	if err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+}
+
+func checkTime(t *testing.T, got time.Time, want time.Time) {
+	t.Helper()
+	if d := got.Sub(want); d > time.Second || d < -time.Second {
+		t.Errorf("got time %v, want %v", got, want)
+	}
+}
+
+func testHealth(t *testing.T, s Storage) {
+	ctx := context.Background()
+	if err := s.Ping(ctx); err != nil {
+		t.Errorf("Ping: %v", err)
+	}
+	pending, err := s.PendingMigrations(ctx)
+	if err != nil || len(pending) != 0 {
+		t.Errorf("PendingMigrations of new storage = %v, %v", pending, err)
+	}
+}
+
+func testUsers(t *testing.T, s Storage) {
+	ctx := context.Background()
+	addUser(t, s, "user")
+	checkErr(t, s.AddUser(ctx, "user", "other_hash", "other_code"), "login is already in use")
+
+	ok, err := s.CheckPassword(ctx, "user", "user_hash")
+	if err != nil || !ok {
+		t.Errorf("CheckPassword with right hash = %v, %v", ok, err)
+	}
+	ok, err = s.CheckPassword(ctx, "user", "wrong_hash")
+	if err != nil || ok {
+		t.Errorf("CheckPassword with wrong hash = %v, %v", ok, err)
+	}
+	ok, err = s.CheckPassword(ctx, "unknown", "user_hash")
+	if err != nil || ok {
+		t.Errorf("CheckPassword of unknown user = %v, %v", ok, err)
+	}
+
+	registeredAt, err := s.GetUserRegistrationTime(ctx, "user")
+	if err != nil {
+		t.Fatalf("GetUserRegistrationTime: %v", err)
+	}
+	checkTime(t, registeredAt, time.Now())
+	_, err = s.GetUserRegistrationTime(ctx, "unknown")
+	checkErr(t, err, "no such user")
+
+	code, err := s.GetReferralCode(ctx, "user")
+	if err != nil || code != "user_code" {
+		t.Errorf("GetReferralCode = %q, %v", code, err)
+	}
+	_, err = s.GetReferralCode(ctx, "unknown")
+	checkErr(t, err, "no such user")
+	login, err := s.FindUserByReferralCode(ctx, "user_code")
+	if err != nil || login != "user" {
+		t.Errorf("FindUserByReferralCode = %q, %v", login, err)
+	}
+	_, err = s.FindUserByReferralCode(ctx, "unknown_code")
+	checkErr(t, err, "no such referral code")
+}
+
+func testSessions(t *testing.T, s Storage) {
+	ctx := context.Background()
+	addUser(t, s, "user")
+	expiresAt := time.Now().Add(time.Hour)
+	if err := s.AddSession(ctx, "user", "token", expiresAt); err != nil {
+		t.Fatalf("AddSession: %v", err)
+	}
+	login, validUntil, err := s.GetSessionInfo(ctx, "token")
+	if err != nil || login != "user" {
+		t.Fatalf("GetSessionInfo = %q, %v", login, err)
+	}
+	checkTime(t, validUntil, expiresAt)
+
+	// user has one session, a new one replaces it and keeps expiry as is
+	expiredAt := time.Now().Add(-time.Hour)
+	if err := s.AddSession(ctx, "user", "expired_token", expiredAt); err != nil {
+		t.Fatalf("AddSession: %v", err)
+	}
+	_, _, err = s.GetSessionInfo(ctx, "token")
+	checkErr(t, err, "no such token")
+	_, validUntil, err = s.GetSessionInfo(ctx, "expired_token")
+	if err != nil {
+		t.Fatalf("GetSessionInfo of expired session: %v", err)
+	}
+	if !validUntil.Before(time.Now()) {
+		t.Errorf("expired session is valid until %v", validUntil)
+	}
+
+	if err := s.RemoveSession(ctx, "expired_token"); err != nil {
+		t.Fatalf("RemoveSession: %v", err)
+	}
+	_, _, err = s.GetSessionInfo(ctx, "expired_token")
+	checkErr(t, err, "no such token")
+	if err := s.RemoveSession(ctx, "expired_token"); err != nil {
+		t.Errorf("RemoveSession of removed session: %v", err)
+	}
+
+	checkErr(t, s.AddSession(ctx, "unknown", "unknown_token", expiresAt), "no such user")
+}
+
+func testOrders(t *testing.T, s Storage) {
+	ctx := context.Background()
+	addUser(t, s, "user")
+	numbers := []string{"12345678903", "4561261212345467", "2377225624"}
+	for _, number := range numbers {
+		if err := s.AddOrder(ctx, "user", number); err != nil {
+			t.Fatalf("AddOrder(%q): %v", number, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	orders, err := s.GetOrders(ctx, "user")
+	if err != nil {
+		t.Fatalf("GetOrders: %v", err)
+	}
+	if len(orders) != len(numbers) {
+		t.Fatalf("GetOrders returned %d orders, want %d", len(orders), len(numbers))
+	}
+	for i, o := range orders {
+		if o.Number != numbers[i] || o.Status != order.ProcessingTypeNew || o.Accrual != 0 {
+			t.Errorf("order %d is %+v, want new order %q sorted by upload time", i, o, numbers[i])
+		}
+		checkTime(t, o.UploadedAt, time.Now())
+	}
+
+	processed := order.Order{Number: numbers[0], Status: order.ProcessingTypeProcessed, Accrual: 729_98}
+	if err := s.UpdateOrder(ctx, processed); err != nil {
+		t.Fatalf("UpdateOrder: %v", err)
+	}
+	orders, err = s.GetOrders(ctx, "user")
+	if err != nil {
+		t.Fatalf("GetOrders: %v", err)
+	}
+	if orders[0].Status != processed.Status || orders[0].Accrual != processed.Accrual {
+		t.Errorf("updated order is %+v, want %+v", orders[0], processed)
+	}
+	checkTime(t, orders[0].ProcessedAt, time.Now())
+	if !orders[1].ProcessedAt.IsZero() {
+		t.Errorf("order which isn't processed has processing time %v", orders[1].ProcessedAt)
+	}
+	// processing time is of the first update to processed
+	time.Sleep(10 * time.Millisecond)
+	if err := s.UpdateOrder(ctx, processed); err != nil {
+		t.Fatalf("UpdateOrder: %v", err)
+	}
+	again, err := s.GetOrders(ctx, "user")
+	if err != nil || !again[0].ProcessedAt.Equal(orders[0].ProcessedAt) {
+		t.Errorf("processing time after repeated update = %v, want %v (%v)", again[0].ProcessedAt,
+			orders[0].ProcessedAt, err)
+	}
+	pending, err := s.GetPendingOrders(ctx)
+	if err != nil || len(pending) != 2 || pending[0] != numbers[1] || pending[1] != numbers[2] {
+		t.Errorf("GetPendingOrders = %v, %v", pending, err)
+	}
+	// statuses of accrual system are mapped by accrualsystem, others are rejected
+	if err := s.UpdateOrder(ctx, order.Order{Number: numbers[1], Status: "REGISTERED"}); err == nil {
+		t.Errorf("UpdateOrder with unknown status succeeded")
+	}
+	counts, err := s.CountOrdersByStatus(ctx)
+	if err != nil || len(counts) != 2 ||
+		counts[order.ProcessingTypeNew] != 2 || counts[order.ProcessingTypeProcessed] != 1 {
+		t.Errorf("CountOrdersByStatus = %v, %v", counts, err)
+	}
+
+	owner, err := s.GetOrderOwner(ctx, numbers[1])
+	if err != nil || owner != "user" {
+		t.Errorf("GetOrderOwner = %q, %v", owner, err)
+	}
+	_, err = s.GetOrderOwner(ctx, "79927398713")
+	checkErr(t, err, "no such order")
+
+	orders, err = s.GetOrders(ctx, "unknown")
+	if err != nil || len(orders) != 0 {
+		t.Errorf("GetOrders of unknown user = %v, %v", orders, err)
+	}
+	if err := s.AddOrder(ctx, "unknown", "79927398713"); err == nil {
+		t.Errorf("AddOrder of unknown user succeeded")
+	}
+}
+
+func testDuplicateOrders(t *testing.T, s Storage) {
+	ctx := context.Background()
+	addUser(t, s, "user")
+	addUser(t, s, "other")
+	if err := s.AddOrder(ctx, "user", "12345678903"); err != nil {
+		t.Fatalf("AddOrder: %v", err)
+	}
+	if err := s.AddOrder(ctx, "user", "12345678903"); err == nil {
+		t.Errorf("AddOrder of the same order twice succeeded")
+	}
+	if err := s.AddOrder(ctx, "other", "12345678903"); err == nil {
+		t.Errorf("AddOrder of order uploaded by another user succeeded")
+	}
+
+	found, err := s.FindOrder(ctx, "12345678903")
+	if err != nil || !found {
+		t.Errorf("FindOrder = %v, %v", found, err)
+	}
+	for login, want := range map[string]bool{"user": true, "other": false} {
+		found, err = s.FindOrderByUser(ctx, login, "12345678903")
+		if err != nil || found != want {
+			t.Errorf("FindOrderByUser(%q) = %v, %v, want %v", login, found, err, want)
+		}
+	}
+	found, err = s.FindOrder(ctx, "79927398713")
+	if err != nil || found {
+		t.Errorf("FindOrder of unknown order = %v, %v", found, err)
+	}
+}
+
+func testWithdraws(t *testing.T, s Storage) {
+	ctx := context.Background()
+	addUser(t, s, "user")
+	sums := []amount.Amount{100_00, 29}
+	for _, sum := range sums {
+		if err := s.MakeWithdraw(ctx, "user", "2377225624", sum); err != nil {
+			t.Fatalf("MakeWithdraw: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	withdraws, err := s.GetWithdraws(ctx, "user")
+	if err != nil {
+		t.Fatalf("GetWithdraws: %v", err)
+	}
+	if len(withdraws) != len(sums) {
+		t.Fatalf("GetWithdraws returned %d withdraws, want %d", len(withdraws), len(sums))
+	}
+	for i, w := range withdraws {
+		if w.Sum != sums[i] || w.Order != "2377225624" || w.Type != withdraw.TypeWithdrawal {
+			t.Errorf("withdraw %d is %+v, want sum %v sorted by time", i, w, sums[i])
+		}
+		checkTime(t, w.ProcessedAt, time.Now())
+	}
+
+	withdraws, err = s.GetWithdraws(ctx, "unknown")
+	if err != nil || len(withdraws) != 0 {
+		t.Errorf("GetWithdraws of unknown user = %v, %v", withdraws, err)
+	}
+	if err := s.MakeWithdraw(ctx, "unknown", "2377225624", 1_00); err == nil {
+		t.Errorf("MakeWithdraw of unknown user succeeded")
+	}
+	if err := s.MakeWithdraw(ctx, "user", "2377225624", -1_00); err == nil {
+		t.Errorf("MakeWithdraw of negative sum succeeded")
+	}
+}
+
+func testConcurrentWithdraws(t *testing.T, s Storage) {
+	ctx := context.Background()
+	addUser(t, s, "user")
+	const n = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- s.MakeWithdraw(ctx, "user", fmt.Sprint(i), 1_00)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("MakeWithdraw: %v", err)
+		}
+	}
+
+	withdraws, err := s.GetWithdraws(ctx, "user")
+	if err != nil {
+		t.Fatalf("GetWithdraws: %v", err)
+	}
+	var total amount.Amount
+	for _, w := range withdraws {
+		total += w.Sum
+	}
+	if len(withdraws) != n || total != n*1_00 {
+		t.Errorf("got %d withdraws of %v total, want %d of %v", len(withdraws), total, n, amount.Amount(n*1_00))
+	}
+}
+
+func testTransfers(t *testing.T, s Storage) {
+	ctx := context.Background()
+	addUser(t, s, "from")
+	addUser(t, s, "to")
+	checkErr(t, s.MakeTransfer(ctx, "from", "to", "ref0", 1_00, 0), "not enough balance")
+
+	if err := s.AddOrder(ctx, "from", "12345678903"); err != nil {
+		t.Fatalf("AddOrder: %v", err)
+	}
+	err := s.UpdateOrder(ctx, order.Order{Number: "12345678903", Status: order.ProcessingTypeProcessed, Accrual: 100_00})
+	if err != nil {
+		t.Fatalf("UpdateOrder: %v", err)
+	}
+	if err := s.MakeTransfer(ctx, "from", "to", "ref1", 30_00, 50_00); err != nil {
+		t.Fatalf("MakeTransfer: %v", err)
+	}
+	checkErr(t, s.MakeTransfer(ctx, "from", "to", "ref2", 30_00, 50_00), "daily transfer limit exceeded")
+	checkErr(t, s.MakeTransfer(ctx, "from", "to", "ref3", 80_00, 0), "not enough balance")
+	checkErr(t, s.MakeTransfer(ctx, "from", "unknown", "ref4", 1_00, 0), "no such user")
+
+	withdraws, err := s.GetWithdraws(ctx, "from")
+	if err != nil {
+		t.Fatalf("GetWithdraws: %v", err)
+	}
+	if len(withdraws) != 1 || withdraws[0].Type != withdraw.TypeTransfer || withdraws[0].Sum != 30_00 ||
+		withdraws[0].Order != "ref1" {
+		t.Errorf("sender's withdraws are %+v, want one transfer", withdraws)
+	}
+	credits, err := s.GetCredits(ctx, "to")
+	if err != nil {
+		t.Fatalf("GetCredits: %v", err)
+	}
+	if len(credits) != 1 || credits[0].Type != credit.TypeTransfer || credits[0].Sum != 30_00 ||
+		credits[0].Reference != "ref1" {
+		t.Errorf("recipient's credits are %+v, want one transfer", credits)
+	}
+	credits, err = s.GetCredits(ctx, "from")
+	if err != nil || len(credits) != 0 {
+		t.Errorf("sender's credits are %+v, %v", credits, err)
+	}
+}
+
+func testReferrals(t *testing.T, s Storage) {
+	ctx := context.Background()
+	addUser(t, s, "referrer")
+	addUser(t, s, "first")
+	addUser(t, s, "second")
+	if err := s.AddReferral(ctx, "referrer", "first", 1); err != nil {
+		t.Fatalf("AddReferral: %v", err)
+	}
+	checkErr(t, s.AddReferral(ctx, "referrer", "second", 1), "referral limit reached")
+	if err := s.AddReferral(ctx, "second", "first", 1); err == nil {
+		t.Errorf("AddReferral of already referred user succeeded")
+	}
+	count, err := s.CountReferrals(ctx, "referrer")
+	if err != nil || count != 1 {
+		t.Errorf("CountReferrals = %d, %v", count, err)
+	}
+
+	paid, err := s.PayReferralBonus(ctx, "second", 10_00, 5_00)
+	if err != nil || paid {
+		t.Errorf("PayReferralBonus of not referred user = %v, %v", paid, err)
+	}
+	paid, err = s.PayReferralBonus(ctx, "first", 10_00, 5_00)
+	if err != nil || !paid {
+		t.Fatalf("PayReferralBonus = %v, %v", paid, err)
+	}
+	paid, err = s.PayReferralBonus(ctx, "first", 10_00, 5_00)
+	if err != nil || paid {
+		t.Errorf("second PayReferralBonus = %v, %v", paid, err)
+	}
+	for login, want := range map[string]amount.Amount{"referrer": 10_00, "first": 5_00} {
+		credits, err := s.GetCredits(ctx, login)
+		if err != nil {
+			t.Fatalf("GetCredits: %v", err)
+		}
+		if len(credits) != 1 || credits[0].Type != credit.TypeReferralBonus || credits[0].Sum != want {
+			t.Errorf("credits of %q are %+v, want one bonus of %v", login, credits, want)
+		}
+	}
+}
+
+func testTransactions(t *testing.T, s Storage) {
+	ctx := context.Background()
+	errRollback := errors.New("rollback")
+	err := s.WithTx(ctx, func(ctx context.Context) error {
+		if err := s.AddUser(ctx, "committed", "hash", "committed_code"); err != nil {
+			return err
+		}
+		return s.AddSession(ctx, "committed", "token", time.Now().Add(time.Hour))
+	})
+	if err != nil {
+		t.Fatalf("WithTx: %v", err)
+	}
+	if login, _, err := s.GetSessionInfo(ctx, "token"); err != nil || login != "committed" {
+		t.Errorf("GetSessionInfo after commit = %q, %v", login, err)
+	}
+
+	err = s.WithTx(ctx, func(ctx context.Context) error {
+		if err := s.AddUser(ctx, "rolled_back", "hash", "rolled_back_code"); err != nil {
+			return err
+		}
+		if err := s.AddOrder(ctx, "rolled_back", "12345678903"); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Fatalf("WithTx returned %v, want error of fn", err)
+	}
+	if _, err := s.GetUserRegistrationTime(ctx, "rolled_back"); err == nil {
+		t.Errorf("user added in rolled back transaction exists")
+	}
+	if found, err := s.FindOrder(ctx, "12345678903"); err != nil || found {
+		t.Errorf("FindOrder of order added in rolled back transaction = %v, %v", found, err)
+	}
+
+	// failed nested transaction doesn't abort the outer one
+	err = s.WithTx(ctx, func(ctx context.Context) error {
+		if err := s.AddOrder(ctx, "committed", "4561261212345467"); err != nil {
+			return err
+		}
+		err := s.WithTx(ctx, func(ctx context.Context) error {
+			if err := s.AddOrder(ctx, "committed", "2377225624"); err != nil {
+				return err
+			}
+			return errRollback
+		})
+		if !errors.Is(err, errRollback) {
+			return fmt.Errorf("nested WithTx returned %v", err)
+		}
+		return s.LockUser(ctx, "committed")
+	})
+	if err != nil {
+		t.Fatalf("WithTx: %v", err)
+	}
+	orders, err := s.GetOrders(ctx, "committed")
+	if err != nil || len(orders) != 1 || orders[0].Number != "4561261212345467" {
+		t.Errorf("GetOrders = %+v, %v, want only the order of outer transaction", orders, err)
+	}
+	checkErr(t, s.LockUser(ctx, "unknown"), "no such user")
+}
+
+func testCancelledContext(t *testing.T, s Storage) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := s.WithTx(ctx, func(ctx context.Context) error {
+		return s.AddUser(ctx, "user", "hash", "user_code")
+	})
+	if err == nil {
+		t.Errorf("WithTx with cancelled context succeeded")
+	}
+	if _, err := s.GetUserRegistrationTime(context.Background(), "user"); err == nil {
+		t.Errorf("user added with cancelled context exists")
+	}
+}
+
+func testExpiredSessions(t *testing.T, s Storage) {
+	ctx := context.Background()
+	addUser(t, s, "active")
+	addUser(t, s, "expired")
+	if err := s.AddSession(ctx, "active", "active_token", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("AddSession: %v", err)
+	}
+	if err := s.AddSession(ctx, "expired", "expired_token", time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("AddSession: %v", err)
+	}
+	removed, err := s.RemoveExpiredSessions(ctx, time.Now())
+	if err != nil || removed != 1 {
+		t.Errorf("RemoveExpiredSessions = %d, %v, want 1", removed, err)
+	}
+	_, _, err = s.GetSessionInfo(ctx, "expired_token")
+	checkErr(t, err, "no such token")
+	if _, _, err := s.GetSessionInfo(ctx, "active_token"); err != nil {
+		t.Errorf("GetSessionInfo of active session: %v", err)
+	}
+	// user can log in again after the expired session is removed
+	if err := s.AddSession(ctx, "expired", "new_token", time.Now().Add(time.Hour)); err != nil {
+		t.Errorf("AddSession after removal: %v", err)
+	}
+}
+
+func testJobRuns(t *testing.T, s Storage) {
+	ctx := context.Background()
+	unlock, ok, err := s.TryLockJob(ctx, "job")
+	if err != nil || !ok {
+		t.Fatalf("TryLockJob = %v, %v", ok, err)
+	}
+	if _, ok, err := s.TryLockJob(ctx, "job"); err != nil || ok {
+		t.Errorf("TryLockJob of locked job = %v, %v", ok, err)
+	}
+	otherUnlock, ok, err := s.TryLockJob(ctx, "other_job")
+	if err != nil || !ok {
+		t.Errorf("TryLockJob of another job = %v, %v", ok, err)
+	} else {
+		otherUnlock()
+	}
+	unlock()
+	unlock, ok, err = s.TryLockJob(ctx, "job")
+	if err != nil || !ok {
+		t.Fatalf("TryLockJob after unlock = %v, %v", ok, err)
+	}
+	unlock()
+
+	lastRun, err := s.LastJobRun(ctx, "job")
+	if err != nil || !lastRun.IsZero() {
+		t.Errorf("LastJobRun of never run job = %v, %v", lastRun, err)
+	}
+	now := time.Now()
+	for _, run := range []jobrun.JobRun{
+		{Job: "job", StartedAt: now.Add(-48 * time.Hour), FinishedAt: now.Add(-48 * time.Hour), Affected: 2},
+		{Job: "job", StartedAt: now, FinishedAt: now, Error: "failed"},
+		{Job: "other_job", StartedAt: now.Add(time.Hour), FinishedAt: now.Add(time.Hour)},
+	} {
+		if err := s.AddJobRun(ctx, run); err != nil {
+			t.Fatalf("AddJobRun: %v", err)
+		}
+	}
+	lastRun, err = s.LastJobRun(ctx, "job")
+	if err != nil {
+		t.Fatalf("LastJobRun: %v", err)
+	}
+	checkTime(t, lastRun, now)
+
+	removed, err := s.RemoveJobRuns(ctx, now.Add(-24*time.Hour))
+	if err != nil || removed != 1 {
+		t.Errorf("RemoveJobRuns = %d, %v, want 1", removed, err)
+	}
+	lastRun, err = s.LastJobRun(ctx, "job")
+	if err != nil {
+		t.Fatalf("LastJobRun: %v", err)
+	}
+	checkTime(t, lastRun, now)
+}
+
+func testExportImport(t *testing.T, s Storage) {
+	ctx := context.Background()
+	addUser(t, s, "referrer")
+	addUser(t, s, "user")
+	if err := s.AddReferral(ctx, "referrer", "user", 10); err != nil {
+		t.Fatalf("AddReferral: %v", err)
+	}
+	if err := s.AddOrder(ctx, "user", "12345678903"); err != nil {
+		t.Fatalf("AddOrder: %v", err)
+	}
+	err := s.UpdateOrder(ctx, order.Order{Number: "12345678903", Status: order.ProcessingTypeProcessed, Accrual: 100_00})
+	if err != nil {
+		t.Fatalf("UpdateOrder: %v", err)
+	}
+	if _, err := s.PayReferralBonus(ctx, "user", 10_00, 5_00); err != nil {
+		t.Fatalf("PayReferralBonus: %v", err)
+	}
+	if err := s.MakeWithdraw(ctx, "user", "2377225624", 20_00); err != nil {
+		t.Fatalf("MakeWithdraw: %v", err)
+	}
+	if err := s.AddSession(ctx, "user", "token", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("AddSession: %v", err)
+	}
+
+	doc, err := s.ExportUser(ctx, "user")
+	if err != nil {
+		t.Fatalf("ExportUser: %v", err)
+	}
+	if doc.Version != userexport.Version || doc.Account.Login != "user" || doc.Account.PasswordHash != "user_hash" ||
+		doc.Account.ReferredBy != "referrer" || !doc.Account.ReferralBonusPaid || len(doc.Orders) != 1 ||
+		len(doc.Withdrawals) != 1 || len(doc.Credits) != 1 || len(doc.Sessions) != 1 {
+		t.Fatalf("ExportUser = %+v", doc)
+	}
+	_, err = s.ExportUser(ctx, "unknown")
+	checkErr(t, err, "no such user")
+
+	// import of exported data changes nothing
+	if err := s.ImportUser(ctx, doc); err != nil {
+		t.Fatalf("ImportUser of existing user: %v", err)
+	}
+	checkExport(t, s, "user", doc)
+
+	// the same data under another login is a new user
+	doc.Account.Login = "copy"
+	doc.Account.ReferralCode = "copy_code"
+	doc.Orders[0].Number = "4561261212345467"
+	doc.Credits[0].Reference = "copy_reference"
+	doc.Sessions = []userexport.Session{}
+	for i := 0; i < 2; i++ {
+		if err := s.ImportUser(ctx, doc); err != nil {
+			t.Fatalf("ImportUser: %v", err)
+		}
+		checkExport(t, s, "copy", doc)
+	}
+	ok, err := s.CheckPassword(ctx, "copy", "user_hash")
+	if err != nil || !ok {
+		t.Errorf("CheckPassword of imported user = %v, %v", ok, err)
+	}
+
+	doc.Account.Login = "thief"
+	doc.Account.ReferralCode = "thief_code"
+	if err := s.ImportUser(ctx, doc); err == nil {
+		t.Errorf("ImportUser of order of another user succeeded")
+	}
+	if _, err := s.GetUserRegistrationTime(ctx, "thief"); err == nil {
+		t.Errorf("user of failed import exists")
+	}
+	// credits of another user aren't skipped as already imported
+	doc.Orders[0].Number = "79927398713"
+	err = s.ImportUser(ctx, doc)
+	checkErr(t, err, "credit copy_reference belongs to another user")
+	if _, err := s.GetUserRegistrationTime(ctx, "thief"); err == nil {
+		t.Errorf("user of failed import exists")
+	}
+	doc.Orders[0].Number = "4561261212345467"
+
+	// data of another account isn't merged into an existing one
+	other := userexport.Document{Version: userexport.Version, Account: userexport.Account{
+		Login: "copy", PasswordHash: "other_hash", CreatedAt: doc.Account.CreatedAt, ReferralCode: "other_code",
+	}}
+	err = s.ImportUser(ctx, other)
+	checkErr(t, err, "login is used by another account")
+	other.Account.PasswordHash = "user_hash"
+	other.Account.CreatedAt = doc.Account.CreatedAt.Add(-time.Hour)
+	err = s.ImportUser(ctx, other)
+	checkErr(t, err, "login is used by another account")
+	doc.Account.Login = "copy"
+	doc.Account.ReferralCode = "copy_code"
+	checkExport(t, s, "copy", doc)
+}
+
+func checkExport(t *testing.T, s Storage, login string, want userexport.Document) {
+	t.Helper()
+	got, err := s.ExportUser(context.Background(), login)
+	if err != nil {
+		t.Fatalf("ExportUser: %v", err)
+	}
+	got.ExportedAt = want.ExportedAt
+	gotJSON, _ := json.Marshal(got)
+	wantJSON, _ := json.Marshal(want)
+	if string(gotJSON) != string(wantJSON) {
+		t.Errorf("ExportUser = %s, want %s", gotJSON, wantJSON)
+	}
+}
+
+func testAccountDeletion(t *testing.T, s Storage) {
+	ctx := context.Background()
+	addUser(t, s, "referrer")
+	addUser(t, s, "user")
+	if err := s.AddSession(ctx, "user", "token", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("AddSession: %v", err)
+	}
+	if err := s.AddReferral(ctx, "referrer", "user", 10); err != nil {
+		t.Fatalf("AddReferral: %v", err)
+	}
+	if _, err := s.PayReferralBonus(ctx, "user", 10_00, 5_00); err != nil {
+		t.Fatalf("PayReferralBonus: %v", err)
+	}
+	addWebhookEndpoint(t, s, "", "http://admin")
+	event, err := webhook.NewEvent(webhook.EventOrderProcessed, "user", map[string]string{"number": "12345678903"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddWebhookEvent(ctx, "user", event); err != nil {
+		t.Fatalf("AddWebhookEvent: %v", err)
+	}
+	if err := s.AddOrder(ctx, "user", "12345678903"); err != nil {
+		t.Fatalf("AddOrder: %v", err)
+	}
+	if err := s.MakeWithdraw(ctx, "user", "2377225624", 0); err != nil {
+		t.Fatalf("MakeWithdraw: %v", err)
+	}
+
+	if err := s.DeleteUser(ctx, "user", "deleted-1"); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	checkErr(t, s.DeleteUser(ctx, "user", "deleted-2"), "no such user")
+	checkErr(t, s.DeleteUser(ctx, "deleted-1", "deleted-2"), "no such user")
+	_, _, err = s.GetSessionInfo(ctx, "token")
+	checkErr(t, err, "no such token")
+	_, err = s.GetUserRegistrationTime(ctx, "user")
+	checkErr(t, err, "no such user")
+	_, err = s.FindUserByReferralCode(ctx, "user_code")
+	checkErr(t, err, "no such referral code")
+	for _, login := range []string{"user", "deleted-1"} {
+		ok, err := s.CheckPassword(ctx, login, "user_hash")
+		if err != nil || ok {
+			t.Errorf("CheckPassword(%q) of deleted user = %v, %v", login, ok, err)
+		}
+	}
+	// history is kept under the anonymous login
+	owner, err := s.GetOrderOwner(ctx, "12345678903")
+	if err != nil || owner != "deleted-1" {
+		t.Errorf("GetOrderOwner of deleted user's order = %q, %v", owner, err)
+	}
+	withdraws, err := s.GetWithdraws(ctx, "deleted-1")
+	if err != nil || len(withdraws) != 1 {
+		t.Errorf("GetWithdraws of deleted user = %+v, %v", withdraws, err)
+	}
+	// other users and admins don't see the login
+	credits, err := s.GetCredits(ctx, "referrer")
+	if err != nil || len(credits) != 1 || credits[0].Reference != "referral:deleted-1:referrer" {
+		t.Errorf("GetCredits of referrer of deleted user = %+v, %v", credits, err)
+	}
+	deliveries, err := s.ClaimWebhookDeliveries(ctx, 10, time.Minute)
+	if err != nil || len(deliveries) != 1 {
+		t.Fatalf("ClaimWebhookDeliveries = %+v, %v", deliveries, err)
+	}
+	wantPayload := strings.Replace(string(event.Payload), `"login":"user"`, `"login":"deleted-1"`, 1)
+	if string(deliveries[0].Payload) != wantPayload {
+		t.Errorf("payload of deleted user's event = %s, want %s", deliveries[0].Payload, wantPayload)
+	}
+
+	if err := s.ReserveLogin(ctx, "user_login_hash", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("ReserveLogin: %v", err)
+	}
+	for _, tt := range []struct {
+		loginHash string
+		want      bool
+	}{
+		{"user_login_hash", true},
+		{"user", false},
+	} {
+		isReserved, err := s.IsLoginReserved(ctx, tt.loginHash)
+		if err != nil || isReserved != tt.want {
+			t.Errorf("IsLoginReserved(%q) = %v, %v, want %v", tt.loginHash, isReserved, err, tt.want)
+		}
+	}
+	removed, err := s.RemoveLoginReservations(ctx, time.Now())
+	if err != nil || removed != 0 {
+		t.Errorf("RemoveLoginReservations of active reservation = %d, %v", removed, err)
+	}
+	removed, err = s.RemoveLoginReservations(ctx, time.Now().Add(2*time.Hour))
+	if err != nil || removed != 1 {
+		t.Errorf("RemoveLoginReservations = %d, %v, want 1", removed, err)
+	}
+	if isReserved, err := s.IsLoginReserved(ctx, "user_login_hash"); err != nil || isReserved {
+		t.Errorf("IsLoginReserved after reservation end = %v, %v", isReserved, err)
+	}
+	if err := s.AddUser(ctx, "user", "new_hash", "new_code"); err != nil {
+		t.Errorf("AddUser after deletion: %v", err)
+	}
+
+	now := time.Now()
+	for _, createdAt := range []time.Time{now.Add(-48 * time.Hour), now} {
+		err := s.AddAuditRecord(ctx, audit.Record{
+			Action:    audit.ActionAccountDeleted,
+			Actor:     audit.ActorUser,
+			Subject:   "deleted-1",
+			CreatedAt: createdAt,
+		})
+		if err != nil {
+			t.Fatalf("AddAuditRecord: %v", err)
+		}
+	}
+	removed, err = s.RemoveAuditRecords(ctx, now.Add(-24*time.Hour))
+	if err != nil || removed != 1 {
+		t.Errorf("RemoveAuditRecords = %d, %v, want 1", removed, err)
+	}
+}
+
+func addWebhookEndpoint(t *testing.T, s Storage, login string, url string) int64 {
+	t.Helper()
+	id, err := s.AddWebhookEndpoint(context.Background(), webhook.Endpoint{
+		Login:     login,
+		URL:       url,
+		Secret:    url + "_secret",
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("AddWebhookEndpoint(%q): %v", url, err)
+	}
+	return id
+}
+
+func testWebhooks(t *testing.T, s Storage) {
+	ctx := context.Background()
+	addUser(t, s, "alice")
+	addUser(t, s, "bob")
+	_, err := s.AddWebhookEndpoint(ctx, webhook.Endpoint{Login: "unknown", URL: "http://unknown", CreatedAt: time.Now()})
+	checkErr(t, err, "no such user")
+	aliceID := addWebhookEndpoint(t, s, "alice", "http://alice")
+	adminID := addWebhookEndpoint(t, s, "", "http://admin")
+
+	endpoints, err := s.GetWebhookEndpoints(ctx, "alice")
+	if err != nil || len(endpoints) != 1 || endpoints[0].ID != aliceID || endpoints[0].URL != "http://alice" ||
+		endpoints[0].Secret != "http://alice_secret" {
+		t.Errorf("GetWebhookEndpoints(alice) = %+v, %v", endpoints, err)
+	}
+	endpoints, err = s.GetWebhookEndpoints(ctx, "")
+	if err != nil || len(endpoints) != 1 || endpoints[0].ID != adminID {
+		t.Errorf("GetWebhookEndpoints of admins = %+v, %v", endpoints, err)
+	}
+	endpoints, err = s.GetWebhookEndpoints(ctx, "bob")
+	if err != nil || len(endpoints) != 0 {
+		t.Errorf("GetWebhookEndpoints(bob) = %+v, %v, want none", endpoints, err)
+	}
+	checkErr(t, s.RemoveWebhookEndpoint(ctx, "bob", aliceID), "no such webhook endpoint")
+	checkErr(t, s.RemoveWebhookEndpoint(ctx, "", aliceID), "no such webhook endpoint")
+
+	newEvent := func(eventType string) webhook.Event {
+		return webhook.Event{Type: eventType, Payload: []byte(`{"type":"` + eventType + `"}`), CreatedAt: time.Now()}
+	}
+	errRollback := errors.New("rollback")
+	err = s.WithTx(ctx, func(ctx context.Context) error {
+		if err := s.AddWebhookEvent(ctx, "alice", newEvent("rolled.back")); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Fatalf("WithTx returned %v, want error of fn", err)
+	}
+	// events of users go to their endpoints and to endpoints of admins
+	if err := s.AddWebhookEvent(ctx, "alice", newEvent("alice.event")); err != nil {
+		t.Fatalf("AddWebhookEvent: %v", err)
+	}
+	if err := s.AddWebhookEvent(ctx, "bob", newEvent("bob.event")); err != nil {
+		t.Fatalf("AddWebhookEvent: %v", err)
+	}
+	deliveries, err := s.ClaimWebhookDeliveries(ctx, 10, time.Hour)
+	if err != nil || len(deliveries) != 3 {
+		t.Fatalf("ClaimWebhookDeliveries = %+v, %v, want 3 deliveries", deliveries, err)
+	}
+	var toAlice, toAdmin []webhook.Delivery
+	for _, d := range deliveries {
+		if d.Type == "rolled.back" {
+			t.Errorf("event of rolled back transaction is delivered")
+		}
+		if string(d.Payload) != `{"type":"`+d.Type+`"}` || d.Attempts != 0 {
+			t.Errorf("delivery = %+v, want new delivery of its event", d)
+		}
+		switch d.EndpointID {
+		case aliceID:
+			toAlice = append(toAlice, d)
+			if d.Login != "alice" || d.URL != "http://alice" || d.Secret != "http://alice_secret" {
+				t.Errorf("delivery to alice's endpoint = %+v", d)
+			}
+		case adminID:
+			toAdmin = append(toAdmin, d)
+			if d.Login != "" || d.URL != "http://admin" {
+				t.Errorf("delivery to admin's endpoint = %+v", d)
+			}
+		}
+	}
+	if len(toAlice) != 1 || toAlice[0].Type != "alice.event" || len(toAdmin) != 2 {
+		t.Fatalf("deliveries to alice = %+v, to admin = %+v", toAlice, toAdmin)
+	}
+	// claimed deliveries are leased
+	if claimed, err := s.ClaimWebhookDeliveries(ctx, 10, time.Hour); err != nil || len(claimed) != 0 {
+		t.Errorf("ClaimWebhookDeliveries of leased deliveries = %+v, %v", claimed, err)
+	}
+
+	if err := s.MarkWebhookDelivered(ctx, toAlice[0].ID); err != nil {
+		t.Fatalf("MarkWebhookDelivered: %v", err)
+	}
+	if err := s.MarkWebhookFailed(ctx, toAdmin[0].ID, "timeout", time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("MarkWebhookFailed: %v", err)
+	}
+	if err := s.MarkWebhookFailed(ctx, toAdmin[1].ID, "refused", time.Time{}); err != nil {
+		t.Fatalf("MarkWebhookFailed: %v", err)
+	}
+	retried, err := s.ClaimWebhookDeliveries(ctx, 10, time.Hour)
+	if err != nil || len(retried) != 1 || retried[0].ID != toAdmin[0].ID || retried[0].Attempts != 1 ||
+		retried[0].LastError != "timeout" {
+		t.Errorf("ClaimWebhookDeliveries after failure = %+v, %v, want the retried delivery", retried, err)
+	}
+	dead, err := s.GetDeadWebhookDeliveries(ctx, 10)
+	if err != nil || len(dead) != 1 || dead[0].ID != toAdmin[1].ID || dead[0].Attempts != 1 ||
+		dead[0].LastError != "refused" || dead[0].URL != "http://admin" || dead[0].Type != toAdmin[1].Type {
+		t.Fatalf("GetDeadWebhookDeliveries = %+v, %v", dead, err)
+	}
+	checkTime(t, dead[0].DeadAt, time.Now())
+
+	if err := s.RetryWebhookDelivery(ctx, dead[0].ID); err != nil {
+		t.Fatalf("RetryWebhookDelivery: %v", err)
+	}
+	checkErr(t, s.RetryWebhookDelivery(ctx, dead[0].ID), "no such dead webhook delivery")
+	checkErr(t, s.RetryWebhookDelivery(ctx, toAlice[0].ID), "no such dead webhook delivery")
+	retried, err = s.ClaimWebhookDeliveries(ctx, 10, time.Hour)
+	if err != nil || len(retried) != 1 || retried[0].ID != dead[0].ID || retried[0].Attempts != 0 {
+		t.Errorf("ClaimWebhookDeliveries after retry = %+v, %v, want the dead delivery", retried, err)
+	}
+	if dead, err := s.GetDeadWebhookDeliveries(ctx, 10); err != nil || len(dead) != 0 {
+		t.Errorf("GetDeadWebhookDeliveries after retry = %+v, %v", dead, err)
+	}
+
+	// only delivered and dead deliveries are removed
+	removed, err := s.RemoveWebhookDeliveries(ctx, time.Now().Add(-time.Hour))
+	if err != nil || removed != 0 {
+		t.Errorf("RemoveWebhookDeliveries of recent deliveries = %d, %v", removed, err)
+	}
+	removed, err = s.RemoveWebhookDeliveries(ctx, time.Now().Add(time.Hour))
+	if err != nil || removed != 1 {
+		t.Errorf("RemoveWebhookDeliveries = %d, %v, want 1", removed, err)
+	}
+
+	// endpoints are removed with their deliveries
+	if err := s.AddWebhookEvent(ctx, "alice", newEvent("alice.event")); err != nil {
+		t.Fatalf("AddWebhookEvent: %v", err)
+	}
+	if err := s.DeleteUser(ctx, "alice", "deleted-1"); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if endpoints, err := s.GetWebhookEndpoints(ctx, "deleted-1"); err != nil || len(endpoints) != 0 {
+		t.Errorf("GetWebhookEndpoints of deleted user = %+v, %v", endpoints, err)
+	}
+	if err := s.RemoveWebhookEndpoint(ctx, "", adminID); err != nil {
+		t.Fatalf("RemoveWebhookEndpoint: %v", err)
+	}
+	checkErr(t, s.RemoveWebhookEndpoint(ctx, "", adminID), "no such webhook endpoint")
+	if err := s.MarkWebhookFailed(ctx, retried[0].ID, "refused", time.Time{}); err != nil {
+		t.Fatalf("MarkWebhookFailed of removed delivery: %v", err)
+	}
+	if dead, err := s.GetDeadWebhookDeliveries(ctx, 10); err != nil || len(dead) != 0 {
+		t.Errorf("GetDeadWebhookDeliveries after endpoints removal = %+v, %v", dead, err)
+	}
+	if claimed, err := s.ClaimWebhookDeliveries(ctx, 10, 0); err != nil || len(claimed) != 0 {
+		t.Errorf("ClaimWebhookDeliveries after endpoints removal = %+v, %v", claimed, err)
+	}
+}
@@ -0,0 +1,95 @@
+package validator
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/nivanov045/gofermart/internal/amount"
+	"github.com/nivanov045/gofermart/internal/withdraw"
+)
+
+// Machine-readable codes of withdrawal validation errors, sums of transfers are
+// rejected with the first three
+const (
+	CodeWrongSum                 = "WRONG_SUM"
+	CodeNonPositiveSum           = "NON_POSITIVE_SUM"
+	CodeTooPreciseSum            = "TOO_PRECISE_SUM"
+	CodeTransactionLimitExceeded = "TRANSACTION_LIMIT_EXCEEDED"
+	CodeDailyLimitExceeded       = "DAILY_LIMIT_EXCEEDED"
+)
+
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// IsLimit tells whether the request is well-formed, but exceeds one of the limits
+func (e *Error) IsLimit() bool {
+	return e.Code == CodeTransactionLimitExceeded || e.Code == CodeDailyLimitExceeded
+}
+
+type Storage interface {
+	GetWithdraws(ctx context.Context, login string) ([]withdraw.Withdraw, error)
+}
+
+type validator struct {
+	storage          Storage
+	transactionLimit amount.Amount
+	dailyLimit       amount.Amount
+}
+
+// New creates withdrawal validator, zero limit means there is no limit
+func New(storage Storage, transactionLimit amount.Amount, dailyLimit amount.Amount) *validator {
+	return &validator{storage: storage, transactionLimit: transactionLimit, dailyLimit: dailyLimit}
+}
+
+// ParseSum parses sum of a withdrawal or transfer, the error is *Error unless the sum is
+// a positive number with at most 2 decimal places
+func ParseSum(sum string) (amount.Amount, error) {
+	result, err := amount.ParseExact(sum)
+	if err != nil {
+		if errors.Is(err, amount.ErrTooPrecise) {
+			return 0, &Error{Code: CodeTooPreciseSum, Message: "sum must have at most 2 decimal places"}
+		}
+		return 0, &Error{Code: CodeWrongSum, Message: "sum must be a number"}
+	}
+	if result <= 0 {
+		return 0, &Error{Code: CodeNonPositiveSum, Message: "sum must be positive"}
+	}
+	return result, nil
+}
+
+// Validate parses sum of login's withdrawal, the error is *Error if the sum is rejected
+func (v *validator) Validate(ctx context.Context, login string, sum string) (amount.Amount, error) {
+	result, err := ParseSum(sum)
+	if err != nil {
+		return 0, err
+	}
+	if v.transactionLimit > 0 && result > v.transactionLimit {
+		return 0, &Error{Code: CodeTransactionLimitExceeded,
+			Message: "sum exceeds per-transaction limit of " + v.transactionLimit.String()}
+	}
+	if v.dailyLimit > 0 {
+		withdraws, err := v.storage.GetWithdraws(ctx, login)
+		if err != nil {
+			return 0, err
+		}
+		dayStart := time.Now().Add(-24 * time.Hour)
+		withdrawn := result
+		for _, w := range withdraws {
+			if w.Type == withdraw.TypeWithdrawal && w.ProcessedAt.After(dayStart) {
+				withdrawn += w.Sum
+			}
+		}
+		if withdrawn > v.dailyLimit {
+			return 0, &Error{Code: CodeDailyLimitExceeded,
+				Message: "sum exceeds daily limit of " + v.dailyLimit.String()}
+		}
+	}
+	return result, nil
+}
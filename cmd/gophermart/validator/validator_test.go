@@ -0,0 +1,40 @@
+package validator
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nivanov045/gofermart/internal/amount"
+)
+
+func TestParseSum(t *testing.T) {
+	tests := []struct {
+		sum  string
+		want amount.Amount
+		code string
+	}{
+		{"1", 1_00, ""},
+		{"0.01", 1, ""},
+		{"12.50", 12_50, ""},
+		{"0.005", 0, CodeTooPreciseSum},
+		{"0.004", 0, CodeTooPreciseSum},
+		{"1.001", 0, CodeTooPreciseSum},
+		{"0", 0, CodeNonPositiveSum},
+		{"0.00", 0, CodeNonPositiveSum},
+		{"-1", 0, CodeNonPositiveSum},
+		{"", 0, CodeWrongSum},
+		{"one", 0, CodeWrongSum},
+	}
+	for _, tt := range tests {
+		got, err := ParseSum(tt.sum)
+		var validationErr *Error
+		switch {
+		case tt.code == "" && err != nil:
+			t.Errorf("ParseSum(%q) error = %v", tt.sum, err)
+		case tt.code != "" && (!errors.As(err, &validationErr) || validationErr.Code != tt.code):
+			t.Errorf("ParseSum(%q) error = %v, want code %s", tt.sum, err, tt.code)
+		case got != tt.want:
+			t.Errorf("ParseSum(%q) = %d, want %d", tt.sum, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+// Package webhooks delivers events of the outbox to webhook endpoints. Deliveries are
+// signed with secrets of endpoints and retried with exponential backoff, deliveries
+// which are out of attempts are dead and stay in the outbox till they are retried by
+// an admin or removed by retention.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/nivanov045/gofermart/internal/webhook"
+)
+
+type Storage interface {
+	ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]webhook.Delivery, error)
+	MarkWebhookDelivered(ctx context.Context, id int64) error
+	MarkWebhookFailed(ctx context.Context, id int64, lastError string, retryAt time.Time) error
+}
+
+// Config of dispatcher, delivery is retried after Backoff, then the delay is doubled up
+// to maxBackoff till MaxAttempts are made
+type Config struct {
+	Interval    time.Duration
+	Timeout     time.Duration
+	Backoff     time.Duration
+	MaxAttempts int
+}
+
+const (
+	// batchSize is how many deliveries are sent at once
+	batchSize  = 20
+	maxBackoff = 6 * time.Hour
+	// maxResponseSize is read from responses, so connections can be reused
+	maxResponseSize = 64 << 10
+)
+
+type dispatcher struct {
+	storage Storage
+	client  *http.Client
+	cfg     Config
+}
+
+// ErrForbiddenAddress is the error of deliveries to endpoints which aren't public
+var ErrForbiddenAddress = errors.New("address of webhook endpoint isn't public")
+
+// NewClient returns client of deliveries which refuses to connect to addresses which
+// aren't public, so endpoints can't reach the service's network. Addresses are checked
+// on dial, after names are resolved, so names resolving to such addresses are refused
+// too. allowPrivate disables the check for local setups.
+func NewClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if !allowPrivate {
+		dialer.Control = checkAddress
+	}
+	return &http.Client{Transport: &http.Transport{
+		// Proxy isn't set, a proxy would be dialed instead of endpoints
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}}
+}
+
+func checkAddress(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !webhook.IsPublicAddress(ip) {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, host)
+	}
+	return nil
+}
+
+// New creates dispatcher which sends deliveries with client, the one of NewClient or of
+// an httptest server in tests. Redirects of endpoints aren't followed.
+func New(storage Storage, client *http.Client, cfg Config) *dispatcher {
+	noRedirects := *client
+	noRedirects.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &dispatcher{storage: storage, client: &noRedirects, cfg: cfg}
+}
+
+// Run dispatches due deliveries every Interval till ctx is done
+func (d *dispatcher) Run(ctx context.Context) {
+	log.Info().Msg("webhook dispatcher started")
+	ticker := time.NewTicker(d.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		// a full batch means there may be more due deliveries
+		for {
+			sent, err := d.DispatchOnce(ctx)
+			if err != nil {
+				log.Error().Err(err).Msg("in webhook dispatch")
+			}
+			if err != nil || sent < batchSize {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DispatchOnce sends a batch of due deliveries and returns how many were sent
+func (d *dispatcher) DispatchOnce(ctx context.Context) (int, error) {
+	// claimed deliveries are sent concurrently, so the lease covers one timeout
+	deliveries, err := d.storage.ClaimWebhookDeliveries(ctx, batchSize, 2*d.cfg.Timeout)
+	if err != nil {
+		return 0, err
+	}
+	var wg sync.WaitGroup
+	for _, delivery := range deliveries {
+		wg.Add(1)
+		go func(delivery webhook.Delivery) {
+			defer wg.Done()
+			d.deliver(ctx, delivery)
+		}(delivery)
+	}
+	wg.Wait()
+	return len(deliveries), nil
+}
+
+func (d *dispatcher) deliver(ctx context.Context, delivery webhook.Delivery) {
+	logger := log.With().Int64("delivery", delivery.ID).Int64("endpoint", delivery.EndpointID).
+		Str("event", delivery.Type).Logger()
+	err := d.send(ctx, delivery)
+	if err == nil {
+		err = d.storage.MarkWebhookDelivered(ctx, delivery.ID)
+		if err != nil {
+			logger.Error().Err(err).Msg("in delivery marking")
+		}
+		return
+	}
+	attempts := delivery.Attempts + 1
+	var retryAt time.Time
+	if attempts < d.cfg.MaxAttempts {
+		retryAt = time.Now().Add(d.backoff(attempts))
+		logger.Warn().Err(err).Int("attempts", attempts).Time("retry_at", retryAt).Msg("webhook delivery failed")
+	} else {
+		logger.Error().Err(err).Int("attempts", attempts).Msg("webhook delivery is dead")
+	}
+	err = d.storage.MarkWebhookFailed(ctx, delivery.ID, err.Error(), retryAt)
+	if err != nil {
+		logger.Error().Err(err).Msg("in delivery marking")
+	}
+}
+
+// backoff returns delay after attempts failed attempts
+func (d *dispatcher) backoff(attempts int) time.Duration {
+	delay := d.cfg.Backoff
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return delay
+}
+
+// send posts the delivery, endpoint must respond with 2xx within Timeout
+func (d *dispatcher) send(ctx context.Context, delivery webhook.Delivery) error {
+	ctx, cancel := context.WithTimeout(ctx, d.cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gophermart-webhooks")
+	req.Header.Set(webhook.HeaderID, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(webhook.HeaderEvent, delivery.Type)
+	req.Header.Set(webhook.HeaderSignature, webhook.Sign(delivery.Secret, time.Now(), delivery.Payload))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxResponseSize))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New("endpoint responded with " + resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package webhooks
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	byName := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+
+	for _, url := range []string{server.URL, byName} {
+		_, err := NewClient(false).Get(url)
+		if !errors.Is(err, ErrForbiddenAddress) {
+			t.Errorf("Get(%s) error = %v, want %v", url, err, ErrForbiddenAddress)
+		}
+		resp, err := NewClient(true).Get(url)
+		if err != nil {
+			t.Errorf("Get(%s) with private addresses allowed: %v", url, err)
+			continue
+		}
+		resp.Body.Close()
+	}
+}
@@ -2,13 +2,21 @@ package server
 
 import (
 	"flag"
+	"time"
 
 	"github.com/caarlos0/env/v6"
+
+	"github.com/nivanov045/gofermart/internal/tracing"
 )
 
 type Config struct {
 	Address     string `env:"RUN_ADDRESS"`
 	DatabaseURI string `env:"DATABASE_URI"`
+
+	ShutdownDelay   time.Duration `env:"SHUTDOWN_DELAY"`
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT"`
+
+	TraceExporter string `env:"TRACE_EXPORTER"`
 }
 
 func NewConfig() (*Config, error) {
@@ -27,6 +35,9 @@ func parseFlags() *Config {
 
 	flag.StringVar(&cfg.Address, "a", "", "address and port for server")
 	flag.StringVar(&cfg.DatabaseURI, "d", "", "database address")
+	flag.DurationVar(&cfg.ShutdownDelay, "sd", 5*time.Second, "how long server is not ready before shutdown")
+	flag.DurationVar(&cfg.ShutdownTimeout, "st", 30*time.Second, "maximal wait for active requests on shutdown")
+	flag.StringVar(&cfg.TraceExporter, "te", tracing.ExporterNone, "trace exporter: none, stdout or otlp")
 	flag.Parse()
 
 	return &cfg
@@ -1,34 +1,67 @@
 package server
 
 import (
+	"context"
+	_ "embed"
 	"errors"
 	"io"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 
 	"github.com/nivanov045/gofermart/internal/accrual/log"
 	"github.com/nivanov045/gofermart/internal/accrual/services"
+	"github.com/nivanov045/gofermart/internal/apierror"
+	"github.com/nivanov045/gofermart/internal/compress"
+	"github.com/nivanov045/gofermart/internal/graceful"
+	"github.com/nivanov045/gofermart/internal/health"
+	"github.com/nivanov045/gofermart/internal/tracing"
 )
 
 type Server struct {
 	service *services.Service
+	health  *health.Checker
 }
 
-func NewServer(service *services.Service) *Server {
-	return &Server{service: service}
+func NewServer(service *services.Service, health *health.Checker) *Server {
+	return &Server{service: service, health: health}
 }
 
-func (a *Server) Run(address string) error {
+// openAPI describes routes under /api/, the contract is checked by servertest
+//
+//go:embed openapi.json
+var openAPI []byte
+
+// Run serves requests until ctx is done, then shuts down gracefully
+func (a *Server) Run(ctx context.Context, address string, shutdown graceful.Config) error {
+	return graceful.Serve(ctx, &http.Server{Addr: address, Handler: a.Handler()}, shutdown)
+}
+
+// Handler returns router with all middlewares and routes of the server
+func (a *Server) Handler() http.Handler {
 	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
+	r.Use(tracing.Middleware("accrual"))
+	r.Use(compress.Middleware)
+	r.NotFound(apierror.NotFound)
+	r.MethodNotAllowed(apierror.MethodNotAllowed)
+
+	r.Get("/healthz", a.health.Liveness)
+	r.Get("/readyz", a.health.Readiness)
 
 	r.Route("/api/", func(r chi.Router) {
 		r.Get("/orders/{number}", a.getOrderStatus)
 		r.Post("/orders", a.registerOrder)
 		r.Post("/goods", a.registerProduct)
 	})
+	r.Get("/openapi.json", serveOpenAPI)
+	return r
+}
 
-	return http.ListenAndServe(address, r)
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(openAPI)
 }
 
 func (a *Server) getOrderStatus(w http.ResponseWriter, r *http.Request) {
@@ -37,7 +70,7 @@ func (a *Server) getOrderStatus(w http.ResponseWriter, r *http.Request) {
 	response, err := a.service.GetOrderReward(r.Context(), id)
 	if err != nil {
 		log.Error(err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		apierror.Internal(w, r)
 		return
 	}
 
@@ -50,7 +83,7 @@ func (a *Server) registerOrder(w http.ResponseWriter, r *http.Request) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		log.Error(err)
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		apierror.Write(w, r, http.StatusBadRequest, apierror.CodeBadRequest, "can't read request body")
 		return
 	}
 
@@ -58,10 +91,10 @@ func (a *Server) registerOrder(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Error(err)
 		if errors.Is(err, services.ErrOrderAlreadyRegistered) {
-			http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+			apierror.Write(w, r, http.StatusConflict, apierror.CodeOrderAlreadyRegistered, "order is already registered")
 			return
 		}
-		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		apierror.Write(w, r, http.StatusBadRequest, apierror.CodeInvalidFormat, "order is malformed")
 		return
 	}
 
@@ -73,7 +106,7 @@ func (a *Server) registerProduct(w http.ResponseWriter, r *http.Request) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		log.Error(err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		apierror.Internal(w, r)
 		return
 	}
 
@@ -82,11 +115,12 @@ func (a *Server) registerProduct(w http.ResponseWriter, r *http.Request) {
 		log.Error(err)
 
 		if errors.Is(err, services.ErrProductAlreadyRegistered) {
-			http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+			apierror.Write(w, r, http.StatusConflict, apierror.CodeProductAlreadyRegistered,
+				"product is already registered")
 		} else if errors.Is(err, services.ErrIncorrectFormat) {
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			apierror.Write(w, r, http.StatusBadRequest, apierror.CodeInvalidFormat, "product is malformed")
 		} else {
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			apierror.Internal(w, r)
 		}
 	}
 }
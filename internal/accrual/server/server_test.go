@@ -0,0 +1,11 @@
+package server_test
+
+import (
+	"testing"
+
+	"github.com/nivanov045/gofermart/internal/accrual/server/servertest"
+)
+
+func TestContract(t *testing.T) {
+	servertest.Run(t)
+}
@@ -0,0 +1,185 @@
+// Package servertest is a contract suite for accrual server. It runs every handler on an
+// in-memory storage and checks responses against the OpenAPI document served at
+// /openapi.json, so the document can't drift from handlers:
+//
+//	func TestContract(t *testing.T) {
+//		servertest.Run(t)
+//	}
+package servertest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nivanov045/gofermart/internal/accrual/models"
+	"github.com/nivanov045/gofermart/internal/accrual/server"
+	"github.com/nivanov045/gofermart/internal/accrual/services"
+	"github.com/nivanov045/gofermart/internal/accrual/storages"
+	"github.com/nivanov045/gofermart/internal/contract"
+	"github.com/nivanov045/gofermart/internal/health"
+)
+
+const (
+	validOrder   = "12345678903"
+	invalidOrder = "12345678904"
+)
+
+// Run runs the suite on a new server
+func Run(t *testing.T) {
+	memory := newMemStorage()
+	service := services.NewService(memory, memory, 1)
+	go service.Run(context.Background())
+	handler := server.NewServer(service, health.New(time.Second)).Handler()
+	c := contract.New(t, handler, "/openapi.json", "/api/")
+
+	expect(t, c, newRequest(http.MethodPost, "/api/goods", `{"match":"Bork","reward":10,"reward_type":"%"}`),
+		http.StatusOK)
+	expect(t, c, newRequest(http.MethodPost, "/api/goods", `{"match":"Bork","reward":5,"reward_type":"pt"}`),
+		http.StatusConflict)
+	expect(t, c, newRequest(http.MethodPost, "/api/goods", `{"match":"Bork","reward":10,"reward_type":"$"}`),
+		http.StatusBadRequest)
+	expect(t, c, newRequest(http.MethodPost, "/api/goods", `{"match":"","reward":10,"reward_type":"%"}`),
+		http.StatusBadRequest)
+	expect(t, c, newRequest(http.MethodPost, "/api/goods", `{"match":`), http.StatusBadRequest)
+
+	order := func(number string) string {
+		return `{"order":"` + number + `","goods":[{"description":"Чайник Bork","price":7000}]}`
+	}
+	expect(t, c, newRequest(http.MethodPost, "/api/orders", order(validOrder)), http.StatusAccepted)
+	expect(t, c, newRequest(http.MethodPost, "/api/orders", order(validOrder)), http.StatusConflict)
+	expect(t, c, newRequest(http.MethodPost, "/api/orders", order(invalidOrder)), http.StatusBadRequest)
+	expect(t, c, newRequest(http.MethodPost, "/api/orders", `{"order":`), http.StatusBadRequest)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var reward models.OrderReward
+		resp := expect(t, c, newRequest(http.MethodGet, "/api/orders/"+validOrder, ""), http.StatusOK)
+		err := json.NewDecoder(resp.Body).Decode(&reward)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("response can't be decoded: %v", err)
+		}
+		if reward.Status == models.OrderStatusText(models.OrderStatusProcessed) {
+			if reward.Accrual != 700 {
+				t.Errorf("accrual = %v, want 700", reward.Accrual)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("order status = %v, want PROCESSED", reward.Status)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	c.CheckCoverage()
+}
+
+func newRequest(method string, path string, body string) *http.Request {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req
+}
+
+func expect(t *testing.T, c *contract.Checker, req *http.Request, want int) *http.Response {
+	t.Helper()
+	method, path := req.Method, req.URL.Path
+	resp := c.Do(req)
+	if resp.StatusCode != want {
+		body, _ := io.ReadAll(resp.Body)
+		t.Errorf("%s %s = %d, want %d: %s", method, path, resp.StatusCode, want, body)
+	}
+	return resp
+}
+
+// memStorage keeps orders and products like the database storage does
+type memStorage struct {
+	mu       sync.Mutex
+	statuses map[string]models.OrderStatus
+	products map[string]models.Product
+	queue    map[string][]byte
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{
+		statuses: make(map[string]models.OrderStatus),
+		products: make(map[string]models.Product),
+		queue:    make(map[string][]byte),
+	}
+}
+
+func (s *memStorage) GetOrderStatus(ctx context.Context, id string) (models.OrderStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status, ok := s.statuses[id]
+	if !ok {
+		return models.OrderStatus{Status: models.OrderStatusInvalid}, storages.ErrOrderNotFound
+	}
+	return status, nil
+}
+
+func (s *memStorage) UpdateOrderStatus(ctx context.Context, id string, orderStatus models.OrderStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statuses[id] = orderStatus
+	return nil
+}
+
+func (s *memStorage) MatchProducts(ctx context.Context, description string) ([]models.Product, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	products := make([]models.Product, 0)
+	for match, product := range s.products {
+		if strings.Contains(description, match) {
+			products = append(products, product)
+		}
+	}
+	return products, nil
+}
+
+func (s *memStorage) RegisterProduct(ctx context.Context, product models.Product) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.products[product.Match]; ok {
+		return storages.ErrProductAlreadyRegistered
+	}
+	s.products[product.Match] = product
+	return nil
+}
+
+func (s *memStorage) GetAllOrders(ctx context.Context) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	orderInfos := make([][]byte, 0, len(s.queue))
+	for _, orderInfo := range s.queue {
+		orderInfos = append(orderInfos, orderInfo)
+	}
+	return orderInfos, nil
+}
+
+func (s *memStorage) RemoveOrder(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.queue, id)
+	return nil
+}
+
+func (s *memStorage) RegisterOrder(ctx context.Context, id string, orderInfo []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.queue[id]; ok {
+		return errors.New("order is already queued")
+	}
+	s.queue[id] = orderInfo
+	s.statuses[id] = models.OrderStatus{Status: models.OrderStatusRegistered}
+	return nil
+}
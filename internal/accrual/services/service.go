@@ -11,6 +11,7 @@ import (
 	"github.com/nivanov045/gofermart/internal/accrual/models"
 	"github.com/nivanov045/gofermart/internal/accrual/storages"
 	"github.com/nivanov045/gofermart/internal/checksums"
+	"github.com/nivanov045/gofermart/internal/tracing"
 )
 
 type Service struct {
@@ -59,6 +60,9 @@ func (s *Service) Run(ctx context.Context) {
 }
 
 func (s *Service) GetOrderReward(ctx context.Context, id string) ([]byte, error) {
+	ctx, span := tracing.Start(ctx, "services.GetOrderReward")
+	defer span.End()
+
 	orderStatus, err := s.storage.GetOrderStatus(ctx, id)
 	if err != nil {
 		return nil, err
@@ -75,6 +79,9 @@ func (s *Service) GetOrderReward(ctx context.Context, id string) ([]byte, error)
 }
 
 func (s *Service) RegisterOrder(ctx context.Context, request []byte) error {
+	ctx, span := tracing.Start(ctx, "services.RegisterOrder")
+	defer span.End()
+
 	var order models.OrderList
 	err := json.Unmarshal(request, &order)
 	if err != nil {
@@ -109,17 +116,14 @@ func (s *Service) RegisterOrder(ctx context.Context, request []byte) error {
 }
 
 func (s *Service) RegisterProduct(ctx context.Context, request []byte) error {
+	ctx, span := tracing.Start(ctx, "services.RegisterProduct")
+	defer span.End()
+
 	var product models.Product
 	err := json.Unmarshal(request, &product)
 	if err != nil {
-		var errUnknownType *models.UnknownRewardTypeError
-		if errors.As(err, &errUnknownType) {
-			return ErrIncorrectFormat
-		}
-		if errors.Is(err, models.ErrIncorrectRewardValue) {
-			return ErrIncorrectFormat
-		}
-		return err
+		// unknown reward types, incorrect values and malformed JSON are rejected alike
+		return ErrIncorrectFormat
 	}
 
 	if product.Match == "" {
@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"sync"
 
+	"go.opentelemetry.io/otel/attribute"
+
 	"github.com/nivanov045/gofermart/internal/accrual/log"
 	"github.com/nivanov045/gofermart/internal/accrual/models"
+	"github.com/nivanov045/gofermart/internal/tracing"
 )
 
 func fanOut(inputCh chan models.OrderList, n int) []chan models.OrderList {
@@ -77,6 +80,9 @@ func (s *Service) newWorker(ctx context.Context, in chan models.OrderList, out c
 }
 
 func (s *Service) computeAccrual(ctx context.Context, order models.OrderList) accrualResult {
+	ctx, span := tracing.Start(ctx, "services.computeAccrual", attribute.String("order", order.ID))
+	defer span.End()
+
 	accrual := 0.0
 	for _, orderProduct := range order.Goods {
 		products, err := s.storage.MatchProducts(ctx, orderProduct.Description)
@@ -3,24 +3,32 @@ package storages
 import (
 	"context"
 	"database/sql"
+	"embed"
 	"errors"
 	"fmt"
+	"io/fs"
 
 	"github.com/jackc/pgconn"
 
 	"github.com/nivanov045/gofermart/internal/accrual/models"
+	"github.com/nivanov045/gofermart/internal/migrate"
+	"github.com/nivanov045/gofermart/internal/tracing"
 )
 
 const (
 	productsTableName    = "products"
 	ordersTableName      = "orders"
 	ordersQueueTableName = "orders_queue"
+	migrationsTableName  = "accrual_schema_migrations"
 )
 
 const (
 	ErrCodeDuplicateKeyViolatesUniqueConstraint = "23505"
 )
 
+//go:embed migrations/*.sql
+var migrations embed.FS
+
 type dbStorage struct {
 	db *sql.DB
 }
@@ -30,25 +38,40 @@ func NewDBStorage(ctx context.Context, db *sql.DB) (Storage, OrderQueue, error)
 		return nil, nil, errors.New("storage creation error: db is nil")
 	}
 
-	s := dbStorage{db: db}
-
-	err := s.createProductsTable(ctx)
+	migrator, err := newMigrator(db)
 	if err != nil {
 		return nil, nil, fmt.Errorf("storage error: %v", err)
 	}
-	err = s.createOrdersTable(ctx)
+	err = migrator.Up(ctx)
 	if err != nil {
 		return nil, nil, fmt.Errorf("storage error: %v", err)
 	}
-	err = s.createOrdersQueueTable(ctx)
+
+	s := dbStorage{db: db}
+	return &s, &s, nil
+}
+
+// PendingMigrations returns versions of migrations which are not applied to db
+func PendingMigrations(ctx context.Context, db *sql.DB) ([]int64, error) {
+	migrator, err := newMigrator(db)
 	if err != nil {
-		return nil, nil, fmt.Errorf("storage error: %v", err)
+		return nil, fmt.Errorf("storage error: %v", err)
 	}
+	return migrator.Pending(ctx)
+}
 
-	return &s, &s, nil
+func newMigrator(db *sql.DB) (*migrate.Migrator, error) {
+	migrationsDir, err := fs.Sub(migrations, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return migrate.New(db, migrationsDir, migrationsTableName)
 }
 
 func (s *dbStorage) GetOrderStatus(ctx context.Context, id string) (models.OrderStatus, error) {
+	ctx, span := tracing.Start(ctx, "storages.GetOrderStatus")
+	defer span.End()
+
 	row := s.db.QueryRowContext(ctx, `SELECT accrual, status FROM `+ordersTableName+` WHERE id = $1`, id)
 	err := row.Err()
 	if err != nil {
@@ -69,6 +92,9 @@ func (s *dbStorage) GetOrderStatus(ctx context.Context, id string) (models.Order
 }
 
 func (s *dbStorage) UpdateOrderStatus(ctx context.Context, id string, orderStatus models.OrderStatus) error {
+	ctx, span := tracing.Start(ctx, "storages.UpdateOrderStatus")
+	defer span.End()
+
 	_, err := s.db.ExecContext(ctx, `INSERT INTO `+ordersTableName+` (id, accrual, status) VALUES ($1, $2, $3)
 										   ON CONFLICT (id)
 										   DO UPDATE SET (accrual, status) = ($2, $3);`, id, orderStatus.Accrual, orderStatus.Status)
@@ -80,6 +106,9 @@ func (s *dbStorage) UpdateOrderStatus(ctx context.Context, id string, orderStatu
 }
 
 func (s *dbStorage) MatchProducts(ctx context.Context, description string) ([]models.Product, error) {
+	ctx, span := tracing.Start(ctx, "storages.MatchProducts")
+	defer span.End()
+
 	rows, err := s.db.QueryContext(ctx,
 		`SELECT matchText, reward, reward_type FROM `+productsTableName+` WHERE $1 LIKE concat('%',matchText,'%');`,
 		description)
@@ -110,6 +139,9 @@ func (s *dbStorage) MatchProducts(ctx context.Context, description string) ([]mo
 }
 
 func (s *dbStorage) RegisterProduct(ctx context.Context, product models.Product) error {
+	ctx, span := tracing.Start(ctx, "storages.RegisterProduct")
+	defer span.End()
+
 	_, err := s.db.ExecContext(ctx,
 		`INSERT INTO `+productsTableName+` (matchText, reward, reward_type) VALUES ($1, $2, $3);`,
 		product.Match, product.Reward, product.RewardType)
@@ -126,6 +158,9 @@ func (s *dbStorage) RegisterProduct(ctx context.Context, product models.Product)
 }
 
 func (s *dbStorage) GetAllOrders(ctx context.Context) ([][]byte, error) {
+	ctx, span := tracing.Start(ctx, "storages.GetAllOrders")
+	defer span.End()
+
 	rows, err := s.db.QueryContext(ctx, `SELECT info FROM `+ordersQueueTableName+`;`)
 	if err != nil {
 		return nil, err
@@ -150,6 +185,9 @@ func (s *dbStorage) GetAllOrders(ctx context.Context) ([][]byte, error) {
 }
 
 func (s *dbStorage) RemoveOrder(ctx context.Context, id string) error {
+	ctx, span := tracing.Start(ctx, "storages.RemoveOrder")
+	defer span.End()
+
 	_, err := s.db.ExecContext(ctx, `DELETE FROM `+ordersQueueTableName+` WHERE id=$1`, id)
 	if err != nil {
 		return err
@@ -159,6 +197,9 @@ func (s *dbStorage) RemoveOrder(ctx context.Context, id string) error {
 }
 
 func (s *dbStorage) RegisterOrder(ctx context.Context, id string, orderInfo []byte) error {
+	ctx, span := tracing.Start(ctx, "storages.RegisterOrder")
+	defer span.End()
+
 	_, err := s.db.ExecContext(ctx, `INSERT INTO `+ordersQueueTableName+` (id, info) VALUES ($1, $2);`, id, orderInfo)
 	if err != nil {
 		return err
@@ -171,92 +212,3 @@ func (s *dbStorage) RegisterOrder(ctx context.Context, id string, orderInfo []by
 
 	return nil
 }
-
-func (s *dbStorage) createProductsTable(ctx context.Context) error {
-	isExists, err := s.isTableExists(ctx, productsTableName)
-	if err != nil {
-		return err
-	}
-	if isExists {
-		return nil
-	}
-
-	_, err = s.db.ExecContext(ctx, `
-		CREATE TABLE `+productsTableName+` (
-			matchText varchar(255) NOT NULL UNIQUE,
-			reward float8,
-			reward_type int
-	);`)
-
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func (s *dbStorage) createOrdersTable(ctx context.Context) error {
-	isExists, err := s.isTableExists(ctx, ordersTableName)
-	if err != nil {
-		return err
-	}
-	if isExists {
-		return nil
-	}
-
-	_, err = s.db.ExecContext(ctx, `
-		CREATE TABLE `+ordersTableName+` (
-			id varchar(255) NOT NULL UNIQUE,
-			accrual float8,
-			status int
-	);`)
-
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func (s *dbStorage) createOrdersQueueTable(ctx context.Context) error {
-	isExists, err := s.isTableExists(ctx, ordersQueueTableName)
-	if err != nil {
-		return err
-	}
-	if isExists {
-		return nil
-	}
-
-	_, err = s.db.ExecContext(ctx, `
-		CREATE TABLE `+ordersQueueTableName+` (
-			id varchar(255) NOT NULL UNIQUE,
-			info bytea
-	);`)
-
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func (s *dbStorage) isTableExists(ctx context.Context, tableName string) (bool, error) {
-	row := s.db.QueryRowContext(ctx, `
-		SELECT EXISTS (
-			SELECT FROM
-		information_schema.tables
-		WHERE
-		table_schema LIKE 'public' AND
-		table_type LIKE 'BASE TABLE' AND
-		table_name = '`+tableName+`'
-	);`)
-
-	err := row.Err()
-	if err != nil {
-		return false, err
-	}
-	var exists bool
-	err = row.Scan(&exists)
-	if err != nil {
-		return false, err
-	}
-
-	return exists, nil
-}
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS orders_queue;
+DROP TABLE IF EXISTS orders;
+DROP TABLE IF EXISTS products;
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS products (
+    matchText varchar(255) NOT NULL UNIQUE,
+    reward float8,
+    reward_type int
+);
+
+CREATE TABLE IF NOT EXISTS orders (
+    id varchar(255) NOT NULL UNIQUE,
+    accrual float8,
+    status int
+);
+
+CREATE TABLE IF NOT EXISTS orders_queue (
+    id varchar(255) NOT NULL UNIQUE,
+    info bytea
+);
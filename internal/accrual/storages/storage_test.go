@@ -0,0 +1,24 @@
+package storages_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/nivanov045/gofermart/internal/accrual/storages"
+	"github.com/nivanov045/gofermart/internal/accrual/storages/storagetest"
+	"github.com/nivanov045/gofermart/internal/pgtest"
+)
+
+func TestDBStorage(t *testing.T) {
+	if os.Getenv(pgtest.EnvDSN) == "" {
+		t.Skip(pgtest.EnvDSN + " is not set")
+	}
+	storagetest.Run(t, func(t *testing.T) (storages.Storage, storages.OrderQueue) {
+		s, q, err := storages.NewDBStorage(context.Background(), pgtest.Open(t))
+		if err != nil {
+			t.Fatalf("storage can't be created: %v", err)
+		}
+		return s, q
+	})
+}
@@ -0,0 +1,124 @@
+// Package storagetest is a conformance suite for accrual storages and order queues.
+// Tests of the storages package run it on Postgres if TEST_DATABASE_URI is set.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/nivanov045/gofermart/internal/accrual/models"
+	"github.com/nivanov045/gofermart/internal/accrual/storages"
+)
+
+// Run runs the suite, newStorage must return empty storage and queue on every call
+func Run(t *testing.T, newStorage func(t *testing.T) (storages.Storage, storages.OrderQueue)) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s storages.Storage, q storages.OrderQueue)
+	}{
+		{"OrderStatus", testOrderStatus},
+		{"Products", testProducts},
+		{"OrderQueue", testOrderQueue},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, q := newStorage(t)
+			tt.test(t, s, q)
+		})
+	}
+}
+
+func testOrderStatus(t *testing.T, s storages.Storage, _ storages.OrderQueue) {
+	ctx := context.Background()
+	status, err := s.GetOrderStatus(ctx, "12345678903")
+	if !errors.Is(err, storages.ErrOrderNotFound) || status.Status != models.OrderStatusInvalid {
+		t.Errorf("GetOrderStatus of unknown order = %+v, %v", status, err)
+	}
+
+	for _, want := range []models.OrderStatus{
+		{Status: models.OrderStatusProcessing},
+		{Status: models.OrderStatusProcessed, Accrual: 729.98},
+	} {
+		if err := s.UpdateOrderStatus(ctx, "12345678903", want); err != nil {
+			t.Fatalf("UpdateOrderStatus: %v", err)
+		}
+		got, err := s.GetOrderStatus(ctx, "12345678903")
+		if err != nil || got != want {
+			t.Errorf("GetOrderStatus = %+v, %v, want %+v", got, err, want)
+		}
+	}
+}
+
+func testProducts(t *testing.T, s storages.Storage, _ storages.OrderQueue) {
+	ctx := context.Background()
+	products := []models.Product{
+		{Match: "Bork", Reward: 10, RewardType: models.RewardTypePercent},
+		{Match: "LG", Reward: 100, RewardType: models.RewardTypePoints},
+	}
+	for _, p := range products {
+		if err := s.RegisterProduct(ctx, p); err != nil {
+			t.Fatalf("RegisterProduct: %v", err)
+		}
+	}
+	err := s.RegisterProduct(ctx, models.Product{Match: "Bork", Reward: 5, RewardType: models.RewardTypePoints})
+	if !errors.Is(err, storages.ErrProductAlreadyRegistered) {
+		t.Errorf("RegisterProduct of registered product = %v", err)
+	}
+
+	for _, tt := range []struct {
+		description string
+		want        []models.Product
+	}{
+		{"Чайник Bork", products[:1]},
+		{"Телевизор LG от Bork", products},
+		{"Samsung", nil},
+	} {
+		got, err := s.MatchProducts(ctx, tt.description)
+		if err != nil {
+			t.Fatalf("MatchProducts: %v", err)
+		}
+		sort.Slice(got, func(i, j int) bool { return got[i].Match < got[j].Match })
+		if len(got) != len(tt.want) {
+			t.Errorf("MatchProducts(%q) = %+v, want %+v", tt.description, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("MatchProducts(%q) = %+v, want %+v", tt.description, got, tt.want)
+			}
+		}
+	}
+}
+
+func testOrderQueue(t *testing.T, s storages.Storage, q storages.OrderQueue) {
+	ctx := context.Background()
+	infos := map[string]string{
+		"12345678903":      `{"order":"12345678903","goods":[]}`,
+		"4561261212345467": `{"order":"4561261212345467","goods":[]}`,
+	}
+	for id, info := range infos {
+		if err := q.RegisterOrder(ctx, id, []byte(info)); err != nil {
+			t.Fatalf("RegisterOrder: %v", err)
+		}
+		status, err := s.GetOrderStatus(ctx, id)
+		if err != nil || status.Status != models.OrderStatusRegistered {
+			t.Errorf("GetOrderStatus of registered order = %+v, %v", status, err)
+		}
+	}
+	if err := q.RegisterOrder(ctx, "12345678903", []byte(infos["12345678903"])); err == nil {
+		t.Errorf("RegisterOrder of queued order succeeded")
+	}
+
+	if err := q.RemoveOrder(ctx, "12345678903"); err != nil {
+		t.Fatalf("RemoveOrder: %v", err)
+	}
+	got, err := q.GetAllOrders(ctx)
+	if err != nil {
+		t.Fatalf("GetAllOrders: %v", err)
+	}
+	if len(got) != 1 || string(got[0]) != infos["4561261212345467"] {
+		t.Errorf("GetAllOrders = %q, want only the order which is not removed", got)
+	}
+}
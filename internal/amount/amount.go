@@ -0,0 +1,207 @@
+// Package amount implements fixed-point sums of loyalty points.
+//
+// Amount keeps points in hundredths, so 1 point is Amount(100). Values are parsed from
+// their decimal representation without going through float64. Digits beyond the
+// second decimal place are rounded half away from zero: 0.125 is 0.13, -0.125 is -0.13.
+package amount
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type Amount int64
+
+const (
+	precision = 2
+	scale     = 100
+	// maxDigits keeps parsed values far from int64 overflow
+	maxDigits = 18
+)
+
+var (
+	ErrWrongFormat = errors.New("wrong format of amount")
+	ErrTooPrecise  = errors.New("amount has more than 2 decimal places")
+)
+
+// Parse parses decimal representation of a sum. Exponent notation used by JSON is
+// accepted as well.
+func Parse(s string) (Amount, error) {
+	negative, digits, exponent, err := split(s)
+	if err != nil {
+		return 0, err
+	}
+	// digits*10^exponent in hundredths is digits*10^(exponent+precision)
+	shift := exponent + precision
+	var roundUp bool
+	if shift < 0 {
+		cut := len(digits) + shift
+		if cut < 0 {
+			return 0, nil
+		}
+		roundUp = digits[cut] >= '5'
+		digits = digits[:cut]
+	} else {
+		if len(strings.TrimLeft(digits, "0"))+shift > maxDigits {
+			return 0, ErrWrongFormat
+		}
+		digits += strings.Repeat("0", shift)
+	}
+	digits = strings.TrimLeft(digits, "0")
+	if len(digits) > maxDigits {
+		return 0, ErrWrongFormat
+	}
+	var value int64
+	if digits != "" {
+		value, err = strconv.ParseInt(digits, 10, 64)
+		if err != nil {
+			return 0, ErrWrongFormat
+		}
+	}
+	if roundUp {
+		value++
+	}
+	if negative {
+		value = -value
+	}
+	return Amount(value), nil
+}
+
+// ParseExact is Parse which fails with ErrTooPrecise instead of rounding
+func ParseExact(s string) (Amount, error) {
+	_, digits, exponent, err := split(s)
+	if err != nil {
+		return 0, err
+	}
+	if shift := exponent + precision; shift < 0 {
+		cut := len(digits) + shift
+		if cut < 0 {
+			cut = 0
+		}
+		if strings.Trim(digits[cut:], "0") != "" {
+			return 0, ErrTooPrecise
+		}
+	}
+	return Parse(s)
+}
+
+// split breaks s into sign, significant digits and decimal exponent
+func split(s string) (negative bool, digits string, exponent int, err error) {
+	if s == "" {
+		return false, "", 0, ErrWrongFormat
+	}
+	if s[0] == '-' || s[0] == '+' {
+		negative = s[0] == '-'
+		s = s[1:]
+	}
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		exponent, err = strconv.Atoi(s[i+1:])
+		if err != nil || exponent > maxDigits || exponent < -maxDigits*2 {
+			return false, "", 0, ErrWrongFormat
+		}
+		s = s[:i]
+	}
+	integer, fraction, _ := strings.Cut(s, ".")
+	if integer == "" && fraction == "" {
+		return false, "", 0, ErrWrongFormat
+	}
+	digits = integer + fraction
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return false, "", 0, ErrWrongFormat
+		}
+	}
+	return negative, digits, exponent - len(fraction), nil
+}
+
+// Percent returns p percents of a rounded half away from zero
+func (a Amount) Percent(p int64) Amount {
+	value := int64(a) * p
+	if value < 0 {
+		return Amount((value - scale/2) / scale)
+	}
+	return Amount((value + scale/2) / scale)
+}
+
+// String formats a without trailing zeros: 10, 10.5, 10.05
+func (a Amount) String() string {
+	value := int64(a)
+	sign := ""
+	if value < 0 {
+		sign = "-"
+		value = -value
+	}
+	integer, fraction := value/scale, value%scale
+	if fraction == 0 {
+		return fmt.Sprintf("%s%d", sign, integer)
+	}
+	return strings.TrimRight(fmt.Sprintf("%s%d.%02d", sign, integer, fraction), "0")
+}
+
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	value, err := Parse(string(data))
+	if err != nil {
+		return err
+	}
+	*a = value
+	return nil
+}
+
+func (a Amount) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a *Amount) UnmarshalText(text []byte) error {
+	value, err := Parse(string(text))
+	if err != nil {
+		return err
+	}
+	*a = value
+	return nil
+}
+
+// Value stores a as BIGINT of hundredths
+func (a Amount) Value() (driver.Value, error) {
+	return int64(a), nil
+}
+
+// Scan reads BIGINT of hundredths, NUMERIC ones, e.g. SUM of BIGINT, come as text
+func (a *Amount) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*a = 0
+	case int64:
+		*a = Amount(v)
+	case string:
+		return a.scanText(v)
+	case []byte:
+		return a.scanText(string(v))
+	default:
+		return fmt.Errorf("can't scan %T into amount", src)
+	}
+	return nil
+}
+
+// scanText reads integer of hundredths, fractions of hundredths are a wrong format
+func (a *Amount) scanText(s string) error {
+	integer, fraction, _ := strings.Cut(s, ".")
+	if strings.Trim(fraction, "0") != "" {
+		return fmt.Errorf("can't scan %q into amount: %w", s, ErrWrongFormat)
+	}
+	value, err := strconv.ParseInt(integer, 10, 64)
+	if err != nil {
+		return fmt.Errorf("can't scan %q into amount: %w", s, ErrWrongFormat)
+	}
+	*a = Amount(value)
+	return nil
+}
@@ -0,0 +1,171 @@
+package amount
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Amount
+		err  error
+	}{
+		{in: "10", want: 10_00},
+		{in: "+1", want: 1_00},
+		{in: "10.5", want: 10_50},
+		{in: "10.05", want: 10_05},
+		{in: ".5", want: 50},
+		{in: "5.", want: 5_00},
+		{in: "-10.5", want: -10_50},
+		{in: "0.124", want: 12},
+		{in: "0.125", want: 13},
+		{in: "-0.125", want: -13},
+		{in: "0.005", want: 1},
+		{in: "0.0049", want: 0},
+		{in: "1e2", want: 100_00},
+		{in: "1.5E-1", want: 15},
+		{in: "12345e-5", want: 12},
+		{in: "1e-30", want: 0},
+		{in: "9999999999999999", want: 9999999999999999_00},
+		{in: "1234567890123456789", err: ErrWrongFormat},
+		{in: "1e18", err: ErrWrongFormat},
+		{in: "", err: ErrWrongFormat},
+		{in: "-", err: ErrWrongFormat},
+		{in: ".", err: ErrWrongFormat},
+		{in: "abc", err: ErrWrongFormat},
+		{in: "1.2.3", err: ErrWrongFormat},
+		{in: "1e", err: ErrWrongFormat},
+		{in: "0x10", err: ErrWrongFormat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := Parse(tt.in)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Parse(%q) error = %v, want %v", tt.in, err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("Parse(%q) = %d, want %d", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseExact(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Amount
+		err  error
+	}{
+		{in: "10.5", want: 10_50},
+		{in: "0.120", want: 12},
+		{in: "-0.10", want: -10},
+		{in: "1.5e-1", want: 15},
+		{in: "0.125", err: ErrTooPrecise},
+		{in: "1e-3", err: ErrTooPrecise},
+		{in: "abc", err: ErrWrongFormat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseExact(tt.in)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("ParseExact(%q) error = %v, want %v", tt.in, err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseExact(%q) = %d, want %d", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPercent(t *testing.T) {
+	tests := []struct {
+		a    Amount
+		p    int64
+		want Amount
+	}{
+		{a: 10_50, p: 10, want: 1_05},
+		{a: 10_00, p: 150, want: 15_00},
+		{a: 5, p: 10, want: 1},
+		{a: 4, p: 10, want: 0},
+		{a: -5, p: 10, want: -1},
+	}
+	for _, tt := range tests {
+		if got := tt.a.Percent(tt.p); got != tt.want {
+			t.Errorf("Amount(%d).Percent(%d) = %d, want %d", tt.a, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		a    Amount
+		want string
+	}{
+		{a: 0, want: "0"},
+		{a: 5, want: "0.05"},
+		{a: 10_00, want: "10"},
+		{a: 10_50, want: "10.5"},
+		{a: 10_05, want: "10.05"},
+		{a: -10_50, want: "-10.5"},
+	}
+	for _, tt := range tests {
+		if got := tt.a.String(); got != tt.want {
+			t.Errorf("Amount(%d).String() = %q, want %q", tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var v struct {
+		Sum Amount `json:"sum"`
+	}
+	err := json.Unmarshal([]byte(`{"sum": 10.125}`), &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Sum != 10_13 {
+		t.Errorf("sum = %d, want %d", v.Sum, 10_13)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"sum":10.13}` {
+		t.Errorf("json = %s", data)
+	}
+	if err := json.Unmarshal([]byte(`{"sum": "10"}`), &v); err == nil {
+		t.Error("string sum is accepted")
+	}
+}
+
+// TestScan covers NUMERIC results, e.g. SUM of BIGINT, which pgx passes as text
+func TestScan(t *testing.T) {
+	tests := []struct {
+		src     interface{}
+		want    Amount
+		wantErr bool
+	}{
+		{src: nil, want: 0},
+		{src: int64(42), want: 42},
+		{src: "1234", want: 1234},
+		{src: "-15", want: -15},
+		{src: "1234.00", want: 1234},
+		{src: []byte("99"), want: 99},
+		{src: "12.5", wantErr: true},
+		{src: "abc", wantErr: true},
+		{src: 1.5, wantErr: true},
+	}
+	for _, tt := range tests {
+		a := Amount(7)
+		err := a.Scan(tt.src)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Scan(%#v) error = %v, want error %v", tt.src, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && a != tt.want {
+			t.Errorf("Scan(%#v) = %d, want %d", tt.src, a, tt.want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Package apierror is the error response of gophermart and accrual:
+//
+//	{"code": "LOGIN_IN_USE", "message": "login is already in use", "request_id": "host/abc-000042"}
+//
+// Clients should branch on code and HTTP status, message is for humans and may change.
+// Details are optional and their shape depends on code. Request ID is the one in logs.
+//
+// Besides codes below, rejected withdrawals and transfers of gophermart have codes of its
+// validator package: WRONG_SUM, NON_POSITIVE_SUM and TOO_PRECISE_SUM with 400 Bad
+// Request, withdrawals also TRANSACTION_LIMIT_EXCEEDED and DAILY_LIMIT_EXCEEDED with 403
+// Forbidden.
+package apierror
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Codes of both services
+const (
+	// CodeBadRequest is returned with 400 when request body can't be read or parsed
+	CodeBadRequest = "BAD_REQUEST"
+	// CodeUnauthorized is returned with 401 when session cookie or admin token is
+	// missing, unknown or expired
+	CodeUnauthorized = "UNAUTHORIZED"
+	// CodeNotFound is returned with 404 for unknown routes
+	CodeNotFound = "NOT_FOUND"
+	// CodeMethodNotAllowed is returned with 405
+	CodeMethodNotAllowed = "METHOD_NOT_ALLOWED"
+	// CodeUnsupportedEncoding is returned with 415 when request body is compressed with
+	// anything but gzip
+	CodeUnsupportedEncoding = "UNSUPPORTED_ENCODING"
+	// CodeInternal is returned with 500, the cause is logged with request ID
+	CodeInternal = "INTERNAL_ERROR"
+)
+
+// Codes of gophermart
+const (
+	// CodeLoginInUse is returned with 409 on registration
+	CodeLoginInUse = "LOGIN_IN_USE"
+	// CodeWrongCredentials is returned with 401 on login
+	CodeWrongCredentials = "WRONG_CREDENTIALS"
+	// CodeWrongPassword is returned with 403 when account deletion isn't confirmed
+	CodeWrongPassword = "WRONG_PASSWORD"
+	// CodeInvalidOrderNumber is returned with 422 when order number fails Luhn check
+	CodeInvalidOrderNumber = "INVALID_ORDER_NUMBER"
+	// CodeOrderOfAnotherUser is returned with 409 when order was uploaded by another user
+	CodeOrderOfAnotherUser = "ORDER_OF_ANOTHER_USER"
+	// CodeInsufficientBalance is returned with 402 on withdrawals and transfers
+	CodeInsufficientBalance = "INSUFFICIENT_BALANCE"
+	// CodeSelfTransfer is returned with 400 on transfer to the sender
+	CodeSelfTransfer = "SELF_TRANSFER"
+	// CodeAccountTooYoung is returned with 403 on transfer from a new account
+	CodeAccountTooYoung = "ACCOUNT_TOO_YOUNG"
+	// CodeTransferLimitExceeded is returned with 403 when daily transfer limit is reached
+	CodeTransferLimitExceeded = "TRANSFER_LIMIT_EXCEEDED"
+	// CodeUserNotFound is returned with 404 by transfers and admin endpoints, details
+	// of admin endpoints have the login
+	CodeUserNotFound = "USER_NOT_FOUND"
+	// CodeWrongWebhookURL is returned with 400 when webhook endpoint isn't an absolute
+	// http or https URL
+	CodeWrongWebhookURL = "WRONG_WEBHOOK_URL"
+	// CodeWebhookEndpointNotFound is returned with 404 for endpoints of other owners too
+	CodeWebhookEndpointNotFound = "WEBHOOK_ENDPOINT_NOT_FOUND"
+	// CodeWebhookDeliveryNotFound is returned with 404 when retried delivery isn't dead
+	CodeWebhookDeliveryNotFound = "WEBHOOK_DELIVERY_NOT_FOUND"
+	// CodeTooManyRequests is returned with 429 and Retry-After in seconds when client
+	// is over its rate limit
+	CodeTooManyRequests = "TOO_MANY_REQUESTS"
+)
+
+// Codes of accrual
+const (
+	// CodeInvalidFormat is returned with 400 when order or product is malformed
+	CodeInvalidFormat = "INVALID_FORMAT"
+	// CodeOrderAlreadyRegistered is returned with 409
+	CodeOrderAlreadyRegistered = "ORDER_ALREADY_REGISTERED"
+	// CodeProductAlreadyRegistered is returned with 409
+	CodeProductAlreadyRegistered = "PRODUCT_ALREADY_REGISTERED"
+)
+
+type Response struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+}
+
+// Write writes error response, request ID is taken from chi's middleware.RequestID
+func Write(w http.ResponseWriter, r *http.Request, status int, code string, message string) {
+	WriteDetails(w, r, status, code, message, nil)
+}
+
+func WriteDetails(w http.ResponseWriter, r *http.Request, status int, code string, message string,
+	details interface{}) {
+	body, err := json.Marshal(Response{
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		RequestID: middleware.GetReqID(r.Context()),
+	})
+	if err != nil {
+		status = http.StatusInternalServerError
+		body = []byte(`{"code":"` + CodeInternal + `","message":"can't write error"}`)
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// Internal writes 500 response, the cause must be logged by caller
+func Internal(w http.ResponseWriter, r *http.Request) {
+	Write(w, r, http.StatusInternalServerError, CodeInternal, "internal error")
+}
+
+// NotFound and MethodNotAllowed replace chi's plain text responses
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	Write(w, r, http.StatusNotFound, CodeNotFound, "no such endpoint")
+}
+
+func MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	Write(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method is not allowed")
+}
@@ -0,0 +1,23 @@
+package audit
+
+import (
+	"time"
+)
+
+const (
+	ActionAccountDeleted string = "ACCOUNT_DELETED"
+)
+
+const (
+	ActorUser  string = "USER"
+	ActorAdmin string = "ADMIN"
+)
+
+// Record is an entry of the audit log, Subject is the login after the action, so it
+// doesn't keep personal data of deleted accounts
+type Record struct {
+	Action    string
+	Actor     string
+	Subject   string
+	CreatedAt time.Time
+}
@@ -0,0 +1,8 @@
+package balance
+
+import "github.com/nivanov045/gofermart/internal/amount"
+
+type Balance struct {
+	Current   amount.Amount `json:"current"`
+	Withdrawn amount.Amount `json:"withdrawn"`
+}
@@ -0,0 +1,109 @@
+// Package compress handles gzip in services. Middleware decompresses request bodies and
+// compresses responses for clients which accept gzip, Transport does the same for
+// clients of other services.
+package compress
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5/middleware"
+
+	"github.com/nivanov045/gofermart/internal/apierror"
+)
+
+const (
+	// level of responses compression, it's a trade-off between CPU and traffic
+	level = 5
+	// MaxBodySize limits decompressed request body, so a small gzip bomb can't exhaust
+	// memory of handlers which read the whole body
+	MaxBodySize = 10 << 20
+)
+
+// Middleware decompresses request bodies with Content-Encoding gzip and compresses
+// responses of text and JSON types if Accept-Encoding allows it. Bodies in other
+// encodings are rejected with 415 Unsupported Media Type.
+func Middleware(next http.Handler) http.Handler {
+	return decompress(middleware.Compress(level)(next))
+}
+
+func decompress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+		case "", "identity":
+			next.ServeHTTP(w, r)
+			return
+		case "gzip", "x-gzip":
+		default:
+			apierror.Write(w, r, http.StatusUnsupportedMediaType, apierror.CodeUnsupportedEncoding,
+				"only gzip content encoding is supported")
+			return
+		}
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			apierror.Write(w, r, http.StatusBadRequest, apierror.CodeBadRequest, "request body is not gzip")
+			return
+		}
+		defer gz.Close()
+		r.Body = http.MaxBytesReader(w, gz, MaxBodySize)
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+		next.ServeHTTP(w, r)
+	})
+}
+
+type transport struct {
+	base http.RoundTripper
+}
+
+// Transport wraps base, so requests accept gzip and gzip responses are decompressed
+// before they are returned. Requests which set Accept-Encoding themselves are sent as is.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	return &transport{base: base}
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Accept-Encoding") == "" {
+		// RoundTrip must not change the request of caller
+		req = req.Clone(req.Context())
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return resp, nil
+	}
+	resp.Body = &gzipBody{body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return resp, nil
+}
+
+// gzipBody reads gzip header on first Read, so empty bodies of e.g. 204 No Content don't
+// fail the request
+type gzipBody struct {
+	body io.ReadCloser
+	gz   *gzip.Reader
+	err  error
+}
+
+func (b *gzipBody) Read(p []byte) (int, error) {
+	if b.gz == nil && b.err == nil {
+		b.gz, b.err = gzip.NewReader(b.body)
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.gz.Read(p)
+}
+
+func (b *gzipBody) Close() error {
+	return b.body.Close()
+}
@@ -0,0 +1,178 @@
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// echo responds with the request body, or 413 if it can't be read
+var echo = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(body)
+})
+
+func TestRequestDecompression(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		want     int
+		wantBody string
+	}{
+		{"plain", "", []byte("12345678903"), http.StatusOK, "12345678903"},
+		{"identity", "identity", []byte("12345678903"), http.StatusOK, "12345678903"},
+		{"gzip", "gzip", gzipped(t, []byte("12345678903")), http.StatusOK, "12345678903"},
+		{"x-gzip", "X-Gzip", gzipped(t, []byte("12345678903")), http.StatusOK, "12345678903"},
+		{"broken gzip", "gzip", []byte("12345678903"), http.StatusBadRequest, ""},
+		{"deflate", "deflate", []byte("12345678903"), http.StatusUnsupportedMediaType, ""},
+		{"br", "br", []byte("12345678903"), http.StatusUnsupportedMediaType, ""},
+		{"limit", "gzip", gzipped(t, bytes.Repeat([]byte{'0'}, MaxBodySize)), http.StatusOK, ""},
+		{"over limit", "gzip", gzipped(t, bytes.Repeat([]byte{'0'}, MaxBodySize+1)),
+			http.StatusRequestEntityTooLarge, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/user/orders", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Encoding", tt.encoding)
+			rec := httptest.NewRecorder()
+			Middleware(echo).ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestResponseCompression(t *testing.T) {
+	body := strings.Repeat(`{"number":"12345678903","status":"NEW"}`, 100)
+	handler := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, body)
+	}))
+	tests := []struct {
+		name     string
+		accept   string
+		wantGzip bool
+	}{
+		{"gzip", "gzip", true},
+		{"gzip among others", "br, gzip;q=0.8", true},
+		{"no header", "", false},
+		{"other encoding", "br", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/user/orders", nil)
+			req.Header.Set("Accept-Encoding", tt.accept)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			got := rec.Body.Bytes()
+			if tt.wantGzip {
+				if rec.Header().Get("Content-Encoding") != "gzip" {
+					t.Fatalf("Content-Encoding = %q", rec.Header().Get("Content-Encoding"))
+				}
+				gz, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, err = io.ReadAll(gz); err != nil {
+					t.Fatal(err)
+				}
+			} else if rec.Header().Get("Content-Encoding") != "" {
+				t.Fatalf("Content-Encoding = %q", rec.Header().Get("Content-Encoding"))
+			}
+			if string(got) != body {
+				t.Errorf("body = %q", got)
+			}
+		})
+	}
+}
+
+// TestEventStreamIsNotBuffered checks that events reach the client before the stream ends
+func TestEventStreamIsNotBuffered(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		<-done
+	})))
+	defer server.Close()
+	defer close(done)
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" {
+		t.Errorf("Content-Encoding = %q", encoding)
+	}
+	line := make(chan string, 1)
+	go func() {
+		l, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		line <- l
+	}()
+	select {
+	case l := <-line:
+		if l != "data: first\n" {
+			t.Errorf("line = %q", l)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event is buffered")
+	}
+}
+
+func TestTransport(t *testing.T) {
+	server := httptest.NewServer(Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, strings.Repeat(`{"status":"PROCESSED"}`, 100))
+	})))
+	defer server.Close()
+
+	client := &http.Client{Transport: Transport(http.DefaultTransport)}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Uncompressed || string(body) != strings.Repeat(`{"status":"PROCESSED"}`, 100) {
+		t.Errorf("Uncompressed = %v, body = %q", resp.Uncompressed, body)
+	}
+}
@@ -0,0 +1,169 @@
+// Package contract checks HTTP handlers of services against the OpenAPI document they
+// serve. Contract suites of services do requests through Checker, which fails the test
+// if a response isn't documented or doesn't match its schema, and finally check that
+// the document and the router describe the same routes:
+//
+//	c := contract.New(t, handler, "/openapi.json", "/api/")
+//	resp := c.Do(httptest.NewRequest(http.MethodGet, "/api/orders/12345678903", nil))
+//	c.CheckCoverage()
+package contract
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/legacy"
+	"github.com/go-chi/chi/v5"
+)
+
+func init() {
+	// event streams are checked as plain text, events themselves aren't described by schemas
+	openapi3filter.RegisterBodyDecoder("text/event-stream", openapi3filter.RegisteredBodyDecoder("text/plain"))
+}
+
+type Checker struct {
+	t       *testing.T
+	handler http.Handler
+	doc     *openapi3.T
+	router  routers.Router
+	prefix  string
+	options *openapi3filter.Options
+	// exercised keeps documented operations which were done as "METHOD path"
+	exercised map[string]bool
+}
+
+// New loads and validates document which handler serves at specPath, only routes with
+// prefix are compared with the document
+func New(t *testing.T, handler http.Handler, specPath string, prefix string) *Checker {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, specPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s = %d, want %d", specPath, rec.Code, http.StatusOK)
+	}
+	doc, err := openapi3.NewLoader().LoadFromData(rec.Body.Bytes())
+	if err != nil {
+		t.Fatalf("document can't be loaded: %v", err)
+	}
+	err = doc.Validate(context.Background())
+	if err != nil {
+		t.Fatalf("document is invalid: %v", err)
+	}
+	router, err := legacy.NewRouter(doc)
+	if err != nil {
+		t.Fatalf("router of document can't be created: %v", err)
+	}
+	return &Checker{
+		t:       t,
+		handler: handler,
+		doc:     doc,
+		router:  router,
+		prefix:  prefix,
+		options: &openapi3filter.Options{
+			IncludeResponseStatus: true,
+			MultiError:            true,
+			AuthenticationFunc:    openapi3filter.NoopAuthenticationFunc,
+		},
+		exercised: make(map[string]bool),
+	}
+}
+
+// Do serves req and checks that the response status is documented for the operation and
+// the response matches its schema. Requests which are accepted with 2xx must match the
+// document too, so it doesn't reject what handlers accept.
+func (c *Checker) Do(req *http.Request) *http.Response {
+	c.t.Helper()
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		if err != nil {
+			c.t.Fatalf("request body can't be read: %v", err)
+		}
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	c.handler.ServeHTTP(rec, req)
+	resp := rec.Result()
+
+	route, pathParams, err := c.router.FindRoute(req)
+	if err != nil {
+		c.t.Errorf("%s %s is not documented: %v", req.Method, req.URL.Path, err)
+		return resp
+	}
+	c.exercised[route.Method+" "+route.Path] = true
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	input := &openapi3filter.RequestValidationInput{
+		Request:    req,
+		PathParams: pathParams,
+		Route:      route,
+		Options:    c.options,
+	}
+	ctx := context.Background()
+	if rec.Code >= 200 && rec.Code < 300 {
+		err = openapi3filter.ValidateRequest(ctx, input)
+		if err != nil {
+			c.t.Errorf("%s %s is accepted with %d, but the request doesn't match document: %v",
+				req.Method, req.URL.Path, rec.Code, err)
+		}
+	}
+	err = openapi3filter.ValidateResponse(ctx, &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: input,
+		Status:                 rec.Code,
+		Header:                 rec.Header(),
+		Body:                   io.NopCloser(bytes.NewReader(rec.Body.Bytes())),
+		Options:                c.options,
+	})
+	if err != nil {
+		c.t.Errorf("response of %s %s with %d doesn't match document: %v\n%s",
+			req.Method, req.URL.Path, rec.Code, err, rec.Body.String())
+	}
+	return resp
+}
+
+// CheckCoverage checks that every documented operation was done and every route of
+// handler with prefix is documented, handler must be a chi router
+func (c *Checker) CheckCoverage() {
+	c.t.Helper()
+	documented := make(map[string]bool)
+	for path, item := range c.doc.Paths {
+		for method := range item.Operations() {
+			operation := method + " " + path
+			documented[operation] = true
+			if !c.exercised[operation] {
+				c.t.Errorf("%s is documented, but not exercised", operation)
+			}
+		}
+	}
+
+	routes, ok := c.handler.(chi.Routes)
+	if !ok {
+		c.t.Fatalf("handler %T is not a chi router", c.handler)
+	}
+	var undocumented []string
+	err := chi.Walk(routes, func(method string, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		route = strings.ReplaceAll(route, "/*/", "/")
+		route = strings.ReplaceAll(route, "//", "/")
+		if strings.HasPrefix(route, c.prefix) && !documented[method+" "+route] {
+			undocumented = append(undocumented, method+" "+route)
+		}
+		return nil
+	})
+	if err != nil {
+		c.t.Fatalf("routes can't be walked: %v", err)
+	}
+	sort.Strings(undocumented)
+	for _, operation := range undocumented {
+		c.t.Errorf("%s is routed, but not documented", operation)
+	}
+}
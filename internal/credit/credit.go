@@ -0,0 +1,20 @@
+package credit
+
+import (
+	"time"
+
+	"github.com/nivanov045/gofermart/internal/amount"
+)
+
+const (
+	TypeTransfer      string = "TRANSFER"
+	TypeReferralBonus string = "REFERRAL_BONUS"
+)
+
+// Credit is a balance replenishment not bound to an order
+type Credit struct {
+	Reference string
+	Type      string
+	Sum       amount.Amount
+	CreatedAt time.Time
+}
@@ -0,0 +1,40 @@
+// Package graceful runs HTTP servers which finish active requests before exit.
+package graceful
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+type Config struct {
+	// Delay is how long server keeps serving after OnShutdown, so probes notice that
+	// it isn't ready and no new requests are routed to it
+	Delay time.Duration
+	// Timeout limits waiting for active requests
+	Timeout time.Duration
+	// OnShutdown is called as soon as ctx is done, e.g. to fail readiness probe
+	OnShutdown func()
+}
+
+// Serve runs server until ctx is done, then shuts it down, nil is returned if shutdown
+// is complete
+func Serve(ctx context.Context, server *http.Server, cfg Config) error {
+	shutdownErr := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		if cfg.OnShutdown != nil {
+			cfg.OnShutdown()
+		}
+		time.Sleep(cfg.Delay)
+		timeoutCtx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+		defer cancel()
+		shutdownErr <- server.Shutdown(timeoutCtx)
+	}()
+	err := server.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return <-shutdownErr
+}
@@ -0,0 +1,14 @@
+package jobrun
+
+import (
+	"time"
+)
+
+// JobRun is a finished run of a background job, Error is empty for successful runs
+type JobRun struct {
+	Job        string
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Affected   int64
+	Error      string
+}
@@ -0,0 +1,112 @@
+// Package logger configures the global zerolog logger shared by services and carries
+// request scoped fields in contexts.
+//
+// Request logger is created by Middleware with request ID, handlers and everything they
+// call annotate it with login and order number, so every line of the request including
+// the access line has them:
+//
+//	logger.Annotate(ctx, logger.FieldLogin, login)
+//	logger.Ctx(ctx).Info().Msg("order added")
+package logger
+
+import (
+	"context"
+	"fmt"
+	"io"
+	stdlog "log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	FieldRequestID = "request_id"
+	FieldLogin     = "login"
+	FieldOrder     = "order"
+)
+
+const (
+	FormatJSON    = "json"
+	FormatConsole = "console"
+)
+
+type ctxKey struct{}
+
+// Init configures global logger, level is one of zerolog levels, e.g. "debug" or "info".
+// Output of the standard library logger is redirected to it.
+func Init(level string, format string) error {
+	parsedLevel, err := zerolog.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	var w io.Writer
+	switch format {
+	case FormatJSON:
+		w = os.Stderr
+	case FormatConsole:
+		w = zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339}
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	zerolog.SetGlobalLevel(parsedLevel)
+	zerolog.CallerMarshalFunc = func(pc uintptr, file string, line int) string {
+		return filepath.Base(filepath.Dir(file)) + "/" + filepath.Base(file) + ":" + strconv.Itoa(line)
+	}
+	log.Logger = zerolog.New(w).With().Timestamp().Caller().Logger()
+	stdlog.SetFlags(0)
+	stdlog.SetOutput(log.Logger)
+	return nil
+}
+
+// Ctx returns logger attached to ctx or global logger if there is none
+func Ctx(ctx context.Context) *zerolog.Logger {
+	if l, ok := ctx.Value(ctxKey{}).(*zerolog.Logger); ok {
+		return l
+	}
+	return &log.Logger
+}
+
+// With returns ctx with a child logger which has additional field, the logger of ctx
+// is left as is
+func With(ctx context.Context, key string, value string) context.Context {
+	l := Ctx(ctx).With().Str(key, value).Logger()
+	return context.WithValue(ctx, ctxKey{}, &l)
+}
+
+// Annotate adds field to logger attached to ctx, all holders of ctx see it. Global
+// logger is never changed, so nothing is done if ctx has no logger. It must not be
+// called concurrently for the same logger.
+func Annotate(ctx context.Context, key string, value string) {
+	l, ok := ctx.Value(ctxKey{}).(*zerolog.Logger)
+	if !ok {
+		return
+	}
+	l.UpdateContext(func(c zerolog.Context) zerolog.Context {
+		return c.Str(key, value)
+	})
+}
+
+// Middleware attaches request logger with request ID set by chi's middleware.RequestID
+// and writes access line after the request
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ctx := With(r.Context(), FieldRequestID, middleware.GetReqID(r.Context()))
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+		Ctx(ctx).Info().
+			Str("method", r.Method).
+			Str("path", r.URL.Path).
+			Str("remote", r.RemoteAddr).
+			Int("status", ww.Status()).
+			Int("bytes", ww.BytesWritten()).
+			Dur("duration", time.Since(start)).
+			Msg("request")
+	})
+}
@@ -0,0 +1,228 @@
+// Package migrate applies versioned SQL migrations to Postgres.
+//
+// Migrations are files named <version>_<name>.up.sql with optional
+// <version>_<name>.down.sql counterparts. Applied versions are recorded in a tracking
+// table, and every run holds a session advisory lock derived from its name, so
+// instances starting at the same time can't apply a migration twice.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+var fileNameRegexp = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+var ErrNoDownMigration = errors.New("migration has no down script")
+
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+type Migrator struct {
+	db         *sql.DB
+	table      string
+	migrations []Migration
+}
+
+// New loads migrations from the root of fsys, table is the name of tracking table
+func New(db *sql.DB, fsys fs.FS, table string) (*Migrator, error) {
+	migrations, err := load(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, table: table, migrations: migrations}, nil
+}
+
+func load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		match := fileNameRegexp.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %v: %w", entry.Name(), err)
+		}
+		content, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %v: version is used by %v", entry.Name(), m.Name)
+		}
+		if match[3] == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %v_%v has no up script", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Up applies all pending migrations, each one in its own transaction
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			if applied[migration.Version] {
+				continue
+			}
+			err = m.apply(ctx, conn, migration.Up,
+				`INSERT INTO `+m.table+` (version, name, applied_at) VALUES ($1, $2, now());`,
+				migration.Version, migration.Name)
+			if err != nil {
+				return fmt.Errorf("migration %v_%v up: %w", migration.Version, migration.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Down rolls back steps last applied migrations
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	return m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && steps > 0; i-- {
+			migration := m.migrations[i]
+			if !applied[migration.Version] {
+				continue
+			}
+			if migration.Down == "" {
+				return fmt.Errorf("migration %v_%v: %w", migration.Version, migration.Name, ErrNoDownMigration)
+			}
+			err = m.apply(ctx, conn, migration.Down, `DELETE FROM `+m.table+` WHERE version = $1;`, migration.Version)
+			if err != nil {
+				return fmt.Errorf("migration %v_%v down: %w", migration.Version, migration.Name, err)
+			}
+			steps--
+		}
+		return nil
+	})
+}
+
+// Pending returns versions which are known, but not applied yet
+func (m *Migrator) Pending(ctx context.Context) ([]int64, error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	applied, err := m.applied(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	var pending []int64
+	for _, migration := range m.migrations {
+		if !applied[migration.Version] {
+			pending = append(pending, migration.Version)
+		}
+	}
+	return pending, nil
+}
+
+// locked runs f holding the advisory lock on a single connection
+func (m *Migrator) locked(ctx context.Context, f func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock(hashtext($1));`, m.table)
+	if err != nil {
+		return fmt.Errorf("migration lock: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock(hashtext($1));`, m.table)
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+m.table+` (
+			version BIGINT PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMP NOT NULL
+	);`)
+	if err != nil {
+		return err
+	}
+	return f(conn)
+}
+
+func (m *Migrator) applied(ctx context.Context, conn *sql.Conn) (map[int64]bool, error) {
+	var isExists bool
+	row := conn.QueryRowContext(ctx, `SELECT EXISTS (
+			SELECT FROM information_schema.tables
+			WHERE table_schema = current_schema() AND table_name = $1);`, m.table)
+	err := row.Scan(&isExists)
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int64]bool)
+	if !isExists {
+		return applied, nil
+	}
+
+	rows, err := conn.QueryContext(ctx, `SELECT version FROM `+m.table+`;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int64
+		err = rows.Scan(&version)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, script string, track string, args ...interface{}) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, script)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, track, args...)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -1,6 +1,10 @@
 package order
 
-import "time"
+import (
+	"time"
+
+	"github.com/nivanov045/gofermart/internal/amount"
+)
 
 const (
 	ProcessingTypeNew        string = "NEW"
@@ -9,22 +13,31 @@ const (
 	ProcessingTypeProcessed  string = "PROCESSED"
 )
 
+const (
+	TypeOrder    string = "ORDER"
+	TypeTransfer string = "TRANSFER"
+)
+
 type InterfaceForAccrualSystem struct {
-	Number  string  `json:"order"`
-	Status  string  `json:"status"`
-	Accrual float64 `json:"accrual,omitempty"`
+	Number  string        `json:"order"`
+	Status  string        `json:"status"`
+	Accrual amount.Amount `json:"accrual,omitempty"`
 }
 
 type Interface struct {
-	Number     string    `json:"number"`
-	Status     string    `json:"status"`
-	Accrual    float64   `json:"accrual,omitempty"` // accrual for processed orders only
-	UploadedAt time.Time `json:"uploaded_at,omitempty"`
+	Number     string        `json:"number"`
+	Status     string        `json:"status"`
+	Accrual    amount.Amount `json:"accrual,omitempty"` // accrual for processed orders only
+	UploadedAt time.Time     `json:"uploaded_at,omitempty"`
+	Type       string        `json:"type,omitempty"`
 }
 
+// Order is processed at ProcessedAt, it's set by storage when the order gets
+// ProcessingTypeProcessed and is zero before
 type Order struct {
-	Number     string
-	Status     string
-	Accrual    int64
-	UploadedAt time.Time
+	Number      string
+	Status      string
+	Accrual     amount.Amount
+	UploadedAt  time.Time
+	ProcessedAt time.Time
 }
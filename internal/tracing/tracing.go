@@ -0,0 +1,96 @@
+// Package tracing sets up OpenTelemetry for services. Trace context is propagated in W3C
+// traceparent headers both by Middleware and by clients wrapped with Transport.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/nivanov045/gofermart/internal/logger"
+)
+
+// Exporters, OTLP is configured by standard OTEL_EXPORTER_OTLP_* variables, e.g.
+// OTEL_EXPORTER_OTLP_ENDPOINT=http://collector:4318
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+)
+
+const (
+	tracerName = "github.com/nivanov045/gofermart"
+
+	FieldTraceID = "trace_id"
+)
+
+// Init installs global tracer provider and propagator, returned func flushes spans which
+// are not exported yet. Spans are not recorded at all with ExporterNone.
+func Init(ctx context.Context, serviceName string, exporter string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+
+	var spanExporter sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		spanExporter, err = stdouttrace.New()
+	case ExporterOTLP:
+		spanExporter, err = otlptracehttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Start starts span which is a child of span in ctx if there is one
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// Middleware starts server span of every request, it's named by chi route pattern, so
+// path parameters don't make names unique. Trace ID is added to request logger, so it
+// must be used after logger.Middleware.
+func Middleware(operation string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		named := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			span := trace.SpanFromContext(r.Context())
+			if span.SpanContext().IsValid() {
+				logger.Annotate(r.Context(), FieldTraceID, span.SpanContext().TraceID().String())
+			}
+			next.ServeHTTP(w, r)
+			if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+				span.SetName(r.Method + " " + rctx.RoutePattern())
+			}
+		})
+		return otelhttp.NewHandler(named, operation)
+	}
+}
+
+// Transport wraps base, so client requests are traced and carry trace context
+func Transport(base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(base)
+}
@@ -0,0 +1,63 @@
+// Package userexport describes the document with all data of one user, which is used
+// for backups, moves between environments and personal data requests.
+package userexport
+
+import (
+	"time"
+
+	"github.com/nivanov045/gofermart/internal/amount"
+)
+
+// Version is incremented on incompatible changes of Document
+const Version = 1
+
+type Document struct {
+	Version     int          `json:"version"`
+	ExportedAt  time.Time    `json:"exported_at"`
+	Account     Account      `json:"account"`
+	Orders      []Order      `json:"orders"`
+	Withdrawals []Withdrawal `json:"withdrawals"`
+	Credits     []Credit     `json:"credits"`
+	// Sessions are exported for information only, tokens are secret and are not
+	// exported, so sessions are not imported
+	Sessions []Session `json:"sessions"`
+}
+
+// Account has PasswordHash only in documents of backups and moves between environments,
+// documents answering personal data requests don't have it
+type Account struct {
+	Login             string    `json:"login"`
+	PasswordHash      string    `json:"password_hash,omitempty"`
+	CreatedAt         time.Time `json:"created_at"`
+	ReferralCode      string    `json:"referral_code"`
+	ReferredBy        string    `json:"referred_by,omitempty"`
+	ReferralBonusPaid bool      `json:"referral_bonus_paid,omitempty"`
+}
+
+// Order has ProcessedAt if it's processed, documents exported before it was kept don't
+// have it
+type Order struct {
+	Number      string        `json:"number"`
+	Status      string        `json:"status"`
+	Accrual     amount.Amount `json:"accrual"`
+	UploadedAt  time.Time     `json:"uploaded_at"`
+	ProcessedAt *time.Time    `json:"processed_at,omitempty"`
+}
+
+type Withdrawal struct {
+	Order       string        `json:"order"`
+	Sum         amount.Amount `json:"sum"`
+	ProcessedAt time.Time     `json:"processed_at"`
+	Type        string        `json:"type"`
+}
+
+type Credit struct {
+	Reference string        `json:"reference"`
+	Type      string        `json:"type"`
+	Sum       amount.Amount `json:"sum"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+type Session struct {
+	ValidUntil time.Time `json:"valid_until"`
+}
@@ -0,0 +1,186 @@
+// Package webhook has events which gophermart delivers to endpoints of partners. Every
+// delivery is a POST of the event payload:
+//
+//	{"type": "order.processed", "login": "alice", "created_at": "...", "data": {...}}
+//
+// with HeaderID, which is the same for retries of the delivery, HeaderEvent and
+// HeaderSignature. Receivers check the signature with the secret of their endpoint:
+//
+//	err := webhook.Verify(secret, r.Header.Get(webhook.HeaderSignature), body, 5*time.Minute)
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	EventOrderProcessed    string = "order.processed"
+	EventOrderInvalid      string = "order.invalid"
+	EventWithdrawalCreated string = "withdrawal.created"
+)
+
+const (
+	HeaderID        = "Webhook-Id"
+	HeaderEvent     = "Webhook-Event"
+	HeaderSignature = "Webhook-Signature"
+)
+
+// Endpoint receives events of its owner, endpoints of admins have empty Login and
+// receive events of all users
+type Endpoint struct {
+	ID        int64
+	Login     string
+	URL       string
+	Secret    string
+	CreatedAt time.Time
+}
+
+// Event is written to the outbox in the transaction of the change, Payload is the body
+// of its deliveries
+type Event struct {
+	Type      string
+	Payload   []byte
+	CreatedAt time.Time
+}
+
+// Delivery is an event in the outbox for one endpoint, Login is the owner of the
+// endpoint. DeadAt is set when the delivery is out of attempts.
+type Delivery struct {
+	Event
+	ID         int64
+	EndpointID int64
+	Login      string
+	URL        string
+	Secret     string
+	Attempts   int
+	LastError  string
+	DeadAt     time.Time
+}
+
+type eventBody struct {
+	Type      string      `json:"type"`
+	Login     string      `json:"login"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// NewEvent builds event of login's change, data is the payload's data
+func NewEvent(eventType string, login string, data interface{}) (Event, error) {
+	createdAt := time.Now()
+	payload, err := json.Marshal(eventBody{eventType, login, createdAt, data})
+	if err != nil {
+		return Event{}, err
+	}
+	return Event{Type: eventType, Payload: payload, CreatedAt: createdAt}, nil
+}
+
+// ReplaceLogin returns payload of event with newLogin if the event is of login, ok is
+// false for events of other users
+func ReplaceLogin(eventPayload []byte, login string, newLogin string) (result []byte, ok bool, err error) {
+	var p eventBody
+	var data json.RawMessage
+	p.Data = &data
+	err = json.Unmarshal(eventPayload, &p)
+	if err != nil {
+		return nil, false, err
+	}
+	if p.Login != login {
+		return eventPayload, false, nil
+	}
+	p.Login = newLogin
+	result, err = json.Marshal(p)
+	if err != nil {
+		return nil, false, err
+	}
+	return result, true, nil
+}
+
+// nonPublicNetworks aren't covered by methods of net.IP: "this network", carrier-grade
+// NAT, which cloud metadata services also use, and IETF protocol assignments
+var nonPublicNetworks = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("192.0.0.0/24"),
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+// IsPublicAddress reports if endpoints may be at ip. Loopback, private, link-local,
+// unspecified and multicast addresses are of the service's own network, e.g. cloud
+// metadata at 169.254.169.254.
+func IsPublicAddress(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// NewSecret returns a random secret for endpoint's signatures
+func NewSecret() (string, error) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// Sign returns value of HeaderSignature: "t=<unix time>,v1=<hex HMAC-SHA256>" of
+// "<unix time>.<body>", so a captured delivery can't be replayed later
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	return "t=" + t + ",v1=" + mac(secret, t, body)
+}
+
+// Verify checks that signature is of body and it was made within tolerance from now
+func Verify(secret string, signature string, body []byte, tolerance time.Duration) error {
+	var t, v1 string
+	for _, part := range strings.Split(signature, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			t = value
+		case "v1":
+			v1 = value
+		}
+	}
+	unix, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || v1 == "" {
+		return errors.New("malformed signature")
+	}
+	if d := time.Since(time.Unix(unix, 0)); d > tolerance || d < -tolerance {
+		return errors.New("signature is too old")
+	}
+	if !hmac.Equal([]byte(v1), []byte(mac(secret, t, body))) {
+		return errors.New("wrong signature")
+	}
+	return nil
+}
+
+func mac(secret string, t string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(t + "."))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
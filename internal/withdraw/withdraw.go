@@ -1,15 +1,26 @@
 package withdraw
 
-import "time"
+import (
+	"time"
+
+	"github.com/nivanov045/gofermart/internal/amount"
+)
+
+const (
+	TypeWithdrawal string = "WITHDRAWAL"
+	TypeTransfer   string = "TRANSFER"
+)
 
 type Withdraw struct {
-	Order       string    `json:"order"`
-	Sum         int64     `json:"sum"`
-	ProcessedAt time.Time `json:"processed_at"`
+	Order       string        `json:"order"`
+	Sum         amount.Amount `json:"sum"`
+	ProcessedAt time.Time     `json:"processed_at"`
+	Type        string        `json:"type"`
 }
 
 type Interface struct {
-	Order       string    `json:"order"`
-	Sum         float64   `json:"sum"`
-	ProcessedAt time.Time `json:"processed_at"`
+	Order       string        `json:"order"`
+	Sum         amount.Amount `json:"sum"`
+	ProcessedAt time.Time     `json:"processed_at"`
+	Type        string        `json:"type,omitempty"`
 }